@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"seesharpsi/bookmd/funcs"
+)
+
+// runConvert implements `bookmd convert [-autofix] [-dry-run] image`: it
+// transcribes one image (or stdin when the argument is "-") and prints the
+// markdown to stdout without touching the database. It returns the process
+// exit code.
+func runConvert(args []string) int {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	autofix := flags.Bool("autofix", false, "repair unclosed fences and broken tables in the output")
+	dryRun := flags.Bool("dry-run", false, "print the estimated tokens and cost instead of converting")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: bookmd convert [-autofix] [-dry-run] <image|->")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	imagePath := flags.Arg(0)
+	if imagePath == "-" {
+		tmp, err := os.CreateTemp("", "bookmd-convert-*")
+		if err != nil {
+			log.Printf("failed to buffer stdin: %s\n", err)
+			return 1
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, os.Stdin)
+		tmp.Close()
+		if err != nil {
+			log.Printf("failed to read stdin: %s\n", err)
+			return 1
+		}
+		imagePath = tmp.Name()
+	}
+
+	if *dryRun {
+		data, err := os.ReadFile(imagePath)
+		if err != nil {
+			log.Printf("failed to read image: %s\n", err)
+			return 1
+		}
+		printEstimate(newTranscriber().EstimateImage(data, pricingFromEnv()))
+		return 0
+	}
+
+	ai := newTranscriber()
+	if _, client := ai.Current(); client == nil {
+		log.Println("OPENAI_API_KEY not set and tesseract is not installed")
+		return 1
+	}
+
+	markdown, err := ai.ConvertImageToMarkdown(context.Background(), imagePath)
+	if err != nil {
+		log.Printf("conversion failed: %s\n", err)
+		return 1
+	}
+
+	for _, issue := range funcs.ValidateMarkdown(markdown) {
+		log.Printf("warning: line %d: %s\n", issue.Line, issue.Message)
+	}
+	if *autofix {
+		markdown = funcs.FixMarkdown(markdown)
+	}
+
+	fmt.Print(markdown)
+	if len(markdown) > 0 && markdown[len(markdown)-1] != '\n' {
+		fmt.Println()
+	}
+	return 0
+}
+
+// printEstimate writes a dry-run summary to stdout
+func printEstimate(e funcs.Estimate) {
+	fmt.Printf("images:        %d\n", e.Images)
+	fmt.Printf("input tokens:  ~%d\n", e.InputTokens)
+	fmt.Printf("output tokens: ~%d\n", e.OutputTokens)
+	fmt.Printf("cost:          ~$%.4f\n", e.CostUSD)
+}
+
+// imageExtensions are the file extensions convert-dir treats as images
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+}
+
+// Statuses of a manifest entry
+const (
+	statusDone   = "done"
+	statusFailed = "failed"
+)
+
+// manifestEntry records the result of converting one image
+type manifestEntry struct {
+	Source    string    `json:"source"`
+	SHA256    string    `json:"sha256"`
+	Output    string    `json:"output,omitempty"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Converted time.Time `json:"converted"`
+}
+
+// manifest is the convert-dir record written next to the output. It is
+// rewritten after every image so an interrupted run can resume.
+type manifest struct {
+	path    string
+	mu      sync.Mutex
+	Entries map[string]*manifestEntry `json:"entries"`
+}
+
+func loadManifest(path string) (*manifest, error) {
+	m := &manifest{path: path, Entries: map[string]*manifestEntry{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return m, nil
+}
+
+// record stores an entry and writes the manifest atomically
+func (m *manifest) record(entry *manifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Entries[entry.Source] = entry
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// converted reports whether source was already converted with the same content
+func (m *manifest) converted(source, hash string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.Entries[source]
+	return ok && entry.Status == statusDone && entry.SHA256 == hash
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// findImages lists the images under dir, relative to it, in sorted order
+func findImages(dir string) ([]string, error) {
+	var images []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && imageExtensions[strings.ToLower(filepath.Ext(path))] {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			images = append(images, rel)
+		}
+		return nil
+	})
+	sort.Strings(images)
+	return images, err
+}
+
+// runConvertDir implements `bookmd convert-dir [-out dir] [-workers n] dir`:
+// it converts every image under dir into a .md file at the same relative
+// path under the output directory. Images already converted with unchanged
+// content, per manifest.json in the output directory, are skipped.
+func runConvertDir(args []string) int {
+	flags := flag.NewFlagSet("convert-dir", flag.ContinueOnError)
+	out := flags.String("out", "./md", "directory to write markdown and manifest.json into")
+	workers := flags.Int("workers", 4, "number of images to convert concurrently")
+	autofix := flags.Bool("autofix", false, "repair unclosed fences and broken tables in the output")
+	dryRun := flags.Bool("dry-run", false, "list the images that would be converted and the estimated cost")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: bookmd convert-dir [flags] <dir>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *workers < 1 {
+		flags.Usage()
+		return 2
+	}
+	src := flags.Arg(0)
+
+	images, err := findImages(src)
+	if err != nil {
+		log.Printf("failed to scan %s: %s\n", src, err)
+		return 1
+	}
+	m, err := loadManifest(filepath.Join(*out, "manifest.json"))
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if *dryRun {
+		return estimateDir(src, images, m)
+	}
+
+	ai := newTranscriber()
+	if _, client := ai.Current(); client == nil {
+		log.Println("OPENAI_API_KEY not set and tesseract is not installed")
+		return 1
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		log.Printf("failed to create %s: %s\n", *out, err)
+		return 1
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	var failed, skipped, done int
+	var countMu sync.Mutex
+	count := func(n *int) {
+		countMu.Lock()
+		*n++
+		countMu.Unlock()
+	}
+
+	for range *workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range jobs {
+				entry := convertOne(ai, src, *out, rel, *autofix, m)
+				if entry == nil {
+					count(&skipped)
+					continue
+				}
+				if entry.Status == statusFailed {
+					log.Printf("%s: %s\n", rel, entry.Error)
+					count(&failed)
+				} else {
+					log.Printf("%s -> %s\n", rel, entry.Output)
+					count(&done)
+				}
+				if err := m.record(entry); err != nil {
+					log.Println(err)
+				}
+			}
+		}()
+	}
+	for _, rel := range images {
+		jobs <- rel
+	}
+	close(jobs)
+	wg.Wait()
+
+	log.Printf("converted %d, skipped %d, failed %d of %d images\n", done, skipped, failed, len(images))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// estimateDir prints the images convert-dir would process and the estimated
+// total, leaving out those the manifest shows are already converted
+func estimateDir(src string, images []string, m *manifest) int {
+	ai, pricing := newTranscriber(), pricingFromEnv()
+	var total funcs.Estimate
+	skipped := 0
+	for _, rel := range images {
+		data, err := os.ReadFile(filepath.Join(src, rel))
+		if err != nil {
+			log.Printf("%s: %s\n", rel, err)
+			return 1
+		}
+		sum := sha256.Sum256(data)
+		if m.converted(rel, hex.EncodeToString(sum[:])) {
+			skipped++
+			continue
+		}
+		e := ai.EstimateImage(data, pricing)
+		fmt.Printf("%s  ~%d tokens\n", rel, e.InputTokens+e.OutputTokens)
+		total.Add(e)
+	}
+	fmt.Printf("\nalready converted: %d\n", skipped)
+	printEstimate(total)
+	return 0
+}
+
+// convertOne converts a single image for convert-dir. It returns nil when the
+// manifest shows the image is already converted.
+func convertOne(ai *funcs.Transcriber, src, out, rel string, autofix bool, m *manifest) *manifestEntry {
+	entry := &manifestEntry{Source: rel, Status: statusFailed, Converted: time.Now().UTC()}
+
+	hash, err := hashFile(filepath.Join(src, rel))
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.SHA256 = hash
+	if m.converted(rel, hash) {
+		return nil
+	}
+
+	markdown, err := ai.ConvertImageToMarkdown(context.Background(), filepath.Join(src, rel))
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	if autofix {
+		markdown = funcs.FixMarkdown(markdown)
+	}
+
+	output := strings.TrimSuffix(rel, filepath.Ext(rel)) + ".md"
+	target := filepath.Join(out, output)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	if err := os.WriteFile(target, []byte(markdown), 0644); err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	entry.Output = output
+	entry.Status = statusDone
+	return entry
+}
+
+// runSeed implements `bookmd seed [-notes n] [-notebooks n] [-seed n]`: it
+// fills a database with fake notes so pagination, search and performance
+// can be worked on against realistic data. It refuses to touch a database
+// that already has notes unless -force is given.
+func runSeed(args []string) int {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	opts := funcs.SeedOptions{}
+	flags.IntVar(&opts.Notes, "notes", 500, "number of notes to generate")
+	flags.IntVar(&opts.Notebooks, "notebooks", 12, "number of notebooks to file them into")
+	flags.Uint64Var(&opts.Seed, "seed", uint64(time.Now().UnixNano()), "random seed, for repeatable data")
+	force := flags.Bool("force", false, "add the notes even if the database already has some")
+	var p Paths
+	flags.StringVar(&p.Data, "data-dir", "", "directory for the database and images (default $XDG_DATA_HOME/bookmd)")
+	flags.StringVar(&p.DB, "db", "", "database file (default <data-dir>/notes.db)")
+	flags.StringVar(&p.Images, "images", "", "images directory (default <data-dir>/images)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: bookmd seed [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 || opts.Notes < 0 || opts.Notebooks < 0 {
+		flags.Usage()
+		return 2
+	}
+
+	p, err := resolvePaths(p)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	db, err := funcs.InitDB(p.DB)
+	if err != nil {
+		log.Printf("failed to open database: %s\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	if count, err := funcs.CountNotes(db); err != nil {
+		log.Println(err)
+		return 1
+	} else if count > 0 && !*force {
+		log.Printf("%s already has %d notes; use -force to add more\n", p.DB, count)
+		return 1
+	}
+
+	start := time.Now()
+	stats, err := funcs.SeedNotes(db, p.Images, opts)
+	if err != nil {
+		log.Printf("seeding failed after %d notes: %s\n", stats.Notes, err)
+		return 1
+	}
+	log.Printf("seeded %d notes, %d notebooks and %d revisions into %s in %s (seed %d)\n",
+		stats.Notes, stats.Notebooks, stats.Revisions, p.DB, time.Since(start).Round(time.Millisecond), opts.Seed)
+	return 0
+}
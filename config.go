@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The server is configured, from highest precedence to lowest, by flags,
+// environment variables, a bookmd.toml file and the built-in defaults.
+// Every flag can be set in the environment as BOOKMD_ and its name in
+// capitals with underscores, such as BOOKMD_AI_TIMEOUT for -ai-timeout, and
+// in the file under its name. A [section] in the file prefixes its keys, so
+// timeout under [ai] is -ai-timeout. The file can also hold the settings
+// read from the environment only, under the names in configEnv.
+
+// configEnv are the file keys of settings read from the environment rather
+// than flags, with their variables
+var configEnv = map[string]string{
+	"ai-provider":    "BOOKMD_AI_PROVIDER",
+	"ai-api-key":     "BOOKMD_AI_API_KEY",
+	"ai-base-url":    "BOOKMD_AI_BASE_URL",
+	"ai-model":       "BOOKMD_AI_MODEL",
+	"ai-prompt":      "BOOKMD_AI_PROMPT",
+	"ai-temperature": "BOOKMD_AI_TEMPERATURE",
+	"ai-max-tokens":  "BOOKMD_AI_MAX_TOKENS",
+	"ai-retries":     "BOOKMD_AI_RETRIES",
+	"ai-retry-delay": "BOOKMD_AI_RETRY_DELAY",
+	"input-price":    "BOOKMD_INPUT_PRICE",
+	"output-price":   "BOOKMD_OUTPUT_PRICE",
+	"tesseract-lang": "BOOKMD_TESSERACT_LANG",
+	"admin-token":    "BOOKMD_ADMIN_TOKEN",
+}
+
+// flagEnv is the environment variable that sets a flag
+func flagEnv(name string) string {
+	return "BOOKMD_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configPath is the config file to read: the one given with -config or
+// BOOKMD_CONFIG, which must exist, else ./bookmd.toml or
+// $XDG_CONFIG_HOME/bookmd/bookmd.toml when there is one
+func configPath(explicit string) (string, bool) {
+	if explicit != "" {
+		return explicit, true
+	}
+	candidates := []string{"bookmd.toml"}
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "bookmd", "bookmd.toml"))
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path, false
+		}
+	}
+	return "", false
+}
+
+// applyConfig sets the flags not given on the command line from the
+// environment, then from the config file named by the -config flag, and
+// exports the file's other settings to the environment where it does not
+// already have them. It returns the file read, if any. Call it right after
+// flag.Parse.
+func applyConfig(fs *flag.FlagSet) (string, error) {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(flagEnv(f.Name))
+		if given[f.Name] || !ok || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("%s: %w", flagEnv(f.Name), err)
+		}
+		given[f.Name] = true
+	})
+	if envErr != nil {
+		return "", envErr
+	}
+
+	explicit := ""
+	if f := fs.Lookup("config"); f != nil {
+		explicit = f.Value.String()
+	}
+	path, required := configPath(explicit)
+	if path == "" {
+		return "", nil
+	}
+	values, err := readConfig(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, v := range values {
+		if f := fs.Lookup(v.key); f != nil && f.Name != "config" {
+			if given[v.key] {
+				continue
+			}
+			if err := fs.Set(v.key, v.value); err != nil {
+				return "", fmt.Errorf("%s:%d: %s: %w", path, v.line, v.key, err)
+			}
+			continue
+		}
+		env, ok := configEnv[v.key]
+		if !ok {
+			return "", fmt.Errorf("%s:%d: unknown setting %s", path, v.line, v.key)
+		}
+		if _, set := os.LookupEnv(env); !set {
+			os.Setenv(env, v.value)
+		}
+	}
+	return path, nil
+}
+
+// configValue is a setting read from the config file, with its section
+// joined to its key
+type configValue struct {
+	key   string
+	value string
+	line  int
+}
+
+// readConfig reads the subset of TOML the config file needs: [sections],
+// comments and key = value pairs whose values are strings, quoted as
+// "basic", 'literal' or """multi-line""", numbers or booleans
+func readConfig(path string) ([]configValue, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values []configValue
+	section := ""
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			name, ok := strings.CutSuffix(stripComment(text), "]")
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unclosed section", path, line)
+			}
+			section = strings.TrimSpace(strings.TrimPrefix(name, "["))
+			continue
+		}
+
+		key, raw, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, line)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		if section != "" {
+			key = section + "-" + key
+		}
+		start := line
+		raw = strings.TrimSpace(raw)
+
+		var value string
+		if quotes := raw[:min(len(raw), 3)]; quotes == `"""` || quotes == `'''` {
+			// A multi-line string runs until its closing quotes
+			body := strings.TrimPrefix(raw, quotes)
+			for !strings.Contains(body, quotes) {
+				if !scanner.Scan() {
+					return nil, fmt.Errorf("%s:%d: unclosed %s string", path, start, quotes)
+				}
+				line++
+				body += "\n" + scanner.Text()
+			}
+			// A newline right after the opening quotes is not part of the string
+			value = strings.TrimPrefix(body[:strings.Index(body, quotes)], "\n")
+			if quotes == `"""` {
+				value, err = unescape(value)
+			}
+		} else {
+			value, err = configString(raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, start, key, err)
+		}
+		values = append(values, configValue{key: key, value: value, line: start})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// stripComment drops a # comment that follows a value outside quotes
+func stripComment(raw string) string {
+	quote := byte(0)
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return strings.TrimSpace(raw[:i])
+		}
+	}
+	return raw
+}
+
+// unescape reads the escapes of a TOML basic string
+func unescape(s string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", fmt.Errorf("string ends in a backslash")
+		}
+		switch s[i] {
+		case 'n':
+			out.WriteByte('\n')
+		case 't':
+			out.WriteByte('\t')
+		case 'r':
+			out.WriteByte('\r')
+		case '"', '\\':
+			out.WriteByte(s[i])
+		case 'u', 'U':
+			size := 4
+			if s[i] == 'U' {
+				size = 8
+			}
+			if i+size >= len(s) {
+				return "", fmt.Errorf("short \\%c escape", s[i])
+			}
+			code, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid \\%c escape", s[i])
+			}
+			out.WriteRune(rune(code))
+			i += size
+		default:
+			return "", fmt.Errorf("unknown escape \\%c", s[i])
+		}
+	}
+	return out.String(), nil
+}
+
+// configString turns a TOML value into the text a flag is set from
+func configString(raw string) (string, error) {
+	raw = stripComment(raw)
+	switch {
+	case strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || raw[len(raw)-1] != raw[0] {
+			return "", fmt.Errorf("unclosed string")
+		}
+		if raw[0] == '\'' {
+			return raw[1 : len(raw)-1], nil
+		}
+		return unescape(raw[1 : len(raw)-1])
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+	number := strings.ReplaceAll(raw, "_", "")
+	if _, err := strconv.ParseFloat(number, 64); err != nil {
+		return "", fmt.Errorf("expected a string, number or boolean, not %s", raw)
+	}
+	return number, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file in a temporary directory
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bookmd.toml")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfig(t *testing.T) {
+	path := writeConfig(t, `# bookmd settings
+port = 8080 # a comment
+data-dir = "/srv/notes # not a comment" # a comment
+tesseract-lang = 'eng#deu' # a comment
+admin-token = "say \"hi\" \\ # there"
+
+[ai]
+model = "gpt-4o"
+timeout = "2m"
+retries = 1_000
+enabled = true
+prompt = """
+Transcribe # everything
+exactly."""
+"quoted-key" = 'x'
+`)
+	want := []configValue{
+		{key: "port", value: "8080", line: 2},
+		{key: "data-dir", value: "/srv/notes # not a comment", line: 3},
+		{key: "tesseract-lang", value: "eng#deu", line: 4},
+		{key: "admin-token", value: `say "hi" \ # there`, line: 5},
+		{key: "ai-model", value: "gpt-4o", line: 8},
+		{key: "ai-timeout", value: "2m", line: 9},
+		{key: "ai-retries", value: "1000", line: 10},
+		{key: "ai-enabled", value: "true", line: 11},
+		{key: "ai-prompt", value: "Transcribe # everything\nexactly.", line: 12},
+		{key: "ai-quoted-key", value: "x", line: 15},
+	}
+	got, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readConfig =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestReadConfigBadLines(t *testing.T) {
+	for _, tc := range []struct {
+		name, text, want string
+	}{
+		{"no equals", "port = 1\njust words\n", ":2: expected key = value"},
+		{"unclosed section", "\n\n[ai\n", ":3: unclosed section"},
+		{"unclosed string", `name = "open`, `:1: name: unclosed string`},
+		{"unclosed multi-line string", "a = 1\nprompt = \"\"\"\nnever closed\n", `:2: unclosed """ string`},
+		{"bare word", "\n# comment\nmodel = gpt-4o\n", ":3: model: expected a string, number or boolean"},
+		{"empty value", "port =\n", ":1: port: expected a string"},
+		{"bad escape", `token = "a\q"`, `:1: token: unknown escape \q`},
+		{"error after multi-line string", "prompt = '''\n\n'''\nport = x\n", ":4: port:"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, tc.text)
+			_, err := readConfig(path)
+			if err == nil {
+				t.Fatal("readConfig accepted a bad line")
+			}
+			if !strings.Contains(err.Error(), path+tc.want) {
+				t.Errorf("error = %q, want it to contain %q", err, path+tc.want)
+			}
+		})
+	}
+}
+
+// configFlags is a flag set with a -config flag and one flag of each kind
+func configFlags() (*flag.FlagSet, *int, *string) {
+	fs := flag.NewFlagSet("bookmd", flag.ContinueOnError)
+	fs.String("config", "", "")
+	port := fs.Int("port", 8080, "")
+	dir := fs.String("data-dir", "data", "")
+	return fs, port, dir
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "port = 1\ndata-dir = \"file\"\nai-model = \"file-model\"\nai-prompt = \"file prompt\"\n")
+	t.Setenv("BOOKMD_PORT", "2")
+	t.Setenv("BOOKMD_DATA_DIR", "")
+	os.Unsetenv("BOOKMD_DATA_DIR")
+	t.Setenv("BOOKMD_AI_MODEL", "env-model")
+	t.Setenv("BOOKMD_AI_PROMPT", "")
+	os.Unsetenv("BOOKMD_AI_PROMPT")
+
+	// The flag beats the environment, which beats the file
+	fs, port, dir := configFlags()
+	if err := fs.Parse([]string{"-config", path, "-port", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 3 {
+		t.Errorf("port = %d, want the flag's 3", *port)
+	}
+	if *dir != "file" {
+		t.Errorf("data-dir = %q, want the file's", *dir)
+	}
+	if got := os.Getenv("BOOKMD_AI_MODEL"); got != "env-model" {
+		t.Errorf("BOOKMD_AI_MODEL = %q, want the environment's", got)
+	}
+	if got := os.Getenv("BOOKMD_AI_PROMPT"); got != "file prompt" {
+		t.Errorf("BOOKMD_AI_PROMPT = %q, want the file's", got)
+	}
+
+	// Without the flag the environment wins
+	fs, port, _ = configFlags()
+	if err := fs.Parse([]string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 2 {
+		t.Errorf("port = %d, want the environment's 2", *port)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, text, want string
+	}{
+		{"unknown key", "port = 1\ncolour = \"blue\"\n", ":2: unknown setting colour"},
+		{"unknown section key", "[ai]\nflavour = \"x\"\n", ":2: unknown setting ai-flavour"},
+		{"bad flag value", "\nport = \"eighty\"\n", ":2: port:"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("BOOKMD_PORT", "")
+			os.Unsetenv("BOOKMD_PORT")
+			path := writeConfig(t, tc.text)
+			fs, _, _ := configFlags()
+			if err := fs.Parse([]string{"-config", path}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := applyConfig(fs)
+			if err == nil || !strings.Contains(err.Error(), path+tc.want) {
+				t.Errorf("applyConfig = %v, want an error containing %q", err, path+tc.want)
+			}
+		})
+	}
+
+	fs, _, _ := configFlags()
+	if err := fs.Parse([]string{"-config", filepath.Join(t.TempDir(), "missing.toml")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyConfig(fs); err == nil {
+		t.Error("applyConfig accepted a missing -config file")
+	}
+}
@@ -2,65 +2,207 @@ package funcs
 
 import (
 	"context"
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
 )
 
+// TranscriptionModel is the default model used to transcribe images
+const TranscriptionModel = "gemini-3-flash-preview"
+
+// TranscriptionPrompt is the default instruction sent along with each image
+const TranscriptionPrompt = "Transcribe this image of notes into clean Markdown. Use headers, bullet points, and code blocks to match the visual structure."
+
+// metadataPrompt is appended to the transcription prompt so the structured
+// response also carries a title and what is written in the page margins
+const metadataPrompt = "Also report the page number written on the page (usually in a corner) as page_number, or 0 if there is none, " +
+	"and any date written on the page as written_date in YYYY-MM-DD format, or an empty string if there is none. " +
+	"Leave the page number and date out of the markdown. " +
+	"Finally, give the page a short descriptive title of at most eight words as title."
+
+// Transcription is the structured result of transcribing an image
+type Transcription struct {
+	Title       string `json:"title"`
+	Markdown    string `json:"markdown"`
+	PageNumber  int    `json:"page_number"`
+	WrittenDate string `json:"written_date"`
+	// Review lists the guardrails the markdown still breaks, if any
+	Review string `json:"-"`
+	// Provenance records how the markdown was produced, for SetNoteCapture
+	// to store
+	Provenance *Provenance `json:"-"`
+}
+
+// transcriptionSchema is the JSON schema the model is asked to answer in
+var transcriptionSchema = jsonschema.Definition{
+	Type: jsonschema.Object,
+	Properties: map[string]jsonschema.Definition{
+		"title":        {Type: jsonschema.String},
+		"markdown":     {Type: jsonschema.String},
+		"page_number":  {Type: jsonschema.Integer},
+		"written_date": {Type: jsonschema.String},
+	},
+	Required: []string{"title", "markdown", "page_number", "written_date"},
+}
+
 // ConvertImageToMarkdown takes a file path,
 // sends the image to the AI, and returns the markdown transcription.
-func ConvertImageToMarkdown(ctx context.Context, client *openai.Client, imagePath string) (string, error) {
-	// Initialize OpenAI client if not provided
-	if client == nil {
-		apiKey := os.Getenv("OPENAI_API_KEY")
-		if apiKey == "" {
-			return "", fmt.Errorf("OPENAI_API_KEY environment variable not set")
-		}
-		client = openai.NewClient(apiKey)
+func (t *Transcriber) ConvertImageToMarkdown(ctx context.Context, imagePath string) (string, error) {
+	tr, err := t.TranscribeImage(ctx, imagePath)
+	if err != nil {
+		return "", err
 	}
-	imageData, err := os.ReadFile(imagePath)
+	return tr.Markdown, nil
+}
+
+// ConvertImageWith transcribes an image with an explicit client, model and
+// prompt, as used by pipeline steps. A nil client uses the Transcriber's;
+// the other parameters are its settings'.
+func (t *Transcriber) ConvertImageWith(ctx context.Context, client VisionClient, model, prompt, imagePath string) (string, error) {
+	tr, err := t.TranscribeImageWith(ctx, client, model, prompt, imagePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read image file: %w", err)
+		return "", err
 	}
+	return tr.Markdown, nil
+}
 
-	mimeType := http.DetectContentType(imageData)
+// TranscribeImage is ConvertImageToMarkdown that also returns the page
+// number and date written on the page. The output is checked against the
+// guardrails.
+func (t *Transcriber) TranscribeImage(ctx context.Context, imagePath string) (*Transcription, error) {
+	return t.TranscribeImageOverride(ctx, imagePath, AIOverrides{})
+}
 
-	base64Image := base64.StdEncoding.EncodeToString(imageData)
+// TranscribeImageOverride is TranscribeImage with some of the settings
+// replaced for this image
+func (t *Transcriber) TranscribeImageOverride(ctx context.Context, imagePath string, o AIOverrides) (*Transcription, error) {
+	settings, client := t.Current()
+	mode := cacheUse
+	if o.Force {
+		mode = cacheRefresh
+	}
+	profile := PromptCustom
+	switch {
+	case o.Prompt != "":
+		profile = PromptOverride
+	case settings.Prompt == TranscriptionPrompt:
+		profile = PromptDefault
+	}
+	settings = settings.With(o)
 
-	dataURL := fmt.Sprintf("data:%s;base64,%s", mimeType, base64Image)
+	ctx, provenance := TrackProvenance(ctx)
+	recordPrompt(ctx, settings.Model, profile, settings.Prompt)
+	tr, err := t.transcribeGuarded(ctx, client, settings, imagePath, mode)
+	if err != nil {
+		return nil, err
+	}
+	tr.Provenance = provenance
+	return tr, nil
+}
+
+// TranscribeImageWith is ConvertImageWith returning the full Transcription.
+// It always asks the provider, bypassing the AI cache.
+func (t *Transcriber) TranscribeImageWith(ctx context.Context, client VisionClient, model, prompt, imagePath string) (*Transcription, error) {
+	settings, current := t.Current()
+	if client == nil {
+		client = current
+	}
+	return t.transcribeImage(ctx, client, settings.With(AIOverrides{Model: model, Prompt: prompt}), imagePath, cacheOff)
+}
 
-	req := openai.ChatCompletionRequest{
-		Model: "gemini-3-flash-preview",
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role: openai.ChatMessageRoleUser,
-				MultiContent: []openai.ChatMessagePart{
-					{
-						Type: openai.ChatMessagePartTypeText,
-						Text: "Transcribe this image of notes into clean Markdown. Use headers, bullet points, and code blocks to match the visual structure.",
-					},
-					{
-						Type: openai.ChatMessagePartTypeImageURL,
-						ImageURL: &openai.ChatMessageImageURL{
-							URL: dataURL,
-						},
-					},
-				},
-			},
-		},
+// transcribeImage sends an image to the AI with the settings' model, prompt
+// and parameters, using the AI cache as mode says
+func (t *Transcriber) transcribeImage(ctx context.Context, client VisionClient, settings AISettings, imagePath string, mode cacheMode) (*Transcription, error) {
+	if client == nil {
+		return nil, fmt.Errorf("no AI API key configured")
+	}
+	imageData, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image file: %w", err)
 	}
 
-	resp, err := client.CreateChatCompletion(ctx, req)
+	req := settings.request(settings.Prompt + "\n\n" + metadataPrompt)
+	req.Image = imageData
+	req.Schema = &transcriptionSchema
+	content, err := t.completeCached(ctx, client, req, mode)
 	if err != nil {
-		return "", fmt.Errorf("ai request failed: %w", err)
+		return nil, err
+	}
+	return parseTranscription(content), nil
+}
+
+// parseTranscription decodes the structured response. Providers that ignore
+// the response format answer in plain markdown, which is kept as is.
+func parseTranscription(content string) *Transcription {
+	var t Transcription
+	raw := strings.TrimSpace(content)
+	raw = strings.TrimPrefix(raw, "```json")
+	raw = strings.TrimSuffix(strings.TrimPrefix(raw, "```"), "```")
+	if err := json.Unmarshal([]byte(raw), &t); err != nil || t.Markdown == "" {
+		return &Transcription{Markdown: content}
+	}
+	if t.PageNumber < 0 {
+		t.PageNumber = 0
+	}
+	t.Title = strings.TrimSpace(t.Title)
+	if len([]rune(t.Title)) > MaxTitleLength {
+		t.Title = string([]rune(t.Title)[:MaxTitleLength])
+	}
+	t.WrittenDate = strings.TrimSpace(t.WrittenDate)
+	if _, err := time.Parse(time.DateOnly, t.WrittenDate); err != nil {
+		t.WrittenDate = ""
 	}
+	return &t
+}
 
-	if len(resp.Choices) == 0 {
-		return "", fmt.Errorf("no response choices returned")
+// CompleteText runs a text-only prompt over input, as used by the later
+// steps of a pipeline. A nil client uses the Transcriber's.
+func (t *Transcriber) CompleteText(ctx context.Context, client VisionClient, model, prompt, input string) (string, error) {
+	client = t.orCurrent(client)
+	if client == nil {
+		return "", fmt.Errorf("no AI API key configured")
 	}
+	return client.Complete(t.withUsageLog(ctx), VisionRequest{Model: model, System: prompt, Prompt: input})
+}
 
-	return resp.Choices[0].Message.Content, nil
+// cleanupPrompt asks for a corrected copy of a transcription, without the
+// image, so it can be reviewed as a diff against the original
+const cleanupPrompt = "You proofread Markdown transcribed from handwritten notes. Fix OCR artifacts, spelling, " +
+	"broken words and Markdown formatting. Keep the content, meaning, wording, language and structure: do not add, " +
+	"remove, summarize or reorder anything, and keep [[links]] as they are. Reply with the corrected Markdown only."
+
+// CleanupMarkdown asks the AI to fix the transcription errors in markdown.
+// The request is recorded in the provenance ctx tracks, if any.
+func (t *Transcriber) CleanupMarkdown(ctx context.Context, markdown string) (string, error) {
+	settings, client := t.Current()
+	recordPrompt(ctx, settings.Model, PromptCleanup, cleanupPrompt)
+	cleaned, err := t.CompleteText(ctx, client, settings.Model, cleanupPrompt, markdown)
+	if err != nil {
+		return "", err
+	}
+	cleaned = strings.TrimSpace(cleaned)
+	// Models often fence their whole reply
+	if rest, ok := strings.CutPrefix(cleaned, "```"); ok && strings.HasSuffix(rest, "```") {
+		_, body, _ := strings.Cut(rest, "\n")
+		cleaned = strings.TrimSpace(strings.TrimSuffix(body, "```"))
+	}
+	if cleaned == "" {
+		return "", fmt.Errorf("the AI returned no markdown")
+	}
+	return cleaned + "\n", nil
+}
+
+// EstimateCleanup projects the cost of cleaning up markdown, whose output
+// is about as long as its input
+func EstimateCleanup(markdown string, pricing Pricing) Estimate {
+	e := Estimate{
+		InputTokens:  (len(cleanupPrompt) + len(markdown)) / charsPerToken,
+		OutputTokens: len(markdown) / charsPerToken,
+	}
+	e.CostUSD = pricing.cost(e.InputTokens, e.OutputTokens)
+	return e
 }
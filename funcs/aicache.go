@@ -0,0 +1,191 @@
+package funcs
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// AICacheEntry is a stored AI response. Response is only filled in when a
+// single entry is fetched.
+type AICacheEntry struct {
+	Key         string     `json:"key"`
+	ImageHash   string     `json:"image_hash"`
+	Model       string     `json:"model"`
+	Prompt      string     `json:"prompt"`
+	Response    string     `json:"response,omitempty"`
+	Size        int        `json:"size"`
+	Hits        int        `json:"hits"`
+	DateCreated time.Time  `json:"date_created"`
+	LastHit     *time.Time `json:"last_hit"`
+}
+
+// AICacheStats summarises the cache
+type AICacheStats struct {
+	Entries int `json:"entries"`
+	Hits    int `json:"hits"`
+	Bytes   int `json:"bytes"`
+}
+
+// Ways a request uses the AI cache
+type cacheMode int
+
+const (
+	// cacheOff sends the request and stores nothing
+	cacheOff cacheMode = iota
+	// cacheUse answers from the cache, storing new responses
+	cacheUse
+	// cacheRefresh sends the request and replaces the cached response
+	cacheRefresh
+)
+
+// ImageHash is the hex SHA-256 of an image's bytes
+func ImageHash(image []byte) string {
+	sum := sha256.Sum256(image)
+	return hex.EncodeToString(sum[:])
+}
+
+// aiCacheKey identifies a request by its image, model, prompts and any
+// parameters set, so keys of requests without parameters are unchanged
+func aiCacheKey(imageHash string, req VisionRequest) string {
+	parts := []string{imageHash, req.Model, req.System, req.Prompt}
+	if req.Temperature != nil || req.MaxTokens != 0 {
+		parts = append(parts, formatTemperature(req.Temperature), formatMaxTokens(req.MaxTokens))
+	}
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// completeCached answers req from the cache when the same image, model and
+// prompt have been sent before, and otherwise sends it and stores the
+// response. With cacheRefresh the cached response is skipped and replaced.
+// Cache errors are logged rather than failing the request.
+func (t *Transcriber) completeCached(ctx context.Context, client VisionClient, req VisionRequest, mode cacheMode) (string, error) {
+	t.mu.RLock()
+	db := t.cache
+	t.mu.RUnlock()
+	ctx = t.withUsageLog(ctx)
+	// Local OCR is cheap to rerun, and its text must not later be mistaken
+	// for the model's answer to the same request
+	if _, local := client.(*TesseractVision); db == nil || local || mode == cacheOff {
+		return client.Complete(ctx, req)
+	}
+
+	imageHash := ImageHash(req.Image)
+	key := aiCacheKey(imageHash, req)
+	var response string
+	if mode == cacheUse {
+		err := db.QueryRow(`UPDATE ai_cache SET hits = hits + 1, last_hit = CURRENT_TIMESTAMP
+			WHERE key = ? RETURNING response`, key).Scan(&response)
+		if err == nil {
+			recordProvenance(ctx, func(p *Provenance) { p.Cached = true })
+			return response, nil
+		}
+		if err != sql.ErrNoRows {
+			slog.Error("failed to read AI cache", "err", err)
+		}
+	}
+
+	response, err := client.Complete(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(`INSERT INTO ai_cache (key, image_hash, model, prompt, response) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET response = excluded.response, date_created = CURRENT_TIMESTAMP`,
+		key, imageHash, req.Model, req.Prompt, response)
+	if err != nil {
+		slog.Error("failed to write AI cache", "err", err)
+	}
+	return response, nil
+}
+
+// GetAICacheStats counts the cached responses and how often they were reused
+func GetAICacheStats(db *sql.DB) (AICacheStats, error) {
+	var stats AICacheStats
+	err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(hits), 0), COALESCE(SUM(LENGTH(response)), 0) FROM ai_cache`).
+		Scan(&stats.Entries, &stats.Hits, &stats.Bytes)
+	if err != nil {
+		return stats, fmt.Errorf("failed to query AI cache stats: %w", err)
+	}
+	return stats, nil
+}
+
+// GetAICacheEntries lists up to limit cached responses, most recently used
+// first, without the responses themselves
+func GetAICacheEntries(db *sql.DB, limit int) ([]AICacheEntry, error) {
+	rows, err := db.Query(`SELECT key, image_hash, model, prompt, LENGTH(response), hits, date_created, last_hit
+		FROM ai_cache ORDER BY COALESCE(last_hit, date_created) DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query AI cache: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AICacheEntry{}
+	for rows.Next() {
+		var e AICacheEntry
+		var lastHit sql.NullTime
+		if err := rows.Scan(&e.Key, &e.ImageHash, &e.Model, &e.Prompt, &e.Size, &e.Hits, &e.DateCreated, &lastHit); err != nil {
+			return nil, fmt.Errorf("failed to scan AI cache entry: %w", err)
+		}
+		if lastHit.Valid {
+			e.LastHit = &lastHit.Time
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating AI cache: %w", err)
+	}
+	return entries, nil
+}
+
+// GetAICacheEntry retrieves one cached response by key
+func GetAICacheEntry(db *sql.DB, key string) (*AICacheEntry, error) {
+	var e AICacheEntry
+	var lastHit sql.NullTime
+	err := db.QueryRow(`SELECT key, image_hash, model, prompt, response, LENGTH(response), hits, date_created, last_hit
+		FROM ai_cache WHERE key = ?`, key).
+		Scan(&e.Key, &e.ImageHash, &e.Model, &e.Prompt, &e.Response, &e.Size, &e.Hits, &e.DateCreated, &lastHit)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no cached response with key %s", key)
+		}
+		return nil, fmt.Errorf("failed to scan AI cache entry: %w", err)
+	}
+	if lastHit.Valid {
+		e.LastHit = &lastHit.Time
+	}
+	return &e, nil
+}
+
+// DeleteAICacheEntry removes one cached response
+func DeleteAICacheEntry(db *sql.DB, key string) error {
+	result, err := db.Exec(`DELETE FROM ai_cache WHERE key = ?`, key)
+	if err != nil {
+		return fmt.Errorf("failed to delete AI cache entry: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return notFound("no cached response with key %s", key)
+	}
+	return nil
+}
+
+// ClearAICache removes every cached response and returns how many there were
+func ClearAICache(db *sql.DB) (int64, error) {
+	result, err := db.Exec(`DELETE FROM ai_cache`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clear AI cache: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return n, nil
+}
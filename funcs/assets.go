@@ -0,0 +1,61 @@
+package funcs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"sync"
+)
+
+// staticAssets holds the fingerprints of the static files, by name. Without
+// them, as in development, pages link the files as they are.
+var staticAssets struct {
+	sync.RWMutex
+	versions map[string]string
+}
+
+// UseStaticAssets fingerprints every file of fsys, so pages link each by the
+// hash of its contents and browsers can cache it until it changes. A nil
+// fsys turns fingerprints off, for assets edited while the server runs.
+func UseStaticAssets(fsys fs.FS) error {
+	var versions map[string]string
+	if fsys != nil {
+		versions = map[string]string{}
+		err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			versions[name] = hex.EncodeToString(sum[:])[:12]
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fingerprint static assets: %w", err)
+		}
+	}
+	staticAssets.Lock()
+	defer staticAssets.Unlock()
+	staticAssets.versions = versions
+	return nil
+}
+
+// StaticVersion is the fingerprint of a static file, "" when it has none
+func StaticVersion(name string) string {
+	staticAssets.RLock()
+	defer staticAssets.RUnlock()
+	return staticAssets.versions[name]
+}
+
+// StaticURL is the link to a static file, with its fingerprint when it has
+// one
+func StaticURL(name string) string {
+	if version := StaticVersion(name); version != "" {
+		return "/static/" + name + "?v=" + version
+	}
+	return "/static/" + name
+}
@@ -0,0 +1,58 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Audit log actions
+const (
+	AuditNotebookLocked   = "notebook.locked"
+	AuditNotebookUnlocked = "notebook.unlocked"
+)
+
+// AuditEntry is an administrative action: what was done to which notebook,
+// by whom and why. Actor is who the server saw make the request.
+type AuditEntry struct {
+	ID          int       `json:"id"`
+	Action      string    `json:"action"`
+	NotebookID  int       `json:"notebook_id"`
+	Actor       string    `json:"actor"`
+	Reason      string    `json:"reason"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+// recordAudit adds an entry to the audit log
+func recordAudit(q dbtx, action string, notebookID int, actor, reason string) error {
+	_, err := q.Exec(`INSERT INTO audit_log (action, notebook_id, actor, reason) VALUES (?, ?, ?, ?)`,
+		action, notebookID, actor, reason)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
+
+// GetAuditLog returns the newest entries of the audit log, at most limit,
+// only those about notebookID unless it is 0
+func GetAuditLog(db *sql.DB, notebookID, limit int) ([]AuditEntry, error) {
+	rows, err := db.Query(`SELECT id, action, notebook_id, actor, reason, date_created FROM audit_log
+		WHERE ? = 0 OR notebook_id = ? ORDER BY id DESC LIMIT ?`, notebookID, notebookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Action, &e.NotebookID, &e.Actor, &e.Reason, &e.DateCreated); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating audit log: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,325 @@
+package funcs
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ManifestName is where a backup keeps its manifest
+const ManifestName = "manifest.json"
+
+// backupFormat is the version of the backup layout, raised when it changes
+// in a way older servers cannot import
+const backupFormat = 1
+
+// BackupManifest lists what a backup holds: the SHA-256 and size of every
+// other file in it, so an import can tell a damaged or altered archive from
+// a good one, and each note with the provenance of its markdown
+type BackupManifest struct {
+	Format      int          `json:"format"`
+	DateCreated time.Time    `json:"date_created"`
+	Files       []BackupFile `json:"files"`
+	Notes       []BackupNote `json:"notes"`
+}
+
+// BackupFile is the checksum of one file of a backup
+type BackupFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// BackupNote is a note of a backup. Markdown and Image are the paths of its
+// files in the archive.
+type BackupNote struct {
+	ID          int         `json:"id"`
+	Title       string      `json:"title"`
+	DateCreated time.Time   `json:"date_created"`
+	Markdown    string      `json:"markdown"`
+	Image       string      `json:"image"`
+	Properties  []Property  `json:"properties"`
+	Provenance  *Provenance `json:"provenance"`
+}
+
+// ErrIntegrity matches, with errors.Is, the error of a backup whose files
+// do not match its manifest
+var ErrIntegrity = errors.New("backup failed verification")
+
+// IntegrityError lists every file of a backup that does not match its
+// manifest
+type IntegrityError struct {
+	Problems []string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("backup failed verification: %s", strings.Join(e.Problems, "; "))
+}
+
+func (e *IntegrityError) Is(target error) bool { return target == ErrIntegrity }
+
+// BackupImport counts the notes an import added and those it skipped
+// because their image was already in the library
+type BackupImport struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// WriteBackup writes every note outside the trash to w as a zip: each
+// note's markdown as notes/<id>.md, each image once under images/ and the
+// manifest last. openImage reads a stored image by name.
+func WriteBackup(db *sql.DB, w io.Writer, openImage func(name string) (io.ReadCloser, error)) error {
+	notes, err := GetAllNotes(db)
+	if err != nil {
+		return err
+	}
+	m := BackupManifest{Format: backupFormat, DateCreated: time.Now().UTC(), Files: []BackupFile{}, Notes: []BackupNote{}}
+	zw := zip.NewWriter(w)
+	written := map[string]bool{}
+	for _, note := range notes {
+		properties, err := GetProperties(db, note.ID)
+		if err != nil {
+			return err
+		}
+		provenance, err := GetNoteProvenance(db, note.ID)
+		if err != nil {
+			return err
+		}
+		entry := BackupNote{
+			ID:          note.ID,
+			Title:       note.Title,
+			DateCreated: note.DateCreated,
+			Markdown:    fmt.Sprintf("notes/%d.md", note.ID),
+			Image:       "images/" + note.Image,
+			Properties:  properties,
+			Provenance:  provenance,
+		}
+		file, err := writeBackupFile(zw, entry.Markdown, m.DateCreated, strings.NewReader(note.Markdown))
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, file)
+		if !written[entry.Image] {
+			image, err := openImage(note.Image)
+			if err != nil {
+				return fmt.Errorf("failed to open image of note %d: %w", note.ID, err)
+			}
+			file, err := writeBackupFile(zw, entry.Image, m.DateCreated, image)
+			image.Close()
+			if err != nil {
+				return err
+			}
+			m.Files = append(m.Files, file)
+			written[entry.Image] = true
+		}
+		m.Notes = append(m.Notes, entry)
+	}
+
+	manifest, err := zw.CreateHeader(&zip.FileHeader{Name: ManifestName, Method: zip.Deflate, Modified: m.DateCreated})
+	if err != nil {
+		return fmt.Errorf("failed to add manifest: %w", err)
+	}
+	encoder := json.NewEncoder(manifest)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(m); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to finish backup: %w", err)
+	}
+	return nil
+}
+
+// writeBackupFile copies r into the archive as name, returning its checksum
+func writeBackupFile(zw *zip.Writer, name string, modified time.Time, r io.Reader) (BackupFile, error) {
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("failed to add %s: %w", name, err)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), r)
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return BackupFile{Path: name, SHA256: hex.EncodeToString(h.Sum(nil)), Bytes: n}, nil
+}
+
+// VerifyBackup reads a backup's manifest and checks every file against it:
+// each listed file must be there with its size and checksum, and nothing
+// else may be. The manifest is returned with an *IntegrityError when a
+// file does not match.
+func VerifyBackup(archive *zip.Reader) (*BackupManifest, error) {
+	data, err := readZipFile(archive, ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	var m BackupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if m.Format < 1 || m.Format > backupFormat {
+		return nil, fmt.Errorf("unsupported backup format %d", m.Format)
+	}
+
+	listed := map[string]BackupFile{}
+	for _, f := range m.Files {
+		listed[f.Path] = f
+	}
+	var problems []string
+	found := map[string]bool{}
+	for _, f := range archive.File {
+		if f.Name == ManifestName || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		want, ok := listed[f.Name]
+		if !ok {
+			problems = append(problems, f.Name+" is not in the manifest")
+			continue
+		}
+		found[f.Name] = true
+		sum, size, err := zipFileSum(f)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s cannot be read: %v", f.Name, err))
+		} else if size != want.Bytes {
+			problems = append(problems, fmt.Sprintf("%s is %d bytes, expected %d", f.Name, size, want.Bytes))
+		} else if sum != want.SHA256 {
+			problems = append(problems, f.Name+" does not match its checksum")
+		}
+	}
+	for _, f := range m.Files {
+		if !found[f.Path] {
+			problems = append(problems, f.Path+" is missing")
+		}
+	}
+	for _, note := range m.Notes {
+		for _, name := range []string{note.Markdown, note.Image} {
+			if _, ok := listed[name]; !ok {
+				problems = append(problems, fmt.Sprintf("note %d's %s has no checksum", note.ID, name))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return &m, &IntegrityError{Problems: problems}
+	}
+	return &m, nil
+}
+
+// zipFileSum reads a file of an archive, returning its SHA-256 and size
+func zipFileSum(f *zip.File) (string, int64, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// readZipFile reads a whole file of an archive by name
+func readZipFile(archive *zip.Reader, name string) ([]byte, error) {
+	r, err := archive.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// ImportBackup adds the notes of a backup once every file has been checked
+// against its manifest; nothing is added from a backup that fails. Notes
+// whose image is already in the library are skipped, so importing a backup
+// twice does not duplicate it. saveImage stores an image and returns the
+// name it was stored under.
+func ImportBackup(db *sql.DB, archive *zip.Reader, saveImage func(name string, data []byte) (string, error)) (BackupImport, error) {
+	var result BackupImport
+	m, err := VerifyBackup(archive)
+	if err != nil {
+		return result, err
+	}
+	// Notes of the backup may share an image, which only the first stores
+	imported := map[string]bool{}
+	for _, entry := range m.Notes {
+		markdown, err := readZipFile(archive, entry.Markdown)
+		if err != nil {
+			return result, err
+		}
+		data, err := readZipFile(archive, entry.Image)
+		if err != nil {
+			return result, err
+		}
+		name := ImageName(data, path.Ext(entry.Image))
+		if !imported[name] {
+			existing, err := NoteWithImage(db, name)
+			if err != nil {
+				return result, err
+			}
+			if existing != 0 {
+				result.Skipped++
+				continue
+			}
+		}
+		image, err := saveImage(path.Base(entry.Image), data)
+		if err != nil {
+			return result, err
+		}
+		imported[image] = true
+		if _, err := importBackupNote(db, entry, image, string(markdown)); err != nil {
+			return result, err
+		}
+		result.Imported++
+	}
+	return result, nil
+}
+
+// importBackupNote adds a note read from a backup, stored with image,
+// keeping its title, date, properties and provenance. Its ID is new.
+func importBackupNote(db *sql.DB, note BackupNote, image, markdown string) (*Note, error) {
+	added, err := AddNote(db, image, markdown)
+	if err != nil {
+		return nil, err
+	}
+	provenance, err := encodeProvenance(note.Provenance)
+	if err != nil {
+		return nil, err
+	}
+	err = inNoteTx(db, added.ID, func(q dbtx) error {
+		_, err := q.Exec(`UPDATE notes SET title = ?, date_created = ?, provenance = ? WHERE id = ?`,
+			note.Title, note.DateCreated.UTC().Format(time.DateTime), provenance, added.ID)
+		if err != nil {
+			return fmt.Errorf("failed to restore imported note: %w", err)
+		}
+		if err := recordChange(q, added.ID, ChangeUpdated, added.Revision); err != nil {
+			return err
+		}
+		for _, p := range note.Properties {
+			if err := setProperty(q, added.ID, p.Key, p.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	imported, err := GetNoteByID(db, added.ID)
+	if err != nil {
+		return nil, err
+	}
+	return imported, nil
+}
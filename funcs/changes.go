@@ -0,0 +1,76 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Change actions recorded in the note_changes log
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// MaxChangesLimit caps how many changes one GetChangesSince call returns
+const MaxChangesLimit = 1000
+
+// Change is one entry in the note change log. Seq increases monotonically
+// and serves as the sync cursor.
+type Change struct {
+	Seq         int64     `json:"seq"`
+	NoteID      int       `json:"note_id"`
+	Action      string    `json:"action"`
+	Revision    int       `json:"revision"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+const insertChangeQuery = `INSERT INTO note_changes (note_id, action, revision) VALUES (?, ?, ?)`
+
+// recordChange appends an entry to the change log
+func recordChange(db execer, noteID int, action string, revision int) error {
+	_, err := db.Exec(insertChangeQuery, noteID, action, revision)
+	if err != nil {
+		return fmt.Errorf("failed to record change: %w", err)
+	}
+	return nil
+}
+
+// GetChangesSince returns up to limit changes with a sequence number greater
+// than cursor, oldest first, and whether more remain after them
+func GetChangesSince(db *sql.DB, cursor int64, limit int) ([]Change, bool, error) {
+	if limit <= 0 || limit > MaxChangesLimit {
+		limit = MaxChangesLimit
+	}
+
+	query := `SELECT seq, note_id, action, revision, date_created FROM note_changes WHERE seq > ? ORDER BY seq LIMIT ?`
+	rows, err := db.Query(query, cursor, limit+1)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to query changes: %w", err)
+	}
+	defer rows.Close()
+
+	changes := []Change{}
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.Seq, &c.NoteID, &c.Action, &c.Revision, &c.DateCreated); err != nil {
+			return nil, false, fmt.Errorf("failed to scan change: %w", err)
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("error iterating changes: %w", err)
+	}
+
+	hasMore := len(changes) > limit
+	if hasMore {
+		changes = changes[:limit]
+	}
+	return changes, hasMore, nil
+}
@@ -0,0 +1,104 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// CompiledNote is one note of a compiled notebook, rendered with anchors
+// that are unique across the whole compilation
+type CompiledNote struct {
+	Note Note   `json:"note"`
+	HTML string `json:"html"`
+}
+
+// Compilation is every note of a notebook and its sub-notebooks read as a
+// single document
+type Compilation struct {
+	Notebook Notebook       `json:"notebook"`
+	Notes    []CompiledNote `json:"notes"`
+	Headings []Heading      `json:"headings"`
+	Markdown string         `json:"markdown"`
+}
+
+// compiledNotes lists the notes of a notebook in the order they were
+// written, followed by those of each sub-notebook in turn
+func compiledNotes(db *sql.DB, notebookID int, seen map[int]bool) ([]Note, error) {
+	if seen[notebookID] {
+		return nil, nil
+	}
+	seen[notebookID] = true
+
+	rows, err := db.Query(`SELECT `+noteColumns+` FROM notes WHERE notebook_id = ? AND deleted_at IS NULL
+		ORDER BY COALESCE(NULLIF(captured_at, ''), date(date_created)), page_number, id`, notebookID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notebook notes: %w", err)
+	}
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes = append(notes, *note)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notes: %w", err)
+	}
+
+	children, err := GetChildNotebooks(db, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		childNotes, err := compiledNotes(db, child.ID, seen)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, childNotes...)
+	}
+	return notes, nil
+}
+
+// chapter is a note's markdown with embeds and links expanded, under a
+// heading with its title unless it already starts with one
+func chapter(db *sql.DB, note *Note) string {
+	markdown := strings.TrimSpace(ExpandTransclusions(db, note))
+	first, _, _ := strings.Cut(markdown, "\n")
+	if headingLevel(first) == 0 {
+		markdown = "# " + NoteTitle(note) + "\n\n" + markdown
+	}
+	return markdown
+}
+
+// CompileNotebook joins the notes of a notebook and its sub-notebooks into
+// one document with a table of contents covering every note
+func CompileNotebook(db *sql.DB, notebookID int) (*Compilation, error) {
+	nb, err := GetNotebook(db, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := compiledNotes(db, notebookID, map[int]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Compilation{Notebook: *nb, Notes: []CompiledNote{}, Headings: []Heading{}}
+	ids := &headingIDs{seen: map[string]int{}}
+	chapters := make([]string, 0, len(notes))
+	for i := range notes {
+		markdown := chapter(db, &notes[i])
+		html, headings, err := renderMarkdown(markdown, ids)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render note %d: %w", notes[i].ID, err)
+		}
+		c.Notes = append(c.Notes, CompiledNote{Note: notes[i], HTML: html})
+		c.Headings = append(c.Headings, headings...)
+		chapters = append(chapters, markdown)
+	}
+	c.Markdown = strings.Join(chapters, "\n\n") + "\n"
+	return c, nil
+}
@@ -0,0 +1,200 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MockVision answers every request without calling a provider. Images get
+// a canned transcription and text steps get their input back.
+type MockVision struct{}
+
+// Complete returns the canned answer for req
+func (MockVision) Complete(ctx context.Context, req VisionRequest) (string, error) {
+	if req.Image == nil {
+		return req.Prompt, nil
+	}
+	if req.Schema == nil {
+		return mockMarkdown(len(req.Image)), nil
+	}
+	data, err := json.Marshal(Transcription{
+		Title:    "Demo transcription",
+		Markdown: mockMarkdown(len(req.Image)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode mock transcription: %w", err)
+	}
+	return string(data), nil
+}
+
+func mockMarkdown(size int) string {
+	return fmt.Sprintf("# Demo transcription\n\nThis is a demo, so the %d byte image was not sent to an AI provider.\n\n"+
+		"- Uploads, edits and notebooks work as usual\n- Deleting and changing settings are turned off\n", size)
+}
+
+// DemoImage is the file name the sample image is stored under in demo mode
+const DemoImage = "demo-sample-note.png"
+
+// demoNote is a sample note seeded in demo mode. Links use [[N]] where N is
+// the position of the target in demoNotes, counting from 1, which matches
+// its ID once the tables have been emptied.
+type demoNote struct {
+	Notebook   string
+	Markdown   string
+	Properties map[string]string
+}
+
+var demoNotes = []demoNote{
+	{
+		Notebook: "Biology",
+		Markdown: "# Cell structure\n\nEvery cell has a **membrane**, **cytoplasm** and genetic material.\n\n" +
+			"## Organelles\n\n- Nucleus: holds the DNA\n- Mitochondria: release energy, see [[2]]\n- Ribosomes: build proteins\n",
+		Properties: map[string]string{"course": "BIO 101", "week": "1"},
+	},
+	{
+		Notebook: "Biology",
+		Markdown: "# Respiration\n\nGlucose + oxygen → carbon dioxide + water + energy\n\n" +
+			"1. Glycolysis in the cytoplasm\n2. Krebs cycle in the mitochondria\n3. Electron transport chain\n\n" +
+			"Back to ![[1#Organelles]]\n",
+		Properties: map[string]string{"course": "BIO 101", "week": "2"},
+	},
+	{
+		Notebook: "History",
+		Markdown: "# The printing press\n\nGutenberg, around 1450. Movable metal type made books cheap enough to spread ideas quickly.\n\n" +
+			"> It is a press, certainly, but a press from which shall flow in inexhaustible streams…\n",
+		Properties: map[string]string{"course": "HIS 210"},
+	},
+	{
+		Markdown: "# Shopping list\n\n- [ ] Notebook with squared paper\n- [ ] Highlighters\n- [x] Coffee\n",
+	},
+}
+
+// demoTables are emptied when the demo is reset, in an order that keeps
+// references valid
+var demoTables = []string{
+	"note_links", "note_properties", "note_revisions", "revision_blobs", "note_feedback", "note_changes", "recent_views", "tag_suggestions",
+	"pipeline_artifacts", "pipeline_runs", "pipelines", "note_types", "notes", "notebooks", "physical_notebooks",
+	"settings", "ai_cache", "ai_usage", "jobs", "job_batches", "uploads", "audit_log",
+}
+
+// ResetDemo empties the database and fills it with the sample notes, each
+// showing sampleImage. Images of the notes it removes are deleted from
+// imageDir, so visitors' uploads do not pile up.
+func ResetDemo(db *sql.DB, imageDir string, sampleImage []byte) error {
+	rows, err := db.Query(`SELECT image FROM notes WHERE image != ?
+		UNION SELECT image FROM note_revisions WHERE image != ?`, DemoImage, DemoImage)
+	if err != nil {
+		return fmt.Errorf("failed to query demo images: %w", err)
+	}
+	var uploads []string
+	for rows.Next() {
+		var image string
+		if err := rows.Scan(&image); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan demo image: %w", err)
+		}
+		uploads = append(uploads, image)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating demo images: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	removed, err := demoNoteIDs(tx)
+	if err != nil {
+		return err
+	}
+	for _, table := range demoTables {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return fmt.Errorf("failed to empty %s: %w", table, err)
+		}
+	}
+	// The change log keeps counting, and records the removed notes as
+	// deleted, so that whoever follows it sees the reset
+	if _, err := tx.Exec(`DELETE FROM sqlite_sequence WHERE name != 'note_changes'`); err != nil {
+		return fmt.Errorf("failed to reset IDs: %w", err)
+	}
+	for _, id := range removed {
+		if err := recordChange(tx, id, ChangeDeleted, 0); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit demo reset: %w", err)
+	}
+
+	for _, image := range uploads {
+		if strings.ContainsAny(image, `/\`) {
+			continue
+		}
+		for _, name := range append([]string{image}, variantNames(image)...) {
+			if err := os.Remove(filepath.Join(imageDir, name)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove demo upload: %w", err)
+			}
+		}
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, DemoImage), sampleImage, 0644); err != nil {
+		return fmt.Errorf("failed to write demo image: %w", err)
+	}
+	return seedDemo(db)
+}
+
+// seedDemo adds the sample notes and their notebooks
+func seedDemo(db *sql.DB) error {
+	notebooks := map[string]int{}
+	for _, sample := range demoNotes {
+		note, err := AddNote(db, DemoImage, sample.Markdown)
+		if err != nil {
+			return err
+		}
+		if sample.Notebook != "" {
+			if _, ok := notebooks[sample.Notebook]; !ok {
+				nb, err := CreateNotebook(db, sample.Notebook, 0)
+				if err != nil {
+					return err
+				}
+				notebooks[sample.Notebook] = nb.ID
+			}
+			if err := MoveNotes(db, []int{note.ID}, notebooks[sample.Notebook]); err != nil {
+				return err
+			}
+		}
+		for key, value := range sample.Properties {
+			if err := SetProperty(db, note.ID, key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// demoNoteIDs lists the notes a demo reset removes
+func demoNoteIDs(tx *sql.Tx) ([]int, error) {
+	rows, err := tx.Query(`SELECT id FROM notes`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query demo notes: %w", err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan demo note: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating demo notes: %w", err)
+	}
+	return ids, nil
+}
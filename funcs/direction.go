@@ -0,0 +1,22 @@
+package funcs
+
+import "unicode"
+
+// DetectDirection guesses the text direction of a transcription by counting
+// strong right-to-left letters (Arabic, Hebrew and friends) against
+// left-to-right ones. It returns "rtl" or "ltr".
+func DetectDirection(text string) string {
+	var rtl, ltr int
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Arabic, unicode.Hebrew, unicode.Syriac, unicode.Thaana, unicode.Nko):
+			rtl++
+		case unicode.IsLetter(r):
+			ltr++
+		}
+	}
+	if rtl > ltr {
+		return "rtl"
+	}
+	return "ltr"
+}
@@ -0,0 +1,31 @@
+package funcs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound matches, with errors.Is, the errors returned for lookups of
+// records that don't exist
+var ErrNotFound = errors.New("not found")
+
+// notFoundError keeps its own message while matching ErrNotFound
+type notFoundError struct{ msg string }
+
+func (e notFoundError) Error() string        { return e.msg }
+func (e notFoundError) Is(target error) bool { return target == ErrNotFound }
+
+// notFound formats an error that matches ErrNotFound
+func notFound(format string, args ...any) error {
+	return notFoundError{fmt.Sprintf(format, args...)}
+}
+
+// ErrLocked matches, with errors.Is, the errors returned for changes to a
+// notebook on legal hold or to its notes
+var ErrLocked = errors.New("locked")
+
+// lockedError keeps its own message while matching ErrLocked
+type lockedError struct{ msg string }
+
+func (e lockedError) Error() string        { return e.msg }
+func (e lockedError) Is(target error) bool { return target == ErrLocked }
@@ -0,0 +1,72 @@
+package funcs
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+)
+
+// Token accounting used for estimates. Gemini bills an image whose sides are
+// both at most 384px as one tile and tiles larger images at 768px, each tile
+// costing the same number of tokens.
+const (
+	imageTileTokens     = 258
+	imageSmallSide      = 384
+	imageTileSide       = 768
+	charsPerToken       = 4
+	EstimatedNoteTokens = 600
+)
+
+// Pricing is the provider's price in US dollars per million tokens
+type Pricing struct {
+	InputPerMillion  float64 `json:"input_per_million"`
+	OutputPerMillion float64 `json:"output_per_million"`
+}
+
+// DefaultPricing is the list price of TranscriptionModel
+var DefaultPricing = Pricing{InputPerMillion: 0.50, OutputPerMillion: 3.00}
+
+// Estimate is the projected cost of transcribing one or more images. Output
+// tokens are a rough per-note average, so treat the cost as an order of
+// magnitude rather than a quote.
+type Estimate struct {
+	Images       int     `json:"images"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+}
+
+// EstimateImage projects the cost of transcribing one image with the
+// Transcriber's prompt. Formats whose size cannot be read are counted as a
+// single tile.
+func (t *Transcriber) EstimateImage(data []byte, pricing Pricing) Estimate {
+	tiles := 1
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		if cfg.Width > imageSmallSide || cfg.Height > imageSmallSide {
+			tiles = int(math.Ceil(float64(cfg.Width)/imageTileSide)) * int(math.Ceil(float64(cfg.Height)/imageTileSide))
+		}
+	}
+
+	e := Estimate{
+		Images:       1,
+		InputTokens:  tiles*imageTileTokens + len(t.Settings().Prompt)/charsPerToken,
+		OutputTokens: EstimatedNoteTokens,
+	}
+	e.CostUSD = pricing.cost(e.InputTokens, e.OutputTokens)
+	return e
+}
+
+// Add accumulates another estimate into e
+func (e *Estimate) Add(other Estimate) {
+	e.Images += other.Images
+	e.InputTokens += other.InputTokens
+	e.OutputTokens += other.OutputTokens
+	e.CostUSD += other.CostUSD
+}
+
+func (p Pricing) cost(input, output int) float64 {
+	return float64(input)/1e6*p.InputPerMillion + float64(output)/1e6*p.OutputPerMillion
+}
@@ -0,0 +1,76 @@
+package funcs
+
+import "sync"
+
+// Event types sent to subscribers
+const (
+	EventJob  = "job"
+	EventNote = "note"
+	// EventHealth carries a Health, sent to each stream that asks for it
+	// rather than published
+	EventHealth = "health"
+)
+
+// Event is a change pushed to live clients. Data is encoded as JSON.
+type Event struct {
+	Type string
+	Data any
+}
+
+// eventBuffer is how many events a subscriber can fall behind by before
+// new ones are dropped for it
+const eventBuffer = 32
+
+// EventBus fans events out to subscribers, such as open browser tabs.
+// Publishing never blocks: a subscriber that is not keeping up misses events.
+type EventBus struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+// Subscribe returns a channel of events and a function that stops them. The
+// channel is closed when the bus is.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subs == nil {
+		b.subs = map[chan Event]struct{}{}
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// Close ends every subscription, as when the server shuts down
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		close(ch)
+	}
+	b.subs = nil
+	b.closed = true
+}
+
+// Publish sends an event to every subscriber
+func (b *EventBus) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package funcs
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Feedback is a user's verdict on one AI transcription
+type Feedback struct {
+	ID            int       `json:"id"`
+	NoteID        int       `json:"note_id"`
+	Rating        int       `json:"rating"`
+	CorrectedText string    `json:"corrected_text,omitempty"`
+	Model         string    `json:"model"`
+	PromptID      string    `json:"prompt_id"`
+	DateCreated   time.Time `json:"date_created"`
+}
+
+// FeedbackStats aggregates feedback for one model and prompt combination
+type FeedbackStats struct {
+	Model        string  `json:"model"`
+	PromptID     string  `json:"prompt_id"`
+	Up           int     `json:"up"`
+	Down         int     `json:"down"`
+	Corrected    int     `json:"corrected"`
+	Approval     float64 `json:"approval"`
+	LastFeedback string  `json:"last_feedback"`
+}
+
+// PromptID is a short stable identifier for a prompt's text, so feedback
+// can be grouped by prompt without storing it on every row
+func PromptID(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(sum[:4])
+}
+
+// AddFeedback records a thumbs up (rating 1) or down (rating -1) on a note,
+// attributed to the model and prompt of settings, those that currently
+// produce transcriptions
+func AddFeedback(db *sql.DB, settings AISettings, noteID, rating int, correctedText string) (*Feedback, error) {
+	if rating != 1 && rating != -1 {
+		return nil, fmt.Errorf("rating must be 1 or -1")
+	}
+	if _, err := GetNoteByID(db, noteID); err != nil {
+		return nil, err
+	}
+
+	model, promptID := settings.Model, PromptID(settings.Prompt)
+	query := `INSERT INTO note_feedback (note_id, rating, corrected_text, model, prompt_id) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, noteID, rating, correctedText, model, promptID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert feedback: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return &Feedback{
+		ID:            int(id),
+		NoteID:        noteID,
+		Rating:        rating,
+		CorrectedText: correctedText,
+		Model:         model,
+		PromptID:      promptID,
+		DateCreated:   time.Now().UTC(),
+	}, nil
+}
+
+// GetFeedbackStats aggregates feedback per model and prompt, most rated first
+func GetFeedbackStats(db *sql.DB) ([]FeedbackStats, error) {
+	query := `SELECT model, prompt_id,
+			SUM(CASE WHEN rating > 0 THEN 1 ELSE 0 END),
+			SUM(CASE WHEN rating < 0 THEN 1 ELSE 0 END),
+			SUM(CASE WHEN corrected_text != '' THEN 1 ELSE 0 END),
+			MAX(date_created)
+		FROM note_feedback
+		GROUP BY model, prompt_id
+		ORDER BY COUNT(*) DESC`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query feedback: %w", err)
+	}
+	defer rows.Close()
+
+	stats := []FeedbackStats{}
+	for rows.Next() {
+		var s FeedbackStats
+		if err := rows.Scan(&s.Model, &s.PromptID, &s.Up, &s.Down, &s.Corrected, &s.LastFeedback); err != nil {
+			return nil, fmt.Errorf("failed to scan feedback stats: %w", err)
+		}
+		if total := s.Up + s.Down; total > 0 {
+			s.Approval = float64(s.Up) / float64(total)
+		}
+		stats = append(stats, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating feedback stats: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,123 @@
+package funcs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// FileUploadThreshold is the image size above which providers with a Files
+// API get the image uploaded and referenced by ID, rather than inlined as
+// base64, which is a third bigger
+const FileUploadThreshold = 1 << 20
+
+// anthropicFilesBeta enables file references in Anthropic requests
+const anthropicFilesBeta = "files-api-2025-04-14"
+
+// uploadedFile is a file stored with Gemini's Files API
+type uploadedFile struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+}
+
+// upload stores an image with Gemini's Files API, which lives under
+// /upload next to the regular endpoints
+func (c *GeminiVision) upload(ctx context.Context, data []byte, mimeType string) (*uploadedFile, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.BaseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Gemini base URL: %w", err)
+	}
+	u.Path = "/upload" + u.Path + "/files"
+	u.RawQuery = "uploadType=multipart"
+
+	// A multipart/related body carries the file metadata and then the bytes
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	meta, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build upload: %w", err)
+	}
+	fmt.Fprintf(meta, `{"file": {"display_name": "bookmd-%d"}}`, time.Now().UnixNano())
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {mimeType}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build upload: %w", err)
+	}
+	part.Write(data)
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to build upload: %w", err)
+	}
+
+	var resp struct {
+		File uploadedFile `json:"file"`
+	}
+	header := http.Header{"x-goog-api-key": {c.APIKey}}
+	if err := sendRequest(ctx, c.HTTP, http.MethodPost, u.String(), header,
+		"multipart/related; boundary="+mw.Boundary(), &body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to upload image: %w", err)
+	}
+	if resp.File.URI == "" {
+		return nil, fmt.Errorf("failed to upload image: no file URI returned")
+	}
+	return &resp.File, nil
+}
+
+// deleteFile removes an upload once the request that used it is done.
+// Gemini expires uploads after two days anyway, so failures are only logged.
+func (c *GeminiVision) deleteFile(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	header := http.Header{"x-goog-api-key": {c.APIKey}}
+	if err := sendRequest(ctx, c.HTTP, http.MethodDelete, strings.TrimSuffix(c.BaseURL, "/")+"/"+name, header, "", nil, nil); err != nil {
+		slog.Error("failed to delete uploaded file", "file", name, "err", err)
+	}
+}
+
+// upload stores an image with Anthropic's Files API and returns its ID
+func (c *AnthropicVision) upload(ctx context.Context, data []byte, mimeType string) (string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="page"`},
+		"Content-Type":        {mimeType},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to build upload: %w", err)
+	}
+	part.Write(data)
+	if err := mw.Close(); err != nil {
+		return "", fmt.Errorf("failed to build upload: %w", err)
+	}
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := sendRequest(ctx, c.HTTP, http.MethodPost, strings.TrimSuffix(c.BaseURL, "/")+"/files", c.filesHeader(),
+		mw.FormDataContentType(), &body, &resp); err != nil {
+		return "", fmt.Errorf("failed to upload image: %w", err)
+	}
+	if resp.ID == "" {
+		return "", fmt.Errorf("failed to upload image: no file ID returned")
+	}
+	return resp.ID, nil
+}
+
+// deleteFile removes an upload once the request that used it is done.
+// Anthropic keeps files until they are deleted, so failures are logged.
+func (c *AnthropicVision) deleteFile(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := sendRequest(ctx, c.HTTP, http.MethodDelete, strings.TrimSuffix(c.BaseURL, "/")+"/files/"+id, c.filesHeader(), "", nil, nil); err != nil {
+		slog.Error("failed to delete uploaded file", "file", id, "err", err)
+	}
+}
+
+func (c *AnthropicVision) filesHeader() http.Header {
+	return http.Header{"x-api-key": {c.APIKey}, "anthropic-version": {"2023-06-01"}, "anthropic-beta": {anthropicFilesBeta}}
+}
@@ -0,0 +1,218 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Guardrails are checks run on every transcription before it is saved. A
+// transcription that fails them is retried with a corrective prompt, and if
+// it still fails it is saved and marked for review.
+type Guardrails struct {
+	MaxLength      int    `json:"max_length"`
+	RequireHeading bool   `json:"require_heading"`
+	NoImageURLs    bool   `json:"no_image_urls"`
+	Language       string `json:"language"`
+	Retries        int    `json:"retries"`
+}
+
+// DefaultGuardrails reject image links, which a photo of a page cannot
+// contain, and retry once
+var DefaultGuardrails = Guardrails{
+	NoImageURLs: true,
+	Retries:     1,
+}
+
+// Validate checks that the guardrails can be applied
+func (g Guardrails) Validate() error {
+	if g.MaxLength < 0 {
+		return fmt.Errorf("max length must not be negative")
+	}
+	if g.Retries < 0 || g.Retries > 3 {
+		return fmt.Errorf("retries must be between 0 and 3")
+	}
+	if g.Language != "" && stopwords[g.Language] == nil {
+		return fmt.Errorf("language must be one of en, es, de, fr or empty")
+	}
+	return nil
+}
+
+// GetGuardrails returns the stored guardrails over the defaults
+func GetGuardrails(db *sql.DB) (Guardrails, error) {
+	g := DefaultGuardrails
+	rows, err := db.Query(`SELECT key, value FROM settings WHERE key LIKE 'guard.%'`)
+	if err != nil {
+		return g, fmt.Errorf("failed to query guardrails: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return g, fmt.Errorf("failed to scan guardrail: %w", err)
+		}
+		switch key {
+		case "guard.max_length":
+			if n, err := strconv.Atoi(value); err == nil {
+				g.MaxLength = n
+			}
+		case "guard.require_heading":
+			g.RequireHeading = value == "true"
+		case "guard.no_image_urls":
+			g.NoImageURLs = value == "true"
+		case "guard.language":
+			g.Language = value
+		case "guard.retries":
+			if n, err := strconv.Atoi(value); err == nil {
+				g.Retries = n
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return g, fmt.Errorf("error iterating guardrails: %w", err)
+	}
+	return g, nil
+}
+
+// SaveGuardrails validates and stores all guardrails
+func SaveGuardrails(db *sql.DB, g Guardrails) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for key, value := range map[string]string{
+		"guard.max_length":      strconv.Itoa(g.MaxLength),
+		"guard.require_heading": strconv.FormatBool(g.RequireHeading),
+		"guard.no_image_urls":   strconv.FormatBool(g.NoImageURLs),
+		"guard.language":        g.Language,
+		"guard.retries":         strconv.Itoa(g.Retries),
+	} {
+		_, err := tx.Exec(`INSERT INTO settings (key, value) VALUES (?, ?)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, value)
+		if err != nil {
+			return fmt.Errorf("failed to save guardrail %s: %w", key, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit guardrails: %w", err)
+	}
+	return nil
+}
+
+// imageLinkRe matches markdown images and HTML img tags. ![[embeds]] of
+// other notes are not images and do not match.
+var imageLinkRe = regexp.MustCompile(`!\[[^\]]*\]\([^)]*\)|(?i:<img\b)`)
+
+// CheckOutput returns a description of each guardrail the markdown breaks
+func (g Guardrails) CheckOutput(markdown string) []string {
+	var failures []string
+	if g.MaxLength > 0 && len([]rune(markdown)) > g.MaxLength {
+		failures = append(failures, fmt.Sprintf("is longer than %d characters", g.MaxLength))
+	}
+	if g.RequireHeading && FirstHeading(markdown) == "" {
+		failures = append(failures, "has no heading")
+	}
+	if g.NoImageURLs && imageLinkRe.MatchString(markdown) {
+		failures = append(failures, "links to images that are not on the page")
+	}
+	if g.Language != "" {
+		if lang := DetectLanguage(markdown); lang != "" && lang != g.Language {
+			failures = append(failures, fmt.Sprintf("is written in %s, expected %s", lang, g.Language))
+		}
+	}
+	return failures
+}
+
+// stopwords are common short words used to guess the language of a note
+var stopwords = map[string]map[string]bool{
+	"en": wordSet("the and of to is in that it for with as on are this be was"),
+	"es": wordSet("el la de que y en los se del las un por con una para es"),
+	"de": wordSet("der die und das ist nicht ein zu den mit sich des auf für im"),
+	"fr": wordSet("le la les et des est un une du que pour dans pas sur au"),
+}
+
+// minLanguageHits is how many stopwords a note needs before its language is
+// guessed; shorter notes pass the language check
+const minLanguageHits = 5
+
+func wordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+// DetectLanguage guesses the language of text from its stopwords. It returns
+// "" when the text is too short to tell.
+func DetectLanguage(text string) string {
+	hits := map[string]int{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r > 0x7F)
+	}) {
+		for lang, set := range stopwords {
+			if set[word] {
+				hits[lang]++
+			}
+		}
+	}
+
+	best, total := "", 0
+	for _, lang := range []string{"en", "es", "de", "fr"} {
+		total += hits[lang]
+		if best == "" || hits[lang] > hits[best] {
+			best = lang
+		}
+	}
+	if total < minLanguageHits {
+		return ""
+	}
+	return best
+}
+
+// transcribeGuarded runs a transcription and checks it against the
+// guardrails, retrying with the failures spelled out in the prompt. The last
+// attempt's failures are left in Transcription.Review.
+func (t *Transcriber) transcribeGuarded(ctx context.Context, client VisionClient, settings AISettings, imagePath string, mode cacheMode) (*Transcription, error) {
+	g := t.Guardrails()
+	attemptSettings := settings
+	for attempt := 0; ; attempt++ {
+		tr, err := t.transcribeImage(ctx, client, attemptSettings, imagePath, mode)
+		if err != nil {
+			return nil, err
+		}
+		failures := g.CheckOutput(tr.Markdown)
+		if len(failures) == 0 || attempt >= g.Retries {
+			tr.Review = strings.Join(failures, "; ")
+			return tr, nil
+		}
+		attemptSettings.Prompt = settings.Prompt + "\n\nA previous transcription of this image was rejected because it " +
+			strings.Join(failures, ", ") + ". Correct this, and transcribe only what is on the page."
+	}
+}
+
+// SetNoteReview marks a note for manual review with the reason, or clears
+// the mark when reason is empty
+func SetNoteReview(db *sql.DB, noteID int, reason string) error {
+	return inNoteTx(db, noteID, func(q dbtx) error {
+		result, err := q.Exec(`UPDATE notes SET review = ? WHERE id = ?`, reason, noteID)
+		if err != nil {
+			return fmt.Errorf("failed to set note review: %w", err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return notFound("note %d not found", noteID)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,51 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Health is the state of the conversion queue and the AI at a glance: the
+// jobs waiting and how long the oldest has, the workers busy, the last AI
+// request and the AI usage since the start of the viewer's day
+type Health struct {
+	Pending       int         `json:"pending"`
+	OldestPending int         `json:"oldest_pending_seconds"`
+	Running       int         `json:"running"`
+	Workers       int         `json:"workers"`
+	AIRunning     int         `json:"ai_running"`
+	AIQueued      int         `json:"ai_queued"`
+	LastAI        *AIRequest  `json:"last_ai"`
+	Today         UsageTotals `json:"today"`
+}
+
+// AIRequest is how an AI request sent to a provider went. Outcome is ok,
+// error or timeout.
+type AIRequest struct {
+	Model      string    `json:"model"`
+	Outcome    string    `json:"outcome"`
+	DurationMS int64     `json:"duration_ms"`
+	DateSent   time.Time `json:"date_sent"`
+}
+
+// GetHealth reports the health of a queue of workers workers sending AI
+// requests under limit, with the AI usage since dayStart priced at pricing
+func GetHealth(db *sql.DB, workers int, limit *AILimit, dayStart time.Time, pricing Pricing) (*Health, error) {
+	counts, err := CountJobs(db)
+	if err != nil {
+		return nil, err
+	}
+	health := &Health{Pending: counts[JobPending], Running: counts[JobRunning], Workers: workers, LastAI: LastAIRequest()}
+	health.AIRunning, health.AIQueued = limit.Load()
+
+	err = db.QueryRow(`SELECT COALESCE(MAX(CAST((julianday('now') - julianday(date_created)) * 86400 AS INTEGER)), 0)
+		FROM jobs WHERE status = ?`, JobPending).Scan(&health.OldestPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query oldest pending job: %w", err)
+	}
+	if health.Today, err = GetUsageSince(db, dayStart, pricing); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
@@ -0,0 +1,101 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// noteLockQuery finds the locked notebook a note is in
+const noteLockQuery = `SELECT b.name FROM notes n JOIN notebooks b ON b.id = n.notebook_id
+	WHERE n.id = ? AND b.locked`
+
+// SetNotebookLocked puts a notebook on legal hold or takes it off, recording
+// who did it and why in the audit log. Unlocking needs a reason.
+func SetNotebookLocked(db *sql.DB, id int, locked bool, actor, reason string) (*Notebook, error) {
+	reason = strings.TrimSpace(reason)
+	if !locked && reason == "" {
+		return nil, fmt.Errorf("a reason is required to unlock a notebook")
+	}
+	nb, err := GetNotebook(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if nb.Locked == locked {
+		return nb, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE notebooks SET locked = ? WHERE id = ?`, locked, id); err != nil {
+		return nil, fmt.Errorf("failed to lock notebook: %w", err)
+	}
+	action := AuditNotebookLocked
+	if !locked {
+		action = AuditNotebookUnlocked
+	}
+	if err := recordAudit(tx, action, id, actor, reason); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit notebook lock: %w", err)
+	}
+	return GetNotebook(db, id)
+}
+
+// inNoteTx runs write in a transaction that first checks the note is not in
+// a locked notebook, so that a lock taken meanwhile cannot be slipped past
+func inNoteTx(db *sql.DB, noteID int, write func(q dbtx) error) error {
+	return (&Store{DB: db}).inTx(context.Background(), func(q dbtx) error {
+		if err := checkNoteUnlocked(q, noteID); err != nil {
+			return err
+		}
+		return write(q)
+	})
+}
+
+// checkNoteUnlocked refuses changes to a note in a locked notebook
+func checkNoteUnlocked(q dbtx, noteID int) error {
+	var name string
+	err := q.QueryRow(noteLockQuery, noteID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check notebook lock: %w", err)
+	}
+	return lockedError{fmt.Sprintf("note %d is in %q, which is locked", noteID, name)}
+}
+
+// checkNotesUnlocked refuses a change to the notes n matching where when one
+// of them is in a locked notebook
+func checkNotesUnlocked(q dbtx, where string, args ...any) error {
+	var name string
+	err := q.QueryRow(`SELECT b.name FROM notes n JOIN notebooks b ON b.id = n.notebook_id
+		WHERE b.locked AND `+where+` LIMIT 1`, args...).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check notebook lock: %w", err)
+	}
+	return lockedError{fmt.Sprintf("notes in %q, which is locked, would change", name)}
+}
+
+// checkNotebookUnlocked refuses changes to a locked notebook or its contents
+func checkNotebookUnlocked(q dbtx, notebookID int) error {
+	var name string
+	err := q.QueryRow(`SELECT name FROM notebooks WHERE id = ? AND locked`, notebookID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check notebook lock: %w", err)
+	}
+	return lockedError{fmt.Sprintf("notebook %q is locked", name)}
+}
@@ -0,0 +1,120 @@
+package funcs
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// lockedNote adds a note to a notebook and puts the notebook on hold
+func lockedNote(t *testing.T, s *Store) *Note {
+	t.Helper()
+	note, err := s.AddNote(context.Background(), "a.png", "# Held\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb, err := CreateNotebook(s.DB, "Evidence", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := MoveNotes(s.DB, []int{note.ID}, nb.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetNotebookLocked(s.DB, nb.ID, true, "admin", "litigation"); err != nil {
+		t.Fatal(err)
+	}
+	held, err := s.GetNote(context.Background(), note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return held
+}
+
+func TestInNoteTxRefusesLockedNote(t *testing.T) {
+	s := newTestStore(t)
+	note := lockedNote(t, s)
+
+	ran := false
+	err := inNoteTx(s.DB, note.ID, func(q dbtx) error {
+		ran = true
+		return nil
+	})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("inNoteTx = %v, want ErrLocked", err)
+	}
+	if ran {
+		t.Error("write ran for a locked note")
+	}
+
+	if _, err := s.UpdateNote(context.Background(), note.ID, "b.png", "# Changed\n"); !errors.Is(err, ErrLocked) {
+		t.Errorf("UpdateNote = %v, want ErrLocked", err)
+	}
+	if err := s.DeleteNote(context.Background(), note.ID); !errors.Is(err, ErrLocked) {
+		t.Errorf("DeleteNote = %v, want ErrLocked", err)
+	}
+	if _, err := SetNoteTitle(s.DB, note.ID, "New"); !errors.Is(err, ErrLocked) {
+		t.Errorf("SetNoteTitle = %v, want ErrLocked", err)
+	}
+	got, err := s.GetNote(context.Background(), note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Markdown != "# Held\n" || got.Revision != note.Revision {
+		t.Errorf("locked note changed to %+v", got)
+	}
+}
+
+func TestInNoteTxWritesUnlockedNote(t *testing.T) {
+	s := newTestStore(t)
+	note, err := s.AddNote(context.Background(), "a.png", "# Free\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inNoteTx(s.DB, note.ID, func(q dbtx) error {
+		_, err := q.Exec(`UPDATE notes SET title = 'Written' WHERE id = ?`, note.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetNote(context.Background(), note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Written" {
+		t.Errorf("title = %q, want the write committed", got.Title)
+	}
+}
+
+func TestCheckNotesUnlocked(t *testing.T) {
+	s := newTestStore(t)
+	held := lockedNote(t, s)
+	free, err := s.AddNote(context.Background(), "b.png", "# Free\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkNotesUnlocked(s.DB, "n.id = ?", free.ID); err != nil {
+		t.Errorf("unlocked note: %v", err)
+	}
+	if err := checkNotesUnlocked(s.DB, "n.id IN (?, ?)", free.ID, held.ID); !errors.Is(err, ErrLocked) {
+		t.Errorf("with a locked note = %v, want ErrLocked", err)
+	}
+	if err := MoveNotes(s.DB, []int{free.ID, held.ID}, 0); !errors.Is(err, ErrLocked) {
+		t.Errorf("MoveNotes out of a locked notebook = %v, want ErrLocked", err)
+	}
+}
+
+func TestUnlockNeedsReason(t *testing.T) {
+	s := newTestStore(t)
+	held := lockedNote(t, s)
+	if _, err := SetNotebookLocked(s.DB, held.NotebookID, false, "admin", " "); err == nil {
+		t.Fatal("unlocked without a reason")
+	}
+	if _, err := SetNotebookLocked(s.DB, held.NotebookID, false, "admin", "case closed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkNoteUnlocked(s.DB, held.ID); err != nil {
+		t.Errorf("after unlock: %v", err)
+	}
+}
@@ -0,0 +1,817 @@
+package funcs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLocale is used when no supported language can be negotiated
+const DefaultLocale = "en"
+
+// catalogs holds the translated UI messages for each supported locale
+var catalogs = map[string]map[string]string{
+	"en": {
+		"page.title":                  "img.md",
+		"skip.content":                "Skip to content",
+		"thumbnail.label":             "%s, created %s",
+		"thumbnail.stats":             "%d words · %d min read",
+		"index.recent":                "Continue where you left off",
+		"live.note_added":             "New note added: %s",
+		"live.job_failed":             "A conversion failed: %s",
+		"health.title":                "Conversions",
+		"health.queue":                "Queue",
+		"health.waiting":              "%d waiting",
+		"health.oldest":               "oldest %d min",
+		"health.workers":              "Workers busy",
+		"health.of":                   "%d of %d",
+		"health.last_ai":              "Last AI call",
+		"health.ai_ok":                "%s s",
+		"health.ai_error":             "failed after %s s",
+		"health.ai_timeout":           "timed out after %s s",
+		"health.none":                 "none yet",
+		"health.spend":                "Spent today",
+		"health.spend_value":          "$%s over %d requests",
+		"health.stalled":              "Jobs are waiting but no worker has picked them up.",
+		"note.toc":                    "Contents",
+		"note.back":                   "All notes",
+		"graph.title":                 "Note graph",
+		"note.label":                  "Print archive label",
+		"note.captured":               "written %s",
+		"note.review":                 "Needs review: %s",
+		"note.review_done":            "Mark as reviewed",
+		"note.scan":                   "Scan of %s",
+		"note.cleanup":                "Clean up with AI and review the changes",
+		"note.regenerate":             "Transcribe the image again",
+		"outline.title":               "Outline",
+		"outline.help":                "Fix the heading levels, or drag headings to reorder their sections.",
+		"outline.promote":             "Promote %s",
+		"outline.demote":              "Demote %s",
+		"outline.up":                  "Move %s up",
+		"outline.down":                "Move %s down",
+		"note.edit":                   "Edit markdown",
+		"note.edit_save":              "Save markdown",
+		"label.caption":               "Note %d",
+		"notebooks.title":             "Notebooks",
+		"notebooks.empty":             "No notebooks yet.",
+		"notebooks.new":               "New notebook",
+		"notebooks.new_child":         "New notebook inside this one",
+		"notebooks.create":            "Create",
+		"notebooks.no_notes":          "No notes in this notebook.",
+		"compile.link":                "Read as one document",
+		"compile.export":              "Download as markdown",
+		"compile.source":              "Open %s",
+		"notebooks.note_ids":          "Note IDs, comma separated",
+		"notebooks.move":              "Move notes here",
+		"notebooks.name":              "Name",
+		"notebooks.parent":            "Inside",
+		"notebooks.top":               "Top level",
+		"notebooks.save":              "Save",
+		"physical.title":              "Paper notebooks",
+		"physical.empty":              "No paper notebooks yet.",
+		"physical.name":               "Name",
+		"physical.pages":              "Pages",
+		"physical.cover":              "Cover photo",
+		"physical.add":                "Add notebook",
+		"physical.progress":           "%d of %d pages digitized",
+		"physical.missing":            "Missing pages: %s",
+		"physical.gaps":               "Gap in the page sequence, not digitized: %s",
+		"physical.complete":           "Every page is digitized.",
+		"physical.page":               "Page %d",
+		"physical.page_number":        "Page",
+		"physical.assign":             "Assign a note to a page",
+		"physical.upload":             "Scan a page",
+		"physical.upload_batch":       "Scan several pages",
+		"physical.images":             "Images, PDFs or a zip",
+		"physical.pdf_single":         "Combine the pages of a PDF into one note",
+		"physical.first_page":         "First page",
+		"physical.note":               "Note ID",
+		"physical.save":               "Assign",
+		"note.qr":                     "QR code linking to this note",
+		"note.qr_download":            "Download QR code for printing",
+		"settings.title":              "Settings",
+		"settings.api_key":            "API key",
+		"settings.api_key_set":        "Leave blank to keep the current key (%s)",
+		"settings.api_key_clear":      "Remove the stored key",
+		"settings.provider":           "Provider",
+		"settings.provider_openai":    "OpenAI-compatible",
+		"settings.provider_tesseract": "Tesseract (offline OCR, text only)",
+		"settings.base_url":           "Base URL",
+		"settings.model":              "Model",
+		"settings.prompt":             "Prompt",
+		"settings.temperature":        "Temperature",
+		"settings.max_tokens":         "Max tokens",
+		"ai.options":                  "AI options",
+		"ai.force":                    "Skip the cached transcription and ask the AI again",
+		"upload.progress":             "Uploading %s: %d%%",
+		"upload.waiting":              "Connection lost, resuming %s when it is back",
+		"upload.converting":           "Upload complete, converting",
+		"upload.failed":               "Upload failed: %s",
+		"settings.save":               "Save",
+		"settings.test":               "Test transcription",
+		"settings.test_ok":            "The sample image was transcribed:",
+		"settings.cache":              "AI response cache",
+		"settings.cache_stats":        "%d cached responses, reused %d times",
+		"settings.cache_clear":        "Clear cache",
+		"usage.title":                 "AI usage",
+		"usage.summary":               "Last %d days: %d requests, %d prompt and %d completion tokens, about $%.2f",
+		"usage.pricing":               "Priced at $%.2f per million prompt tokens and $%.2f per million completion tokens. Set BOOKMD_INPUT_PRICE and BOOKMD_OUTPUT_PRICE to match your provider.",
+		"usage.requests":              "Requests",
+		"usage.prompt_tokens":         "Prompt tokens",
+		"usage.completion_tokens":     "Completion tokens",
+		"usage.cost":                  "Cost",
+		"storage.title":               "Storage",
+		"storage.summary":             "Database %s, of which %s can be reclaimed; images %s",
+		"storage.last_maintenance":    "Last maintenance %s freed %s in %d ms",
+		"storage.never_maintained":    "The database has not been maintained yet.",
+		"storage.maintain":            "Vacuum and analyze now",
+		"storage.backup":              "Download a backup",
+		"storage.import":              "Backup to import",
+		"storage.import_submit":       "Import",
+		"storage.backup_hint":         "A backup holds every note with its image and a manifest of their SHA-256 checksums. Importing one checks every file first and refuses the whole backup if any is damaged or altered.",
+		"hold.title":                  "Legal hold",
+		"hold.hint":                   "A notebook on hold cannot have its notes edited, moved or deleted. Unlocking it needs a reason and is recorded.",
+		"hold.notice":                 "This notebook is on legal hold: its notes cannot be changed.",
+		"hold.reason":                 "Reason",
+		"hold.lock":                   "Lock notebook",
+		"hold.unlock":                 "Unlock notebook",
+		"audit.notebook.locked":       "Locked",
+		"audit.notebook.unlocked":     "Unlocked",
+		"storage.notebook":            "Notebook",
+		"storage.notes":               "Notes",
+		"storage.text":                "Text",
+		"storage.images":              "Images",
+		"storage.unfiled":             "No notebook",
+		"storage.tables":              "Database tables",
+		"settings.test_failed":        "The test transcription failed: %s",
+		"feedback.question":           "Was this transcription good?",
+		"feedback.corrected":          "Corrected text (optional)",
+		"feedback.up":                 "Good transcription",
+		"feedback.down":               "Bad transcription",
+		"type.notes":                  "Notes",
+		"type.upload":                 "Upload a %s",
+		"type.image":                  "Image",
+		"type.submit":                 "Upload and transcribe",
+		"type.empty":                  "No notes of this type yet.",
+		"type.note":                   "Note",
+		"type.created":                "Created",
+		"note.properties":             "Properties",
+		"note.export":                 "Download markdown",
+		"property.key":                "Key",
+		"property.value":              "Value",
+		"property.add":                "Add property",
+		"property.remove":             "Remove %s",
+		"report.title":                "Notes to tidy up",
+		"report.empty":                "Nothing to tidy up.",
+		"provenance.title":            "Info",
+		"provenance.none":             "Not recorded: this version was written or edited by hand, or before provenance was kept.",
+		"provenance.model":            "Model",
+		"provenance.prompt":           "Prompt",
+		"provenance.preprocessing":    "Image",
+		"provenance.postprocessing":   "Markdown",
+		"provenance.responses":        "Response IDs",
+		"provenance.latency":          "Latency",
+		"provenance.requests":         "%d requests, %s s",
+		"provenance.cached":           "from cache",
+		"provenance.date":             "Produced",
+		"provenance.step.original":    "sent as uploaded",
+		"provenance.step.scale":       "scaled to %s px",
+		"provenance.step.jpeg":        "JPEG quality %s",
+		"provenance.step.pages":       "%s pages transcribed one by one",
+		"provenance.step.autofix":     "formatting fixed",
+		"history.title":               "History",
+		"history.empty":               "This note has not been changed since it was created.",
+		"history.from":                "Compare",
+		"history.to":                  "with",
+		"history.current":             "Current version",
+		"history.revision":            "Revision %d",
+		"history.compare":             "Show changes",
+		"history.words":               "%d words",
+		"history.rollback":            "Restore this version",
+		"trash.title":                 "Trash",
+		"trash.empty":                 "The trash is empty.",
+		"trash.deleted":               "deleted %s",
+		"trash.restore":               "Restore",
+		"trash.purge":                 "Delete forever",
+		"trash.empty_now":             "Empty trash",
+		"tags.title":                  "Suggested tags",
+		"tags.untagged":               "%d notes have no tags yet.",
+		"tags.batch":                  "Notes to tag",
+		"tags.max_cost":               "Spending cap (USD)",
+		"tags.suggest":                "Suggest tags",
+		"tags.empty":                  "No suggested tags to review.",
+		"tags.tags":                   "Tags",
+		"tags.apply":                  "Apply",
+		"tags.dismiss":                "Dismiss",
+		"replace.title":               "Find and replace",
+		"replace.find":                "Find",
+		"replace.with":                "Replace with",
+		"replace.regex":               "Regular expression",
+		"replace.notebook":            "Notebook",
+		"replace.all_notebooks":       "All notebooks",
+		"replace.tag":                 "Tag",
+		"replace.query":               "Only notes containing",
+		"replace.preview":             "Preview",
+		"replace.none":                "No notes match.",
+		"search.title":                "Search",
+		"search.placeholder":          "Search notes",
+		"search.submit":               "Search",
+		"search.help":                 "Use \"quotes\" for an exact phrase, and tag:name, notebook:name, before:YYYY-MM-DD or after:YYYY-MM-DD to narrow the results.",
+		"search.none":                 "No notes match.",
+		"search.count":                "%d matching notes",
+		"search.pages":                "Result pages",
+		"search.prev":                 "Previous",
+		"search.next":                 "Next",
+		"note.starred":                "Starred",
+		"note.star":                   "Star this note",
+		"note.unstar":                 "Remove the star",
+		"replace.count":               "%d matches",
+		"replace.open":                "Open",
+		"replace.apply":               "Replace in the selected notes",
+		"report.orphan":               "no links",
+		"report.stub":                 "very short",
+		"report.review":               "needs review",
+		"note.backlinks":              "Linked from",
+		"note.backlink":               "Note %d",
+	},
+	"es": {
+		"page.title":                  "img.md",
+		"skip.content":                "Saltar al contenido",
+		"thumbnail.label":             "%s, creada el %s",
+		"thumbnail.stats":             "%d palabras · %d min de lectura",
+		"index.recent":                "Continúa donde lo dejaste",
+		"live.note_added":             "Nota nueva añadida: %s",
+		"live.job_failed":             "Falló una conversión: %s",
+		"health.title":                "Conversiones",
+		"health.queue":                "Cola",
+		"health.waiting":              "%d en espera",
+		"health.oldest":               "la más antigua hace %d min",
+		"health.workers":              "Trabajadores ocupados",
+		"health.of":                   "%d de %d",
+		"health.last_ai":              "Última llamada a la IA",
+		"health.ai_ok":                "%s s",
+		"health.ai_error":             "falló tras %s s",
+		"health.ai_timeout":           "agotó el tiempo tras %s s",
+		"health.none":                 "ninguna aún",
+		"health.spend":                "Gastado hoy",
+		"health.spend_value":          "$%s en %d peticiones",
+		"health.stalled":              "Hay trabajos en espera pero ningún trabajador los ha tomado.",
+		"note.toc":                    "Contenido",
+		"note.back":                   "Todas las notas",
+		"graph.title":                 "Grafo de notas",
+		"note.label":                  "Imprimir etiqueta de archivo",
+		"note.captured":               "escrita el %s",
+		"note.review":                 "Por revisar: %s",
+		"note.review_done":            "Marcar como revisada",
+		"note.scan":                   "Escaneo de %s",
+		"note.cleanup":                "Corregir con IA y revisar los cambios",
+		"note.regenerate":             "Volver a transcribir la imagen",
+		"outline.title":               "Esquema",
+		"outline.help":                "Corrige los niveles de los encabezados o arrástralos para reordenar sus secciones.",
+		"outline.promote":             "Subir de nivel %s",
+		"outline.demote":              "Bajar de nivel %s",
+		"outline.up":                  "Mover %s arriba",
+		"outline.down":                "Mover %s abajo",
+		"note.edit":                   "Editar markdown",
+		"note.edit_save":              "Guardar markdown",
+		"label.caption":               "Nota %d",
+		"notebooks.title":             "Cuadernos",
+		"notebooks.empty":             "Todavía no hay cuadernos.",
+		"notebooks.new":               "Nuevo cuaderno",
+		"notebooks.new_child":         "Nuevo cuaderno dentro de este",
+		"notebooks.create":            "Crear",
+		"notebooks.no_notes":          "No hay notas en este cuaderno.",
+		"compile.link":                "Leer como un solo documento",
+		"compile.export":              "Descargar como markdown",
+		"compile.source":              "Abrir %s",
+		"notebooks.note_ids":          "ID de notas, separados por comas",
+		"notebooks.move":              "Mover notas aquí",
+		"notebooks.name":              "Nombre",
+		"notebooks.parent":            "Dentro de",
+		"notebooks.top":               "Nivel superior",
+		"notebooks.save":              "Guardar",
+		"physical.title":              "Cuadernos de papel",
+		"physical.empty":              "Todavía no hay cuadernos de papel.",
+		"physical.name":               "Nombre",
+		"physical.pages":              "Páginas",
+		"physical.cover":              "Foto de la portada",
+		"physical.add":                "Añadir cuaderno",
+		"physical.progress":           "%d de %d páginas digitalizadas",
+		"physical.missing":            "Páginas que faltan: %s",
+		"physical.gaps":               "Hueco en la secuencia de páginas, sin digitalizar: %s",
+		"physical.complete":           "Todas las páginas están digitalizadas.",
+		"physical.page":               "Página %d",
+		"physical.page_number":        "Página",
+		"physical.assign":             "Asignar una nota a una página",
+		"physical.upload":             "Escanear una página",
+		"physical.upload_batch":       "Escanear varias páginas",
+		"physical.images":             "Imágenes, PDF o un zip",
+		"physical.pdf_single":         "Unir las páginas de un PDF en una nota",
+		"physical.first_page":         "Primera página",
+		"physical.note":               "ID de la nota",
+		"physical.save":               "Asignar",
+		"note.qr":                     "Código QR que enlaza a esta nota",
+		"note.qr_download":            "Descargar el código QR para imprimir",
+		"settings.title":              "Ajustes",
+		"settings.api_key":            "Clave de API",
+		"settings.api_key_set":        "Déjalo en blanco para mantener la clave actual (%s)",
+		"settings.api_key_clear":      "Eliminar la clave guardada",
+		"settings.provider":           "Proveedor",
+		"settings.provider_openai":    "Compatible con OpenAI",
+		"settings.provider_tesseract": "Tesseract (OCR sin conexión, solo texto)",
+		"settings.base_url":           "URL base",
+		"settings.model":              "Modelo",
+		"settings.prompt":             "Instrucción",
+		"settings.temperature":        "Temperatura",
+		"settings.max_tokens":         "Tokens máximos",
+		"ai.options":                  "Opciones de IA",
+		"ai.force":                    "Ignorar la transcripción en caché y volver a preguntar a la IA",
+		"upload.progress":             "Subiendo %s: %d%%",
+		"upload.waiting":              "Conexión perdida, se reanudará %s cuando vuelva",
+		"upload.converting":           "Subida completa, convirtiendo",
+		"upload.failed":               "Falló la subida: %s",
+		"settings.save":               "Guardar",
+		"settings.test":               "Probar transcripción",
+		"settings.test_ok":            "La imagen de ejemplo se transcribió:",
+		"settings.cache":              "Caché de respuestas de IA",
+		"settings.cache_stats":        "%d respuestas en caché, reutilizadas %d veces",
+		"settings.cache_clear":        "Vaciar caché",
+		"usage.title":                 "Uso de la IA",
+		"usage.summary":               "Últimos %d días: %d peticiones, %d tokens de entrada y %d de salida, unos $%.2f",
+		"usage.pricing":               "Calculado a $%.2f por millón de tokens de entrada y $%.2f por millón de tokens de salida. Define BOOKMD_INPUT_PRICE y BOOKMD_OUTPUT_PRICE según tu proveedor.",
+		"usage.requests":              "Peticiones",
+		"usage.prompt_tokens":         "Tokens de entrada",
+		"usage.completion_tokens":     "Tokens de salida",
+		"usage.cost":                  "Coste",
+		"storage.title":               "Almacenamiento",
+		"storage.summary":             "Base de datos %s, de la que se pueden recuperar %s; imágenes %s",
+		"storage.last_maintenance":    "El último mantenimiento, el %s, liberó %s en %d ms",
+		"storage.never_maintained":    "Aún no se ha hecho mantenimiento de la base de datos.",
+		"storage.maintain":            "Compactar y analizar ahora",
+		"storage.backup":              "Descargar una copia de seguridad",
+		"storage.import":              "Copia de seguridad para importar",
+		"storage.import_submit":       "Importar",
+		"storage.backup_hint":         "Una copia de seguridad contiene cada nota con su imagen y un manifiesto con sus sumas SHA-256. Al importarla se comprueba cada archivo y se rechaza entera si alguno está dañado o alterado.",
+		"hold.title":                  "Retención legal",
+		"hold.hint":                   "Las notas de un cuaderno retenido no se pueden editar, mover ni eliminar. Desbloquearlo requiere un motivo y queda registrado.",
+		"hold.notice":                 "Este cuaderno está bajo retención legal: sus notas no se pueden cambiar.",
+		"hold.reason":                 "Motivo",
+		"hold.lock":                   "Bloquear cuaderno",
+		"hold.unlock":                 "Desbloquear cuaderno",
+		"audit.notebook.locked":       "Bloqueado",
+		"audit.notebook.unlocked":     "Desbloqueado",
+		"storage.notebook":            "Cuaderno",
+		"storage.notes":               "Notas",
+		"storage.text":                "Texto",
+		"storage.images":              "Imágenes",
+		"storage.unfiled":             "Sin cuaderno",
+		"storage.tables":              "Tablas de la base de datos",
+		"settings.test_failed":        "La transcripción de prueba falló: %s",
+		"feedback.question":           "¿Fue buena esta transcripción?",
+		"feedback.corrected":          "Texto corregido (opcional)",
+		"feedback.up":                 "Buena transcripción",
+		"feedback.down":               "Mala transcripción",
+		"type.notes":                  "Notas",
+		"type.upload":                 "Subir: %s",
+		"type.image":                  "Imagen",
+		"type.submit":                 "Subir y transcribir",
+		"type.empty":                  "Todavía no hay notas de este tipo.",
+		"type.note":                   "Nota",
+		"type.created":                "Creada",
+		"note.properties":             "Propiedades",
+		"note.export":                 "Descargar markdown",
+		"property.key":                "Clave",
+		"property.value":              "Valor",
+		"property.add":                "Añadir propiedad",
+		"property.remove":             "Quitar %s",
+		"report.title":                "Notas por ordenar",
+		"report.empty":                "No hay nada que ordenar.",
+		"provenance.title":            "Información",
+		"provenance.none":             "Sin registro: esta versión se escribió o editó a mano, o antes de que se guardara su procedencia.",
+		"provenance.model":            "Modelo",
+		"provenance.prompt":           "Prompt",
+		"provenance.preprocessing":    "Imagen",
+		"provenance.postprocessing":   "Markdown",
+		"provenance.responses":        "IDs de respuesta",
+		"provenance.latency":          "Latencia",
+		"provenance.requests":         "%d solicitudes, %s s",
+		"provenance.cached":           "desde la caché",
+		"provenance.date":             "Generado",
+		"provenance.step.original":    "enviada tal como se subió",
+		"provenance.step.scale":       "reducida a %s px",
+		"provenance.step.jpeg":        "JPEG de calidad %s",
+		"provenance.step.pages":       "%s páginas transcritas una a una",
+		"provenance.step.autofix":     "formato corregido",
+		"history.title":               "Historial",
+		"history.empty":               "Esta nota no ha cambiado desde que se creó.",
+		"history.from":                "Comparar",
+		"history.to":                  "con",
+		"history.current":             "Versión actual",
+		"history.revision":            "Revisión %d",
+		"history.compare":             "Mostrar cambios",
+		"history.words":               "%d palabras",
+		"history.rollback":            "Restaurar esta versión",
+		"trash.title":                 "Papelera",
+		"trash.empty":                 "La papelera está vacía.",
+		"trash.deleted":               "eliminada %s",
+		"trash.restore":               "Restaurar",
+		"trash.purge":                 "Eliminar para siempre",
+		"trash.empty_now":             "Vaciar papelera",
+		"tags.title":                  "Etiquetas sugeridas",
+		"tags.untagged":               "%d notas aún no tienen etiquetas.",
+		"tags.batch":                  "Notas a etiquetar",
+		"tags.max_cost":               "Límite de gasto (USD)",
+		"tags.suggest":                "Sugerir etiquetas",
+		"tags.empty":                  "No hay etiquetas sugeridas por revisar.",
+		"tags.tags":                   "Etiquetas",
+		"tags.apply":                  "Aplicar",
+		"tags.dismiss":                "Descartar",
+		"replace.title":               "Buscar y reemplazar",
+		"replace.find":                "Buscar",
+		"replace.with":                "Reemplazar por",
+		"replace.regex":               "Expresión regular",
+		"replace.notebook":            "Cuaderno",
+		"replace.all_notebooks":       "Todos los cuadernos",
+		"replace.tag":                 "Etiqueta",
+		"replace.query":               "Solo notas que contengan",
+		"replace.preview":             "Vista previa",
+		"replace.none":                "Ninguna nota coincide.",
+		"search.title":                "Buscar",
+		"search.placeholder":          "Buscar notas",
+		"search.submit":               "Buscar",
+		"search.help":                 "Usa \"comillas\" para una frase exacta, y tag:nombre, notebook:nombre, before:AAAA-MM-DD o after:AAAA-MM-DD para acotar los resultados.",
+		"search.none":                 "Ninguna nota coincide.",
+		"search.count":                "%d notas coinciden",
+		"search.pages":                "Páginas de resultados",
+		"search.prev":                 "Anterior",
+		"search.next":                 "Siguiente",
+		"note.starred":                "Destacada",
+		"note.star":                   "Destacar esta nota",
+		"note.unstar":                 "Quitar el destacado",
+		"replace.count":               "%d coincidencias",
+		"replace.open":                "Abrir",
+		"replace.apply":               "Reemplazar en las notas seleccionadas",
+		"report.orphan":               "sin enlaces",
+		"report.stub":                 "muy corta",
+		"report.review":               "por revisar",
+		"note.backlinks":              "Enlazada desde",
+		"note.backlink":               "Nota %d",
+	},
+	"de": {
+		"page.title":                  "img.md",
+		"skip.content":                "Zum Inhalt springen",
+		"thumbnail.label":             "%s, erstellt am %s",
+		"thumbnail.stats":             "%d Wörter · %d Min. Lesezeit",
+		"index.recent":                "Weiter, wo du aufgehört hast",
+		"live.note_added":             "Neue Notiz hinzugefügt: %s",
+		"live.job_failed":             "Eine Umwandlung ist fehlgeschlagen: %s",
+		"health.title":                "Umwandlungen",
+		"health.queue":                "Warteschlange",
+		"health.waiting":              "%d wartend",
+		"health.oldest":               "älteste seit %d Min.",
+		"health.workers":              "Beschäftigte Worker",
+		"health.of":                   "%d von %d",
+		"health.last_ai":              "Letzter KI-Aufruf",
+		"health.ai_ok":                "%s s",
+		"health.ai_error":             "nach %s s fehlgeschlagen",
+		"health.ai_timeout":           "nach %s s abgelaufen",
+		"health.none":                 "noch keiner",
+		"health.spend":                "Heute ausgegeben",
+		"health.spend_value":          "$%s für %d Anfragen",
+		"health.stalled":              "Aufträge warten, aber kein Worker hat sie übernommen.",
+		"note.toc":                    "Inhalt",
+		"note.back":                   "Alle Notizen",
+		"graph.title":                 "Notizgraph",
+		"note.label":                  "Archivetikett drucken",
+		"note.captured":               "geschrieben am %s",
+		"note.review":                 "Zu prüfen: %s",
+		"note.review_done":            "Als geprüft markieren",
+		"note.scan":                   "Scan von %s",
+		"note.cleanup":                "Mit KI bereinigen und Änderungen prüfen",
+		"note.regenerate":             "Bild erneut transkribieren",
+		"outline.title":               "Gliederung",
+		"outline.help":                "Korrigiere die Überschriftenebenen oder ziehe Überschriften, um ihre Abschnitte neu zu ordnen.",
+		"outline.promote":             "%s höherstufen",
+		"outline.demote":              "%s herabstufen",
+		"outline.up":                  "%s nach oben verschieben",
+		"outline.down":                "%s nach unten verschieben",
+		"note.edit":                   "Markdown bearbeiten",
+		"note.edit_save":              "Markdown speichern",
+		"label.caption":               "Notiz %d",
+		"notebooks.title":             "Notizbücher",
+		"notebooks.empty":             "Noch keine Notizbücher.",
+		"notebooks.new":               "Neues Notizbuch",
+		"notebooks.new_child":         "Neues Notizbuch in diesem",
+		"notebooks.create":            "Anlegen",
+		"notebooks.no_notes":          "Keine Notizen in diesem Notizbuch.",
+		"compile.link":                "Als ein Dokument lesen",
+		"compile.export":              "Als Markdown herunterladen",
+		"compile.source":              "%s öffnen",
+		"notebooks.note_ids":          "Notiz-IDs, durch Kommas getrennt",
+		"notebooks.move":              "Notizen hierher verschieben",
+		"notebooks.name":              "Name",
+		"notebooks.parent":            "In",
+		"notebooks.top":               "Oberste Ebene",
+		"notebooks.save":              "Speichern",
+		"physical.title":              "Papiernotizbücher",
+		"physical.empty":              "Noch keine Papiernotizbücher.",
+		"physical.name":               "Name",
+		"physical.pages":              "Seiten",
+		"physical.cover":              "Foto des Umschlags",
+		"physical.add":                "Notizbuch hinzufügen",
+		"physical.progress":           "%d von %d Seiten digitalisiert",
+		"physical.missing":            "Fehlende Seiten: %s",
+		"physical.gaps":               "Lücke in der Seitenfolge, nicht digitalisiert: %s",
+		"physical.complete":           "Alle Seiten sind digitalisiert.",
+		"physical.page":               "Seite %d",
+		"physical.page_number":        "Seite",
+		"physical.assign":             "Eine Notiz einer Seite zuordnen",
+		"physical.upload":             "Eine Seite scannen",
+		"physical.upload_batch":       "Mehrere Seiten scannen",
+		"physical.images":             "Bilder, PDFs oder ein Zip",
+		"physical.pdf_single":         "Die Seiten eines PDFs zu einer Notiz zusammenfassen",
+		"physical.first_page":         "Erste Seite",
+		"physical.note":               "Notiz-ID",
+		"physical.save":               "Zuordnen",
+		"note.qr":                     "QR-Code, der auf diese Notiz verweist",
+		"note.qr_download":            "QR-Code zum Drucken herunterladen",
+		"settings.title":              "Einstellungen",
+		"settings.api_key":            "API-Schlüssel",
+		"settings.api_key_set":        "Leer lassen, um den aktuellen Schlüssel zu behalten (%s)",
+		"settings.api_key_clear":      "Gespeicherten Schlüssel entfernen",
+		"settings.provider":           "Anbieter",
+		"settings.provider_openai":    "OpenAI-kompatibel",
+		"settings.provider_tesseract": "Tesseract (Offline-OCR, nur Text)",
+		"settings.base_url":           "Basis-URL",
+		"settings.model":              "Modell",
+		"settings.prompt":             "Anweisung",
+		"settings.temperature":        "Temperatur",
+		"settings.max_tokens":         "Maximale Tokens",
+		"ai.options":                  "KI-Optionen",
+		"ai.force":                    "Zwischengespeicherte Transkription ignorieren und die KI erneut fragen",
+		"upload.progress":             "%s wird hochgeladen: %d%%",
+		"upload.waiting":              "Verbindung unterbrochen, %s wird fortgesetzt, sobald sie zurück ist",
+		"upload.converting":           "Hochladen abgeschlossen, wird umgewandelt",
+		"upload.failed":               "Hochladen fehlgeschlagen: %s",
+		"settings.save":               "Speichern",
+		"settings.test":               "Transkription testen",
+		"settings.test_ok":            "Das Beispielbild wurde transkribiert:",
+		"settings.cache":              "KI-Antwortcache",
+		"settings.cache_stats":        "%d gespeicherte Antworten, %d-mal wiederverwendet",
+		"settings.cache_clear":        "Cache leeren",
+		"usage.title":                 "KI-Nutzung",
+		"usage.summary":               "Letzte %d Tage: %d Anfragen, %d Eingabe- und %d Ausgabetokens, etwa $%.2f",
+		"usage.pricing":               "Berechnet mit $%.2f pro Million Eingabetokens und $%.2f pro Million Ausgabetokens. Setze BOOKMD_INPUT_PRICE und BOOKMD_OUTPUT_PRICE passend zu deinem Anbieter.",
+		"usage.requests":              "Anfragen",
+		"usage.prompt_tokens":         "Eingabetokens",
+		"usage.completion_tokens":     "Ausgabetokens",
+		"usage.cost":                  "Kosten",
+		"storage.title":               "Speicher",
+		"storage.summary":             "Datenbank %s, davon %s freigebbar; Bilder %s",
+		"storage.last_maintenance":    "Die letzte Wartung am %s hat %s in %d ms freigegeben",
+		"storage.never_maintained":    "Die Datenbank wurde noch nicht gewartet.",
+		"storage.maintain":            "Jetzt komprimieren und analysieren",
+		"storage.backup":              "Sicherung herunterladen",
+		"storage.import":              "Zu importierende Sicherung",
+		"storage.import_submit":       "Importieren",
+		"storage.backup_hint":         "Eine Sicherung enthält jede Notiz mit ihrem Bild und ein Manifest ihrer SHA-256-Prüfsummen. Beim Import wird jede Datei geprüft und die ganze Sicherung abgelehnt, wenn eine beschädigt oder verändert ist.",
+		"hold.title":                  "Rechtliche Sperre",
+		"hold.hint":                   "Die Notizen eines gesperrten Notizbuchs können nicht bearbeitet, verschoben oder gelöscht werden. Das Entsperren braucht eine Begründung und wird protokolliert.",
+		"hold.notice":                 "Dieses Notizbuch ist rechtlich gesperrt: seine Notizen können nicht geändert werden.",
+		"hold.reason":                 "Begründung",
+		"hold.lock":                   "Notizbuch sperren",
+		"hold.unlock":                 "Notizbuch entsperren",
+		"audit.notebook.locked":       "Gesperrt",
+		"audit.notebook.unlocked":     "Entsperrt",
+		"storage.notebook":            "Notizbuch",
+		"storage.notes":               "Notizen",
+		"storage.text":                "Text",
+		"storage.images":              "Bilder",
+		"storage.unfiled":             "Kein Notizbuch",
+		"storage.tables":              "Datenbanktabellen",
+		"settings.test_failed":        "Die Testtranskription ist fehlgeschlagen: %s",
+		"feedback.question":           "War diese Transkription gut?",
+		"feedback.corrected":          "Korrigierter Text (optional)",
+		"feedback.up":                 "Gute Transkription",
+		"feedback.down":               "Schlechte Transkription",
+		"type.notes":                  "Notizen",
+		"type.upload":                 "%s hochladen",
+		"type.image":                  "Bild",
+		"type.submit":                 "Hochladen und transkribieren",
+		"type.empty":                  "Noch keine Notizen dieses Typs.",
+		"type.note":                   "Notiz",
+		"type.created":                "Erstellt",
+		"note.properties":             "Eigenschaften",
+		"note.export":                 "Markdown herunterladen",
+		"property.key":                "Schlüssel",
+		"property.value":              "Wert",
+		"property.add":                "Eigenschaft hinzufügen",
+		"property.remove":             "%s entfernen",
+		"report.title":                "Aufzuräumende Notizen",
+		"report.empty":                "Nichts aufzuräumen.",
+		"provenance.title":            "Info",
+		"provenance.none":             "Nicht erfasst: Diese Version wurde von Hand geschrieben oder bearbeitet oder entstand, bevor die Herkunft gespeichert wurde.",
+		"provenance.model":            "Modell",
+		"provenance.prompt":           "Prompt",
+		"provenance.preprocessing":    "Bild",
+		"provenance.postprocessing":   "Markdown",
+		"provenance.responses":        "Antwort-IDs",
+		"provenance.latency":          "Latenz",
+		"provenance.requests":         "%d Anfragen, %s s",
+		"provenance.cached":           "aus dem Cache",
+		"provenance.date":             "Erstellt",
+		"provenance.step.original":    "wie hochgeladen gesendet",
+		"provenance.step.scale":       "auf %s px verkleinert",
+		"provenance.step.jpeg":        "JPEG-Qualität %s",
+		"provenance.step.pages":       "%s Seiten einzeln transkribiert",
+		"provenance.step.autofix":     "Formatierung korrigiert",
+		"history.title":               "Verlauf",
+		"history.empty":               "Diese Notiz wurde seit ihrer Erstellung nicht geändert.",
+		"history.from":                "Vergleiche",
+		"history.to":                  "mit",
+		"history.current":             "Aktuelle Version",
+		"history.revision":            "Revision %d",
+		"history.compare":             "Änderungen zeigen",
+		"history.words":               "%d Wörter",
+		"history.rollback":            "Diese Version wiederherstellen",
+		"trash.title":                 "Papierkorb",
+		"trash.empty":                 "Der Papierkorb ist leer.",
+		"trash.deleted":               "gelöscht %s",
+		"trash.restore":               "Wiederherstellen",
+		"trash.purge":                 "Endgültig löschen",
+		"trash.empty_now":             "Papierkorb leeren",
+		"tags.title":                  "Vorgeschlagene Tags",
+		"tags.untagged":               "%d Notizen haben noch keine Tags.",
+		"tags.batch":                  "Zu taggende Notizen",
+		"tags.max_cost":               "Ausgabenlimit (USD)",
+		"tags.suggest":                "Tags vorschlagen",
+		"tags.empty":                  "Keine vorgeschlagenen Tags zu prüfen.",
+		"tags.tags":                   "Tags",
+		"tags.apply":                  "Übernehmen",
+		"tags.dismiss":                "Verwerfen",
+		"replace.title":               "Suchen und ersetzen",
+		"replace.find":                "Suchen",
+		"replace.with":                "Ersetzen durch",
+		"replace.regex":               "Regulärer Ausdruck",
+		"replace.notebook":            "Notizbuch",
+		"replace.all_notebooks":       "Alle Notizbücher",
+		"replace.tag":                 "Tag",
+		"replace.query":               "Nur Notizen mit",
+		"replace.preview":             "Vorschau",
+		"replace.none":                "Keine Notiz passt.",
+		"search.title":                "Suche",
+		"search.placeholder":          "Notizen durchsuchen",
+		"search.submit":               "Suchen",
+		"search.help":                 "Verwende \"Anführungszeichen\" für eine exakte Phrase und tag:Name, notebook:Name, before:JJJJ-MM-TT oder after:JJJJ-MM-TT, um die Ergebnisse einzugrenzen.",
+		"search.none":                 "Keine Notiz passt.",
+		"search.count":                "%d passende Notizen",
+		"search.pages":                "Ergebnisseiten",
+		"search.prev":                 "Zurück",
+		"search.next":                 "Weiter",
+		"note.starred":                "Markiert",
+		"note.star":                   "Diese Notiz markieren",
+		"note.unstar":                 "Markierung entfernen",
+		"replace.count":               "%d Treffer",
+		"replace.open":                "Öffnen",
+		"replace.apply":               "In den ausgewählten Notizen ersetzen",
+		"report.orphan":               "keine Links",
+		"report.stub":                 "sehr kurz",
+		"report.review":               "zu prüfen",
+		"note.backlinks":              "Verlinkt von",
+		"note.backlink":               "Notiz %d",
+	},
+}
+
+// monthNames holds the localized month names for each supported locale
+var monthNames = map[string][12]string{
+	"en": {"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+	"es": {"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+	"de": {"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+}
+
+// DisplayPrefs carries the per-request settings used to render the UI
+type DisplayPrefs struct {
+	Locale   string
+	Location *time.Location
+	Theme    string
+	Density  string
+}
+
+// Date renders t in the viewer's timezone and locale
+func (p DisplayPrefs) Date(t time.Time) string {
+	return FormatDate(p.Locale, t.In(orUTC(p.Location)))
+}
+
+// DateTime renders t with a 24-hour clock in the viewer's timezone and locale
+func (p DisplayPrefs) DateTime(t time.Time) string {
+	t = t.In(orUTC(p.Location))
+	return fmt.Sprintf("%s %s", FormatDate(p.Locale, t), t.Format("15:04 MST"))
+}
+
+// orUTC returns loc, or UTC when loc is nil
+func orUTC(loc *time.Location) *time.Location {
+	if loc == nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// ParseTimezone resolves an IANA timezone name, falling back to UTC when the
+// name is empty or unknown
+func ParseTimezone(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// SupportedLocale reports whether a message catalog exists for the locale
+func SupportedLocale(locale string) bool {
+	_, ok := catalogs[locale]
+	return ok
+}
+
+// NegotiateLocale picks a supported locale, preferring an explicit override
+// and otherwise walking the Accept-Language header by quality
+func NegotiateLocale(acceptLanguage, override string) string {
+	if override = strings.ToLower(strings.TrimSpace(override)); SupportedLocale(override) {
+		return override
+	}
+
+	type candidate struct {
+		tag string
+		q   float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if v, ok := strings.CutPrefix(param, "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		candidates = append(candidates, candidate{tag: tag, q: q})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, c := range candidates {
+		if c.q <= 0 {
+			continue
+		}
+		base, _, _ := strings.Cut(c.tag, "-")
+		if SupportedLocale(base) {
+			return base
+		}
+	}
+
+	return DefaultLocale
+}
+
+// T returns the translated message for key, formatted with args, falling
+// back to the default locale and finally to the key itself
+func T(locale, key string, args ...any) string {
+	msg, ok := catalogs[locale][key]
+	if !ok {
+		msg, ok = catalogs[DefaultLocale][key]
+	}
+	if !ok {
+		msg = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// FormatDate renders a date the way the given locale writes it out
+func FormatDate(locale string, t time.Time) string {
+	months, ok := monthNames[locale]
+	if !ok {
+		locale = DefaultLocale
+		months = monthNames[DefaultLocale]
+	}
+	month := months[t.Month()-1]
+
+	switch locale {
+	case "es":
+		return fmt.Sprintf("%d de %s de %d", t.Day(), month, t.Year())
+	case "de":
+		return fmt.Sprintf("%d. %s %d", t.Day(), month, t.Year())
+	default:
+		return fmt.Sprintf("%s %d, %d", month, t.Day(), t.Year())
+	}
+}
@@ -0,0 +1,386 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Job statuses
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a queued conversion of an uploaded image into a note. Source is
+// the name the file was uploaded under. Params holds
+// the upload's options for the worker; Result is what the worker reported
+// back, such as markdown warnings.
+type Job struct {
+	ID           int             `json:"id"`
+	Status       string          `json:"status"`
+	BatchID      int             `json:"batch_id,omitempty"`
+	Source       string          `json:"source,omitempty"`
+	Image        string          `json:"image"`
+	Params       json.RawMessage `json:"-"`
+	NoteID       int             `json:"note_id,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	Result       json.RawMessage `json:"result,omitempty"`
+	DateCreated  time.Time       `json:"date_created"`
+	DateFinished *time.Time      `json:"date_finished,omitempty"`
+}
+
+// Finished reports whether the job is done or failed
+func (j *Job) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// jobColumns lists the columns scanned by scanJob, in order
+const jobColumns = `id, status, batch_id, source, image, params, note_id, error, result, date_created, date_finished`
+
+func scanJob(row rowScanner) (*Job, error) {
+	var job Job
+	var params, result string
+	var finished sql.NullTime
+	err := row.Scan(&job.ID, &job.Status, &job.BatchID, &job.Source, &job.Image, &params, &job.NoteID, &job.Error, &result,
+		&job.DateCreated, &finished)
+	if err != nil {
+		return nil, err
+	}
+	job.Params = json.RawMessage(params)
+	if result != "" {
+		job.Result = json.RawMessage(result)
+	}
+	if finished.Valid {
+		job.DateFinished = &finished.Time
+	}
+	return &job, nil
+}
+
+// GetJob retrieves a job by ID
+func GetJob(db *sql.DB, id int) (*Job, error) {
+	job, err := scanJob(db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no job found with id %d", id)
+		}
+		return nil, fmt.Errorf("failed to scan job: %w", err)
+	}
+	return job, nil
+}
+
+// CountJobs returns the number of jobs with each status
+func CountJobs(db *sql.DB) (map[string]int, error) {
+	rows, err := db.Query(`SELECT status, COUNT(*) FROM jobs GROUP BY status`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count jobs: %w", err)
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, fmt.Errorf("failed to scan job count: %w", err)
+		}
+		counts[status] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating job counts: %w", err)
+	}
+	return counts, nil
+}
+
+// JobQueue runs jobs on a pool of workers. Jobs are stored in the database,
+// so ones still pending when the server stops are picked up when it starts
+// again.
+type JobQueue struct {
+	DB      *sql.DB
+	Workers int
+	// Process converts a job into a note, returning the note's ID and a
+	// result to store with the job
+	Process func(ctx context.Context, job *Job) (int, any, error)
+	// Notify, when set, is called each time a job changes status
+	Notify func(job *Job)
+
+	wake    chan struct{}
+	stop    chan struct{}
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// ErrQueueStopped is returned by Enqueue once Drain has been called
+var ErrQueueStopped = errors.New("job queue is shutting down")
+
+// jobPollInterval is how often idle workers look for jobs they were not
+// woken for
+const jobPollInterval = 5 * time.Second
+
+// Start requeues jobs interrupted by a restart and starts the workers, which
+// run until ctx is done or the queue is drained
+func (q *JobQueue) Start(ctx context.Context) error {
+	if _, err := q.DB.Exec(`UPDATE jobs SET status = ? WHERE status = ?`, JobPending, JobRunning); err != nil {
+		return fmt.Errorf("failed to requeue interrupted jobs: %w", err)
+	}
+	q.wake = make(chan struct{}, 1)
+	q.stop = make(chan struct{})
+	ctx, q.cancel = context.WithCancel(ctx)
+	for range max(q.Workers, 1) {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			q.work(ctx)
+		}()
+	}
+	return nil
+}
+
+// Drain stops the workers from claiming jobs and waits for the running ones
+// to finish. When ctx is done first they are canceled and put back in the
+// queue, to run again on the next Start.
+func (q *JobQueue) Drain(ctx context.Context) error {
+	close(q.stop)
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	q.cancel()
+	<-done
+	return ctx.Err()
+}
+
+// stopped reports whether Drain has been called
+func (q *JobQueue) stopped() bool {
+	select {
+	case <-q.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Enqueue stores a pending job for image, uploaded as source, and wakes a
+// worker. batch is the ID from NewBatch, or 0 for a single upload. The job
+// is logged with ctx, tying it to the request that made it.
+func (q *JobQueue) Enqueue(ctx context.Context, batch int, source, image string, params any) (*Job, error) {
+	if q.stopped() {
+		return nil, ErrQueueStopped
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode job params: %w", err)
+	}
+	result, err := q.DB.Exec(`INSERT INTO jobs (status, batch_id, source, image, params) VALUES (?, ?, ?, ?, ?)`,
+		JobPending, batch, source, image, string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert job: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	slog.InfoContext(ctx, "job queued", "job_id", id, "batch_id", batch, "source", source)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	job, err := GetJob(q.DB, int(id))
+	if err != nil {
+		return nil, err
+	}
+	q.notify(job)
+	return job, nil
+}
+
+func (q *JobQueue) notify(job *Job) {
+	if q.Notify != nil {
+		q.Notify(job)
+	}
+}
+
+// Wait blocks until the job finishes or ctx is done, returning its final state
+func (q *JobQueue) Wait(ctx context.Context, id int) (*Job, error) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		job, err := GetJob(q.DB, id)
+		if err != nil || job.Finished() {
+			return job, err
+		}
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// work runs jobs one at a time until ctx is done or the queue is drained
+func (q *JobQueue) work(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for !q.stopped() {
+		job, err := q.claim()
+		if err != nil {
+			slog.Error("failed to claim job", "err", err)
+		}
+		if job != nil {
+			q.notify(job)
+			q.run(ctx, job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim marks the oldest pending job as running and returns it, or nil when
+// there is none
+func (q *JobQueue) claim() (*Job, error) {
+	job, err := scanJob(q.DB.QueryRow(`UPDATE jobs SET status = ?
+		WHERE id = (SELECT id FROM jobs WHERE status = ? ORDER BY id LIMIT 1)
+		RETURNING `+jobColumns, JobRunning, JobPending))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan job: %w", err)
+	}
+	return job, nil
+}
+
+var (
+	jobsFinished = NewCounter("bookmd_jobs_finished_total",
+		"Conversion jobs finished, by status: done or failed.", "status")
+	jobDuration = NewHistogram("bookmd_job_duration_seconds",
+		"Time conversion jobs took, AI requests and retries included.",
+		[]float64{1, 2, 5, 10, 20, 30, 60, 120, 300, 600})
+)
+
+// run processes a claimed job and records how it ended. Everything logged
+// with ctx while it runs names the job.
+func (q *JobQueue) run(ctx context.Context, job *Job) {
+	ctx = WithLogAttrs(ctx, "job_id", job.ID)
+	slog.DebugContext(ctx, "job started", "source", job.Source, "image", job.Image)
+	start := time.Now()
+	noteID, result, err := q.Process(ctx, job)
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by a shutdown rather than failed
+		slog.WarnContext(ctx, "job interrupted, requeued")
+		if _, err := q.DB.Exec(`UPDATE jobs SET status = ? WHERE id = ?`, JobPending, job.ID); err != nil {
+			slog.ErrorContext(ctx, "failed to requeue job", "err", err)
+		}
+		return
+	}
+	status, message := JobDone, ""
+	if err != nil {
+		status, message = JobFailed, err.Error()
+		slog.ErrorContext(ctx, "job failed", "source", job.Source, "duration_ms", time.Since(start).Milliseconds(), "err", err)
+	} else {
+		slog.InfoContext(ctx, "job done", "note_id", noteID, "duration_ms", time.Since(start).Milliseconds())
+	}
+	jobsFinished.Inc(status)
+	jobDuration.Observe(time.Since(start).Seconds())
+	data := []byte{}
+	if result != nil {
+		if data, err = json.Marshal(result); err != nil {
+			slog.ErrorContext(ctx, "failed to encode job result", "err", err)
+			data = []byte{}
+		}
+	}
+
+	_, err = q.DB.Exec(`UPDATE jobs SET status = ?, note_id = ?, error = ?, result = ?, date_finished = CURRENT_TIMESTAMP
+		WHERE id = ?`, status, noteID, message, string(data), job.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to finish job", "err", err)
+		return
+	}
+	if job, err = GetJob(q.DB, job.ID); err == nil {
+		q.notify(job)
+	}
+}
+
+// Batch is a group of jobs uploaded together. Status is pending until a job
+// starts, running until all have finished, then done if any succeeded and
+// failed if none did.
+type Batch struct {
+	ID          int            `json:"id"`
+	Status      string         `json:"status"`
+	Counts      map[string]int `json:"counts"`
+	Jobs        []Job          `json:"jobs"`
+	DateCreated time.Time      `json:"date_created"`
+}
+
+// NewBatch starts a batch for jobs to be enqueued into
+func (q *JobQueue) NewBatch() (int, error) {
+	result, err := q.DB.Exec(`INSERT INTO job_batches DEFAULT VALUES`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert batch: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	return int(id), nil
+}
+
+// GetBatch retrieves a batch with the status of each of its jobs
+func GetBatch(db *sql.DB, id int) (*Batch, error) {
+	batch := Batch{ID: id, Counts: map[string]int{}, Jobs: []Job{}}
+	err := db.QueryRow(`SELECT date_created FROM job_batches WHERE id = ?`, id).Scan(&batch.DateCreated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no batch found with id %d", id)
+		}
+		return nil, fmt.Errorf("failed to scan batch: %w", err)
+	}
+
+	rows, err := db.Query(`SELECT `+jobColumns+` FROM jobs WHERE batch_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query batch jobs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job: %w", err)
+		}
+		batch.Jobs = append(batch.Jobs, *job)
+		batch.Counts[job.Status]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating batch jobs: %w", err)
+	}
+
+	switch {
+	case batch.Counts[JobRunning] > 0 || batch.Counts[JobPending] > 0 && batch.Counts[JobPending] < len(batch.Jobs):
+		batch.Status = JobRunning
+	case batch.Counts[JobPending] > 0 || len(batch.Jobs) == 0:
+		batch.Status = JobPending
+	case batch.Counts[JobDone] > 0:
+		batch.Status = JobDone
+	default:
+		batch.Status = JobFailed
+	}
+	return &batch, nil
+}
@@ -0,0 +1,200 @@
+package funcs
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// mm converts millimetres to PDF points
+func mm(v float64) float64 { return v * 72 / 25.4 }
+
+// LabelSheet describes a label stock: the page size and the grid of labels
+// on it, all in points
+type LabelSheet struct {
+	Name         string
+	PageW, PageH float64
+	LabelW       float64
+	LabelH       float64
+	Cols, Rows   int
+	Left, Top    float64
+	GapX, GapY   float64
+}
+
+// LabelSheets are the built-in label stocks, by the name used in ?size=
+var LabelSheets = map[string]LabelSheet{
+	// Continuous-roll printers print one label per page
+	"62x29":  SingleLabel(62, 29),
+	"62x100": SingleLabel(62, 100),
+	"54x25":  SingleLabel(54, 25),
+	// Avery 5160 / 8160: 3 x 10 on US Letter
+	"avery-5160": {Name: "avery-5160", PageW: 612, PageH: 792, LabelW: 189, LabelH: 72,
+		Cols: 3, Rows: 10, Left: 13.5, Top: 36, GapX: 9},
+	// Avery L7159: 3 x 8 on A4
+	"a4-24": {Name: "a4-24", PageW: mm(210), PageH: mm(297), LabelW: mm(63.5), LabelH: mm(33.9),
+		Cols: 3, Rows: 8, Left: mm(6.4), Top: mm(12.9), GapX: mm(2.5)},
+}
+
+// SingleLabel is a stock of one label per page of the given size in mm
+func SingleLabel(widthMM, heightMM float64) LabelSheet {
+	return LabelSheet{
+		Name:  fmt.Sprintf("%gx%g", widthMM, heightMM),
+		PageW: mm(widthMM), PageH: mm(heightMM),
+		LabelW: mm(widthMM), LabelH: mm(heightMM),
+		Cols: 1, Rows: 1,
+	}
+}
+
+// Label is the content printed on one label
+type Label struct {
+	Title   string
+	Date    string
+	Caption string
+	QRText  string
+}
+
+// RenderLabels lays labels out on as many sheets as needed and returns the
+// PDF. Each label shows a QR code of QRText on the left and the title, date
+// and caption on the right.
+func RenderLabels(labels []Label, sheet LabelSheet) ([]byte, error) {
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("no labels to print")
+	}
+	perPage := sheet.Cols * sheet.Rows
+
+	var pages []string
+	for start := 0; start < len(labels); start += perPage {
+		var content strings.Builder
+		for i, label := range labels[start:min(start+perPage, len(labels))] {
+			col, row := i%sheet.Cols, i/sheet.Cols
+			x := sheet.Left + float64(col)*(sheet.LabelW+sheet.GapX)
+			// PDF coordinates grow upwards from the bottom of the page
+			y := sheet.PageH - sheet.Top - float64(row+1)*sheet.LabelH - float64(row)*sheet.GapY
+			if err := drawLabel(&content, label, x, y, sheet.LabelW, sheet.LabelH); err != nil {
+				return nil, err
+			}
+		}
+		pages = append(pages, content.String())
+	}
+	return writePDF(pages, sheet.PageW, sheet.PageH), nil
+}
+
+// drawLabel writes the drawing operators for one label with its lower-left
+// corner at x, y
+func drawLabel(out *strings.Builder, label Label, x, y, w, h float64) error {
+	pad := min(w, h) * 0.08
+	side := h - 2*pad
+	textX := x + pad
+
+	if label.QRText != "" {
+		code, err := EncodeQR(label.QRText)
+		if err != nil {
+			return err
+		}
+		module := side / float64(code.Size)
+		for my := 0; my < code.Size; my++ {
+			for mx := 0; mx < code.Size; mx++ {
+				if code.Dark(mx, my) {
+					fmt.Fprintf(out, "%.2f %.2f %.2f %.2f re\n",
+						x+pad+float64(mx)*module, y+h-pad-float64(my+1)*module, module, module)
+				}
+			}
+		}
+		out.WriteString("f\n")
+		textX += side + pad
+	}
+
+	textW := x + w - pad - textX
+	size := min(11, h/4)
+	lines := []struct {
+		font string
+		size float64
+		text string
+	}{
+		{"F2", size, label.Title},
+		{"F1", size * 0.8, label.Date},
+		{"F1", size * 0.8, label.Caption},
+	}
+	baseline := y + h - pad - size
+	for _, line := range lines {
+		if line.text == "" {
+			continue
+		}
+		fmt.Fprintf(out, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n",
+			line.font, line.size, textX, baseline, pdfString(fitText(line.text, textW, line.size)))
+		baseline -= line.size * 1.3
+	}
+	return nil
+}
+
+// fitText shortens text with an ellipsis to fit width, using the average
+// Helvetica character width
+func fitText(text string, width, size float64) string {
+	maxChars := int(width / (size * 0.52))
+	runes := []rune(text)
+	if len(runes) <= maxChars {
+		return text
+	}
+	if maxChars < 2 {
+		return ""
+	}
+	return string(runes[:maxChars-1]) + "…"
+}
+
+// pdfString escapes text for a PDF literal string in WinAnsiEncoding.
+// Characters outside Latin-1 and the ellipsis become "?".
+func pdfString(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '…':
+			b.WriteString(`\205`)
+		case r >= 0x20 && r < 0x7F:
+			b.WriteRune(r)
+		case r >= 0xA0 && r <= 0xFF:
+			fmt.Fprintf(&b, `\%03o`, r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// writePDF assembles a PDF with one page per content stream, using the
+// standard Helvetica fonts
+func writePDF(pages []string, w, h float64) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	// Objects 1-4 are the catalog, page tree and fonts; each page then takes
+	// two objects, the page and its content stream
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", w, h, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
@@ -0,0 +1,144 @@
+package funcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of -ai-concurrency and -ai-timeout
+const (
+	DefaultAIConcurrency = 2
+	DefaultAITimeout     = 2 * time.Minute
+)
+
+// AILimit holds the slots AI requests take while they are sent to a
+// provider; a nil channel lets every request through at once. timeout
+// bounds each attempt at a request, 0 leaving it to the caller's context.
+// The zero AILimit sets no limit.
+type AILimit struct {
+	mu      sync.RWMutex
+	slots   chan struct{}
+	timeout time.Duration
+	running atomic.Int64
+	queued  atomic.Int64
+}
+
+// SetConcurrency lets at most n AI requests reach the providers at once
+// and queues the rest, or lifts the limit when n is 0. Requests already
+// sent finish under the old limit.
+func (l *AILimit) SetConcurrency(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.slots = nil
+	if n > 0 {
+		l.slots = make(chan struct{}, n)
+	}
+}
+
+// SetTimeout gives each attempt at an AI request at most d once it has a
+// slot, or no limit of its own when d is 0. An attempt that runs out of
+// time is retried like an overloaded provider.
+func (l *AILimit) SetTimeout(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.timeout = d
+}
+
+// Load reports the AI requests being sent and those waiting for a slot
+func (l *AILimit) Load() (running, queued int) {
+	return int(l.running.Load()), int(l.queued.Load())
+}
+
+var (
+	aiRequests = NewCounter("bookmd_ai_requests_total",
+		"AI requests sent to a provider, by model and outcome: ok, error or timeout.", "model", "outcome")
+	aiDuration = NewHistogram("bookmd_ai_request_duration_seconds",
+		"Time AI providers took to answer, from when a request had a slot.",
+		[]float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300}, "model")
+)
+
+// LimitedVision sends the requests of Client once Limit has a slot free,
+// waiting until then or until the request is canceled, and within the
+// limit's timeout. Retries wrap it, so a request backing off gives its slot
+// to the next one.
+type LimitedVision struct {
+	Client VisionClient
+	Limit  *AILimit
+}
+
+func (c *LimitedVision) Complete(ctx context.Context, req VisionRequest) (out string, err error) {
+	limit := c.Limit
+	limit.mu.RLock()
+	slots, timeout := limit.slots, limit.timeout
+	limit.mu.RUnlock()
+
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			queued := limit.queued.Add(1)
+			slog.InfoContext(ctx, "AI requests at their limit, queueing", "limit", cap(slots), "queued", queued)
+			select {
+			case slots <- struct{}{}:
+				limit.queued.Add(-1)
+			case <-ctx.Done():
+				limit.queued.Add(-1)
+				return "", ctx.Err()
+			}
+		}
+		defer func() { <-slots }()
+	}
+
+	limit.running.Add(1)
+	defer limit.running.Add(-1)
+	start := time.Now()
+	defer func() {
+		took := time.Since(start)
+		observeAIRequest(req.Model, took, err)
+		recordProvenance(ctx, func(p *Provenance) {
+			p.Requests++
+			p.LatencyMS += took.Milliseconds()
+		})
+	}()
+	if timeout == 0 {
+		return c.Client.Complete(ctx, req)
+	}
+	attempt, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out, err = c.Client.Complete(attempt, req)
+	if err != nil && ctx.Err() == nil && errors.Is(attempt.Err(), context.DeadlineExceeded) {
+		return "", &UnavailableError{Status: http.StatusGatewayTimeout, Err: fmt.Errorf("AI provider did not answer within %s: %w", timeout, err)}
+	}
+	return out, err
+}
+
+// observeAIRequest counts an AI request and the time it took
+func observeAIRequest(model string, took time.Duration, err error) {
+	outcome := "ok"
+	var unavailable *UnavailableError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &unavailable) && unavailable.Status == http.StatusGatewayTimeout:
+		outcome = "timeout"
+	case err != nil:
+		outcome = "error"
+	}
+	aiRequests.Inc(model, outcome)
+	aiDuration.Observe(took.Seconds(), model)
+	lastAIRequest.Store(&AIRequest{Model: model, Outcome: outcome, DurationMS: took.Milliseconds(), DateSent: time.Now().Add(-took).UTC()})
+}
+
+// lastAIRequest is the AI request that finished last
+var lastAIRequest atomic.Pointer[AIRequest]
+
+// LastAIRequest reports the AI request that finished last, or nil before
+// the first since the server started
+func LastAIRequest() *AIRequest {
+	return lastAIRequest.Load()
+}
@@ -0,0 +1,357 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Link kinds stored in the note_links table
+const (
+	LinkEmbed = "embed"
+	LinkWiki  = "wiki"
+)
+
+// maxTransclusionDepth bounds how deeply embeds may nest
+const maxTransclusionDepth = 3
+
+// embedPattern matches ![[note-slug]] and ![[note-slug#heading]]
+var embedPattern = regexp.MustCompile(`!\[\[([^\]#|]+)(?:#([^\]|]+))?\]\]`)
+
+// linkPattern matches wiki-links and embeds alike: [[note-slug#heading|label]]
+// with an optional leading ! for embeds
+var linkPattern = regexp.MustCompile(`(!?)\[\[([^\]#|]+)(?:#([^\]|]+))?(?:\|([^\]]+))?\]\]`)
+
+// NoteLink is a reference from one note to another
+type NoteLink struct {
+	SourceID int    `json:"source_id"`
+	TargetID int    `json:"target_id"`
+	Fragment string `json:"fragment"`
+	Kind     string `json:"kind"`
+}
+
+// ParseLinks returns the wiki-links and embeds referenced in markdown.
+// References whose slug does not start with a note ID are ignored.
+func ParseLinks(sourceID int, markdown string) []NoteLink {
+	var links []NoteLink
+	for _, m := range linkPattern.FindAllStringSubmatch(markdown, -1) {
+		targetID, err := ParseNoteSlug(strings.TrimSpace(m[2]))
+		if err != nil || targetID == sourceID {
+			continue
+		}
+		kind := LinkWiki
+		if m[1] == "!" {
+			kind = LinkEmbed
+		}
+		links = append(links, NoteLink{
+			SourceID: sourceID,
+			TargetID: targetID,
+			Fragment: strings.TrimSpace(m[3]),
+			Kind:     kind,
+		})
+	}
+	return links
+}
+
+// SyncNoteLinks replaces the stored links of a note with those found in
+// its markdown
+func SyncNoteLinks(db *sql.DB, id int, markdown string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := syncLinks(tx, id, markdown); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit links: %w", err)
+	}
+	return nil
+}
+
+const (
+	clearLinksQuery = `DELETE FROM note_links WHERE source_id = ?`
+	insertLinkQuery = `INSERT OR IGNORE INTO note_links (source_id, target_id, fragment, kind) VALUES (?, ?, ?, ?)`
+)
+
+// syncLinks is SyncNoteLinks within a transaction the caller commits
+func syncLinks(q dbtx, id int, markdown string) error {
+	if _, err := q.Exec(clearLinksQuery, id); err != nil {
+		return fmt.Errorf("failed to clear links: %w", err)
+	}
+	for _, link := range ParseLinks(id, markdown) {
+		_, err := q.Exec(insertLinkQuery, link.SourceID, link.TargetID, link.Fragment, link.Kind)
+		if err != nil {
+			return fmt.Errorf("failed to insert link: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetBacklinks returns the links pointing at a note
+func GetBacklinks(db *sql.DB, id int) ([]NoteLink, error) {
+	rows, err := db.Query(`SELECT source_id, target_id, fragment, kind FROM note_links WHERE target_id = ?
+		AND source_id IN (SELECT id FROM notes WHERE deleted_at IS NULL) ORDER BY source_id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backlinks: %w", err)
+	}
+	defer rows.Close()
+
+	var links []NoteLink
+	for rows.Next() {
+		var link NoteLink
+		if err := rows.Scan(&link.SourceID, &link.TargetID, &link.Fragment, &link.Kind); err != nil {
+			return nil, fmt.Errorf("failed to scan link: %w", err)
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating backlinks: %w", err)
+	}
+	return links, nil
+}
+
+// ExtractSection returns the markdown under the heading whose anchor is id,
+// up to the next heading of the same or a higher level. An empty id returns
+// the whole document.
+func ExtractSection(markdown, id string) (string, bool) {
+	if id == "" {
+		return markdown, true
+	}
+
+	ids := &headingIDs{seen: map[string]int{}}
+	lines := strings.Split(markdown, "\n")
+	openFence := ""
+	start, level := -1, 0
+	for i, line := range lines {
+		if marker := fenceMarker(line); marker != "" {
+			if openFence == "" {
+				openFence = marker
+			} else if marker == openFence {
+				openFence = ""
+			}
+			continue
+		}
+		if openFence != "" {
+			continue
+		}
+		l := headingLevel(line)
+		if l == 0 {
+			continue
+		}
+		if start >= 0 && l <= level {
+			return strings.Join(lines[start:i], "\n"), true
+		}
+		text := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if start < 0 && string(ids.Generate([]byte(text), 0)) == id {
+			start, level = i, l
+		}
+	}
+	if start < 0 {
+		return "", false
+	}
+	return strings.Join(lines[start:], "\n"), true
+}
+
+// ExpandTransclusions replaces ![[note-slug#heading]] embeds with the
+// referenced section, quoted and followed by a link back to its source, and
+// turns [[note-slug]] wiki-links into ordinary markdown links. Missing
+// targets and cycles are left as a short notice.
+func ExpandTransclusions(db *sql.DB, note *Note) string {
+	markdown := expandTransclusions(db, note.Markdown, map[int]bool{note.ID: true}, 0)
+	return expandWikiLinks(db, markdown)
+}
+
+// expandWikiLinks rewrites [[note-slug#heading|label]] as a markdown link to
+// the note's current slug. Embeds are expected to have been expanded already.
+func expandWikiLinks(db *sql.DB, markdown string) string {
+	return linkPattern.ReplaceAllStringFunc(markdown, func(ref string) string {
+		m := linkPattern.FindStringSubmatch(ref)
+		targetID, err := ParseNoteSlug(strings.TrimSpace(m[2]))
+		if m[1] == "!" || err != nil {
+			return ref
+		}
+		target, err := GetNoteByID(db, targetID)
+		if err != nil {
+			return ref
+		}
+
+		label := strings.TrimSpace(m[4])
+		if label == "" {
+			label = NoteTitle(target)
+		}
+		href := "/n/" + NoteSlug(target)
+		if fragment := strings.TrimSpace(m[3]); fragment != "" {
+			href += "#" + fragment
+		}
+		return "[" + label + "](" + href + ")"
+	})
+}
+
+func expandTransclusions(db *sql.DB, markdown string, visiting map[int]bool, depth int) string {
+	return embedPattern.ReplaceAllStringFunc(markdown, func(embed string) string {
+		m := embedPattern.FindStringSubmatch(embed)
+		targetID, err := ParseNoteSlug(strings.TrimSpace(m[1]))
+		if err != nil {
+			return embed
+		}
+		fragment := strings.TrimSpace(m[2])
+
+		if depth >= maxTransclusionDepth || visiting[targetID] {
+			return fmt.Sprintf("\n\n> *Embed of note %d skipped (circular or nested too deeply)*\n\n", targetID)
+		}
+		target, err := GetNoteByID(db, targetID)
+		if err != nil {
+			return fmt.Sprintf("\n\n> *Embedded note %d not found*\n\n", targetID)
+		}
+		section, ok := ExtractSection(target.Markdown, fragment)
+		if !ok {
+			return fmt.Sprintf("\n\n> *Section %q not found in note %d*\n\n", fragment, targetID)
+		}
+
+		visiting[targetID] = true
+		section = expandTransclusions(db, section, visiting, depth+1)
+		delete(visiting, targetID)
+
+		href := "/n/" + NoteSlug(target)
+		if fragment != "" {
+			href += "#" + fragment
+		}
+
+		// Blank lines around the quote keep neighbouring text out of it
+		var b strings.Builder
+		b.WriteString("\n\n")
+		for _, line := range strings.Split(strings.TrimRight(section, "\n"), "\n") {
+			b.WriteString("> " + line + "\n")
+		}
+		b.WriteString(">\n> [↩ " + NoteTitle(target) + "](" + href + ")\n\n")
+		return b.String()
+	})
+}
+
+// GraphNode is a note in the link graph
+type GraphNode struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// GraphEdge is a link between two notes in the graph
+type GraphEdge struct {
+	Source int    `json:"source"`
+	Target int    `json:"target"`
+	Kind   string `json:"kind"`
+}
+
+// Graph is the note link graph served to the graph view
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphData builds the graph of all notes and the links between them.
+// Links to notes that no longer exist are left out.
+func GraphData(db *sql.DB) (*Graph, error) {
+	notes, err := GetAllNotes(db)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	exists := make(map[int]bool, len(notes))
+	for i := range notes {
+		note := &notes[i]
+		exists[note.ID] = true
+		graph.Nodes = append(graph.Nodes, GraphNode{
+			ID:    note.ID,
+			Title: NoteTitle(note),
+			URL:   "/n/" + NoteSlug(note),
+		})
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT source_id, target_id, kind FROM note_links ORDER BY source_id, target_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query links: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var edge GraphEdge
+		if err := rows.Scan(&edge.Source, &edge.Target, &edge.Kind); err != nil {
+			return nil, fmt.Errorf("failed to scan link: %w", err)
+		}
+		if exists[edge.Source] && exists[edge.Target] {
+			graph.Edges = append(graph.Edges, edge)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating links: %w", err)
+	}
+
+	return graph, nil
+}
+
+// StubWordCount is the word count below which a note is reported as a stub
+const StubWordCount = 30
+
+// Reasons a note shows up in the tidy-up report
+const (
+	ReasonOrphan = "orphan"
+	ReasonStub   = "stub"
+	ReasonReview = "review"
+)
+
+// ReportEntry is a note that needs attention, with the reasons why
+type ReportEntry struct {
+	Note    Note     `json:"note"`
+	Reasons []string `json:"reasons"`
+}
+
+// TidyReport lists notes with no links in or out (orphans), notes with
+// very little content (stubs) and transcriptions marked for review, newest
+// first
+func TidyReport(db *sql.DB) ([]ReportEntry, error) {
+	notes, err := GetAllNotes(db)
+	if err != nil {
+		return nil, err
+	}
+
+	linked := map[int]bool{}
+	rows, err := db.Query(`SELECT source_id, target_id FROM note_links WHERE source_id IN (SELECT id FROM notes WHERE deleted_at IS NULL)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query links: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var source, target int
+		if err := rows.Scan(&source, &target); err != nil {
+			return nil, fmt.Errorf("failed to scan link: %w", err)
+		}
+		linked[source] = true
+		linked[target] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating links: %w", err)
+	}
+
+	var report []ReportEntry
+	for _, note := range notes {
+		var reasons []string
+		if !linked[note.ID] {
+			reasons = append(reasons, ReasonOrphan)
+		}
+		if note.WordCount < StubWordCount {
+			reasons = append(reasons, ReasonStub)
+		}
+		if note.Review != "" {
+			reasons = append(reasons, ReasonReview)
+		}
+		if len(reasons) > 0 {
+			report = append(report, ReportEntry{Note: note, Reasons: reasons})
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,63 @@
+package funcs
+
+import (
+	"context"
+	"log/slog"
+)
+
+// logAttrsKey holds the attributes WithLogAttrs adds to a context
+type logAttrsKey struct{}
+
+// WithLogAttrs adds attributes, as key and value pairs like slog.Info
+// takes, to every line logged with the context, such as the ID of the
+// request or job it belongs to
+func WithLogAttrs(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	record := slog.Record{}
+	record.Add(args...)
+	added := make([]slog.Attr, 0, len(attrs)+record.NumAttrs())
+	added = append(added, attrs...)
+	record.Attrs(func(a slog.Attr) bool {
+		added = append(added, a)
+		return true
+	})
+	return context.WithValue(ctx, logAttrsKey{}, added)
+}
+
+// LogAttr returns the value of an attribute WithLogAttrs added to ctx
+func LogAttr(ctx context.Context, key string) (slog.Value, bool) {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	for i := len(attrs) - 1; i >= 0; i-- {
+		if attrs[i].Key == key {
+			return attrs[i].Value, true
+		}
+	}
+	return slog.Value{}, false
+}
+
+// ContextHandler logs the attributes WithLogAttrs added to the context of
+// each record ahead of the record's own
+type ContextHandler struct {
+	slog.Handler
+}
+
+func (h ContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr); len(attrs) > 0 {
+		withContext := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+		withContext.AddAttrs(attrs...)
+		r.Attrs(func(a slog.Attr) bool {
+			withContext.AddAttrs(a)
+			return true
+		})
+		r = withContext
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ContextHandler) WithGroup(name string) slog.Handler {
+	return ContextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,37 @@
+package funcs
+
+import "fmt"
+
+// Limits of the low-power profile, for a Raspberry Pi or similar board
+// with 512 MB to 1 GB of memory. A 24 megapixel JPEG decodes to about 36 MB.
+const (
+	lowPowerMaxPixels   = 24_000_000
+	lowPowerDisplayEdge = 1200
+	lowPowerAIEdge      = 1600
+	lowPowerCacheKiB    = 2048
+	lowPowerMmapBytes   = 256 << 20
+)
+
+// dbPragmas are set on every database connection InitDB opens. Waiting for
+// a lock rather than failing at once lets a background job write while a
+// request does, and the write-ahead log lets requests read while either
+// writes. New databases allow incremental vacuums, which RunMaintenance
+// turns on for older ones.
+var dbPragmas = []string{"busy_timeout(5000)", "journal_mode(WAL)", "auto_vacuum(incremental)"}
+
+// UseLowPower sets up image handling and the database for constrained
+// devices: images over 24 megapixels are not decoded, the display and AI
+// variants are made smaller, and SQLite keeps a small page cache, reading
+// the file through mmap so the kernel can reclaim the memory. Call it
+// before InitDB.
+func UseLowPower() {
+	MaxDecodePixels = lowPowerMaxPixels
+	display, ai := ImageVariants[VariantDisplay], ImageVariants[VariantAI]
+	display.Edge, ai.Edge = lowPowerDisplayEdge, lowPowerAIEdge
+	ImageVariants[VariantDisplay], ImageVariants[VariantAI] = display, ai
+	dbPragmas = append(dbPragmas,
+		fmt.Sprintf("cache_size(-%d)", lowPowerCacheKiB),
+		fmt.Sprintf("mmap_size(%d)", lowPowerMmapBytes),
+		"temp_store(file)",
+	)
+}
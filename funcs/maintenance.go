@@ -0,0 +1,263 @@
+package funcs
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MaintenanceReport is the outcome of a maintenance run. FullVacuum is set
+// when the database had to be rewritten to allow incremental vacuums, which
+// happens once for databases created before them.
+type MaintenanceReport struct {
+	DateRun    time.Time `json:"date_run"`
+	DurationMS int64     `json:"duration_ms"`
+	BytesFreed int64     `json:"bytes_freed"`
+	FullVacuum bool      `json:"full_vacuum"`
+}
+
+// TableStorage is the space a table takes with its indexes
+type TableStorage struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// NotebookStorage is the space the notes of a notebook take, notebook 0
+// holding those in none. ImageBytes counts each note's image with its
+// variants.
+type NotebookStorage struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Notes      int    `json:"notes"`
+	TextBytes  int64  `json:"text_bytes"`
+	ImageBytes int64  `json:"image_bytes"`
+}
+
+// StorageReport breaks down the space the library takes, the largest table
+// and notebook first. FreeBytes are pages of the database that maintenance
+// can return to the file system. ImagesBytes is filled in by the caller,
+// which knows where the images are kept.
+type StorageReport struct {
+	DatabaseBytes   int64              `json:"database_bytes"`
+	FreeBytes       int64              `json:"free_bytes"`
+	ImagesBytes     int64              `json:"images_bytes"`
+	Tables          []TableStorage     `json:"tables"`
+	Notebooks       []NotebookStorage  `json:"notebooks"`
+	LastMaintenance *MaintenanceReport `json:"last_maintenance"`
+}
+
+// maintenanceKey is the settings key the last maintenance run is kept under
+const maintenanceKey = "maintenance.last"
+
+// maintenanceMu keeps a scheduled run and one asked for from overlapping
+var maintenanceMu sync.Mutex
+
+// RunMaintenance returns the database's free pages to the file system with
+// an incremental vacuum and refreshes the query planner's statistics with
+// ANALYZE. A database created without incremental vacuums is vacuumed in
+// full once to turn them on, which rewrites the whole file.
+func RunMaintenance(db *sql.DB) (*MaintenanceReport, error) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+
+	// The auto_vacuum pragma only takes effect in a VACUUM on the same connection
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve a connection: %w", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	report := &MaintenanceReport{DateRun: start.UTC()}
+	before, err := pageBytes(conn, "page_count")
+	if err != nil {
+		return nil, err
+	}
+
+	var mode int
+	if err := conn.QueryRowContext(context.Background(), `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return nil, fmt.Errorf("failed to read auto_vacuum: %w", err)
+	}
+	// 2 is incremental
+	if mode != 2 {
+		report.FullVacuum = true
+		if _, err := conn.ExecContext(context.Background(), `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+			return nil, fmt.Errorf("failed to set auto_vacuum: %w", err)
+		}
+		if _, err := conn.ExecContext(context.Background(), `VACUUM`); err != nil {
+			return nil, fmt.Errorf("failed to vacuum database: %w", err)
+		}
+	} else if err := incrementalVacuum(conn); err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(context.Background(), `ANALYZE`); err != nil {
+		return nil, fmt.Errorf("failed to analyze database: %w", err)
+	}
+
+	after, err := pageBytes(conn, "page_count")
+	if err != nil {
+		return nil, err
+	}
+	report.BytesFreed = max(before-after, 0)
+	report.DurationMS = time.Since(start).Milliseconds()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode maintenance report: %w", err)
+	}
+	_, err = conn.ExecContext(context.Background(), `INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, maintenanceKey, string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to save maintenance report: %w", err)
+	}
+	return report, nil
+}
+
+// incrementalVacuum frees every free page of the database. The pragma
+// frees one page each time it is stepped, so its rows are read to the end.
+func incrementalVacuum(conn *sql.Conn) error {
+	rows, err := conn.QueryContext(context.Background(), `PRAGMA incremental_vacuum`)
+	if err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	return nil
+}
+
+// pageBytes reads a page count pragma of the database in bytes
+func pageBytes(conn *sql.Conn, pragma string) (int64, error) {
+	var pages, size int64
+	if err := conn.QueryRowContext(context.Background(), `PRAGMA `+pragma).Scan(&pages); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", pragma, err)
+	}
+	if err := conn.QueryRowContext(context.Background(), `PRAGMA page_size`).Scan(&size); err != nil {
+		return 0, fmt.Errorf("failed to read page_size: %w", err)
+	}
+	return pages * size, nil
+}
+
+// GetLastMaintenance returns the last maintenance run, or nil before the first
+func GetLastMaintenance(db *sql.DB) (*MaintenanceReport, error) {
+	var value string
+	err := db.QueryRow(`SELECT value FROM settings WHERE key = ?`, maintenanceKey).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load maintenance report: %w", err)
+	}
+	var report MaintenanceReport
+	if err := json.Unmarshal([]byte(value), &report); err != nil {
+		return nil, fmt.Errorf("failed to decode maintenance report: %w", err)
+	}
+	return &report, nil
+}
+
+// GetStorage reports the space the database and each notebook's notes take.
+// fileSize gives the size of a stored image file by name, 0 when it is
+// missing.
+func GetStorage(db *sql.DB, fileSize func(name string) int64) (*StorageReport, error) {
+	report := &StorageReport{Tables: []TableStorage{}, Notebooks: []NotebookStorage{}}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve a connection: %w", err)
+	}
+	if report.DatabaseBytes, err = pageBytes(conn, "page_count"); err == nil {
+		report.FreeBytes, err = pageBytes(conn, "freelist_count")
+	}
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT COALESCE(m.tbl_name, s.name), SUM(s.pgsize) FROM dbstat s
+		LEFT JOIN sqlite_schema m ON m.name = s.name GROUP BY 1 ORDER BY 2 DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query table sizes: %w", err)
+	}
+	for rows.Next() {
+		var table TableStorage
+		if err := rows.Scan(&table.Name, &table.Bytes); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan table size: %w", err)
+		}
+		report.Tables = append(report.Tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating table sizes: %w", err)
+	}
+
+	rows, err = db.Query(`SELECT n.notebook_id, COALESCE(b.name, ''), n.image, length(CAST(n.markdown AS BLOB))
+		FROM notes n LEFT JOIN notebooks b ON b.id = n.notebook_id WHERE n.deleted_at IS NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notebook sizes: %w", err)
+	}
+	defer rows.Close()
+	byID := map[int]*NotebookStorage{}
+	var order []int
+	for rows.Next() {
+		var id int
+		var name, image string
+		var text int64
+		if err := rows.Scan(&id, &name, &image, &text); err != nil {
+			return nil, fmt.Errorf("failed to scan note size: %w", err)
+		}
+		notebook, ok := byID[id]
+		if !ok {
+			notebook = &NotebookStorage{ID: id, Name: name}
+			byID[id] = notebook
+			order = append(order, id)
+		}
+		notebook.Notes++
+		notebook.TextBytes += text
+		notebook.ImageBytes += fileSize(image)
+		for _, variant := range variantNames(image) {
+			if variant != image {
+				notebook.ImageBytes += fileSize(variant)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating note sizes: %w", err)
+	}
+	for _, id := range order {
+		report.Notebooks = append(report.Notebooks, *byID[id])
+	}
+	slices.SortStableFunc(report.Notebooks, func(a, b NotebookStorage) int {
+		return cmp.Compare(b.TextBytes+b.ImageBytes, a.TextBytes+a.ImageBytes)
+	})
+
+	report.LastMaintenance, err = GetLastMaintenance(db)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// FormatBytes writes a size in B, KB, MB or GB
+func FormatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, suffix := float64(n)/unit, "KB"
+	for _, next := range []string{"MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
@@ -0,0 +1,278 @@
+package funcs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MatrixBot transcribes images posted to the Matrix rooms it has joined and
+// replies to each with the markdown. It accepts room invites automatically.
+type MatrixBot struct {
+	Homeserver  string
+	AccessToken string
+	DB          *sql.DB
+	AI          *Transcriber
+	// SaveImage stores a posted image the way uploads are stored, returning
+	// its name, and ImagePath is the file the AI reads a stored image from
+	SaveImage func(name string, r io.Reader) (string, error)
+	ImagePath func(name string) string
+	HTTP      *http.Client
+
+	userID string
+	txn    atomic.Int64
+}
+
+// matrixSync is the subset of a /sync response the bot reads
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// matrixEvent is a room timeline event
+type matrixEvent struct {
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+		URL     string `json:"url"`
+		Info    struct {
+			MimeType string `json:"mimetype"`
+		} `json:"info"`
+	} `json:"content"`
+}
+
+// Run syncs with the homeserver until ctx is cancelled. Messages already in
+// the rooms when the bot starts are skipped. An image being transcribed when
+// ctx ends is finished before Run returns.
+func (b *MatrixBot) Run(ctx context.Context) error {
+	if b.HTTP == nil {
+		b.HTTP = &http.Client{Timeout: 90 * time.Second}
+	}
+	b.Homeserver = strings.TrimRight(b.Homeserver, "/")
+
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := b.call(ctx, http.MethodGet, "/_matrix/client/v3/account/whoami", nil, &whoami); err != nil {
+		return fmt.Errorf("matrix login check failed: %w", err)
+	}
+	b.userID = whoami.UserID
+	slog.Info("matrix bot running", "user", b.userID)
+
+	// The initial sync only establishes where to start from
+	var initial matrixSync
+	if err := b.call(ctx, http.MethodGet, "/_matrix/client/v3/sync?timeout=0", nil, &initial); err != nil {
+		return fmt.Errorf("matrix initial sync failed: %w", err)
+	}
+	since := initial.NextBatch
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var resp matrixSync
+		path := "/_matrix/client/v3/sync?timeout=30000&since=" + url.QueryEscape(since)
+		if err := b.call(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			slog.Error("matrix sync failed", "err", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		since = resp.NextBatch
+
+		for roomID := range resp.Rooms.Invite {
+			if err := b.call(ctx, http.MethodPost, "/_matrix/client/v3/join/"+url.PathEscape(roomID), struct{}{}, nil); err != nil {
+				slog.Error("matrix join failed", "room", roomID, "err", err)
+			}
+		}
+
+		for roomID, room := range resp.Rooms.Join {
+			for _, event := range room.Timeline.Events {
+				if event.Type != "m.room.message" || event.Content.MsgType != "m.image" || event.Sender == b.userID {
+					continue
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				work := context.WithoutCancel(ctx)
+				if err := b.handleImage(work, roomID, event); err != nil {
+					slog.Error("matrix image failed", "event", event.EventID, "err", err)
+					b.reply(work, roomID, event.EventID, "Sorry, I couldn't transcribe that image.", "")
+				}
+			}
+		}
+	}
+}
+
+// handleImage downloads, transcribes and stores one image event, then
+// replies with the markdown
+func (b *MatrixBot) handleImage(ctx context.Context, roomID string, event matrixEvent) error {
+	data, err := b.download(ctx, event.Content.URL)
+	if err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(event.Content.Body)
+	if ext == "" {
+		if exts, _ := mime.ExtensionsByType(event.Content.Info.MimeType); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	filename, err := b.SaveImage("matrix"+ext, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to save image: %w", err)
+	}
+	// An image already made into a note is answered with that note
+	existing, err := existingNote(b.DB, filename)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return b.replyMarkdown(ctx, roomID, event.EventID, existing.Markdown)
+	}
+
+	transcription, err := b.AI.TranscribeImage(ctx, b.ImagePath(filename))
+	if err != nil {
+		return err
+	}
+
+	markdown := transcription.Markdown
+	note, err := AddNote(b.DB, filename, markdown)
+	if err != nil {
+		return err
+	}
+	if err := SetNoteCapture(b.DB, note.ID, transcription); err != nil {
+		return err
+	}
+	for key, value := range map[string]string{
+		"matrix_room_id":  roomID,
+		"matrix_event_id": event.EventID,
+		"matrix_sender":   event.Sender,
+	} {
+		if err := SetProperty(b.DB, note.ID, key, value); err != nil {
+			return err
+		}
+	}
+
+	return b.replyMarkdown(ctx, roomID, event.EventID, markdown)
+}
+
+// replyMarkdown replies to an event with markdown, rendered for clients
+// that show HTML
+func (b *MatrixBot) replyMarkdown(ctx context.Context, roomID, eventID, markdown string) error {
+	html, _, err := RenderMarkdown(markdown)
+	if err != nil {
+		html = ""
+	}
+	return b.reply(ctx, roomID, eventID, markdown, html)
+}
+
+// download fetches an mxc:// content URI through the authenticated media API
+func (b *MatrixBot) download(ctx context.Context, mxc string) ([]byte, error) {
+	serverAndID, ok := strings.CutPrefix(mxc, "mxc://")
+	if !ok {
+		return nil, fmt.Errorf("unsupported content uri %q", mxc)
+	}
+	server, mediaID, ok := strings.Cut(serverAndID, "/")
+	if !ok {
+		return nil, fmt.Errorf("malformed content uri %q", mxc)
+	}
+
+	path := "/_matrix/client/v1/media/download/" + url.PathEscape(server) + "/" + url.PathEscape(mediaID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.Homeserver+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.AccessToken)
+
+	resp, err := b.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download media: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("media download returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+}
+
+// reply sends a message in response to an event. html may be empty.
+func (b *MatrixBot) reply(ctx context.Context, roomID, eventID, body, html string) error {
+	content := map[string]any{
+		"msgtype": "m.text",
+		"body":    body,
+		"m.relates_to": map[string]any{
+			"m.in_reply_to": map[string]string{"event_id": eventID},
+		},
+	}
+	if html != "" {
+		content["format"] = "org.matrix.custom.html"
+		content["formatted_body"] = html
+	}
+
+	txnID := fmt.Sprintf("bookmd-%d-%d", time.Now().UnixNano(), b.txn.Add(1))
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + txnID
+	return b.call(ctx, http.MethodPut, path, content, nil)
+}
+
+// call performs an authenticated client-server API request, encoding body
+// and decoding the response into out when they are non-nil
+func (b *MatrixBot) call(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.Homeserver+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.AccessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := b.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
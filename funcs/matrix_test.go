@@ -0,0 +1,92 @@
+package funcs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// transcribeAs answers every transcription with markdown
+type transcribeAs string
+
+func (m transcribeAs) Complete(ctx context.Context, req VisionRequest) (string, error) {
+	data, err := json.Marshal(Transcription{Title: "Page", Markdown: string(m)})
+	return string(data), err
+}
+
+func TestMatrixImagePostedTwiceDedups(t *testing.T) {
+	s := newTestStore(t)
+	page := []byte("\x89PNG\r\n\x1a\nthe same page")
+
+	var mu sync.Mutex
+	var replies []string
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v1/media/download/"):
+			w.Write(page)
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			var content struct {
+				Body string `json:"body"`
+			}
+			json.NewDecoder(r.Body).Decode(&content)
+			mu.Lock()
+			replies = append(replies, content.Body)
+			mu.Unlock()
+			io.WriteString(w, `{"event_id": "$reply"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer homeserver.Close()
+
+	dir := t.TempDir()
+	ai := NewTranscriber(DefaultAISettings())
+	ai.UseClient(transcribeAs("# The page\n"))
+	b := &MatrixBot{
+		Homeserver: homeserver.URL,
+		DB:         s.DB,
+		AI:         ai,
+		SaveImage: func(name string, r io.Reader) (string, error) {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return "", err
+			}
+			filename := ImageName(data, filepath.Ext(name))
+			return filename, os.WriteFile(filepath.Join(dir, filename), data, 0o644)
+		},
+		ImagePath: func(name string) string { return filepath.Join(dir, name) },
+		HTTP:      homeserver.Client(),
+	}
+
+	for _, id := range []string{"$first", "$second"} {
+		var event matrixEvent
+		event.EventID = id
+		event.Content.MsgType = "m.image"
+		event.Content.Body = "page.png"
+		event.Content.URL = "mxc://example.org/media"
+		if err := b.handleImage(context.Background(), "!room:example.org", event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := s.CountNotes(context.Background()); err != nil || n != 1 {
+		t.Errorf("CountNotes = %d, %v, want one note for the page posted twice", n, err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != ImageName(page, ".png") {
+		t.Errorf("stored %v, want the page once under its hash", files)
+	}
+	if len(replies) != 2 || replies[0] != "# The page\n" || replies[1] != replies[0] {
+		t.Errorf("replies = %q, want the note's markdown twice", replies)
+	}
+}
@@ -0,0 +1,382 @@
+package funcs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters, the same as FTS5's
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// MemoryIndex is an inverted index of note titles and markdown held in
+// memory, for fast searches on slow disks. It ranks like the FTS5 index,
+// and follows the note_changes log to stay up to date; see Sync.
+type MemoryIndex struct {
+	// syncMu lets one Sync at a time move cursor, the last change indexed
+	syncMu sync.Mutex
+	cursor int64
+	mu     sync.RWMutex
+	// postings holds the positions of each term in each note. Title tokens
+	// come first, then a gap, then the markdown's, so that a phrase never
+	// runs from one into the other.
+	postings    map[string]map[int][]int32
+	docs        map[int]indexedDoc
+	titleTokens int
+	bodyTokens  int
+}
+
+// indexedDoc is what the index needs to know of a note to score or remove it
+type indexedDoc struct {
+	titleLen int
+	bodyLen  int
+	terms    []string
+}
+
+// MemoryIndexStats describes the size of the index. Bytes is an estimate
+// of the memory its terms and postings take.
+type MemoryIndexStats struct {
+	Notes    int `json:"notes"`
+	Terms    int `json:"terms"`
+	Postings int `json:"postings"`
+	Bytes    int `json:"bytes"`
+}
+
+// NewMemoryIndex indexes every note in db, including those in the trash,
+// which searches filter out
+func NewMemoryIndex(db *sql.DB) (*MemoryIndex, error) {
+	x := &MemoryIndex{postings: map[string]map[int][]int32{}, docs: map[int]indexedDoc{}}
+	// The cursor is read first, so that notes changed while they are read
+	// are indexed again by the next Sync
+	if err := db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM note_changes`).Scan(&x.cursor); err != nil {
+		return nil, fmt.Errorf("failed to read change cursor: %w", err)
+	}
+	rows, err := db.Query(`SELECT id, title, markdown FROM notes`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes to index: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var title, markdown string
+		if err := rows.Scan(&id, &title, &markdown); err != nil {
+			return nil, fmt.Errorf("failed to scan note to index: %w", err)
+		}
+		x.Set(id, title, markdown)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notes to index: %w", err)
+	}
+	return x, nil
+}
+
+// foldRune lowercases r and drops the accent of common Latin letters, as
+// FTS5's remove_diacritics does
+func foldRune(r rune) rune {
+	r = unicode.ToLower(r)
+	if i := strings.IndexRune(accented, r); i >= 0 {
+		return rune(unaccented[len([]rune(accented[:i]))])
+	}
+	return r
+}
+
+// accented and unaccented pair each accented letter with its base letter
+const (
+	accented   = "àáâãäåāăąçćčďèéêëēęěìíîïīłñńňòóôõöøōŕřśšťùúûüūůýÿźżž"
+	unaccented = "aaaaaaaaacccdeeeeeeeiiiiilnnnooooooorrsstuuuuuuyyzzz"
+)
+
+// searchTokens splits text into lowercase words without accents, the way
+// the FTS5 tokenizer does
+func searchTokens(text string) []string {
+	var tokens []string
+	var token strings.Builder
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+			if !unicode.Is(unicode.Mn, r) {
+				token.WriteRune(foldRune(r))
+			}
+			continue
+		}
+		if token.Len() > 0 {
+			tokens = append(tokens, token.String())
+			token.Reset()
+		}
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+// Set indexes a note, replacing what was indexed for it before
+func (x *MemoryIndex) Set(id int, title, markdown string) {
+	titleTokens, bodyTokens := searchTokens(title), searchTokens(markdown)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+
+	doc := indexedDoc{titleLen: len(titleTokens), bodyLen: len(bodyTokens)}
+	add := func(term string, pos int32) {
+		notes := x.postings[term]
+		if notes == nil {
+			notes = map[int][]int32{}
+			x.postings[term] = notes
+		}
+		if notes[id] == nil {
+			doc.terms = append(doc.terms, term)
+		}
+		notes[id] = append(notes[id], pos)
+	}
+	for i, term := range titleTokens {
+		add(term, int32(i))
+	}
+	for i, term := range bodyTokens {
+		add(term, int32(doc.titleLen+1+i))
+	}
+	x.docs[id] = doc
+	x.titleTokens += doc.titleLen
+	x.bodyTokens += doc.bodyLen
+}
+
+// Remove drops a note from the index
+func (x *MemoryIndex) Remove(id int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+}
+
+func (x *MemoryIndex) remove(id int) {
+	doc, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(x.postings[term], id)
+		if len(x.postings[term]) == 0 {
+			delete(x.postings, term)
+		}
+	}
+	x.titleTokens -= doc.titleLen
+	x.bodyTokens -= doc.bodyLen
+	delete(x.docs, id)
+}
+
+// phraseCounts counts, for each note containing every token of phrase in
+// order, how often it appears in the title and in the markdown
+func (x *MemoryIndex) phraseCounts(phrase []string) map[int][2]int {
+	counts := map[int][2]int{}
+	for id, starts := range x.postings[phrase[0]] {
+		var c [2]int
+	start:
+		for _, pos := range starts {
+			for k, term := range phrase[1:] {
+				if !containsPos(x.postings[term][id], pos+int32(k+1)) {
+					continue start
+				}
+			}
+			if int(pos) < x.docs[id].titleLen {
+				c[0]++
+			} else {
+				c[1]++
+			}
+		}
+		if c[0]+c[1] > 0 {
+			counts[id] = c
+		}
+	}
+	return counts
+}
+
+// containsPos reports whether the sorted positions include pos
+func containsPos(positions []int32, pos int32) bool {
+	lo, hi := 0, len(positions)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		switch {
+		case positions[mid] == pos:
+			return true
+		case positions[mid] < pos:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return false
+}
+
+// Match scores the notes containing every phrase with BM25, weighting
+// titles by titleWeight as the FTS5 search does. Scores are positive and
+// higher is better.
+func (x *MemoryIndex) Match(phrases [][]string) map[int]float64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	n := float64(len(x.docs))
+	if n == 0 {
+		return map[int]float64{}
+	}
+	avgTitle := math.Max(float64(x.titleTokens)/n, 1)
+	avgBody := math.Max(float64(x.bodyTokens)/n, 1)
+
+	var scores map[int]float64
+	for _, phrase := range phrases {
+		if len(phrase) == 0 {
+			continue
+		}
+		counts := x.phraseCounts(phrase)
+		matched := float64(len(counts))
+		// FTS5 floors the IDF of terms in most notes just above zero
+		idf := math.Max(math.Log((n-matched+0.5)/(matched+0.5)), 1e-6)
+
+		next := map[int]float64{}
+		for id, c := range counts {
+			if scores != nil {
+				if _, ok := scores[id]; !ok {
+					continue
+				}
+			}
+			doc := x.docs[id]
+			score := titleWeight*idf*bm25Term(c[0], doc.titleLen, avgTitle) +
+				idf*bm25Term(c[1], doc.bodyLen, avgBody)
+			next[id] = scores[id] + score
+		}
+		scores = next
+	}
+	if scores == nil {
+		scores = map[int]float64{}
+	}
+	return scores
+}
+
+// bm25Term is the BM25 weight of a phrase appearing tf times in a column
+// of length tokens, where columns average avg tokens
+func bm25Term(tf, length int, avg float64) float64 {
+	f := float64(tf)
+	return f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*float64(length)/avg))
+}
+
+// Stats reports the size of the index
+func (x *MemoryIndex) Stats() MemoryIndexStats {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	stats := MemoryIndexStats{Notes: len(x.docs), Terms: len(x.postings)}
+	// Rough sizes of a map entry, a slice header and a position
+	const entry, slice, position = 16, 24, 4
+	for term, notes := range x.postings {
+		stats.Bytes += len(term) + entry
+		for _, positions := range notes {
+			stats.Postings++
+			stats.Bytes += entry + slice + position*cap(positions)
+		}
+	}
+	for _, doc := range x.docs {
+		stats.Bytes += entry + slice + entry*len(doc.terms)
+	}
+	return stats
+}
+
+// searchPhrases splits the query's words and phrases into tokens
+func (q SearchQuery) searchPhrases() [][]string {
+	phrases := [][]string{}
+	for _, s := range append(append([]string{}, q.Terms...), q.Phrases...) {
+		if tokens := searchTokens(s); len(tokens) > 0 {
+			phrases = append(phrases, tokens)
+		}
+	}
+	return phrases
+}
+
+// memoryMatches is the matches part of a search answered by the index: the
+// scored notes as JSON for json_each, with the starting relevance of 1 the
+// FTS5 search gives
+func memoryMatches(index *MemoryIndex, q SearchQuery) string {
+	relevance := map[string]float64{}
+	for id, score := range index.Match(q.searchPhrases()) {
+		relevance[strconv.Itoa(id)] = 1 + score
+	}
+	data, _ := json.Marshal(relevance)
+	return string(data)
+}
+
+// memorySnippet is the stretch of markdown around the first word of the
+// query, or its start when only the title matched, for results found by
+// the index
+func memorySnippet(markdown string, q SearchQuery) string {
+	wanted := map[string]bool{}
+	for _, phrase := range q.searchPhrases() {
+		wanted[phrase[0]] = true
+	}
+	words := strings.Fields(markdown)
+	for i, word := range words {
+		for _, token := range searchTokens(word) {
+			if !wanted[token] {
+				continue
+			}
+			start := max(0, i-snippetTokens/2)
+			end := min(len(words), start+snippetTokens)
+			snippet := strings.Join(words[start:end], " ")
+			if start > 0 {
+				snippet = "…" + snippet
+			}
+			if end < len(words) {
+				snippet += "…"
+			}
+			return snippet
+		}
+	}
+	snippet := strings.Join(words[:min(len(words), snippetTokens)], " ")
+	if len(words) > snippetTokens {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// Sync indexes again the notes changed in db since the last Sync, or since
+// the index was built, and drops those that no longer exist
+func (x *MemoryIndex) Sync(db *sql.DB) error {
+	x.syncMu.Lock()
+	defer x.syncMu.Unlock()
+
+	rows, err := db.Query(`SELECT seq, note_id FROM note_changes WHERE seq > ? ORDER BY seq`, x.cursor)
+	if err != nil {
+		return fmt.Errorf("failed to query changes to index: %w", err)
+	}
+	cursor := x.cursor
+	changed := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&cursor, &id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan change to index: %w", err)
+		}
+		changed[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating changes to index: %w", err)
+	}
+
+	for id := range changed {
+		var title, markdown string
+		err := db.QueryRow(`SELECT title, markdown FROM notes WHERE id = ?`, id).Scan(&title, &markdown)
+		switch {
+		case err == sql.ErrNoRows:
+			x.Remove(id)
+		case err != nil:
+			return fmt.Errorf("failed to read note to index: %w", err)
+		default:
+			x.Set(id, title, markdown)
+		}
+	}
+	x.cursor = cursor
+	return nil
+}
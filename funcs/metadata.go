@@ -0,0 +1,32 @@
+package funcs
+
+import (
+	"strings"
+	"unicode"
+)
+
+// WordsPerMinute is the reading speed used to estimate reading time
+const WordsPerMinute = 200
+
+// CountWords counts the words in a markdown document, ignoring tokens that
+// are pure markdown syntax such as "#", "-", "|" or "```"
+func CountWords(markdown string) int {
+	count := 0
+	for _, field := range strings.Fields(markdown) {
+		if strings.IndexFunc(field, func(r rune) bool {
+			return unicode.IsLetter(r) || unicode.IsDigit(r)
+		}) >= 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// ReadingTime estimates the minutes needed to read the given number of
+// words, rounding up so any non-empty note takes at least a minute
+func ReadingTime(words int) int {
+	if words <= 0 {
+		return 0
+	}
+	return (words + WordsPerMinute - 1) / WordsPerMinute
+}
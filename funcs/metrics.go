@@ -0,0 +1,186 @@
+package funcs
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics are counted as the server runs and written in the Prometheus
+// text format by WriteMetrics. Each is registered when it is made.
+var metrics struct {
+	sync.Mutex
+	all []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.all = append(metrics.all, m)
+}
+
+// labelSet writes label values as name="value" pairs, escaped as the text
+// format wants
+func labelSet(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs[i] = name + `="` + value + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// withLabels adds a label set to a sample's name
+func withLabels(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+// Counter is a total that only goes up, per set of label values
+type Counter struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+// NewCounter registers a counter with the names of its labels
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Add adds v to the total of the label values, given in the order of the
+// counter's labels
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := labelSet(c.labels, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+// Inc adds one to the total of the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range slices.Sorted(maps.Keys(c.values)) {
+		fmt.Fprintf(w, "%s %s\n", withLabels(c.name, key), formatSample(c.values[key]))
+	}
+}
+
+// Histogram counts observations, such as durations in seconds, into
+// buckets by their upper bounds, per set of label values
+type Histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with its bucket bounds, in increasing
+// order, and the names of its labels
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	register(h)
+	return h
+}
+
+// Observe counts v under the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := labelSet(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range slices.Sorted(maps.Keys(h.series)) {
+		s := h.series[key]
+		prefix := key
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatSample(bound), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		fmt.Fprintf(w, "%s %s\n", withLabels(h.name+"_sum", key), formatSample(s.sum))
+		fmt.Fprintf(w, "%s %d\n", withLabels(h.name+"_count", key), s.count)
+	}
+}
+
+// WriteGauge writes a gauge measured when the metrics are read, one sample
+// per set of label values
+func WriteGauge(w io.Writer, name, help string, samples map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, labels := range slices.Sorted(maps.Keys(samples)) {
+		fmt.Fprintf(w, "%s %s\n", withLabels(name, labels), formatSample(samples[labels]))
+	}
+}
+
+// MetricLabel writes one label for WriteGauge
+func MetricLabel(name, value string) string {
+	return labelSet([]string{name}, []string{value})
+}
+
+// WriteMetrics writes every counter and histogram
+func WriteMetrics(w io.Writer) {
+	metrics.Lock()
+	all := slices.Clone(metrics.all)
+	metrics.Unlock()
+	for _, m := range all {
+		m.write(w)
+	}
+}
+
+func formatSample(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
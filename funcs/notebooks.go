@@ -0,0 +1,279 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Notebook is a folder that groups notes, such as one per course.
+// Notebooks nest; a ParentID of 0 is the top level.
+type Notebook struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentID int    `json:"parent_id"`
+	// Locked puts the notebook on legal hold; see SetNotebookLocked
+	Locked      bool        `json:"locked"`
+	DateCreated time.Time   `json:"date_created"`
+	NoteCount   int         `json:"note_count"`
+	Children    []*Notebook `json:"children,omitempty"`
+}
+
+// CreateNotebook adds a notebook under parentID
+func CreateNotebook(db *sql.DB, name string, parentID int) (*Notebook, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("notebook name required")
+	}
+	if parentID != 0 {
+		if _, err := GetNotebook(db, parentID); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := db.Exec(`INSERT INTO notebooks (name, parent_id) VALUES (?, ?)`, name, parentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert notebook: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	return GetNotebook(db, int(id))
+}
+
+// GetNotebook retrieves a notebook by ID, without its children
+func GetNotebook(db *sql.DB, id int) (*Notebook, error) {
+	return getNotebook(db, id)
+}
+
+func getNotebook(q dbtx, id int) (*Notebook, error) {
+	var nb Notebook
+	err := q.QueryRow(`SELECT id, name, parent_id, locked, date_created,
+		(SELECT COUNT(*) FROM notes WHERE notebook_id = notebooks.id AND deleted_at IS NULL)
+		FROM notebooks WHERE id = ?`, id).
+		Scan(&nb.ID, &nb.Name, &nb.ParentID, &nb.Locked, &nb.DateCreated, &nb.NoteCount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no notebook found with id %d", id)
+		}
+		return nil, fmt.Errorf("failed to scan notebook: %w", err)
+	}
+	return &nb, nil
+}
+
+// GetNotebooks lists every notebook by name, without nesting them
+func GetNotebooks(db *sql.DB) ([]*Notebook, error) {
+	return queryNotebooks(db, `1`)
+}
+
+// GetChildNotebooks lists the notebooks directly under parentID by name
+func GetChildNotebooks(db *sql.DB, parentID int) ([]*Notebook, error) {
+	return queryNotebooks(db, `parent_id = ?`, parentID)
+}
+
+// queryNotebooks lists the notebooks matching where, by name
+func queryNotebooks(db *sql.DB, where string, args ...any) ([]*Notebook, error) {
+	rows, err := db.Query(`SELECT id, name, parent_id, locked, date_created,
+		(SELECT COUNT(*) FROM notes WHERE notebook_id = notebooks.id AND deleted_at IS NULL)
+		FROM notebooks WHERE `+where+` ORDER BY name COLLATE NOCASE, id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notebooks: %w", err)
+	}
+	defer rows.Close()
+
+	notebooks := []*Notebook{}
+	for rows.Next() {
+		var nb Notebook
+		if err := rows.Scan(&nb.ID, &nb.Name, &nb.ParentID, &nb.Locked, &nb.DateCreated, &nb.NoteCount); err != nil {
+			return nil, fmt.Errorf("failed to scan notebook: %w", err)
+		}
+		notebooks = append(notebooks, &nb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notebooks: %w", err)
+	}
+	return notebooks, nil
+}
+
+// NotebookTree returns the top-level notebooks with their children nested
+// under them. A notebook whose parent is missing is shown at the top level.
+func NotebookTree(db *sql.DB) ([]*Notebook, error) {
+	notebooks, err := GetNotebooks(db)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[int]*Notebook{}
+	for _, nb := range notebooks {
+		byID[nb.ID] = nb
+	}
+	roots := []*Notebook{}
+	for _, nb := range notebooks {
+		if parent, ok := byID[nb.ParentID]; ok {
+			parent.Children = append(parent.Children, nb)
+		} else {
+			roots = append(roots, nb)
+		}
+	}
+	return roots, nil
+}
+
+// UpdateNotebook renames a notebook and moves it under parentID. A notebook
+// cannot be moved into itself or one of its descendants.
+func UpdateNotebook(db *sql.DB, id int, name string, parentID int) (*Notebook, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("notebook name required")
+	}
+	if _, err := GetNotebook(db, id); err != nil {
+		return nil, err
+	}
+
+	// Walk up from the new parent; reaching id would create a cycle
+	for ancestor := parentID; ancestor != 0; {
+		if ancestor == id {
+			return nil, fmt.Errorf("a notebook cannot be moved into itself")
+		}
+		parent, err := GetNotebook(db, ancestor)
+		if err != nil {
+			return nil, err
+		}
+		ancestor = parent.ParentID
+	}
+
+	err := (&Store{DB: db}).inTx(context.Background(), func(q dbtx) error {
+		if err := checkNotebookUnlocked(q, id); err != nil {
+			return err
+		}
+		if _, err := q.Exec(`UPDATE notebooks SET name = ?, parent_id = ? WHERE id = ?`, name, parentID, id); err != nil {
+			return fmt.Errorf("failed to update notebook: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetNotebook(db, id)
+}
+
+// DeleteNotebook removes a notebook. Its notes and child notebooks move up
+// to its parent rather than being deleted, which a locked parent refuses
+// when there are notes to move.
+func DeleteNotebook(db *sql.DB, id int) error {
+	return (&Store{DB: db}).inTx(context.Background(), func(q dbtx) error {
+		nb, err := getNotebook(q, id)
+		if err != nil {
+			return err
+		}
+		if err := checkNotebookUnlocked(q, id); err != nil {
+			return err
+		}
+		if nb.NoteCount > 0 {
+			if err := checkNotebookUnlocked(q, nb.ParentID); err != nil {
+				return err
+			}
+		}
+
+		if _, err := q.Exec(`UPDATE notebooks SET parent_id = ? WHERE parent_id = ?`, nb.ParentID, id); err != nil {
+			return fmt.Errorf("failed to move child notebooks: %w", err)
+		}
+		if err := moveNotes(q, `notebook_id = ?`, []any{id}, nb.ParentID); err != nil {
+			return err
+		}
+		if _, err := q.Exec(`DELETE FROM notebooks WHERE id = ?`, id); err != nil {
+			return fmt.Errorf("failed to delete notebook: %w", err)
+		}
+		return nil
+	})
+}
+
+// MoveNotes puts notes into a notebook; a notebook ID of 0 takes them out of
+// any notebook. Each moved note gets a new revision so syncing clients see
+// the move. Notes cannot be moved into or out of a locked notebook.
+func MoveNotes(db *sql.DB, noteIDs []int, notebookID int) error {
+	if len(noteIDs) == 0 {
+		return fmt.Errorf("no notes to move")
+	}
+	return (&Store{DB: db}).inTx(context.Background(), func(q dbtx) error {
+		if notebookID != 0 {
+			if _, err := getNotebook(q, notebookID); err != nil {
+				return err
+			}
+			if err := checkNotebookUnlocked(q, notebookID); err != nil {
+				return err
+			}
+		}
+
+		args := make([]any, len(noteIDs))
+		for i, id := range noteIDs {
+			if _, err := getNote(q, id); err != nil {
+				return err
+			}
+			if err := checkNoteUnlocked(q, id); err != nil {
+				return err
+			}
+			args[i] = id
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(noteIDs)), ", ")
+		return moveNotes(q, `id IN (`+placeholders+`)`, args, notebookID)
+	})
+}
+
+// moveNotes sets the notebook of the notes matching where, bumping their
+// revisions and recording the changes
+func moveNotes(q dbtx, where string, args []any, notebookID int) error {
+	rows, err := q.Query(`UPDATE notes SET notebook_id = ?, revision = revision + 1
+		WHERE notebook_id != ? AND `+where+` RETURNING id, revision`,
+		append([]any{notebookID, notebookID}, args...)...)
+	if err != nil {
+		return fmt.Errorf("failed to move notes: %w", err)
+	}
+	type moved struct{ id, revision int }
+	var changes []moved
+	for rows.Next() {
+		var m moved
+		if err := rows.Scan(&m.id, &m.revision); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan moved note: %w", err)
+		}
+		changes = append(changes, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating moved notes: %w", err)
+	}
+
+	for _, m := range changes {
+		if err := recordChange(q, m.id, ChangeUpdated, m.revision); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetNotebookNotes lists the notes directly in a notebook, newest first.
+// A notebook ID of 0 lists the notes that are in no notebook.
+func GetNotebookNotes(db *sql.DB, notebookID int) ([]Note, error) {
+	rows, err := db.Query(`SELECT `+noteColumns+` FROM notes WHERE notebook_id = ? AND deleted_at IS NULL ORDER BY date_created DESC, id DESC`, notebookID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notebook notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes = append(notes, *note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notes: %w", err)
+	}
+	return notes, nil
+}
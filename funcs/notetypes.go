@@ -0,0 +1,253 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field kinds a note type can declare
+const (
+	FieldText    = "text"
+	FieldNumber  = "number"
+	FieldDate    = "date"
+	FieldBoolean = "boolean"
+)
+
+// TypeField is one field declared by a note type
+type TypeField struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Required bool   `json:"required"`
+}
+
+// NoteType is a named schema (Lecture, Meeting, Receipt) whose fields are
+// stored as note properties
+type NoteType struct {
+	Name   string      `json:"name"`
+	Fields []TypeField `json:"fields"`
+}
+
+// validate checks that a type's name and field declarations are usable
+func (t *NoteType) validate() error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return fmt.Errorf("note type name required")
+	}
+
+	seen := map[string]bool{}
+	for i := range t.Fields {
+		f := &t.Fields[i]
+		name, err := normalizePropertyKey(f.Name)
+		if err != nil {
+			return fmt.Errorf("field %d: %w", i+1, err)
+		}
+		f.Name = name
+		if seen[name] {
+			return fmt.Errorf("duplicate field %q", name)
+		}
+		seen[name] = true
+
+		switch f.Kind {
+		case "":
+			f.Kind = FieldText
+		case FieldText, FieldNumber, FieldDate, FieldBoolean:
+		default:
+			return fmt.Errorf("field %q has unknown kind %q", name, f.Kind)
+		}
+	}
+	return nil
+}
+
+// ValidateFields checks submitted field values against the type and returns
+// them normalized (numbers trimmed, booleans as "true"/"false", dates as
+// YYYY-MM-DD). Values for undeclared fields are rejected.
+func (t *NoteType) ValidateFields(values map[string]string) (map[string]string, error) {
+	declared := map[string]TypeField{}
+	for _, f := range t.Fields {
+		declared[f.Name] = f
+	}
+	for name := range values {
+		if _, ok := declared[name]; !ok {
+			return nil, fmt.Errorf("%s has no field %q", t.Name, name)
+		}
+	}
+
+	normalized := map[string]string{}
+	for _, f := range t.Fields {
+		value := strings.TrimSpace(values[f.Name])
+		if value == "" {
+			if f.Required {
+				return nil, fmt.Errorf("field %q is required", f.Name)
+			}
+			continue
+		}
+
+		switch f.Kind {
+		case FieldNumber:
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("field %q must be a number", f.Name)
+			}
+		case FieldDate:
+			d, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return nil, fmt.Errorf("field %q must be a date (YYYY-MM-DD)", f.Name)
+			}
+			value = d.Format("2006-01-02")
+		case FieldBoolean:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("field %q must be true or false", f.Name)
+			}
+			value = strconv.FormatBool(b)
+		}
+		normalized[f.Name] = value
+	}
+	return normalized, nil
+}
+
+// SaveNoteType creates or replaces a note type definition
+func SaveNoteType(db *sql.DB, t NoteType) (*NoteType, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	fields, err := json.Marshal(t.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode fields: %w", err)
+	}
+
+	query := `INSERT INTO note_types (name, fields) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET fields = excluded.fields`
+	if _, err := db.Exec(query, t.Name, string(fields)); err != nil {
+		return nil, fmt.Errorf("failed to save note type: %w", err)
+	}
+	return &t, nil
+}
+
+// DeleteNoteType removes a note type. Notes keep their stored field values
+// but no longer reference the type, which a note of it in a locked notebook
+// refuses.
+func DeleteNoteType(db *sql.DB, name string) error {
+	return (&Store{DB: db}).inTx(context.Background(), func(q dbtx) error {
+		if err := checkNotesUnlocked(q, `n.note_type = ?`, name); err != nil {
+			return err
+		}
+		result, err := q.Exec(`DELETE FROM note_types WHERE name = ?`, name)
+		if err != nil {
+			return fmt.Errorf("failed to delete note type: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return notFound("no note type named %q", name)
+		}
+
+		if _, err := q.Exec(`UPDATE notes SET note_type = '' WHERE note_type = ?`, name); err != nil {
+			return fmt.Errorf("failed to clear note type: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetNoteType retrieves a note type by name
+func GetNoteType(db *sql.DB, name string) (*NoteType, error) {
+	var fields string
+	err := db.QueryRow(`SELECT fields FROM note_types WHERE name = ?`, name).Scan(&fields)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no note type named %q", name)
+		}
+		return nil, fmt.Errorf("failed to scan note type: %w", err)
+	}
+
+	t := &NoteType{Name: name}
+	if err := json.Unmarshal([]byte(fields), &t.Fields); err != nil {
+		return nil, fmt.Errorf("failed to decode fields of %q: %w", name, err)
+	}
+	return t, nil
+}
+
+// GetNoteTypes lists all note types ordered by name
+func GetNoteTypes(db *sql.DB) ([]NoteType, error) {
+	rows, err := db.Query(`SELECT name, fields FROM note_types ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query note types: %w", err)
+	}
+	defer rows.Close()
+
+	types := []NoteType{}
+	for rows.Next() {
+		var t NoteType
+		var fields string
+		if err := rows.Scan(&t.Name, &fields); err != nil {
+			return nil, fmt.Errorf("failed to scan note type: %w", err)
+		}
+		if err := json.Unmarshal([]byte(fields), &t.Fields); err != nil {
+			return nil, fmt.Errorf("failed to decode fields of %q: %w", t.Name, err)
+		}
+		types = append(types, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating note types: %w", err)
+	}
+	return types, nil
+}
+
+// SetNoteType assigns a type to a note and stores its validated field
+// values as properties
+func SetNoteType(db *sql.DB, noteID int, typeName string, values map[string]string) error {
+	return inNoteTx(db, noteID, func(q dbtx) error {
+		if _, err := q.Exec(`UPDATE notes SET note_type = ? WHERE id = ?`, typeName, noteID); err != nil {
+			return fmt.Errorf("failed to set note type: %w", err)
+		}
+		for key, value := range values {
+			if err := setProperty(q, noteID, key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetNotesByType returns the notes of a type, newest first, along with each
+// note's properties keyed by note ID
+func GetNotesByType(db *sql.DB, typeName string) ([]Note, map[int]map[string]string, error) {
+	rows, err := db.Query(`SELECT `+noteColumns+` FROM notes WHERE note_type = ? AND deleted_at IS NULL ORDER BY date_created DESC`, typeName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes = append(notes, *note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating notes: %w", err)
+	}
+	rows.Close()
+
+	values := map[int]map[string]string{}
+	for _, note := range notes {
+		properties, err := GetProperties(db, note.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[note.ID] = map[string]string{}
+		for _, p := range properties {
+			values[note.ID][p.Key] = p.Value
+		}
+	}
+	return notes, values, nil
+}
@@ -0,0 +1,126 @@
+package funcs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TesseractVision reads images offline with the tesseract command. It only
+// extracts text, so the reply is plain markdown without a title or page
+// details, and text-only steps such as tagging need an AI provider.
+type TesseractVision struct {
+	Path string
+	// Languages are tesseract language codes joined by +, such as eng+deu;
+	// empty uses tesseract's default
+	Languages string
+}
+
+// LocalOCR returns a TesseractVision when tesseract is installed, reading
+// the languages from BOOKMD_TESSERACT_LANG, or nil when it is not
+func LocalOCR() VisionClient {
+	path, err := exec.LookPath("tesseract")
+	if err != nil {
+		return nil
+	}
+	return &TesseractVision{Path: path, Languages: os.Getenv("BOOKMD_TESSERACT_LANG")}
+}
+
+// ocrTimeout bounds a tesseract run
+const ocrTimeout = 2 * time.Minute
+
+func (c *TesseractVision) Complete(ctx context.Context, req VisionRequest) (string, error) {
+	if req.Image == nil {
+		return "", fmt.Errorf("local OCR only reads images; configure an AI provider for this step")
+	}
+	dir, err := os.MkdirTemp("", "bookmd-ocr-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input")
+	if err := os.WriteFile(input, req.Image, 0600); err != nil {
+		return "", fmt.Errorf("failed to write image: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ocrTimeout)
+	defer cancel()
+	args := []string{input, "stdout"}
+	if c.Languages != "" {
+		args = append(args, "-l", c.Languages)
+	}
+	cmd := exec.CommandContext(ctx, c.Path, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tesseract failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	markdown := ocrMarkdown(string(out))
+	if markdown == "" {
+		return "", fmt.Errorf("no text found in the image")
+	}
+	recordResponse(ctx, ProviderTesseract, "")
+	return markdown, nil
+}
+
+// ocrBullet matches the bullet glyphs OCR reads at the start of list items
+var ocrBullet = regexp.MustCompile(`^\s*[•·▪◦*»-]\s+`)
+
+// ocrMarkdown turns tesseract's line-by-line output into markdown: lines of
+// a paragraph are joined, words hyphenated across lines are mended and
+// bullet glyphs become list items
+func ocrMarkdown(text string) string {
+	var blocks []string
+	var paragraph strings.Builder
+	flush := func() {
+		if paragraph.Len() > 0 {
+			blocks = append(blocks, paragraph.String())
+			paragraph.Reset()
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\f", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			flush()
+		case ocrBullet.MatchString(line):
+			flush()
+			paragraph.WriteString("- " + ocrBullet.ReplaceAllString(line, ""))
+		default:
+			current := paragraph.String()
+			switch {
+			case current == "":
+			case strings.HasSuffix(current, "-") && !strings.HasSuffix(current, " -"):
+				paragraph.Reset()
+				paragraph.WriteString(strings.TrimSuffix(current, "-"))
+			default:
+				paragraph.WriteByte(' ')
+			}
+			paragraph.WriteString(line)
+		}
+	}
+	flush()
+
+	// Consecutive items make one tight list
+	var markdown strings.Builder
+	for i, block := range blocks {
+		if i > 0 {
+			if strings.HasPrefix(block, "- ") && strings.HasPrefix(blocks[i-1], "- ") {
+				markdown.WriteString("\n")
+			} else {
+				markdown.WriteString("\n\n")
+			}
+		}
+		markdown.WriteString(block)
+	}
+	if markdown.Len() == 0 {
+		return ""
+	}
+	return markdown.String() + "\n"
+}
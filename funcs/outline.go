@@ -0,0 +1,152 @@
+package funcs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OutlineHeading is one ATX heading of a note, numbered in document order.
+// Its section runs to the next heading of the same or a higher level.
+type OutlineHeading struct {
+	Index int    `json:"index"`
+	Line  int    `json:"line"`
+	Level int    `json:"level"`
+	Text  string `json:"text"`
+	// Up and Down are where MoveHeading puts the section to swap it with
+	// the sibling before or after it, or -1 when there is none
+	Up   int `json:"up"`
+	Down int `json:"down"`
+}
+
+// Outline lists the headings of markdown outside code fences
+func Outline(markdown string) []OutlineHeading {
+	headings := outlineHeadings(strings.Split(markdown, "\n"))
+	for i := range headings {
+		headings[i].Up, headings[i].Down = -1, -1
+		for j := i - 1; j >= 0; j-- {
+			if headings[j].Level <= headings[i].Level {
+				if headings[j].Level == headings[i].Level {
+					headings[i].Up = j
+				}
+				break
+			}
+		}
+		if next := sectionEnd(headings, i); next < len(headings) && headings[next].Level == headings[i].Level {
+			headings[i].Down = sectionEnd(headings, next)
+		}
+	}
+	return headings
+}
+
+// outlineHeadings finds the headings among lines
+func outlineHeadings(lines []string) []OutlineHeading {
+	headings := []OutlineHeading{}
+	openFence := ""
+	for i, line := range lines {
+		if marker := fenceMarker(line); marker != "" {
+			if openFence == "" {
+				openFence = marker
+			} else if marker == openFence {
+				openFence = ""
+			}
+			continue
+		}
+		if openFence != "" {
+			continue
+		}
+		if level := headingLevel(line); level > 0 {
+			headings = append(headings, OutlineHeading{
+				Index: len(headings),
+				Line:  i + 1,
+				Level: level,
+				Text:  strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#")),
+			})
+		}
+	}
+	return headings
+}
+
+// sectionEnd is the index of the first heading after heading i that is not
+// inside its section, or len(headings)
+func sectionEnd(headings []OutlineHeading, i int) int {
+	for j := i + 1; j < len(headings); j++ {
+		if headings[j].Level <= headings[i].Level {
+			return j
+		}
+	}
+	return len(headings)
+}
+
+// splitLines splits markdown into lines, dropping the empty line after a
+// final newline so sections can be moved to the end
+func splitLines(markdown string) ([]string, bool) {
+	trailing := strings.HasSuffix(markdown, "\n")
+	lines := strings.Split(strings.TrimSuffix(markdown, "\n"), "\n")
+	return lines, trailing
+}
+
+// joinLines undoes splitLines
+func joinLines(lines []string, trailing bool) string {
+	markdown := strings.Join(lines, "\n")
+	if trailing {
+		markdown += "\n"
+	}
+	return markdown
+}
+
+// ShiftHeading promotes (delta < 0) or demotes (delta > 0) heading index
+// and every heading in its section, keeping the levels between 1 and 6
+func ShiftHeading(markdown string, index, delta int) (string, error) {
+	lines, trailing := splitLines(markdown)
+	headings := outlineHeadings(lines)
+	if index < 0 || index >= len(headings) {
+		return "", notFound("heading %d not found", index)
+	}
+	end := sectionEnd(headings, index)
+	for _, h := range headings[index:end] {
+		if level := h.Level + delta; level < 1 || level > 6 {
+			return "", fmt.Errorf("heading levels must stay between 1 and 6")
+		}
+	}
+	for _, h := range headings[index:end] {
+		line := strings.TrimLeft(lines[h.Line-1], " ")
+		lines[h.Line-1] = strings.Repeat("#", h.Level+delta) + line[h.Level:]
+	}
+	return joinLines(lines, trailing), nil
+}
+
+// MoveHeading moves the section of heading from, with its sub-headings, to
+// just before heading to, or to the end when to is the number of headings.
+// Text before the first heading stays in place.
+func MoveHeading(markdown string, from, to int) (string, error) {
+	lines, trailing := splitLines(markdown)
+	headings := outlineHeadings(lines)
+	if from < 0 || from >= len(headings) {
+		return "", notFound("heading %d not found", from)
+	}
+	if to < 0 || to > len(headings) {
+		return "", fmt.Errorf("target heading %d not found", to)
+	}
+	end := sectionEnd(headings, from)
+	if to == from || to == end {
+		return markdown, nil
+	}
+	if to > from && to < end {
+		return "", fmt.Errorf("a heading cannot be moved into its own section")
+	}
+
+	lineOf := func(i int) int {
+		if i == len(headings) {
+			return len(lines)
+		}
+		return headings[i].Line - 1
+	}
+	start, stop, at := lineOf(from), lineOf(end), lineOf(to)
+	section := append([]string{}, lines[start:stop]...)
+	rest := append(append([]string{}, lines[:start]...), lines[stop:]...)
+	if at > start {
+		at -= len(section)
+	}
+	moved := append(append(append([]string{}, rest[:at]...), section...), rest[at:]...)
+	return joinLines(moved, trailing), nil
+}
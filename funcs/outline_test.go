@@ -0,0 +1,131 @@
+package funcs
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// jumpy skips heading levels: B and D are level 3 under level 1 and 2
+const jumpy = "# A\n### B\n## C\n### D\n# E\n"
+
+func TestOutlineHeadingJumps(t *testing.T) {
+	want := []OutlineHeading{
+		{Index: 0, Line: 1, Level: 1, Text: "A", Up: -1, Down: 5},
+		{Index: 1, Line: 2, Level: 3, Text: "B", Up: -1, Down: -1},
+		{Index: 2, Line: 3, Level: 2, Text: "C", Up: -1, Down: -1},
+		{Index: 3, Line: 4, Level: 3, Text: "D", Up: -1, Down: -1},
+		{Index: 4, Line: 5, Level: 1, Text: "E", Up: 0, Down: -1},
+	}
+	if got := Outline(jumpy); !reflect.DeepEqual(got, want) {
+		t.Errorf("Outline = %+v, want %+v", got, want)
+	}
+}
+
+func TestShiftHeading(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		markdown string
+		index    int
+		delta    int
+		want     string
+	}{
+		{"promote over a jump", jumpy, 1, -1, "# A\n## B\n## C\n### D\n# E\n"},
+		{"demote a section with jumps", jumpy, 0, 1, "## A\n#### B\n### C\n#### D\n# E\n"},
+		{"second of duplicates", "## Same\none\n## Same\ntwo\n", 1, -1, "## Same\none\n# Same\ntwo\n"},
+		{"fenced headings untouched", "# A\n```\n# not\n## not\n```\n## B\n", 0, 1, "## A\n```\n# not\n## not\n```\n### B\n"},
+		{"no trailing newline", "# A\n## B", 1, 2, "# A\n#### B"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ShiftHeading(tc.markdown, tc.index, tc.delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("ShiftHeading = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := ShiftHeading(jumpy, 1, 4); err == nil {
+		t.Error("demoted a heading past level 6")
+	}
+	if _, err := ShiftHeading(jumpy, 0, -1); err == nil {
+		t.Error("promoted a heading past level 1")
+	}
+	if _, err := ShiftHeading(jumpy, 5, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown heading = %v, want ErrNotFound", err)
+	}
+}
+
+func TestOutlineDuplicateHeadings(t *testing.T) {
+	const markdown = "## Same\none\n## Same\ntwo\n"
+	headings := Outline(markdown)
+	if len(headings) != 2 || headings[0].Text != headings[1].Text {
+		t.Fatalf("Outline = %+v, want two headings named Same", headings)
+	}
+	if headings[0].Down != 2 || headings[1].Up != 0 {
+		t.Errorf("Outline = %+v, want them swappable", headings)
+	}
+
+	got, err := MoveHeading(markdown, 1, headings[1].Up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "## Same\ntwo\n## Same\none\n"; got != want {
+		t.Errorf("MoveHeading = %q, want %q", got, want)
+	}
+}
+
+func TestOutlineSkipsCodeFences(t *testing.T) {
+	const markdown = "# A\n```\n# not\n```\n## B\n~~~\n## also not\n```\n~~~\n# C\n"
+	var texts []string
+	for _, h := range Outline(markdown) {
+		texts = append(texts, h.Text)
+	}
+	if want := []string{"A", "B", "C"}; !reflect.DeepEqual(texts, want) {
+		t.Fatalf("headings = %q, want %q", texts, want)
+	}
+
+	got, err := MoveHeading(markdown, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "## B\n~~~\n## also not\n```\n~~~\n# A\n```\n# not\n```\n# C\n"; got != want {
+		t.Errorf("MoveHeading = %q, want the fence to move with its section", got)
+	}
+
+	if headings := Outline("# A\n```\n# B\n"); len(headings) != 1 {
+		t.Errorf("Outline of an unclosed fence = %+v, want only A", headings)
+	}
+}
+
+func TestMoveHeading(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		from, to int
+		want     string
+	}{
+		{"to the end", 1, 5, "# A\n## C\n### D\n# E\n### B\n"},
+		{"section down", 0, 5, "# E\n# A\n### B\n## C\n### D\n"},
+		{"section up", 4, 0, "# E\n# A\n### B\n## C\n### D\n"},
+		{"in place", 2, 4, jumpy},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MoveHeading(jumpy, tc.from, tc.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("MoveHeading = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := MoveHeading(jumpy, 0, 2); err == nil {
+		t.Error("moved a heading into its own section")
+	}
+	if _, err := MoveHeading(jumpy, 0, 6); err == nil {
+		t.Error("moved a heading past the end")
+	}
+}
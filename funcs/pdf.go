@@ -0,0 +1,134 @@
+package funcs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxPDFPages is the most pages taken from one PDF
+const MaxPDFPages = 200
+
+// IsPDF reports whether data is a PDF file
+func IsPDF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("%PDF-"))
+}
+
+// PDFPages turns each page of a PDF into a JPEG image. It uses pdftoppm
+// from poppler when it is installed. Without it, the page scans embedded in
+// the PDF are extracted directly, which covers what scanner apps export but
+// not PDFs of typed text.
+func PDFPages(ctx context.Context, data []byte) ([][]byte, error) {
+	if !IsPDF(data) {
+		return nil, fmt.Errorf("not a PDF file")
+	}
+	if path, err := exec.LookPath("pdftoppm"); err == nil {
+		return rasterizePDF(ctx, path, data)
+	}
+	pages := embeddedScans(data)
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no scanned pages found in the PDF; install pdftoppm to convert other PDFs")
+	}
+	return pages, nil
+}
+
+// pdfRasterTimeout bounds a pdftoppm run
+const pdfRasterTimeout = 2 * time.Minute
+
+// rasterizePDF renders the pages with pdftoppm at a resolution that keeps
+// handwriting legible
+func rasterizePDF(ctx context.Context, pdftoppm string, data []byte) ([][]byte, error) {
+	dir, err := os.MkdirTemp("", "bookmd-pdf-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input.pdf")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write PDF: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pdfRasterTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, pdftoppm, "-r", "200", "-jpeg", "-jpegopt", "quality=90",
+		"-l", strconv.Itoa(MaxPDFPages), input, filepath.Join(dir, "page"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to rasterize PDF: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// pdftoppm pads page numbers to the width of the last one
+	names, err := filepath.Glob(filepath.Join(dir, "page-*.jpg"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pages: %w", err)
+	}
+	slices.Sort(names)
+	pages := make([][]byte, 0, len(names))
+	for _, name := range names {
+		page, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read page: %w", err)
+		}
+		pages = append(pages, page)
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("the PDF has no pages")
+	}
+	return pages, nil
+}
+
+var (
+	pdfImageDict = regexp.MustCompile(`(?s)<<((?:[^<>]|<<[^<>]*>>)*)>>\s*stream\r?\n`)
+	pdfLength    = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+	pdfWidth     = regexp.MustCompile(`/Width\s+(\d+)`)
+)
+
+// minScanWidth skips small embedded images such as logos
+const minScanWidth = 300
+
+// embeddedScans extracts the JPEG images in a PDF, in the order they are
+// stored, which is page order for scanner exports
+func embeddedScans(data []byte) [][]byte {
+	var pages [][]byte
+	for _, m := range pdfImageDict.FindAllSubmatchIndex(data, -1) {
+		dict := string(data[m[2]:m[3]])
+		if !strings.Contains(dict, "/Image") || !strings.Contains(dict, "/DCTDecode") {
+			continue
+		}
+		if w := pdfWidth.FindStringSubmatch(dict); w != nil {
+			if width, _ := strconv.Atoi(w[1]); width < minScanWidth {
+				continue
+			}
+		}
+
+		start, end := m[1], -1
+		if l := pdfLength.FindStringSubmatch(dict); l != nil && l[2] == "" {
+			if n, err := strconv.Atoi(l[1]); err == nil && start+n <= len(data) {
+				end = start + n
+			}
+		}
+		if end < 0 {
+			i := bytes.Index(data[start:], []byte("endstream"))
+			if i < 0 {
+				continue
+			}
+			end = start + i
+		}
+		scan := bytes.TrimRight(data[start:end], "\r\n")
+		if !bytes.HasPrefix(scan, []byte{0xff, 0xd8}) {
+			continue
+		}
+		pages = append(pages, scan)
+		if len(pages) == MaxPDFPages {
+			break
+		}
+	}
+	return pages
+}
@@ -0,0 +1,303 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PhysicalNotebook is a paper notebook whose pages are scanned into notes.
+// PageCount is the number of pages it has, or 0 when unknown.
+type PhysicalNotebook struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	CoverImage  string    `json:"cover_image"`
+	PageCount   int       `json:"page_count"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+// NotebookPage is one page of a physical notebook and the notes scanned
+// from it; a page with no notes has not been digitized
+type NotebookPage struct {
+	Page    int   `json:"page"`
+	NoteIDs []int `json:"note_ids"`
+}
+
+// CreatePhysicalNotebook registers a paper notebook
+func CreatePhysicalNotebook(db *sql.DB, name, coverImage string, pageCount int) (*PhysicalNotebook, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("notebook name required")
+	}
+	if pageCount < 0 {
+		return nil, fmt.Errorf("page count cannot be negative")
+	}
+
+	result, err := db.Exec(`INSERT INTO physical_notebooks (name, cover_image, page_count) VALUES (?, ?, ?)`,
+		name, coverImage, pageCount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert notebook: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+	return GetPhysicalNotebook(db, int(id))
+}
+
+// GetPhysicalNotebook retrieves a paper notebook by ID
+func GetPhysicalNotebook(db *sql.DB, id int) (*PhysicalNotebook, error) {
+	var nb PhysicalNotebook
+	err := db.QueryRow(`SELECT id, name, cover_image, page_count, date_created FROM physical_notebooks WHERE id = ?`, id).
+		Scan(&nb.ID, &nb.Name, &nb.CoverImage, &nb.PageCount, &nb.DateCreated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no notebook found with id %d", id)
+		}
+		return nil, fmt.Errorf("failed to scan notebook: %w", err)
+	}
+	return &nb, nil
+}
+
+// GetPhysicalNotebooks lists the paper notebooks in the order they were added
+func GetPhysicalNotebooks(db *sql.DB) ([]PhysicalNotebook, error) {
+	rows, err := db.Query(`SELECT id, name, cover_image, page_count, date_created FROM physical_notebooks ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notebooks: %w", err)
+	}
+	defer rows.Close()
+
+	notebooks := []PhysicalNotebook{}
+	for rows.Next() {
+		var nb PhysicalNotebook
+		if err := rows.Scan(&nb.ID, &nb.Name, &nb.CoverImage, &nb.PageCount, &nb.DateCreated); err != nil {
+			return nil, fmt.Errorf("failed to scan notebook: %w", err)
+		}
+		notebooks = append(notebooks, nb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notebooks: %w", err)
+	}
+	return notebooks, nil
+}
+
+// DeletePhysicalNotebook removes a paper notebook and unassigns its notes,
+// which a note of it in a locked notebook refuses
+func DeletePhysicalNotebook(db *sql.DB, id int) error {
+	return (&Store{DB: db}).inTx(context.Background(), func(q dbtx) error {
+		if err := checkNotesUnlocked(q, `n.physical_notebook_id = ?`, id); err != nil {
+			return err
+		}
+		result, err := q.Exec(`DELETE FROM physical_notebooks WHERE id = ?`, id)
+		if err != nil {
+			return fmt.Errorf("failed to delete notebook: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return notFound("no notebook found with id %d", id)
+		}
+
+		if _, err := q.Exec(`UPDATE notes SET physical_notebook_id = 0, page_number = 0 WHERE physical_notebook_id = ?`, id); err != nil {
+			return fmt.Errorf("failed to unassign notes: %w", err)
+		}
+		return nil
+	})
+}
+
+// SetNotePage records which page of which paper notebook a note was scanned
+// from. A notebook ID of 0 clears the mapping.
+func SetNotePage(db *sql.DB, noteID, notebookID, page int) error {
+	if err := ValidateNotePage(db, notebookID, page); err != nil {
+		return err
+	}
+	if notebookID == 0 {
+		page = 0
+	}
+	return inNoteTx(db, noteID, func(q dbtx) error {
+		result, err := q.Exec(`UPDATE notes SET physical_notebook_id = ?, page_number = ? WHERE id = ?`, notebookID, page, noteID)
+		if err != nil {
+			return fmt.Errorf("failed to set note page: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return notFound("no note found with id %d", noteID)
+		}
+		return nil
+	})
+}
+
+// ValidateNotePage checks that page exists in the paper notebook. A
+// notebook ID of 0 is always valid.
+func ValidateNotePage(db *sql.DB, notebookID, page int) error {
+	if notebookID == 0 {
+		return nil
+	}
+	if page < 1 {
+		return fmt.Errorf("page number must be at least 1")
+	}
+	nb, err := GetPhysicalNotebook(db, notebookID)
+	if err != nil {
+		return err
+	}
+	if nb.PageCount > 0 && page > nb.PageCount {
+		return fmt.Errorf("%s only has %d pages", nb.Name, nb.PageCount)
+	}
+	return nil
+}
+
+// NotebookPages maps every page of a paper notebook to the notes scanned
+// from it. Pages run to the notebook's page count, or to the highest page
+// seen when the count is unknown.
+func NotebookPages(db *sql.DB, nb *PhysicalNotebook) ([]NotebookPage, error) {
+	rows, err := db.Query(`SELECT id, page_number FROM notes WHERE physical_notebook_id = ? AND page_number > 0 AND deleted_at IS NULL ORDER BY page_number, id`, nb.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notebook pages: %w", err)
+	}
+	defer rows.Close()
+
+	scanned := map[int][]int{}
+	last := nb.PageCount
+	for rows.Next() {
+		var id, page int
+		if err := rows.Scan(&id, &page); err != nil {
+			return nil, fmt.Errorf("failed to scan notebook page: %w", err)
+		}
+		scanned[page] = append(scanned[page], id)
+		last = max(last, page)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notebook pages: %w", err)
+	}
+
+	pages := make([]NotebookPage, last)
+	for i := range pages {
+		pages[i] = NotebookPage{Page: i + 1, NoteIDs: scanned[i+1]}
+		if pages[i].NoteIDs == nil {
+			pages[i].NoteIDs = []int{}
+		}
+	}
+	return pages, nil
+}
+
+// DigitizedPages counts the pages that have at least one note
+func DigitizedPages(pages []NotebookPage) int {
+	n := 0
+	for _, p := range pages {
+		if len(p.NoteIDs) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// MissingPages lists the pages with no notes
+func MissingPages(pages []NotebookPage) []int {
+	missing := []int{}
+	for _, p := range pages {
+		if len(p.NoteIDs) == 0 {
+			missing = append(missing, p.Page)
+		}
+	}
+	return missing
+}
+
+// PageGaps lists the missing pages that come before the last digitized
+// page: a break in the sequence rather than pages not yet reached
+func PageGaps(pages []NotebookPage) []int {
+	last := 0
+	for _, p := range pages {
+		if len(p.NoteIDs) > 0 {
+			last = p.Page
+		}
+	}
+	gaps := []int{}
+	for _, p := range pages {
+		if p.Page < last && len(p.NoteIDs) == 0 {
+			gaps = append(gaps, p.Page)
+		}
+	}
+	return gaps
+}
+
+// PageRanges formats sorted page numbers as ranges, e.g. "3, 5–8"
+func PageRanges(pages []int) string {
+	var ranges []string
+	for i := 0; i < len(pages); i++ {
+		start := i
+		for i+1 < len(pages) && pages[i+1] == pages[i]+1 {
+			i++
+		}
+		if start == i {
+			ranges = append(ranges, fmt.Sprint(pages[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d–%d", pages[start], pages[i]))
+		}
+	}
+	return strings.Join(ranges, ", ")
+}
+
+// NotebookGaps is PageGaps for the paper notebook with the given ID
+func NotebookGaps(db *sql.DB, notebookID int) ([]int, error) {
+	nb, err := GetPhysicalNotebook(db, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := NotebookPages(db, nb)
+	if err != nil {
+		return nil, err
+	}
+	return PageGaps(pages), nil
+}
+
+// NextPage is the page after the last digitized one
+func NextPage(pages []NotebookPage) int {
+	next := 1
+	for _, p := range pages {
+		if len(p.NoteIDs) > 0 {
+			next = p.Page + 1
+		}
+	}
+	return next
+}
+
+// Captured is the date written on the page, if one was read off it
+func (n *Note) Captured() (time.Time, bool) {
+	t, err := time.Parse(time.DateOnly, n.CapturedAt)
+	return t, err == nil
+}
+
+// SetNoteCapture stores the title the AI gave the page and the page number
+// and date it read off it, and its provenance, and marks the note for review
+// if the transcription broke a guardrail. A generated title or detected page
+// never replaces one that is already set, and a note without a detected date
+// keeps its previous one.
+func SetNoteCapture(db *sql.DB, noteID int, t *Transcription) error {
+	provenance, err := encodeProvenance(t.Provenance)
+	if err != nil {
+		return err
+	}
+	return inNoteTx(db, noteID, func(q dbtx) error {
+		var revision int
+		err := q.QueryRow(`UPDATE notes SET
+			title = CASE WHEN title = '' THEN ? ELSE title END,
+			page_number = CASE WHEN page_number = 0 THEN ? ELSE page_number END,
+			captured_at = CASE WHEN ? = '' THEN captured_at ELSE ? END,
+			review = ?, provenance = ?
+			WHERE id = ? RETURNING revision`, t.Title, t.PageNumber, t.WrittenDate, t.WrittenDate, t.Review, provenance, noteID).Scan(&revision)
+		if err == sql.ErrNoRows {
+			return notFound("no note with id %d", noteID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set note capture metadata: %w", err)
+		}
+		return recordChange(q, noteID, ChangeUpdated, revision)
+	})
+}
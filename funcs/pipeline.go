@@ -0,0 +1,321 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Inputs a pipeline step can read
+const (
+	StepInputImage    = "image"
+	StepInputPrevious = "previous"
+)
+
+// Where a pipeline step's output goes. Property outputs are written as
+// "property:<key>"; a step without an output is kept only as an artifact.
+const (
+	StepOutputMarkdown = "markdown"
+	stepOutputProperty = "property:"
+)
+
+// PipelineStep is one AI call in a pipeline. The first step transcribes the
+// image; later steps read the previous step's output unless they set Input
+// to "image". An empty Model uses the active model.
+type PipelineStep struct {
+	Name   string `json:"name"`
+	Input  string `json:"input"`
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+	Output string `json:"output"`
+}
+
+// Pipeline is a named, ordered list of AI steps run over a note, e.g.
+// transcribe → clean up → summarize → tag
+type Pipeline struct {
+	Name  string         `json:"name"`
+	Steps []PipelineStep `json:"steps"`
+}
+
+// PipelineRun is one execution of a pipeline over a note
+type PipelineRun struct {
+	ID          int        `json:"id"`
+	Pipeline    string     `json:"pipeline"`
+	NoteID      int        `json:"note_id"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error"`
+	DateCreated time.Time  `json:"date_created"`
+	Artifacts   []Artifact `json:"artifacts"`
+}
+
+// Statuses of a pipeline run
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// Artifact is the stored result of one step of a run, kept for debugging
+// whether or not the step's output was saved to the note
+type Artifact struct {
+	Step       int    `json:"step"`
+	Name       string `json:"name"`
+	Model      string `json:"model"`
+	Output     string `json:"output"`
+	Error      string `json:"error"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// validate checks that a pipeline's name and steps are usable
+func (p *Pipeline) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return fmt.Errorf("pipeline name required")
+	}
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("pipeline needs at least one step")
+	}
+
+	for i := range p.Steps {
+		s := &p.Steps[i]
+		s.Name = strings.TrimSpace(s.Name)
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("step %d", i+1)
+		}
+		if strings.TrimSpace(s.Prompt) == "" {
+			return fmt.Errorf("step %q needs a prompt", s.Name)
+		}
+
+		switch s.Input {
+		case "":
+			s.Input = StepInputPrevious
+			if i == 0 {
+				s.Input = StepInputImage
+			}
+		case StepInputImage:
+		case StepInputPrevious:
+			if i == 0 {
+				return fmt.Errorf("step %q has no previous step to read", s.Name)
+			}
+		default:
+			return fmt.Errorf("step %q has unknown input %q", s.Name, s.Input)
+		}
+
+		if key, ok := strings.CutPrefix(s.Output, stepOutputProperty); ok {
+			key, err := normalizePropertyKey(key)
+			if err != nil {
+				return fmt.Errorf("step %q: %w", s.Name, err)
+			}
+			s.Output = stepOutputProperty + key
+		} else if s.Output != "" && s.Output != StepOutputMarkdown {
+			return fmt.Errorf("step %q has unknown output %q", s.Name, s.Output)
+		}
+	}
+	return nil
+}
+
+// SavePipeline creates or replaces a pipeline definition
+func SavePipeline(db *sql.DB, p Pipeline) (*Pipeline, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	steps, err := json.Marshal(p.Steps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode steps: %w", err)
+	}
+
+	query := `INSERT INTO pipelines (name, steps) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET steps = excluded.steps`
+	if _, err := db.Exec(query, p.Name, string(steps)); err != nil {
+		return nil, fmt.Errorf("failed to save pipeline: %w", err)
+	}
+	return &p, nil
+}
+
+// DeletePipeline removes a pipeline definition. Its past runs are kept.
+func DeletePipeline(db *sql.DB, name string) error {
+	result, err := db.Exec(`DELETE FROM pipelines WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete pipeline: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return notFound("no pipeline named %q", name)
+	}
+	return nil
+}
+
+// GetPipeline retrieves a pipeline by name
+func GetPipeline(db *sql.DB, name string) (*Pipeline, error) {
+	var steps string
+	err := db.QueryRow(`SELECT steps FROM pipelines WHERE name = ?`, name).Scan(&steps)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no pipeline named %q", name)
+		}
+		return nil, fmt.Errorf("failed to scan pipeline: %w", err)
+	}
+
+	p := &Pipeline{Name: name}
+	if err := json.Unmarshal([]byte(steps), &p.Steps); err != nil {
+		return nil, fmt.Errorf("failed to decode steps of %q: %w", name, err)
+	}
+	return p, nil
+}
+
+// GetPipelines lists all pipelines ordered by name
+func GetPipelines(db *sql.DB) ([]Pipeline, error) {
+	rows, err := db.Query(`SELECT name, steps FROM pipelines ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pipelines: %w", err)
+	}
+	defer rows.Close()
+
+	pipelines := []Pipeline{}
+	for rows.Next() {
+		var p Pipeline
+		var steps string
+		if err := rows.Scan(&p.Name, &steps); err != nil {
+			return nil, fmt.Errorf("failed to scan pipeline: %w", err)
+		}
+		if err := json.Unmarshal([]byte(steps), &p.Steps); err != nil {
+			return nil, fmt.Errorf("failed to decode steps of %q: %w", p.Name, err)
+		}
+		pipelines = append(pipelines, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating pipelines: %w", err)
+	}
+	return pipelines, nil
+}
+
+// RunPipeline runs each step of the pipeline over the note in order,
+// storing every step's output as an artifact of the run. Outputs are only
+// saved to the note once all steps have succeeded, so a failed run leaves
+// the note untouched. Steps run with the AI settings of ai.
+func RunPipeline(ctx context.Context, db *sql.DB, ai *Transcriber, p *Pipeline, note *Note, imageDir string) (*PipelineRun, error) {
+	result, err := db.Exec(`INSERT INTO pipeline_runs (pipeline, note_id, status) VALUES (?, ?, ?)`,
+		p.Name, note.ID, RunRunning)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start pipeline run: %w", err)
+	}
+	runID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	settings, client := ai.Current()
+	imagePath := filepath.Join(imageDir, note.Image)
+	outputs := make([]string, len(p.Steps))
+	provenances := make([]*Provenance, len(p.Steps))
+	runErr := func() error {
+		for i, step := range p.Steps {
+			model := step.Model
+			if model == "" {
+				model = settings.Model
+			}
+
+			start := time.Now()
+			stepCtx, provenance := TrackProvenance(ctx)
+			recordPrompt(stepCtx, model, p.Name+"/"+step.Name, step.Prompt)
+			provenances[i] = provenance
+			var output string
+			var err error
+			if step.Input == StepInputImage {
+				provenance.Preprocessing = VariantSteps(VariantOriginal)
+				output, err = ai.ConvertImageWith(stepCtx, client, model, step.Prompt, imagePath)
+			} else {
+				output, err = ai.CompleteText(stepCtx, client, model, step.Prompt, outputs[i-1])
+			}
+			artifact := Artifact{Step: i + 1, Name: step.Name, Model: model, Output: output,
+				DurationMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				artifact.Error = err.Error()
+			}
+			if _, dbErr := db.Exec(`INSERT INTO pipeline_artifacts (run_id, step, name, model, output, error, duration_ms)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`, runID, artifact.Step, artifact.Name, artifact.Model,
+				artifact.Output, artifact.Error, artifact.DurationMS); dbErr != nil {
+				return fmt.Errorf("failed to store artifact: %w", dbErr)
+			}
+			if err != nil {
+				return fmt.Errorf("step %q failed: %w", step.Name, err)
+			}
+			outputs[i] = output
+		}
+		return savePipelineOutputs(db, p, note, outputs, provenances)
+	}()
+
+	status, message := RunSucceeded, ""
+	if runErr != nil {
+		status, message = RunFailed, runErr.Error()
+	}
+	if _, err := db.Exec(`UPDATE pipeline_runs SET status = ?, error = ? WHERE id = ?`, status, message, runID); err != nil {
+		return nil, fmt.Errorf("failed to finish pipeline run: %w", err)
+	}
+
+	run, err := GetPipelineRun(db, int(runID))
+	if err != nil {
+		return nil, err
+	}
+	return run, runErr
+}
+
+// savePipelineOutputs writes each step's output where the step asks, the
+// markdown with the provenance of the step that wrote it
+func savePipelineOutputs(db *sql.DB, p *Pipeline, note *Note, outputs []string, provenances []*Provenance) error {
+	for i, step := range p.Steps {
+		if step.Output == StepOutputMarkdown {
+			if _, err := UpdateNote(db, note.ID, note.Image, outputs[i]); err != nil {
+				return err
+			}
+			if err := SetNoteProvenance(db, note.ID, provenances[i]); err != nil {
+				return err
+			}
+		} else if key, ok := strings.CutPrefix(step.Output, stepOutputProperty); ok {
+			if err := SetProperty(db, note.ID, key, strings.TrimSpace(outputs[i])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetPipelineRun retrieves a run with its artifacts in step order
+func GetPipelineRun(db *sql.DB, id int) (*PipelineRun, error) {
+	var run PipelineRun
+	err := db.QueryRow(`SELECT id, pipeline, note_id, status, error, date_created FROM pipeline_runs WHERE id = ?`, id).
+		Scan(&run.ID, &run.Pipeline, &run.NoteID, &run.Status, &run.Error, &run.DateCreated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no pipeline run found with id %d", id)
+		}
+		return nil, fmt.Errorf("failed to scan pipeline run: %w", err)
+	}
+
+	rows, err := db.Query(`SELECT step, name, model, output, error, duration_ms FROM pipeline_artifacts
+		WHERE run_id = ? ORDER BY step`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query artifacts: %w", err)
+	}
+	defer rows.Close()
+
+	run.Artifacts = []Artifact{}
+	for rows.Next() {
+		var a Artifact
+		if err := rows.Scan(&a.Step, &a.Name, &a.Model, &a.Output, &a.Error, &a.DurationMS); err != nil {
+			return nil, fmt.Errorf("failed to scan artifact: %w", err)
+		}
+		run.Artifacts = append(run.Artifacts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating artifacts: %w", err)
+	}
+	return &run, nil
+}
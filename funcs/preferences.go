@@ -0,0 +1,117 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+)
+
+// Preferences are interface choices kept on the server so they follow the
+// reader across devices. bookmd has a single reader, so they are stored once
+// per instance in the settings table.
+type Preferences struct {
+	Theme           string `json:"theme"`
+	DefaultNotebook string `json:"default_notebook"`
+	EditorFontSize  int    `json:"editor_font_size"`
+	PreviewMode     string `json:"preview_mode"`
+	ListDensity     string `json:"list_density"`
+}
+
+// DefaultPreferences apply until the reader changes them
+var DefaultPreferences = Preferences{
+	Theme:          "system",
+	EditorFontSize: 16,
+	PreviewMode:    "rendered",
+	ListDensity:    "comfortable",
+}
+
+// Allowed preference values
+var (
+	themes       = map[string]bool{"system": true, "light": true, "dark": true}
+	previewModes = map[string]bool{"rendered": true, "source": true, "split": true}
+	densities    = map[string]bool{"comfortable": true, "compact": true}
+)
+
+// Validate checks that each preference holds an allowed value
+func (p Preferences) Validate() error {
+	if !themes[p.Theme] {
+		return fmt.Errorf("theme must be system, light or dark")
+	}
+	if !previewModes[p.PreviewMode] {
+		return fmt.Errorf("preview mode must be rendered, source or split")
+	}
+	if !densities[p.ListDensity] {
+		return fmt.Errorf("list density must be comfortable or compact")
+	}
+	if p.EditorFontSize < 10 || p.EditorFontSize > 32 {
+		return fmt.Errorf("editor font size must be between 10 and 32")
+	}
+	return nil
+}
+
+// GetPreferences returns the stored preferences over the defaults
+func GetPreferences(db *sql.DB) (Preferences, error) {
+	p := DefaultPreferences
+	rows, err := db.Query(`SELECT key, value FROM settings WHERE key LIKE 'pref.%'`)
+	if err != nil {
+		return p, fmt.Errorf("failed to query preferences: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return p, fmt.Errorf("failed to scan preference: %w", err)
+		}
+		switch key {
+		case "pref.theme":
+			p.Theme = value
+		case "pref.default_notebook":
+			p.DefaultNotebook = value
+		case "pref.editor_font_size":
+			if n, err := strconv.Atoi(value); err == nil {
+				p.EditorFontSize = n
+			}
+		case "pref.preview_mode":
+			p.PreviewMode = value
+		case "pref.list_density":
+			p.ListDensity = value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return p, fmt.Errorf("error iterating preferences: %w", err)
+	}
+	return p, nil
+}
+
+// SavePreferences validates and stores all preferences
+func SavePreferences(db *sql.DB, p Preferences) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for key, value := range map[string]string{
+		"pref.theme":            p.Theme,
+		"pref.default_notebook": p.DefaultNotebook,
+		"pref.editor_font_size": strconv.Itoa(p.EditorFontSize),
+		"pref.preview_mode":     p.PreviewMode,
+		"pref.list_density":     p.ListDensity,
+	} {
+		_, err := tx.Exec(`INSERT INTO settings (key, value) VALUES (?, ?)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, value)
+		if err != nil {
+			return fmt.Errorf("failed to save preference %s: %w", key, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit preferences: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Property is a user-defined key/value pair attached to a note
+type Property struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// normalizePropertyKey trims a key and rejects ones that cannot be written
+// as a frontmatter key
+func normalizePropertyKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", fmt.Errorf("property key required")
+	}
+	if strings.ContainsAny(key, ":\n\r#") {
+		return "", fmt.Errorf("invalid property key %q", key)
+	}
+	return key, nil
+}
+
+// SetProperty creates or replaces a property on a note
+func SetProperty(db *sql.DB, noteID int, key, value string) error {
+	return inNoteTx(db, noteID, func(q dbtx) error {
+		return setProperty(q, noteID, key, value)
+	})
+}
+
+// setProperty is SetProperty for callers that checked the note's lock in q
+func setProperty(q dbtx, noteID int, key, value string) error {
+	key, err := normalizePropertyKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := getNote(q, noteID); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO note_properties (note_id, key, value) VALUES (?, ?, ?)
+		ON CONFLICT(note_id, key) DO UPDATE SET value = excluded.value`
+	if _, err := q.Exec(query, noteID, key, value); err != nil {
+		return fmt.Errorf("failed to set property: %w", err)
+	}
+	return nil
+}
+
+// DeleteProperty removes a property from a note
+func DeleteProperty(db *sql.DB, noteID int, key string) error {
+	return inNoteTx(db, noteID, func(q dbtx) error {
+		result, err := q.Exec(`DELETE FROM note_properties WHERE note_id = ? AND key = ?`, noteID, strings.TrimSpace(key))
+		if err != nil {
+			return fmt.Errorf("failed to delete property: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return notFound("no property %q on note %d", key, noteID)
+		}
+		return nil
+	})
+}
+
+// GetProperties returns a note's properties ordered by key
+func GetProperties(db *sql.DB, noteID int) ([]Property, error) {
+	rows, err := db.Query(`SELECT key, value FROM note_properties WHERE note_id = ? ORDER BY key`, noteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query properties: %w", err)
+	}
+	defer rows.Close()
+
+	properties := []Property{}
+	for rows.Next() {
+		var p Property
+		if err := rows.Scan(&p.Key, &p.Value); err != nil {
+			return nil, fmt.Errorf("failed to scan property: %w", err)
+		}
+		properties = append(properties, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating properties: %w", err)
+	}
+	return properties, nil
+}
+
+// FindNotesByProperty returns notes that have the given property. An empty
+// value matches any note that has the key at all.
+func FindNotesByProperty(db *sql.DB, key, value string) ([]Note, error) {
+	query := `SELECT ` + noteColumns + ` FROM notes
+		WHERE id IN (SELECT note_id FROM note_properties WHERE key = ? AND (? = '' OR value = ?))
+		AND deleted_at IS NULL
+		ORDER BY date_created DESC`
+	rows, err := db.Query(query, strings.TrimSpace(key), value, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes = append(notes, *note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notes: %w", err)
+	}
+	return notes, nil
+}
+
+// yamlString quotes a value for YAML frontmatter
+func yamlString(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+// plainYAMLKey reports whether a key can be written without quotes
+func plainYAMLKey(key string) bool {
+	for i, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case (r >= '0' && r <= '9') || r == '-':
+			if i == 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return key != ""
+}
+
+// WithFrontmatter prefixes markdown with a YAML frontmatter block holding
+// the note's properties. Markdown is returned unchanged when there are none.
+func WithFrontmatter(markdown string, properties []Property) string {
+	if len(properties) == 0 {
+		return markdown
+	}
+
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, p := range properties {
+		key := p.Key
+		if !plainYAMLKey(key) {
+			key = yamlString(key)
+		}
+		b.WriteString(key + ": " + yamlString(p.Value) + "\n")
+	}
+	b.WriteString("---\n\n")
+	b.WriteString(markdown)
+	return b.String()
+}
@@ -0,0 +1,201 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provenance records how a version of a note's markdown was produced: the
+// provider and model that wrote it, the prompt they were given, what was
+// done to the image before and to the markdown after, the provider's IDs of
+// its responses and how long it took them. It is kept with the note and
+// moves to the revision the note saves when its markdown is replaced; markdown
+// edited by hand has none.
+type Provenance struct {
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	// Prompt is the prompt's profile: default, custom (from the settings),
+	// override (for one request), cleanup or a pipeline step, as
+	// pipeline/step
+	Prompt string `json:"prompt,omitempty"`
+	// PromptVersion is the start of the SHA-256 of the prompt's text, which
+	// changes whenever the text does
+	PromptVersion  string   `json:"prompt_version,omitempty"`
+	Preprocessing  []string `json:"preprocessing,omitempty"`
+	Postprocessing []string `json:"postprocessing,omitempty"`
+	// ResponseIDs holds one ID per provider response, for the providers
+	// that give them: a PDF has one per page, a retry after a guardrail
+	// one per attempt
+	ResponseIDs []string `json:"response_ids,omitempty"`
+	// Requests counts the requests sent; Cached is set when a response
+	// came from the AI cache instead
+	Requests    int       `json:"requests"`
+	Cached      bool      `json:"cached,omitempty"`
+	LatencyMS   int64     `json:"latency_ms"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+// Prompt profiles
+const (
+	PromptDefault  = "default"
+	PromptCustom   = "custom"
+	PromptOverride = "override"
+	PromptCleanup  = "cleanup"
+)
+
+// Processing steps of a Provenance, followed by a colon and an argument
+// where they take one
+const (
+	// StepOriginal sends the upload as it is
+	StepOriginal = "original"
+	// StepScale shrinks the image to at most the argument's pixels on its
+	// longest edge
+	StepScale = "scale"
+	// StepJPEG re-encodes the image as a JPEG of the argument's quality
+	StepJPEG = "jpeg"
+	// StepPages transcribes the argument's pages of a PDF one by one and
+	// joins them
+	StepPages = "pages"
+	// StepAutofix fixes the markdown's formatting
+	StepAutofix = "autofix"
+)
+
+// VariantSteps are the preprocessing steps of sending the AI an image's
+// variant
+func VariantSteps(variant string) []string {
+	spec, ok := ImageVariants[variant]
+	if !ok {
+		return []string{StepOriginal}
+	}
+	return []string{fmt.Sprintf("%s:%d", StepScale, spec.Edge), fmt.Sprintf("%s:%d", StepJPEG, spec.Quality)}
+}
+
+// ProvenanceStep describes a processing step in the locale's language
+func ProvenanceStep(locale, step string) string {
+	name, arg, ok := strings.Cut(step, ":")
+	if !ok {
+		return T(locale, "provenance.step."+name)
+	}
+	return T(locale, "provenance.step."+name, arg)
+}
+
+// promptVersion is the version a prompt's text is recorded under
+func promptVersion(prompt string) string {
+	return blobHash(prompt)[:12]
+}
+
+// Merge adds the AI requests of another part of the same markdown, such as
+// another page of a PDF
+func (p *Provenance) Merge(other *Provenance) {
+	if other == nil {
+		return
+	}
+	p.ResponseIDs = append(p.ResponseIDs, other.ResponseIDs...)
+	p.Requests += other.Requests
+	p.Cached = p.Cached || other.Cached
+	p.LatencyMS += other.LatencyMS
+}
+
+// provenanceKey holds the provenanceRecorder of a context
+type provenanceKey struct{}
+
+// provenanceRecorder fills in a Provenance from the AI requests made with
+// its context
+type provenanceRecorder struct {
+	mu sync.Mutex
+	p  *Provenance
+}
+
+// TrackProvenance returns a context recording the AI requests made with it
+// into the returned Provenance, which the callee fills in with its prompt
+func TrackProvenance(ctx context.Context) (context.Context, *Provenance) {
+	p := &Provenance{DateCreated: time.Now().UTC()}
+	return context.WithValue(ctx, provenanceKey{}, &provenanceRecorder{p: p}), p
+}
+
+// recordProvenance changes the Provenance tracked by ctx, if there is one
+func recordProvenance(ctx context.Context, change func(p *Provenance)) {
+	if r, ok := ctx.Value(provenanceKey{}).(*provenanceRecorder); ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		change(r.p)
+	}
+}
+
+// recordPrompt records the model and prompt a request is about to be sent
+// with
+func recordPrompt(ctx context.Context, model, profile, prompt string) {
+	recordProvenance(ctx, func(p *Provenance) {
+		p.Model, p.Prompt, p.PromptVersion = model, profile, promptVersion(prompt)
+	})
+}
+
+// recordResponse records a provider's answer and its ID, when it has one
+func recordResponse(ctx context.Context, provider, responseID string) {
+	recordProvenance(ctx, func(p *Provenance) {
+		p.Provider = provider
+		if responseID != "" {
+			p.ResponseIDs = append(p.ResponseIDs, responseID)
+		}
+	})
+}
+
+// SetNoteProvenance stores how the note's current markdown was produced,
+// or clears it when p is nil
+func SetNoteProvenance(db *sql.DB, noteID int, p *Provenance) error {
+	return inNoteTx(db, noteID, func(q dbtx) error {
+		return setNoteProvenance(q, noteID, p)
+	})
+}
+
+func setNoteProvenance(q dbtx, noteID int, p *Provenance) error {
+	data, err := encodeProvenance(p)
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec(`UPDATE notes SET provenance = ? WHERE id = ?`, data, noteID); err != nil {
+		return fmt.Errorf("failed to save provenance: %w", err)
+	}
+	return nil
+}
+
+// GetNoteProvenance returns how the note's current markdown was produced,
+// nil when it is not known
+func GetNoteProvenance(db *sql.DB, noteID int) (*Provenance, error) {
+	var data string
+	err := db.QueryRow(`SELECT provenance FROM notes WHERE id = ? AND deleted_at IS NULL`, noteID).Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no note found with id %d", noteID)
+		}
+		return nil, fmt.Errorf("failed to load provenance: %w", err)
+	}
+	return decodeProvenance(data)
+}
+
+func encodeProvenance(p *Provenance) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode provenance: %w", err)
+	}
+	return string(data), nil
+}
+
+func decodeProvenance(data string) (*Provenance, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var p Provenance
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return nil, fmt.Errorf("failed to decode provenance: %w", err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,186 @@
+package funcs
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// Heading is one entry in a note's table of contents
+type Heading struct {
+	Level int    `json:"level"`
+	Text  string `json:"text"`
+	ID    string `json:"id"`
+}
+
+// markdownRenderer converts note markdown to HTML. Raw HTML in the source is
+// escaped rather than passed through.
+var markdownRenderer = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+)
+
+// Slugify lowercases text and joins its letters and digits with hyphens,
+// e.g. "Week 3: Graphs!" becomes "week-3-graphs"
+func Slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// headingIDs generates heading anchors from the heading text, suffixing
+// repeats with -1, -2, ... so the same markdown always yields the same IDs
+type headingIDs struct {
+	seen map[string]int
+}
+
+func (ids *headingIDs) Generate(value []byte, kind ast.NodeKind) []byte {
+	base := Slugify(string(value))
+	if base == "" {
+		base = "section"
+	}
+	id := base
+	for n := ids.seen[base]; ids.seen[id] > 0; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	ids.seen[base]++
+	if id != base {
+		ids.seen[id]++
+	}
+	return []byte(id)
+}
+
+func (ids *headingIDs) Put(value []byte) {
+	ids.seen[string(value)]++
+}
+
+// RenderMarkdown converts markdown to HTML with stable heading anchors and
+// returns the headings in document order for building a table of contents
+func RenderMarkdown(markdown string) (string, []Heading, error) {
+	return renderMarkdown(markdown, &headingIDs{seen: map[string]int{}})
+}
+
+// renderMarkdown is RenderMarkdown with anchors kept unique across every
+// document rendered with ids
+func renderMarkdown(markdown string, ids *headingIDs) (string, []Heading, error) {
+	source := []byte(markdown)
+	ctx := parser.NewContext(parser.WithIDs(ids))
+	doc := markdownRenderer.Parser().Parse(text.NewReader(source), parser.WithContext(ctx))
+
+	var headings []Heading
+	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		id, _ := heading.AttributeString("id")
+		idBytes, _ := id.([]byte)
+		headings = append(headings, Heading{
+			Level: heading.Level,
+			Text:  string(nodeText(heading, source)),
+			ID:    string(idBytes),
+		})
+		return ast.WalkSkipChildren, nil
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to collect headings: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := markdownRenderer.Renderer().Render(&buf, source, doc); err != nil {
+		return "", nil, fmt.Errorf("failed to render markdown: %w", err)
+	}
+
+	return buf.String(), headings, nil
+}
+
+// nodeText concatenates the text segments under a node
+func nodeText(n ast.Node, source []byte) []byte {
+	var buf bytes.Buffer
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if t, ok := c.(*ast.Text); ok {
+			buf.Write(t.Segment.Value(source))
+			if t.SoftLineBreak() {
+				buf.WriteByte(' ')
+			}
+			continue
+		}
+		buf.Write(nodeText(c, source))
+	}
+	return buf.Bytes()
+}
+
+// FirstHeading returns the text of the first ATX heading outside code
+// fences, or "" if the markdown has none
+func FirstHeading(markdown string) string {
+	openFence := ""
+	for _, line := range strings.Split(markdown, "\n") {
+		if marker := fenceMarker(line); marker != "" {
+			if openFence == "" {
+				openFence = marker
+			} else if marker == openFence {
+				openFence = ""
+			}
+			continue
+		}
+		if openFence == "" && headingLevel(line) > 0 {
+			return strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		}
+	}
+	return ""
+}
+
+// NoteTitle names a note by its title, then its first heading, or by its ID
+// when it has neither
+func NoteTitle(note *Note) string {
+	if note.Title != "" {
+		return note.Title
+	}
+	if title := FirstHeading(note.Markdown); title != "" {
+		return title
+	}
+	return fmt.Sprintf("Note %d", note.ID)
+}
+
+// NoteSlug builds the URL slug for a note: its ID followed by a slug of
+// its title or first heading. Only the ID is used to resolve it, so links
+// keep working when the title or markdown changes.
+func NoteSlug(note *Note) string {
+	title := note.Title
+	if title == "" {
+		title = FirstHeading(note.Markdown)
+	}
+	if slug := Slugify(title); slug != "" {
+		return fmt.Sprintf("%d-%s", note.ID, slug)
+	}
+	return strconv.Itoa(note.ID)
+}
+
+// ParseNoteSlug extracts the note ID from a slug built by NoteSlug
+func ParseNoteSlug(slug string) (int, error) {
+	idStr, _, _ := strings.Cut(slug, "-")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid note slug %q", slug)
+	}
+	return id, nil
+}
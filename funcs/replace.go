@@ -0,0 +1,217 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ReplaceScope narrows a find and replace to some notes. Every set field
+// must match; an empty scope covers every note outside the trash.
+type ReplaceScope struct {
+	// NotebookID includes the notebook's sub-notebooks
+	NotebookID int    `json:"notebook_id"`
+	Tag        string `json:"tag"`
+	// Query keeps notes whose markdown contains it, ignoring case
+	Query   string `json:"query"`
+	NoteIDs []int  `json:"note_ids"`
+}
+
+// Replacement is what to find and what to put in its place. A regex
+// replacement can refer to groups as $1 or ${name}; a literal one is
+// inserted as is.
+type Replacement struct {
+	Find  string `json:"find"`
+	With  string `json:"with"`
+	Regex bool   `json:"regex"`
+}
+
+// ReplaceMatch is one match in a note, shown with the text around it
+type ReplaceMatch struct {
+	Line        int    `json:"line"`
+	Prefix      string `json:"prefix"`
+	Match       string `json:"match"`
+	Replacement string `json:"replacement"`
+	Suffix      string `json:"suffix"`
+}
+
+// ReplacePreview lists the matches in one note. Count is every match, while
+// Matches stops at maxPreviewMatches.
+type ReplacePreview struct {
+	Note    Note           `json:"note"`
+	Count   int            `json:"count"`
+	Matches []ReplaceMatch `json:"matches"`
+}
+
+// Sizes of a preview
+const (
+	maxPreviewMatches = 20
+	previewContext    = 30
+)
+
+// compile turns the replacement into a regexp, rejecting patterns that
+// match empty text, which would insert the replacement between every
+// character
+func (r Replacement) compile() (*regexp.Regexp, error) {
+	if r.Find == "" {
+		return nil, fmt.Errorf("text to find required")
+	}
+	pattern := r.Find
+	if !r.Regex {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	if re.MatchString("") {
+		return nil, fmt.Errorf("pattern must not match empty text")
+	}
+	return re, nil
+}
+
+// replaceAll applies the replacement to markdown
+func (r Replacement) replaceAll(re *regexp.Regexp, markdown string) string {
+	if r.Regex {
+		return re.ReplaceAllString(markdown, r.With)
+	}
+	return re.ReplaceAllLiteralString(markdown, r.With)
+}
+
+// tagCondition matches the notes tagged tag, ignoring case and spaces
+func tagCondition(tag string) (string, []any) {
+	tag = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(tag)), " ", "")
+	return `id IN (SELECT note_id FROM note_properties
+		WHERE key = ? AND ',' || REPLACE(LOWER(value), ' ', '') || ',' LIKE ?)`, []any{TagProperty, "%," + tag + ",%"}
+}
+
+// scopedNotes lists the notes in scope, newest first
+func scopedNotes(db *sql.DB, scope ReplaceScope) ([]Note, error) {
+	where := []string{"deleted_at IS NULL"}
+	var args []any
+	if scope.NotebookID != 0 {
+		where = append(where, `notebook_id IN (WITH RECURSIVE tree(id) AS (SELECT ?
+			UNION SELECT notebooks.id FROM notebooks JOIN tree ON notebooks.parent_id = tree.id) SELECT id FROM tree)`)
+		args = append(args, scope.NotebookID)
+	}
+	if strings.TrimSpace(scope.Tag) != "" {
+		condition, tagArgs := tagCondition(scope.Tag)
+		where = append(where, condition)
+		args = append(args, tagArgs...)
+	}
+	if scope.Query != "" {
+		where = append(where, `INSTR(LOWER(markdown), LOWER(?)) > 0`)
+		args = append(args, scope.Query)
+	}
+	if len(scope.NoteIDs) > 0 {
+		where = append(where, `id IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(scope.NoteIDs)), ", ")+`)`)
+		for _, id := range scope.NoteIDs {
+			args = append(args, id)
+		}
+	}
+
+	rows, err := db.Query(`SELECT `+noteColumns+` FROM notes WHERE `+strings.Join(where, " AND ")+
+		` ORDER BY date_created DESC, id DESC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes = append(notes, *note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notes: %w", err)
+	}
+	return notes, nil
+}
+
+// PreviewReplace lists the notes in scope that the replacement would
+// change, with their matches
+func PreviewReplace(db *sql.DB, scope ReplaceScope, r Replacement) ([]ReplacePreview, error) {
+	re, err := r.compile()
+	if err != nil {
+		return nil, err
+	}
+	notes, err := scopedNotes(db, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	previews := []ReplacePreview{}
+	for _, note := range notes {
+		found := re.FindAllStringSubmatchIndex(note.Markdown, -1)
+		if len(found) == 0 || r.replaceAll(re, note.Markdown) == note.Markdown {
+			continue
+		}
+		preview := ReplacePreview{Note: note, Count: len(found), Matches: []ReplaceMatch{}}
+		for _, m := range found[:min(len(found), maxPreviewMatches)] {
+			preview.Matches = append(preview.Matches, previewMatch(re, r, note.Markdown, m))
+		}
+		previews = append(previews, preview)
+	}
+	return previews, nil
+}
+
+// previewMatch shows a match at m with the text on either side of it
+func previewMatch(re *regexp.Regexp, r Replacement, markdown string, m []int) ReplaceMatch {
+	start, end := max(0, m[0]-previewContext), min(len(markdown), m[1]+previewContext)
+	for start < m[0] && !utf8.RuneStart(markdown[start]) {
+		start++
+	}
+	for end > m[1] && end < len(markdown) && !utf8.RuneStart(markdown[end]) {
+		end--
+	}
+	replacement := r.With
+	if r.Regex {
+		replacement = string(re.ExpandString(nil, r.With, markdown, m))
+	}
+	return ReplaceMatch{
+		Line:        1 + strings.Count(markdown[:m[0]], "\n"),
+		Prefix:      markdown[start:m[0]],
+		Match:       markdown[m[0]:m[1]],
+		Replacement: replacement,
+		Suffix:      markdown[m[1]:end],
+	}
+}
+
+// ApplyReplace makes the replacement in every note in scope, saving each
+// changed note through the store so its old content is kept as a revision.
+// It returns the IDs of the notes changed; notes of locked notebooks are
+// left as they are.
+func ApplyReplace(ctx context.Context, store *Store, scope ReplaceScope, r Replacement) ([]int, error) {
+	re, err := r.compile()
+	if err != nil {
+		return nil, err
+	}
+	notes, err := scopedNotes(store.DB, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := []int{}
+	for _, note := range notes {
+		markdown := r.replaceAll(re, note.Markdown)
+		if markdown == note.Markdown {
+			continue
+		}
+		_, err := store.UpdateNote(ctx, note.ID, note.Image, markdown)
+		if errors.Is(err, ErrLocked) {
+			continue
+		}
+		if err != nil {
+			return changed, fmt.Errorf("failed to update note %d: %w", note.ID, err)
+		}
+		changed = append(changed, note.ID)
+	}
+	return changed, nil
+}
@@ -0,0 +1,147 @@
+package funcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ErrUnavailable matches, with errors.Is, AI requests that failed in a way
+// that may succeed later: rate limits, overloaded or failing providers and
+// network errors
+var ErrUnavailable = errors.New("ai provider unavailable")
+
+// UnavailableError is a transient failure of an AI request. RetryAfter is
+// the wait the provider asked for, if it sent one.
+type UnavailableError struct {
+	Status     int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *UnavailableError) Error() string        { return e.Err.Error() }
+func (e *UnavailableError) Unwrap() error        { return e.Err }
+func (e *UnavailableError) Is(target error) bool { return target == ErrUnavailable }
+
+// retryableStatus reports whether a provider reply with status is worth
+// retrying. 529 is Anthropic's overloaded status.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as a date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// openAIError marks the transient errors of the go-openai client, which
+// does not expose Retry-After
+func openAIError(err error) error {
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	status := 0
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr):
+		status = reqErr.HTTPStatusCode
+	}
+	if retryableStatus(status) {
+		return &UnavailableError{Status: status, Err: err}
+	}
+	return err
+}
+
+// Retry settings used when BOOKMD_AI_RETRIES and BOOKMD_AI_RETRY_DELAY are
+// not set. A Retry-After longer than maxRetryWait fails the request at once
+// rather than holding it open.
+const (
+	defaultRetries    = 3
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = 30 * time.Second
+	maxRetryWait      = time.Minute
+)
+
+// RetryingVision retries the transient failures of Client with exponential
+// backoff and jitter, waiting at least as long as the provider's Retry-After
+type RetryingVision struct {
+	Client  VisionClient
+	Retries int
+	Delay   time.Duration
+	// Sleep waits d or until ctx ends, returning ctx's error then; nil
+	// waits on a timer
+	Sleep func(ctx context.Context, d time.Duration) error
+}
+
+// withRetries wraps client in a RetryingVision configured from
+// BOOKMD_AI_RETRIES and BOOKMD_AI_RETRY_DELAY
+func withRetries(client VisionClient) VisionClient {
+	retries, delay := defaultRetries, defaultRetryDelay
+	if n, err := strconv.Atoi(os.Getenv("BOOKMD_AI_RETRIES")); err == nil && n >= 0 {
+		retries = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("BOOKMD_AI_RETRY_DELAY")); err == nil && d > 0 {
+		delay = d
+	}
+	return &RetryingVision{Client: client, Retries: retries, Delay: delay}
+}
+
+// backoff is the wait before retry attempt+1: the delay doubled for each
+// attempt, capped, with the upper half randomized so clients spread out
+func (c *RetryingVision) backoff(attempt int) time.Duration {
+	d := min(c.Delay<<attempt, maxRetryDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+func (c *RetryingVision) Complete(ctx context.Context, req VisionRequest) (string, error) {
+	for attempt := 0; ; attempt++ {
+		out, err := c.Client.Complete(ctx, req)
+		var unavailable *UnavailableError
+		if err == nil || !errors.As(err, &unavailable) || attempt >= c.Retries || ctx.Err() != nil {
+			return out, err
+		}
+		wait := max(c.backoff(attempt), unavailable.RetryAfter)
+		if wait > maxRetryWait {
+			return "", err
+		}
+
+		if c.sleep(ctx, wait) != nil {
+			return "", fmt.Errorf("gave up retrying: %w", err)
+		}
+	}
+}
+
+func (c *RetryingVision) sleep(ctx context.Context, d time.Duration) error {
+	if c.Sleep != nil {
+		return c.Sleep(ctx, d)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,156 @@
+package funcs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// scriptedVision fails with errs in turn, then succeeds
+type scriptedVision struct {
+	errs  []error
+	calls int
+}
+
+func (v *scriptedVision) Complete(ctx context.Context, req VisionRequest) (string, error) {
+	v.calls++
+	if v.calls <= len(v.errs) {
+		return "", v.errs[v.calls-1]
+	}
+	return "done", nil
+}
+
+// recordSleep records the waits asked for without waiting
+func recordSleep(waits *[]time.Duration) func(context.Context, time.Duration) error {
+	return func(ctx context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		return ctx.Err()
+	}
+}
+
+func unavailable(retryAfter time.Duration) error {
+	return &UnavailableError{Status: http.StatusTooManyRequests, RetryAfter: retryAfter, Err: errors.New("rate limited")}
+}
+
+func TestRetryingVisionAttempts(t *testing.T) {
+	permanent := errors.New("bad request")
+	for _, tc := range []struct {
+		name    string
+		errs    []error
+		retries int
+		calls   int
+		wantErr error
+	}{
+		{"success", nil, 3, 1, nil},
+		{"recovers", []error{unavailable(0), unavailable(0)}, 3, 3, nil},
+		{"runs out of retries", []error{unavailable(0), unavailable(0), unavailable(0)}, 2, 3, ErrUnavailable},
+		{"no retries", []error{unavailable(0)}, 0, 1, ErrUnavailable},
+		{"not retryable", []error{permanent}, 3, 1, permanent},
+		{"not retryable after a retry", []error{unavailable(0), permanent}, 3, 2, permanent},
+		{"retry after too long", []error{unavailable(2 * maxRetryWait)}, 3, 1, ErrUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &scriptedVision{errs: tc.errs}
+			var waits []time.Duration
+			c := &RetryingVision{Client: client, Retries: tc.retries, Delay: time.Second, Sleep: recordSleep(&waits)}
+			out, err := c.Complete(context.Background(), VisionRequest{})
+			if client.calls != tc.calls {
+				t.Errorf("calls = %d, want %d", client.calls, tc.calls)
+			}
+			if len(waits) != max(tc.calls-1, 0) {
+				t.Errorf("slept %d times, want %d", len(waits), tc.calls-1)
+			}
+			if tc.wantErr == nil {
+				if err != nil || out != "done" {
+					t.Errorf("Complete = %q, %v, want success", out, err)
+				}
+			} else if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Complete error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryingVisionBackoff(t *testing.T) {
+	client := &scriptedVision{errs: []error{unavailable(0), unavailable(0), unavailable(0), unavailable(0), unavailable(0)}}
+	var waits []time.Duration
+	c := &RetryingVision{Client: client, Retries: 10, Delay: 4 * time.Second, Sleep: recordSleep(&waits)}
+	if _, err := c.Complete(context.Background(), VisionRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The delay doubles, capped at maxRetryDelay, with the upper half random
+	for attempt, wait := range waits {
+		d := min(c.Delay<<attempt, maxRetryDelay)
+		if wait < d/2 || wait > d {
+			t.Errorf("wait %d = %v, want between %v and %v", attempt, wait, d/2, d)
+		}
+	}
+}
+
+func TestRetryingVisionWaitsRetryAfter(t *testing.T) {
+	client := &scriptedVision{errs: []error{unavailable(10 * time.Second)}}
+	var waits []time.Duration
+	c := &RetryingVision{Client: client, Retries: 1, Delay: time.Millisecond, Sleep: recordSleep(&waits)}
+	if _, err := c.Complete(context.Background(), VisionRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 1 || waits[0] != 10*time.Second {
+		t.Errorf("waits = %v, want the 10s the provider asked for", waits)
+	}
+}
+
+func TestRetryingVisionCanceledWhileSleeping(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &scriptedVision{errs: []error{unavailable(0), unavailable(0)}}
+	c := &RetryingVision{Client: client, Retries: 3, Delay: time.Second,
+		Sleep: func(ctx context.Context, d time.Duration) error {
+			cancel()
+			return ctx.Err()
+		}}
+	_, err := c.Complete(ctx, VisionRequest{})
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Complete = %v, want the provider's error", err)
+	}
+	if client.calls != 1 {
+		t.Errorf("calls = %d, want no attempt after the cancel", client.calls)
+	}
+
+	// The timer the default sleep waits on gives way to the context too
+	ctx, cancel = context.WithCancel(context.Background())
+	client = &scriptedVision{errs: []error{unavailable(0), unavailable(0)}}
+	c = &RetryingVision{Client: client, Retries: 3, Delay: maxRetryDelay}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := c.Complete(ctx, VisionRequest{}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Complete = %v, want the provider's error", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Complete took %v after the cancel", took)
+	}
+	if client.calls != 1 {
+		t.Errorf("calls = %d, want 1", client.calls)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-3", 0},
+		{"soon", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	} {
+		if got := parseRetryAfter(tc.value, now); got != tc.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
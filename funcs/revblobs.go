@@ -0,0 +1,310 @@
+package funcs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The markdown of revisions is kept in revision_blobs under the SHA-256 of
+// the text, so a text saved by several revisions, as after a rollback, is
+// stored once. A blob holds either the whole text or a line delta against
+// the blob of the note's previous revision, and is put back together when it
+// is read. Deltas are chained at most maxDeltaChain deep, bounding the work
+// of reading a revision.
+const (
+	maxDeltaChain = 16
+	// maxDeltaCells bounds the lines compared for a delta, after the lines the
+	// texts share at either end; a larger change is stored as one insertion
+	maxDeltaCells = 250_000
+)
+
+// Operations of a delta, each followed by a uvarint: a number of base lines
+// to copy or skip, or the length of the lines to insert, joined by newlines,
+// which come next
+const (
+	deltaCopy   = 'c'
+	deltaSkip   = 's'
+	deltaInsert = 'i'
+)
+
+const (
+	getBlobQuery       = `SELECT base, depth, data FROM revision_blobs WHERE hash = ?`
+	blobDepthQuery     = `SELECT depth FROM revision_blobs WHERE hash = ?`
+	insertBlobQuery    = `INSERT INTO revision_blobs (hash, base, depth, words, data) VALUES (?, ?, ?, ?, ?) ON CONFLICT(hash) DO NOTHING`
+	latestRevisionHash = `SELECT content_hash FROM note_revisions WHERE note_id = ? ORDER BY revision DESC LIMIT 1`
+)
+
+// blobHash is the key a text is stored under
+func blobHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// putBlob stores text unless it is already stored, as a delta against the
+// blob base when that is smaller, and returns its hash
+func putBlob(q dbtx, text, base string) (string, error) {
+	hash := blobHash(text)
+	var depth int
+	err := q.QueryRow(blobDepthQuery, hash).Scan(&depth)
+	if err == nil {
+		return hash, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("failed to look up revision blob: %w", err)
+	}
+
+	data := []byte(text)
+	if base != "" {
+		var baseDepth int
+		err := q.QueryRow(blobDepthQuery, base).Scan(&baseDepth)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("failed to look up revision blob: %w", err)
+		}
+		if err == nil && baseDepth < maxDeltaChain {
+			baseText, err := readBlob(q, base)
+			if err != nil {
+				return "", err
+			}
+			// A delta that does not give the text back is not kept, so a
+			// bug in encoding cannot lose a revision
+			delta := encodeDelta(baseText, text)
+			if len(delta) < len(data) {
+				if applied, err := applyDelta(baseText, delta); err == nil && applied == text {
+					data, depth = delta, baseDepth+1
+				}
+			}
+		}
+	}
+	if depth == 0 {
+		base = ""
+	}
+
+	if _, err := q.Exec(insertBlobQuery, hash, base, depth, CountWords(text), data); err != nil {
+		return "", fmt.Errorf("failed to save revision blob: %w", err)
+	}
+	return hash, nil
+}
+
+// readBlob puts back together the text stored under hash
+func readBlob(q dbtx, hash string) (string, error) {
+	// Follow the chain of deltas down to a whole text
+	var deltas [][]byte
+	var text string
+	for next := hash; ; {
+		var base string
+		var depth int
+		var data []byte
+		err := q.QueryRow(getBlobQuery, next).Scan(&base, &depth, &data)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return "", fmt.Errorf("revision blob %s is missing", next)
+			}
+			return "", fmt.Errorf("failed to read revision blob: %w", err)
+		}
+		if base == "" {
+			text = string(data)
+			break
+		}
+		if len(deltas) > maxDeltaChain {
+			return "", fmt.Errorf("revision blob %s has too long a chain of deltas", hash)
+		}
+		deltas = append(deltas, data)
+		next = base
+	}
+
+	for i := len(deltas) - 1; i >= 0; i-- {
+		var err error
+		if text, err = applyDelta(text, deltas[i]); err != nil {
+			return "", fmt.Errorf("revision blob %s is corrupt: %w", hash, err)
+		}
+	}
+	if blobHash(text) != hash {
+		return "", fmt.Errorf("revision blob %s is corrupt: its text does not match its hash", hash)
+	}
+	return text, nil
+}
+
+// encodeDelta writes the operations turning base into text
+func encodeDelta(base, text string) []byte {
+	from, to := strings.Split(base, "\n"), strings.Split(text, "\n")
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix && from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+
+	var out bytes.Buffer
+	op := func(code byte, n int) {
+		if n > 0 {
+			out.WriteByte(code)
+			out.Write(binary.AppendUvarint(nil, uint64(n)))
+		}
+	}
+	var inserted []string
+	flush := func() {
+		if len(inserted) > 0 {
+			joined := strings.Join(inserted, "\n")
+			out.WriteByte(deltaInsert)
+			out.Write(binary.AppendUvarint(nil, uint64(len(joined))))
+			out.WriteString(joined)
+			inserted = inserted[:0]
+		}
+	}
+
+	op(deltaCopy, prefix)
+	middleFrom, middleTo := from[prefix:len(from)-suffix], to[prefix:len(to)-suffix]
+	switch {
+	case len(middleFrom) == 0 || len(middleTo) == 0 || len(middleFrom)*len(middleTo) > maxDeltaCells:
+		op(deltaSkip, len(middleFrom))
+		inserted = append(inserted, middleTo...)
+	default:
+		// Runs of the same operation are written as one
+		run, count := "", 0
+		for _, line := range DiffLines(strings.Join(middleFrom, "\n"), strings.Join(middleTo, "\n")) {
+			if line.Op == DiffAdded {
+				// The run before an insertion is written first so its lines
+				// keep their place
+				writeRun(op, run, count)
+				run, count = "", 0
+				inserted = append(inserted, line.Text)
+				continue
+			}
+			flush()
+			if line.Op != run {
+				writeRun(op, run, count)
+				run, count = line.Op, 0
+			}
+			count++
+		}
+		writeRun(op, run, count)
+	}
+	flush()
+	op(deltaCopy, suffix)
+	return out.Bytes()
+}
+
+// writeRun writes count lines of a diff operation other than an addition
+func writeRun(op func(byte, int), run string, count int) {
+	switch run {
+	case DiffSame:
+		op(deltaCopy, count)
+	case DiffRemoved:
+		op(deltaSkip, count)
+	}
+}
+
+// applyDelta runs the operations of a delta on base
+func applyDelta(base string, delta []byte) (string, error) {
+	from := strings.Split(base, "\n")
+	var to []string
+	pos := 0
+	for len(delta) > 0 {
+		code := delta[0]
+		n, size := binary.Uvarint(delta[1:])
+		if size <= 0 {
+			return "", fmt.Errorf("bad length in delta")
+		}
+		delta = delta[1+size:]
+		switch code {
+		case deltaCopy, deltaSkip:
+			if uint64(len(from)-pos) < n {
+				return "", fmt.Errorf("delta runs past its base")
+			}
+			if code == deltaCopy {
+				to = append(to, from[pos:pos+int(n)]...)
+			}
+			pos += int(n)
+		case deltaInsert:
+			if uint64(len(delta)) < n {
+				return "", fmt.Errorf("delta insertion runs past its end")
+			}
+			to = append(to, strings.Split(string(delta[:n]), "\n")...)
+			delta = delta[n:]
+		default:
+			return "", fmt.Errorf("unknown delta operation %q", code)
+		}
+	}
+	if pos != len(from) {
+		return "", fmt.Errorf("delta leaves %d lines of its base unused", len(from)-pos)
+	}
+	return strings.Join(to, "\n"), nil
+}
+
+// pruneRevisionBlobs removes the blobs no revision needs any more, directly
+// or as the base of another blob
+func pruneRevisionBlobs(q dbtx) error {
+	for {
+		result, err := q.Exec(`DELETE FROM revision_blobs
+			WHERE hash NOT IN (SELECT content_hash FROM note_revisions)
+			AND hash NOT IN (SELECT base FROM revision_blobs)`)
+		if err != nil {
+			return fmt.Errorf("failed to prune revision blobs: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// migrateRevisions moves the markdown of revisions saved before blobs
+// existed into blobs, one note at a time so each delta is against the
+// revision before it
+func migrateRevisions(db *sql.DB) error {
+	rows, err := db.Query(`SELECT note_id, revision, markdown FROM note_revisions
+		WHERE content_hash = '' ORDER BY note_id, revision`)
+	if err != nil {
+		return fmt.Errorf("failed to query revisions to migrate: %w", err)
+	}
+	type legacy struct {
+		noteID, revision int
+		markdown         string
+	}
+	var revisions []legacy
+	for rows.Next() {
+		var rev legacy
+		if err := rows.Scan(&rev.noteID, &rev.revision, &rev.markdown); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan revision: %w", err)
+		}
+		revisions = append(revisions, rev)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating revisions: %w", err)
+	}
+	if len(revisions) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	base, note := "", 0
+	for _, rev := range revisions {
+		if rev.noteID != note {
+			base, note = "", rev.noteID
+		}
+		if base, err = putBlob(tx, rev.markdown, base); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE note_revisions SET content_hash = ?, markdown = '' WHERE note_id = ? AND revision = ?`,
+			base, rev.noteID, rev.revision); err != nil {
+			return fmt.Errorf("failed to migrate revision: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit revision migration: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package funcs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name, base, text string
+	}{
+		{"insert between same lines", "P\nB\nC\nQ", "P2\nB\ny\nC\nQ2"},
+		{"insert at start", "a\nb\nc", "new\na\nb\nc"},
+		{"insert at end", "a\nb\nc", "a\nb\nc\nnew"},
+		{"insert into empty", "", "a\nb"},
+		{"replace run", "a\nb\nc\nd\ne", "a\nx\ny\nd\ne"},
+		{"replace and insert around same", "h\n1\n2\nk\n3\n4\nf", "h\nx\nk\ny\nz\nf"},
+		{"delete run", "a\nb\nc\nd\ne", "a\ne"},
+		{"delete everything", "a\nb\nc", ""},
+		{"delete and insert alternating", "a\nb\nc\nd\ne\nf", "a\nX\nc\nY\ne\nZ"},
+		{"blank lines", "a\n\n\nb\n", "a\n\nc\n\nb\n"},
+		{"identical", "a\nb", "a\nb"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			delta := encodeDelta(tc.base, tc.text)
+			got, err := applyDelta(tc.base, delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.text {
+				t.Errorf("applyDelta(%q, encodeDelta) = %q, want %q", tc.base, got, tc.text)
+			}
+		})
+	}
+}
+
+func TestDeltaRoundTripLarge(t *testing.T) {
+	var base, text []string
+	for i := range 600 {
+		line := strings.Repeat("x", i%7)
+		base = append(base, line)
+		if i%5 != 0 {
+			text = append(text, line)
+		}
+		if i%11 == 0 {
+			text = append(text, "added")
+		}
+	}
+	from, to := strings.Join(base, "\n"), strings.Join(text, "\n")
+	got, err := applyDelta(from, encodeDelta(from, to))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != to {
+		t.Error("large delta did not round-trip")
+	}
+}
+
+func TestPutBlobReadsBack(t *testing.T) {
+	s := newTestStore(t)
+	texts := []string{"P\nB\nC\nQ", "P2\nB\ny\nC\nQ2", "P2\ny\nC", "P2\ny\nC\nend"}
+	base := ""
+	for _, text := range texts {
+		hash, err := putBlob(s.DB, text, base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readBlob(s.DB, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != text {
+			t.Errorf("readBlob = %q, want %q", got, text)
+		}
+		base = hash
+	}
+}
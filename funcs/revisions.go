@@ -0,0 +1,233 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NoteRevision is an earlier version of a note's markdown and image, saved
+// when the note was overwritten. Revision is the note's revision number
+// while it had this content.
+type NoteRevision struct {
+	NoteID    int    `json:"note_id"`
+	Revision  int    `json:"revision"`
+	Image     string `json:"image"`
+	Markdown  string `json:"markdown,omitempty"`
+	WordCount int    `json:"word_count"`
+	// Provenance records how the markdown was produced, nil when unknown
+	Provenance  *Provenance `json:"provenance"`
+	DateCreated time.Time   `json:"date_created"`
+}
+
+const (
+	revisionSourceQuery = `SELECT image, markdown, revision, provenance FROM notes WHERE id = ?`
+	insertRevisionQuery = `INSERT INTO note_revisions (note_id, revision, image, markdown, content_hash, provenance) VALUES (?, ?, ?, '', ?, ?)
+		ON CONFLICT(note_id, revision) DO NOTHING`
+)
+
+// saveRevision keeps a copy of the note's markdown, image and provenance
+// before they are replaced, the markdown as a blob. Nothing is saved when
+// they are not changing.
+func saveRevision(q dbtx, id int, image, markdown string) error {
+	old, err := readRevisionSource(q, id)
+	if err != nil {
+		return err
+	}
+	if old.image == image && old.markdown == markdown {
+		return nil
+	}
+	return storeRevision(q, id, old)
+}
+
+// snapshotRevision keeps a copy of the note as it is, for changes such as a
+// new title that give it a new revision while its content stays the same
+func snapshotRevision(q dbtx, id int) error {
+	old, err := readRevisionSource(q, id)
+	if err != nil {
+		return err
+	}
+	return storeRevision(q, id, old)
+}
+
+// revisionSource is what a revision keeps of a note
+type revisionSource struct {
+	image, markdown, provenance string
+	revision                    int
+}
+
+func readRevisionSource(q dbtx, id int) (revisionSource, error) {
+	var old revisionSource
+	err := q.QueryRow(revisionSourceQuery, id).Scan(&old.image, &old.markdown, &old.revision, &old.provenance)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return old, notFound("no note found with id %d", id)
+		}
+		return old, fmt.Errorf("failed to read note before update: %w", err)
+	}
+	return old, nil
+}
+
+func storeRevision(q dbtx, id int, old revisionSource) error {
+	var previous string
+	err := q.QueryRow(latestRevisionHash, id).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read previous revision: %w", err)
+	}
+	hash, err := putBlob(q, old.markdown, previous)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(insertRevisionQuery, id, old.revision, old.image, hash, old.provenance)
+	if err != nil {
+		return fmt.Errorf("failed to save revision: %w", err)
+	}
+	return nil
+}
+
+// GetRevisions lists the saved versions of a note, newest first, without
+// their markdown
+func GetRevisions(db *sql.DB, noteID int) ([]NoteRevision, error) {
+	rows, err := db.Query(`SELECT r.note_id, r.revision, r.image, COALESCE(b.words, 0), r.provenance, r.date_created
+		FROM note_revisions r LEFT JOIN revision_blobs b ON b.hash = r.content_hash
+		WHERE r.note_id = ? ORDER BY r.revision DESC`, noteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []NoteRevision{}
+	for rows.Next() {
+		var rev NoteRevision
+		var provenance string
+		if err := rows.Scan(&rev.NoteID, &rev.Revision, &rev.Image, &rev.WordCount, &provenance, &rev.DateCreated); err != nil {
+			return nil, fmt.Errorf("failed to scan revision: %w", err)
+		}
+		if rev.Provenance, err = decodeProvenance(provenance); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating revisions: %w", err)
+	}
+	return revisions, nil
+}
+
+// GetRevision retrieves one saved version of a note
+func GetRevision(db *sql.DB, noteID, revision int) (*NoteRevision, error) {
+	return getRevision(db, noteID, revision)
+}
+
+func getRevision(q dbtx, noteID, revision int) (*NoteRevision, error) {
+	var rev NoteRevision
+	var hash, provenance string
+	err := q.QueryRow(`SELECT note_id, revision, image, content_hash, provenance, date_created FROM note_revisions
+		WHERE note_id = ? AND revision = ?`, noteID, revision).
+		Scan(&rev.NoteID, &rev.Revision, &rev.Image, &hash, &provenance, &rev.DateCreated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("note %d has no revision %d", noteID, revision)
+		}
+		return nil, fmt.Errorf("failed to scan revision: %w", err)
+	}
+	if rev.Markdown, err = readBlob(q, hash); err != nil {
+		return nil, err
+	}
+	if rev.Provenance, err = decodeProvenance(provenance); err != nil {
+		return nil, err
+	}
+	rev.WordCount = CountWords(rev.Markdown)
+	return &rev, nil
+}
+
+// RollbackNote puts a saved version back as the note's content, with its
+// provenance. The content it replaces is saved as a revision in turn, so a
+// rollback can be undone. It all happens in one transaction, so the note is
+// never left with the old content but not its provenance.
+func RollbackNote(db *sql.DB, noteID, revision int) (*Note, error) {
+	var note *Note
+	err := inNoteTx(db, noteID, func(q dbtx) error {
+		rev, err := getRevision(q, noteID, revision)
+		if err != nil {
+			return err
+		}
+		if note, err = updateNote(q, noteID, rev.Image, rev.Markdown); err != nil {
+			return err
+		}
+		return setNoteProvenance(q, noteID, rev.Provenance)
+	})
+	return note, err
+}
+
+// Diff operations
+const (
+	DiffSame    = "same"
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+)
+
+// DiffLine is one line of a diff
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// maxDiffCells bounds the work DiffLines does; larger inputs are shown as
+// everything removed and everything added
+const maxDiffCells = 4_000_000
+
+// DiffLines compares two texts line by line using their longest common
+// subsequence
+func DiffLines(a, b string) []DiffLine {
+	from, to := strings.Split(a, "\n"), strings.Split(b, "\n")
+	diff := []DiffLine{}
+	if len(from)*len(to) > maxDiffCells {
+		for _, line := range from {
+			diff = append(diff, DiffLine{DiffRemoved, line})
+		}
+		for _, line := range to {
+			diff = append(diff, DiffLine{DiffAdded, line})
+		}
+		return diff
+	}
+
+	// lcs[i][j] is the length of the common subsequence of from[i:] and to[j:]
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(from) && j < len(to) {
+		switch {
+		case from[i] == to[j]:
+			diff = append(diff, DiffLine{DiffSame, from[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{DiffRemoved, from[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{DiffAdded, to[j]})
+			j++
+		}
+	}
+	for ; i < len(from); i++ {
+		diff = append(diff, DiffLine{DiffRemoved, from[i]})
+	}
+	for ; j < len(to); j++ {
+		diff = append(diff, DiffLine{DiffAdded, to[j]})
+	}
+	return diff
+}
@@ -0,0 +1,136 @@
+package funcs
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUpdateNoteSavesRevision(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	note, err := s.AddNote(ctx, "a.png", "# One\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateNote(ctx, note.ID, "b.png", "# Two\n"); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged content gets a new revision number but nothing to keep
+	if _, err := s.UpdateNote(ctx, note.ID, "b.png", "# Two\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := GetRevisions(s.DB, note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].Revision != 1 {
+		t.Fatalf("revisions = %+v, want only revision 1", revisions)
+	}
+	rev, err := GetRevision(s.DB, note.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.Image != "a.png" || rev.Markdown != "# One\n" {
+		t.Errorf("revision 1 = %q %q, want the original content", rev.Image, rev.Markdown)
+	}
+}
+
+func TestSnapshotRevisionKeepsUnchangedContent(t *testing.T) {
+	s := newTestStore(t)
+	note, err := s.AddNote(context.Background(), "a.png", "# Same\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	titled, err := SetNoteTitle(s.DB, note.ID, "A title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if titled.Revision != 2 {
+		t.Fatalf("revision = %d, want 2", titled.Revision)
+	}
+
+	rev, err := GetRevision(s.DB, note.ID, 1)
+	if err != nil {
+		t.Fatalf("revision 1 was not kept: %v", err)
+	}
+	if rev.Markdown != "# Same\n" {
+		t.Errorf("revision 1 markdown = %q", rev.Markdown)
+	}
+}
+
+func TestRevisionsSurviveManyEdits(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	versions := []string{"# A\n\nx\n", "# A\n\nx\ny\n", "# B\n\ny\n", "", "# C\n\nx\ny\nz\n"}
+	note, err := s.AddNote(ctx, "a.png", versions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, markdown := range versions[1:] {
+		if _, err := s.UpdateNote(ctx, note.ID, "a.png", markdown); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range versions[:len(versions)-1] {
+		rev, err := GetRevision(s.DB, note.ID, i+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev.Markdown != want {
+			t.Errorf("revision %d = %q, want %q", i+1, rev.Markdown, want)
+		}
+	}
+}
+
+func TestRollbackNote(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	note, err := s.AddNote(ctx, "a.png", "# AI\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provenance := &Provenance{Provider: "openai", Model: "gpt-4o"}
+	if err := SetNoteProvenance(s.DB, note.ID, provenance); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateNote(ctx, note.ID, "a.png", "# Hand edited\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	rolled, err := RollbackNote(s.DB, note.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolled.Markdown != "# AI\n" || rolled.Revision != 3 {
+		t.Errorf("rolled back to %q at revision %d, want the AI markdown at 3", rolled.Markdown, rolled.Revision)
+	}
+	got, err := GetNoteProvenance(s.DB, note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Model != "gpt-4o" {
+		t.Errorf("provenance = %+v, want the revision's", got)
+	}
+	// The hand edit it replaced can be rolled back to in turn
+	if rev, err := GetRevision(s.DB, note.ID, 2); err != nil || rev.Markdown != "# Hand edited\n" {
+		t.Errorf("revision 2 = %+v, %v, want the hand edit", rev, err)
+	}
+
+	if _, err := RollbackNote(s.DB, note.ID, 9); !errors.Is(err, ErrNotFound) {
+		t.Errorf("rollback to a missing revision = %v, want ErrNotFound", err)
+	}
+	if after, err := s.GetNote(ctx, note.ID); err != nil || after.Revision != rolled.Revision {
+		t.Errorf("failed rollback changed the note to %+v, %v", after, err)
+	}
+}
+
+func TestRollbackLockedNote(t *testing.T) {
+	s := newTestStore(t)
+	held := lockedNote(t, s)
+	if _, err := RollbackNote(s.DB, held.ID, 1); !errors.Is(err, ErrLocked) {
+		t.Errorf("RollbackNote = %v, want ErrLocked", err)
+	}
+}
@@ -0,0 +1,289 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// StarProperty is the note property marking a favorite note. Any value but
+// an empty one, "false", "no" or "0" stars the note.
+const StarProperty = "starred"
+
+// Weights of the search ranking. A note's text relevance is multiplied by
+// up to 1+recencyBoost for a note from today, falling by half after
+// recencyHalfLife days, and by starBoost when the note is starred.
+const (
+	titleWeight     = 4.0
+	recencyBoost    = 1.0
+	recencyHalfLife = 30.0
+	starBoost       = 1.5
+	snippetTokens   = 16
+)
+
+// starredCondition matches starred notes
+const starredCondition = `id IN (SELECT note_id FROM note_properties
+	WHERE key = '` + StarProperty + `' AND LOWER(TRIM(value)) NOT IN ('', 'false', 'no', '0'))`
+
+// Starred reports whether properties star a note
+func Starred(properties []Property) bool {
+	for _, p := range properties {
+		if p.Key == StarProperty {
+			switch strings.ToLower(strings.TrimSpace(p.Value)) {
+			case "", "false", "no", "0":
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// SearchQuery is a parsed search. Words and phrases must all appear in a
+// note's title or markdown; every operator must match too.
+type SearchQuery struct {
+	Terms   []string `json:"terms"`
+	Phrases []string `json:"phrases"`
+	Tags    []string `json:"tags"`
+	// Notebook is a notebook ID or name and includes its sub-notebooks
+	Notebook string `json:"notebook"`
+	// Before and After bound the date a note was captured, or created when
+	// the page had no date, exclusive and as YYYY-MM-DD
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// Empty reports whether the query has nothing to search for
+func (q SearchQuery) Empty() bool {
+	return len(q.Terms) == 0 && len(q.Phrases) == 0 && len(q.Tags) == 0 &&
+		q.Notebook == "" && q.Before == "" && q.After == ""
+}
+
+// SearchResult is a note matching a search, with its score and, for text
+// searches, the piece of the note that matched
+type SearchResult struct {
+	Note    Note    `json:"note"`
+	Score   float64 `json:"score"`
+	Starred bool    `json:"starred"`
+	Snippet string  `json:"snippet"`
+}
+
+// splitSearch splits q at spaces outside double quotes. A quoted token
+// comes back with its quotes so phrases can be told apart from words.
+func splitSearch(q string) []string {
+	var tokens []string
+	var token strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			token.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+// unquote strips the double quotes from a token
+func unquote(token string) string {
+	return strings.TrimSpace(strings.ReplaceAll(token, `"`, ""))
+}
+
+// ParseSearch reads a search box query: words, "exact phrases" and the
+// operators tag:, notebook:, before: and after:. Operator values may be
+// quoted, as in notebook:"Week 2". An unknown operator is searched for as a
+// word.
+func ParseSearch(q string) (SearchQuery, error) {
+	query := SearchQuery{Terms: []string{}, Phrases: []string{}, Tags: []string{}}
+	for _, token := range splitSearch(q) {
+		if strings.HasPrefix(token, `"`) {
+			if phrase := unquote(token); phrase != "" {
+				query.Phrases = append(query.Phrases, phrase)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(token, ":")
+		value = unquote(value)
+		if !ok || value == "" {
+			query.Terms = append(query.Terms, unquote(token))
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "tag":
+			query.Tags = append(query.Tags, ParseTags(value)...)
+		case "notebook":
+			query.Notebook = value
+		case "before", "after":
+			if _, err := time.Parse(time.DateOnly, value); err != nil {
+				return query, fmt.Errorf("%s: needs a date as YYYY-MM-DD, not %q", strings.ToLower(key), value)
+			}
+			if strings.EqualFold(key, "before") {
+				query.Before = value
+			} else {
+				query.After = value
+			}
+		default:
+			query.Terms = append(query.Terms, unquote(token))
+		}
+	}
+	return query, nil
+}
+
+// ftsString quotes s as an FTS5 string, which matches it as a phrase and
+// keeps characters such as - and : from being read as FTS5 syntax
+func ftsString(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// match is the FTS5 expression for the query's words and phrases, or ""
+func (q SearchQuery) match() string {
+	parts := []string{}
+	for _, s := range append(append([]string{}, q.Terms...), q.Phrases...) {
+		parts = append(parts, ftsString(s))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Search finds the notes outside the trash matching q, best first, and the
+// number of matches in all. Text matches are ranked by BM25, with titles
+// weighted above the body, then boosted for recent and starred notes; a
+// search with only operators ranks by recency and stars alone. Words and
+// phrases are looked up in index, brought up to date first, or in the FTS5
+// index when it is nil.
+func Search(db *sql.DB, index *MemoryIndex, q SearchQuery, limit, offset int) ([]SearchResult, int, error) {
+	if q.Empty() {
+		return nil, 0, fmt.Errorf("search query required")
+	}
+	if index != nil {
+		if err := index.Sync(db); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// BM25 falls to about zero for words in most notes, so every match
+	// starts from a relevance of 1 for the boosts to work on. Arguments go in
+	// the order they appear: the match, the ranking weights, then the filters.
+	matches := `SELECT id AS note_id, 1.0 AS relevance, '' AS snippet FROM notes`
+	var args []any
+	if match := q.match(); match != "" && index != nil {
+		matches = `SELECT CAST(key AS INTEGER) AS note_id, value AS relevance, '' AS snippet FROM json_each(?)`
+		args = append(args, memoryMatches(index, q))
+	} else if match != "" {
+		matches = fmt.Sprintf(`SELECT rowid AS note_id, 1 + MAX(0, -bm25(notes_fts, %g, 1.0)) AS relevance,
+			snippet(notes_fts, 1, '', '', '…', %d) AS snippet
+			FROM notes_fts WHERE notes_fts MATCH ?`, titleWeight, snippetTokens)
+		args = append(args, match)
+	}
+	args = append(args, recencyBoost, recencyHalfLife, recencyHalfLife, starBoost)
+
+	where := []string{"deleted_at IS NULL"}
+	for _, tag := range q.Tags {
+		condition, tagArgs := tagCondition(tag)
+		where = append(where, condition)
+		args = append(args, tagArgs...)
+	}
+	if q.Notebook != "" {
+		where = append(where, `notebook_id IN (WITH RECURSIVE tree(id) AS (
+			SELECT id FROM notebooks WHERE CAST(id AS TEXT) = ? OR LOWER(name) = LOWER(?)
+			UNION SELECT notebooks.id FROM notebooks JOIN tree ON notebooks.parent_id = tree.id) SELECT id FROM tree)`)
+		args = append(args, q.Notebook, q.Notebook)
+	}
+	const noteDate = `date(COALESCE(NULLIF(captured_at, ''), date_created))`
+	if q.Before != "" {
+		where = append(where, noteDate+` < ?`)
+		args = append(args, q.Before)
+	}
+	if q.After != "" {
+		where = append(where, noteDate+` > ?`)
+		args = append(args, q.After)
+	}
+
+	query := `WITH matches AS (` + matches + `)
+		SELECT ` + noteColumns + `, snippet, ` + starredCondition + ` AS starred,
+			relevance * (1 + ? * ? / (? + MAX(0, julianday('now') - julianday(COALESCE(NULLIF(captured_at, ''), date_created)))))
+				* CASE WHEN ` + starredCondition + ` THEN ? ELSE 1 END AS score,
+			COUNT(*) OVER ()
+		FROM notes JOIN matches ON matches.note_id = notes.id
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY score DESC, id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to search notes: %w", err)
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	total := 0
+	for rows.Next() {
+		var result SearchResult
+		var deletedAt sql.NullTime
+		note := &result.Note
+		err := rows.Scan(&note.ID, &note.DateCreated, &note.Image, &note.Title, &note.Markdown,
+			&note.Direction, &note.WordCount, &note.ReadingTime, &note.NoteType, &note.Revision,
+			&note.NotebookID, &note.PhysicalID, &note.PageNumber, &note.CapturedAt, &note.Review, &deletedAt,
+			&result.Snippet, &result.Starred, &result.Score, &total)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan search result: %w", err)
+		}
+		if index != nil && q.match() != "" {
+			result.Snippet = memorySnippet(note.Markdown, q)
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating search results: %w", err)
+	}
+	return results, total, nil
+}
+
+// createSearchIndex creates the full-text index of note titles and
+// markdown, kept up to date by triggers, and fills it when it is new
+func createSearchIndex(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'notes_fts'`).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check search index: %w", err)
+	}
+
+	index := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS notes_fts USING fts5(
+		title, markdown, content='notes', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+	);
+
+	CREATE TRIGGER IF NOT EXISTS notes_fts_insert AFTER INSERT ON notes BEGIN
+		INSERT INTO notes_fts(rowid, title, markdown) VALUES (new.id, new.title, new.markdown);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS notes_fts_delete AFTER DELETE ON notes BEGIN
+		INSERT INTO notes_fts(notes_fts, rowid, title, markdown) VALUES ('delete', old.id, old.title, old.markdown);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS notes_fts_update AFTER UPDATE OF title, markdown ON notes BEGIN
+		INSERT INTO notes_fts(notes_fts, rowid, title, markdown) VALUES ('delete', old.id, old.title, old.markdown);
+		INSERT INTO notes_fts(rowid, title, markdown) VALUES (new.id, new.title, new.markdown);
+	END;
+	`
+	if _, err := db.Exec(index); err != nil {
+		return fmt.Errorf("failed to create search index: %w", err)
+	}
+	if exists == 0 {
+		if _, err := db.Exec(`INSERT INTO notes_fts(notes_fts) VALUES ('rebuild')`); err != nil {
+			return fmt.Errorf("failed to build search index: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package funcs
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseSearch(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		q     string
+		want  SearchQuery
+		match string
+	}{
+		{
+			name:  "words",
+			q:     "  lecture   notes ",
+			want:  SearchQuery{Terms: []string{"lecture", "notes"}},
+			match: `"lecture" "notes"`,
+		},
+		{
+			name:  "quoted phrase",
+			q:     `"cell division" mitosis`,
+			want:  SearchQuery{Terms: []string{"mitosis"}, Phrases: []string{"cell division"}},
+			match: `"mitosis" "cell division"`,
+		},
+		{
+			name: "field filters",
+			q:    `tag:Biology,exam notebook:"Week 2" after:2026-01-01 before:2026-02-01`,
+			want: SearchQuery{Tags: []string{"biology", "exam"}, Notebook: "Week 2", After: "2026-01-01", Before: "2026-02-01"},
+		},
+		{
+			name:  "operators ignore case",
+			q:     "TAG:math Notebook:3",
+			want:  SearchQuery{Tags: []string{"math"}, Notebook: "3"},
+			match: "",
+		},
+		{
+			name:  "unknown operator is a word",
+			q:     "author:ada",
+			want:  SearchQuery{Terms: []string{"author:ada"}},
+			match: `"author:ada"`,
+		},
+		{
+			name:  "operator without a value is a word",
+			q:     "tag: notebook:",
+			want:  SearchQuery{Terms: []string{"tag:", "notebook:"}},
+			match: `"tag:" "notebook:"`,
+		},
+		{
+			// There is no negation: a leading - is part of the word, and
+			// quoting keeps FTS5 from reading it as NOT
+			name:  "negation is searched for literally",
+			q:     "-draft NOT final",
+			want:  SearchQuery{Terms: []string{"-draft", "NOT", "final"}},
+			match: `"-draft" "NOT" "final"`,
+		},
+		{
+			name:  "unbalanced quote runs to the end",
+			q:     `mitosis "cell division`,
+			want:  SearchQuery{Terms: []string{"mitosis"}, Phrases: []string{"cell division"}},
+			match: `"mitosis" "cell division"`,
+		},
+		{
+			name: "empty phrases are dropped",
+			q:    `"" "  " """`,
+			want: SearchQuery{},
+		},
+		{
+			name: "empty query",
+			q:    "   ",
+			want: SearchQuery{},
+		},
+		{
+			name:  "FTS syntax characters",
+			q:     `a* (b OR c) ^d e:f NEAR(g,h) "i""j"`,
+			want:  SearchQuery{Terms: []string{"a*", "(b", "OR", "c)", "^d", "e:f", "NEAR(g,h)"}, Phrases: []string{"ij"}},
+			match: `"a*" "(b" "OR" "c)" "^d" "e:f" "NEAR(g,h)" "ij"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseSearch(tc.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.want
+			for _, list := range []*[]string{&want.Terms, &want.Phrases, &want.Tags} {
+				if *list == nil {
+					*list = []string{}
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ParseSearch(%q) = %+v, want %+v", tc.q, got, want)
+			}
+			if m := got.match(); m != tc.match {
+				t.Errorf("match = %s, want %s", m, tc.match)
+			}
+		})
+	}
+}
+
+func TestParseSearchBadDate(t *testing.T) {
+	for _, q := range []string{"before:yesterday", "after:2026-13-01", `after:"1 Jan"`} {
+		if _, err := ParseSearch(q); err == nil {
+			t.Errorf("ParseSearch(%q) accepted a bad date", q)
+		}
+	}
+}
+
+func TestSearchFTSSyntaxCharacters(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.AddNote(context.Background(), "a.png", "# NEAR(x) and a-b\n\nOR ^start \"quoted\"\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		q    string
+		hits int
+	}{
+		{`a-b`, 1}, {`NEAR(x)`, 1}, {`OR`, 1}, {`^start`, 1}, {`"quoted`, 1}, {`*`, 0}, {`"a-b" AND`, 1}, {`"a-b" missing`, 0},
+	} {
+		query, err := ParseSearch(tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, total, err := Search(s.DB, nil, query, 10, 0)
+		if err != nil {
+			t.Errorf("Search(%q): %v", tc.q, err)
+		} else if total != tc.hits {
+			t.Errorf("Search(%q) found %d notes, want %d", tc.q, total, tc.hits)
+		}
+	}
+}
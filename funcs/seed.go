@@ -0,0 +1,198 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SeedOptions controls the fake data SeedNotes generates
+type SeedOptions struct {
+	Notes     int
+	Notebooks int
+	// Seed makes the output repeatable; the same seed gives the same notes
+	Seed uint64
+}
+
+// SeedStats counts what SeedNotes created
+type SeedStats struct {
+	Notes     int
+	Notebooks int
+	Revisions int
+}
+
+// seedImages is how many placeholder images the fake notes share
+const seedImages = 8
+
+var (
+	seedSubjects = []string{"Biology", "Chemistry", "History", "Linear algebra", "Databases", "Philosophy",
+		"Economics", "Spanish", "Statistics", "Operating systems", "Literature", "Physics"}
+	seedTags  = []string{"exam", "lecture", "reading", "lab", "todo", "summary", "draft", "important", "formula", "question"}
+	seedWords = strings.Fields(`lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor
+		incididunt ut labore et dolore magna aliqua enim ad minim veniam quis nostrud exercitation ullamco laboris
+		nisi aliquip ex ea commodo consequat duis aute irure in reprehenderit voluptate velit esse cillum fugiat
+		nulla pariatur excepteur sint occaecat cupidatat non proident sunt culpa qui officia deserunt mollit anim
+		id est laborum`)
+)
+
+// SeedNotes fills the database with fake notes for development: lorem
+// ipsum markdown over placeholder images written to imageDir, spread over
+// the past year, filed into nested notebooks, tagged, linked to one another
+// and with some earlier revisions.
+func SeedNotes(db *sql.DB, imageDir string, opts SeedOptions) (SeedStats, error) {
+	var stats SeedStats
+	rng := rand.New(rand.NewPCG(opts.Seed, opts.Seed^0x9e3779b97f4a7c15))
+
+	images := make([]string, seedImages)
+	for i := range images {
+		images[i] = fmt.Sprintf("seed-%d.png", i+1)
+		if err := writeSeedImage(filepath.Join(imageDir, images[i]), rng); err != nil {
+			return stats, err
+		}
+	}
+
+	var notebooks []int
+	for i := range opts.Notebooks {
+		parent := 0
+		if len(notebooks) > 0 && rng.IntN(3) == 0 {
+			parent = notebooks[rng.IntN(len(notebooks))]
+		}
+		name := seedSubjects[i%len(seedSubjects)]
+		if i >= len(seedSubjects) {
+			name = fmt.Sprintf("%s %d", name, i/len(seedSubjects)+1)
+		}
+		nb, err := CreateNotebook(db, name, parent)
+		if err != nil {
+			return stats, err
+		}
+		notebooks = append(notebooks, nb.ID)
+		stats.Notebooks++
+	}
+
+	var noteIDs []int
+	now := time.Now().UTC()
+	for range opts.Notes {
+		note, err := AddNote(db, images[rng.IntN(len(images))], seedMarkdown(rng, noteIDs))
+		if err != nil {
+			return stats, err
+		}
+		noteIDs = append(noteIDs, note.ID)
+		stats.Notes++
+
+		// Spread the notes over the past year and into the notebooks
+		created := now.Add(-time.Duration(rng.Int64N(int64(365 * 24 * time.Hour))))
+		notebook := 0
+		if len(notebooks) > 0 && rng.IntN(5) > 0 {
+			notebook = notebooks[rng.IntN(len(notebooks))]
+		}
+		if _, err := db.Exec(`UPDATE notes SET date_created = ?, notebook_id = ? WHERE id = ?`,
+			created.Format(time.DateTime), notebook, note.ID); err != nil {
+			return stats, fmt.Errorf("failed to date seeded note: %w", err)
+		}
+
+		tags := rng.Perm(len(seedTags))[:1+rng.IntN(3)]
+		names := make([]string, len(tags))
+		for i, t := range tags {
+			names[i] = seedTags[t]
+		}
+		if err := SetProperty(db, note.ID, "tags", strings.Join(names, ", ")); err != nil {
+			return stats, err
+		}
+
+		// About one note in four has been edited since it was transcribed
+		if rng.IntN(4) == 0 {
+			markdown := note.Markdown
+			for range 1 + rng.IntN(3) {
+				markdown += "\n" + seedSentence(rng) + "\n"
+				if _, err := UpdateNote(db, note.ID, note.Image, markdown); err != nil {
+					return stats, err
+				}
+				stats.Revisions++
+			}
+		}
+	}
+	return stats, nil
+}
+
+// seedMarkdown writes a lorem ipsum note with a heading, sections, lists,
+// the odd code block and sometimes a link to an earlier note
+func seedMarkdown(rng *rand.Rand, earlier []int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n%s\n", seedTitle(rng), seedParagraph(rng))
+	for range 1 + rng.IntN(3) {
+		fmt.Fprintf(&b, "\n## %s\n\n", seedTitle(rng))
+		switch rng.IntN(4) {
+		case 0:
+			for range 2 + rng.IntN(4) {
+				fmt.Fprintf(&b, "- %s\n", strings.TrimSuffix(seedSentence(rng), "."))
+			}
+		case 1:
+			fmt.Fprintf(&b, "```\n%s = %d * %s\n```\n", seedWords[rng.IntN(len(seedWords))], rng.IntN(100),
+				seedWords[rng.IntN(len(seedWords))])
+		default:
+			fmt.Fprintf(&b, "%s\n", seedParagraph(rng))
+		}
+	}
+	if len(earlier) > 0 && rng.IntN(3) == 0 {
+		fmt.Fprintf(&b, "\nSee also [[%d]].\n", earlier[rng.IntN(len(earlier))])
+	}
+	return b.String()
+}
+
+func seedTitle(rng *rand.Rand) string {
+	words := make([]string, 2+rng.IntN(3))
+	for i := range words {
+		words[i] = seedWords[rng.IntN(len(seedWords))]
+	}
+	return strings.ToUpper(words[0][:1]) + strings.Join(words, " ")[1:]
+}
+
+func seedSentence(rng *rand.Rand) string {
+	words := make([]string, 6+rng.IntN(10))
+	for i := range words {
+		words[i] = seedWords[rng.IntN(len(seedWords))]
+	}
+	return strings.ToUpper(words[0][:1]) + strings.Join(words, " ")[1:] + "."
+}
+
+func seedParagraph(rng *rand.Rand) string {
+	sentences := make([]string, 2+rng.IntN(4))
+	for i := range sentences {
+		sentences[i] = seedSentence(rng)
+	}
+	return strings.Join(sentences, " ")
+}
+
+// writeSeedImage draws a ruled page in a random paper tint
+func writeSeedImage(path string, rng *rand.Rand) error {
+	const width, height = 480, 640
+	paper := color.RGBA{uint8(225 + rng.IntN(31)), uint8(225 + rng.IntN(31)), uint8(200 + rng.IntN(56)), 255}
+	ink := color.RGBA{150, 170, 210, 255}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			if y > 60 && y%24 == 0 || x == 60 {
+				img.Set(x, y, ink)
+			} else {
+				img.Set(x, y, paper)
+			}
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create placeholder image: %w", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		return fmt.Errorf("failed to encode placeholder image: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// DefaultBaseURL is Gemini's OpenAI-compatible endpoint
+const DefaultBaseURL = "https://generativelanguage.googleapis.com/v1beta/openai/"
+
+// Keys of the AI settings in the settings table
+const (
+	SettingProvider    = "ai.provider"
+	SettingAPIKey      = "ai.api_key"
+	SettingBaseURL     = "ai.base_url"
+	SettingModel       = "ai.model"
+	SettingPrompt      = "ai.prompt"
+	SettingTemperature = "ai.temperature"
+	SettingMaxTokens   = "ai.max_tokens"
+)
+
+// MaxTokensLimit is the largest reply length that can be asked for
+const MaxTokensLimit = 128000
+
+// AISettings configures the transcription provider
+type AISettings struct {
+	Provider string `json:"provider"`
+	APIKey   string `json:"-"`
+	BaseURL  string `json:"base_url"`
+	Model    string `json:"model"`
+	Prompt   string `json:"prompt"`
+	// Temperature is left to the provider's default when nil
+	Temperature *float64 `json:"temperature"`
+	// MaxTokens bounds the reply; zero uses the provider's default
+	MaxTokens int `json:"max_tokens"`
+}
+
+// AIOverrides replace parts of the AI settings for a single request. Empty
+// fields keep the configured value.
+type AIOverrides struct {
+	Model       string   `json:"model,omitempty"`
+	Prompt      string   `json:"prompt,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	// Force asks the provider even when the response is cached, replacing
+	// the cached one
+	Force bool `json:"force,omitempty"`
+}
+
+// With returns the settings with the overrides applied
+func (s AISettings) With(o AIOverrides) AISettings {
+	if o.Model != "" {
+		s.Model = o.Model
+	}
+	if o.Prompt != "" {
+		s.Prompt = o.Prompt
+	}
+	if o.Temperature != nil {
+		s.Temperature = o.Temperature
+	}
+	if o.MaxTokens != 0 {
+		s.MaxTokens = o.MaxTokens
+	}
+	return s
+}
+
+// ParseTemperature reads a sampling temperature between 0 and 2, or nil
+// from an empty string
+func ParseTemperature(value string) (*float64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := strconv.ParseFloat(value, 64)
+	if err != nil || t < 0 || t > 2 {
+		return nil, fmt.Errorf("temperature must be a number from 0 to 2")
+	}
+	return &t, nil
+}
+
+// ParseMaxTokens reads a reply length of 1 to MaxTokensLimit tokens, or 0
+// from an empty string
+func ParseMaxTokens(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > MaxTokensLimit {
+		return 0, fmt.Errorf("max tokens must be a whole number from 1 to %d", MaxTokensLimit)
+	}
+	return n, nil
+}
+
+// formatTemperature is the stored form of a temperature, empty when unset
+func formatTemperature(t *float64) string {
+	if t == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*t, 'f', -1, 64)
+}
+
+// formatMaxTokens is the stored form of a reply length, empty when unset
+func formatMaxTokens(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// request builds a request in the settings' model and parameters
+func (s AISettings) request(prompt string) VisionRequest {
+	return VisionRequest{Model: s.Model, Prompt: prompt, Temperature: s.Temperature, MaxTokens: s.MaxTokens}
+}
+
+// DefaultAISettings uses the built-in model and prompt with OpenAI-compatible
+// requests to Gemini. BOOKMD_AI_PROVIDER, BOOKMD_AI_API_KEY (or
+// OPENAI_API_KEY), BOOKMD_AI_BASE_URL, BOOKMD_AI_MODEL, BOOKMD_AI_PROMPT,
+// BOOKMD_AI_TEMPERATURE and BOOKMD_AI_MAX_TOKENS override them.
+func DefaultAISettings() AISettings {
+	s := AISettings{
+		Provider: ProviderOpenAI,
+		APIKey:   os.Getenv("OPENAI_API_KEY"),
+		BaseURL:  DefaultBaseURL,
+		Model:    TranscriptionModel,
+		Prompt:   TranscriptionPrompt,
+	}
+	if v := os.Getenv("BOOKMD_AI_PROVIDER"); ValidProvider(v) {
+		s.Provider = v
+	}
+	if v := os.Getenv("BOOKMD_AI_API_KEY"); v != "" {
+		s.APIKey = v
+	}
+	if v := os.Getenv("BOOKMD_AI_BASE_URL"); v != "" {
+		s.BaseURL = v
+	}
+	if v := os.Getenv("BOOKMD_AI_MODEL"); v != "" {
+		s.Model = v
+	}
+	if v := os.Getenv("BOOKMD_AI_PROMPT"); v != "" {
+		s.Prompt = v
+	}
+	if t, err := ParseTemperature(os.Getenv("BOOKMD_AI_TEMPERATURE")); err == nil && t != nil {
+		s.Temperature = t
+	}
+	if n, err := ParseMaxTokens(os.Getenv("BOOKMD_AI_MAX_TOKENS")); err == nil && n != 0 {
+		s.MaxTokens = n
+	}
+	return s
+}
+
+// NewClient builds a client for the settings' provider. Without an API key,
+// which Ollama and Tesseract do not need, it falls back to local OCR, or
+// returns nil when tesseract is not installed either. The native providers
+// use their own endpoint while the base URL is left at the OpenAI-compatible
+// default. Provider clients retry transient failures and wait their turn
+// under limit.
+func (s AISettings) newClient(limit *AILimit) VisionClient {
+	if s.Provider == ProviderTesseract || (s.APIKey == "" && s.Provider != ProviderOllama) {
+		return LocalOCR()
+	}
+	nativeURL := func(native string) string {
+		if s.BaseURL == "" || s.BaseURL == DefaultBaseURL {
+			return native
+		}
+		return s.BaseURL
+	}
+	var client VisionClient
+	switch s.Provider {
+	case ProviderGemini:
+		client = &GeminiVision{APIKey: s.APIKey, BaseURL: nativeURL(GeminiBaseURL)}
+	case ProviderAnthropic:
+		client = &AnthropicVision{APIKey: s.APIKey, BaseURL: nativeURL(AnthropicBaseURL)}
+	case ProviderOllama:
+		client = &OllamaVision{APIKey: s.APIKey, BaseURL: nativeURL(OllamaBaseURL)}
+	default:
+		config := openai.DefaultConfig(s.APIKey)
+		config.BaseURL = s.BaseURL
+		client = &OpenAIVision{Client: openai.NewClientWithConfig(config)}
+	}
+	return withRetries(&LimitedVision{Client: client, Limit: limit})
+}
+
+// ValidProvider reports whether provider names a supported AI provider
+func ValidProvider(provider string) bool {
+	switch provider {
+	case ProviderOpenAI, ProviderGemini, ProviderAnthropic, ProviderOllama, ProviderTesseract:
+		return true
+	}
+	return false
+}
+
+// MaskedKey shows only the last four characters of the API key
+func (s AISettings) MaskedKey() string {
+	if len(s.APIKey) <= 4 {
+		return ""
+	}
+	return "…" + s.APIKey[len(s.APIKey)-4:]
+}
+
+// LoadAISettings returns the defaults overridden by any stored settings
+func LoadAISettings(db *sql.DB) (AISettings, error) {
+	s := DefaultAISettings()
+	rows, err := db.Query(`SELECT key, value FROM settings WHERE key LIKE 'ai.%'`)
+	if err != nil {
+		return s, fmt.Errorf("failed to query settings: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return s, fmt.Errorf("failed to scan setting: %w", err)
+		}
+		if value == "" {
+			continue
+		}
+		switch key {
+		case SettingProvider:
+			s.Provider = value
+		case SettingAPIKey:
+			s.APIKey = value
+		case SettingBaseURL:
+			s.BaseURL = value
+		case SettingModel:
+			s.Model = value
+		case SettingPrompt:
+			s.Prompt = value
+		case SettingTemperature:
+			if t, err := ParseTemperature(value); err == nil {
+				s.Temperature = t
+			}
+		case SettingMaxTokens:
+			if n, err := ParseMaxTokens(value); err == nil {
+				s.MaxTokens = n
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return s, fmt.Errorf("error iterating settings: %w", err)
+	}
+	return s, nil
+}
+
+// SaveAISettings stores the given settings. An empty value removes the
+// stored setting so the default applies again.
+func SaveAISettings(db *sql.DB, s AISettings) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for key, value := range map[string]string{
+		SettingProvider:    s.Provider,
+		SettingAPIKey:      s.APIKey,
+		SettingBaseURL:     s.BaseURL,
+		SettingModel:       s.Model,
+		SettingPrompt:      s.Prompt,
+		SettingTemperature: formatTemperature(s.Temperature),
+		SettingMaxTokens:   formatMaxTokens(s.MaxTokens),
+	} {
+		if value == "" {
+			_, err = tx.Exec(`DELETE FROM settings WHERE key = ?`, key)
+		} else {
+			_, err = tx.Exec(`INSERT INTO settings (key, value) VALUES (?, ?)
+				ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, value)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save setting %s: %w", key, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit settings: %w", err)
+	}
+	return nil
+}
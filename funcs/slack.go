@@ -0,0 +1,238 @@
+package funcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// slackAPI is the base URL of the Slack Web API
+const slackAPI = "https://slack.com/api/"
+
+// slackMaxSkew is how old a signed Slack request may be before it is
+// rejected as a possible replay
+const slackMaxSkew = 5 * time.Minute
+
+// SlackApp transcribes images shared in Slack channels and replies in a
+// thread with the markdown
+type SlackApp struct {
+	BotToken      string
+	SigningSecret string
+	DB            *sql.DB
+	AI            *Transcriber
+	// SaveImage stores a shared image the way uploads are stored, returning
+	// its name, and ImagePath is the file the AI reads a stored image from
+	SaveImage func(name string, r io.Reader) (string, error)
+	ImagePath func(name string) string
+	HTTP      *http.Client
+}
+
+// slackFile is the subset of a Slack file object the app reads
+type slackFile struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Mimetype   string `json:"mimetype"`
+	URLPrivate string `json:"url_private"`
+	Permalink  string `json:"permalink"`
+	Shares     struct {
+		Public  map[string][]struct{ Ts string } `json:"public"`
+		Private map[string][]struct{ Ts string } `json:"private"`
+	} `json:"shares"`
+}
+
+// VerifySlackRequest checks the X-Slack-Signature header of a request body
+// against the signing secret
+func VerifySlackRequest(secret string, header http.Header, body []byte, now time.Time) error {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or invalid slack timestamp")
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return fmt.Errorf("slack request timestamp too old")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", ts)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("slack signature mismatch")
+	}
+	return nil
+}
+
+// LatestImage finds the most recent image file posted in a channel
+func (s *SlackApp) LatestImage(ctx context.Context, channelID string) (string, error) {
+	var resp struct {
+		Messages []struct {
+			Files []slackFile `json:"files"`
+		} `json:"messages"`
+	}
+	params := url.Values{"channel": {channelID}, "limit": {"50"}}
+	if err := s.call(ctx, "conversations.history", params, &resp); err != nil {
+		return "", err
+	}
+
+	for _, msg := range resp.Messages {
+		for _, file := range msg.Files {
+			if strings.HasPrefix(file.Mimetype, "image/") {
+				return file.ID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no recent image in this channel")
+}
+
+// TranscribeFile downloads a shared image, stores it as a note with its Slack
+// permalink as provenance, and replies in the thread of the message that
+// shared it. A non-image file is ignored.
+func (s *SlackApp) TranscribeFile(ctx context.Context, fileID, channelID string) error {
+	var info struct {
+		File slackFile `json:"file"`
+	}
+	if err := s.call(ctx, "files.info", url.Values{"file": {fileID}}, &info); err != nil {
+		return err
+	}
+	file := info.File
+	if !strings.HasPrefix(file.Mimetype, "image/") {
+		return nil
+	}
+
+	data, err := s.download(ctx, file.URLPrivate)
+	if err != nil {
+		return err
+	}
+	filename, err := s.SaveImage(file.Name, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to save image: %w", err)
+	}
+	// An image already made into a note is answered with that note
+	existing, err := existingNote(s.DB, filename)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return s.postMessage(ctx, channelID, shareTs(file, channelID), existing.Markdown)
+	}
+
+	transcription, err := s.AI.TranscribeImage(ctx, s.ImagePath(filename))
+	if err != nil {
+		s.postMessage(ctx, channelID, shareTs(file, channelID), "Sorry, I couldn't transcribe that image.")
+		return err
+	}
+
+	markdown := transcription.Markdown
+	note, err := AddNote(s.DB, filename, markdown)
+	if err != nil {
+		return err
+	}
+	if err := SetNoteCapture(s.DB, note.ID, transcription); err != nil {
+		return err
+	}
+	for key, value := range map[string]string{
+		"slack_channel":   channelID,
+		"slack_file_id":   file.ID,
+		"slack_permalink": file.Permalink,
+	} {
+		if err := SetProperty(s.DB, note.ID, key, value); err != nil {
+			return err
+		}
+	}
+
+	return s.postMessage(ctx, channelID, shareTs(file, channelID), markdown)
+}
+
+// shareTs returns the timestamp of the message that shared a file in a
+// channel, which is the thread to reply in
+func shareTs(file slackFile, channelID string) string {
+	for _, shares := range []map[string][]struct{ Ts string }{file.Shares.Public, file.Shares.Private} {
+		if s := shares[channelID]; len(s) > 0 {
+			return s[0].Ts
+		}
+	}
+	return ""
+}
+
+// postMessage sends text to a channel, threaded under threadTs when set
+func (s *SlackApp) postMessage(ctx context.Context, channelID, threadTs, text string) error {
+	params := url.Values{"channel": {channelID}, "text": {text}}
+	if threadTs != "" {
+		params.Set("thread_ts", threadTs)
+	}
+	return s.call(ctx, "chat.postMessage", params, nil)
+}
+
+// download fetches a private Slack file URL with the bot token
+func (s *SlackApp) download(ctx context.Context, fileURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.BotToken)
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file download returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+}
+
+// call invokes a Web API method with form parameters and decodes the
+// response into out, turning "ok": false into an error
+func (s *SlackApp) call(ctx context.Context, method string, params url.Values, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackAPI+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.BotToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("slack %s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("slack %s failed: %w", method, err)
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fmt.Errorf("slack %s returned invalid JSON", method)
+	}
+	if !status.OK {
+		return fmt.Errorf("slack %s failed: %s", method, status.Error)
+	}
+	if out != nil {
+		return json.NewDecoder(bytes.NewReader(data)).Decode(out)
+	}
+	return nil
+}
+
+func (s *SlackApp) client() *http.Client {
+	if s.HTTP == nil {
+		s.HTTP = &http.Client{Timeout: 60 * time.Second}
+	}
+	return s.HTTP
+}
@@ -1,8 +1,11 @@
 package funcs
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -13,13 +16,65 @@ type Note struct {
 	ID          int       `json:"id"`
 	DateCreated time.Time `json:"date_created"`
 	Image       string    `json:"image"`
+	Title       string    `json:"title"`
 	Markdown    string    `json:"markdown"`
+	Direction   string    `json:"direction"`
+	WordCount   int       `json:"word_count"`
+	ReadingTime int       `json:"reading_time"`
+	NoteType    string    `json:"note_type"`
+	Revision    int       `json:"revision"`
+	NotebookID  int       `json:"notebook_id"`
+	PhysicalID  int       `json:"physical_notebook_id"`
+	PageNumber  int       `json:"page_number"`
+	CapturedAt  string    `json:"captured_at"`
+	Review      string    `json:"review"`
+	// DeletedAt is when the note was moved to the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
+// noteColumns lists the columns scanned by scanNote, in order
+const noteColumns = `id, date_created, image, title, markdown, direction, word_count, reading_time, note_type, revision, notebook_id, physical_notebook_id, page_number, captured_at, review, deleted_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanNote reads one row selected with noteColumns
+func scanNote(row rowScanner) (*Note, error) {
+	var note Note
+	var deletedAt sql.NullTime
+	err := row.Scan(&note.ID, &note.DateCreated, &note.Image, &note.Title, &note.Markdown,
+		&note.Direction, &note.WordCount, &note.ReadingTime, &note.NoteType, &note.Revision,
+		&note.NotebookID, &note.PhysicalID, &note.PageNumber, &note.CapturedAt, &note.Review, &deletedAt)
+	if err != nil {
+		return nil, err
+	}
+	if deletedAt.Valid {
+		note.DeletedAt = &deletedAt.Time
+	}
+	return &note, nil
+}
+
+// Queries of the core note functions, prepared by NewStore
+const (
+	getNoteQuery    = `SELECT ` + noteColumns + ` FROM notes WHERE id = ? AND deleted_at IS NULL`
+	countNotesQuery = `SELECT COUNT(*) FROM notes WHERE deleted_at IS NULL`
+	insertNoteQuery = `INSERT INTO notes (image, markdown, direction, word_count, reading_time) VALUES (?, ?, ?, ?, ?)`
+	updateNoteQuery = `UPDATE notes SET image = ?, markdown = ?, direction = ?, word_count = ?, reading_time = ?, revision = revision + 1,
+		provenance = CASE WHEN markdown = ? THEN provenance ELSE '' END WHERE id = ?`
+	deleteNoteQuery = `UPDATE notes SET deleted_at = CURRENT_TIMESTAMP, revision = revision + 1
+		WHERE id = ? AND deleted_at IS NULL RETURNING revision`
+)
+
 // AddNote inserts a new note into the database
 func AddNote(db *sql.DB, image, markdown string) (*Note, error) {
-	query := `INSERT INTO notes (image, markdown) VALUES (?, ?)`
-	result, err := db.Exec(query, image, markdown)
+	return (&Store{DB: db}).AddNote(context.Background(), image, markdown)
+}
+
+func addNote(q dbtx, image, markdown string) (*Note, error) {
+	words := CountWords(markdown)
+	result, err := q.Exec(insertNoteQuery, image, markdown, DetectDirection(markdown), words, ReadingTime(words))
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert note: %w", err)
 	}
@@ -29,21 +84,38 @@ func AddNote(db *sql.DB, image, markdown string) (*Note, error) {
 		return nil, fmt.Errorf("failed to get last insert id: %w", err)
 	}
 
-	// Retrieve the newly created note
-	note := &Note{
-		ID:          int(id),
-		DateCreated: time.Now(),
-		Image:       image,
-		Markdown:    markdown,
+	if err := syncLinks(q, int(id), markdown); err != nil {
+		return nil, err
+	}
+	if err := recordChange(q, int(id), ChangeCreated, 1); err != nil {
+		return nil, err
 	}
 
+	// Retrieve the newly created note
+	note, err := getNote(q, int(id))
+	if err != nil {
+		return nil, err
+	}
 	return note, nil
 }
 
 // UpdateNote updates an existing note in the database
 func UpdateNote(db *sql.DB, id int, image, markdown string) (*Note, error) {
-	query := `UPDATE notes SET image = ?, markdown = ? WHERE id = ?`
-	result, err := db.Exec(query, image, markdown, id)
+	return (&Store{DB: db}).UpdateNote(context.Background(), id, image, markdown)
+}
+
+func updateNote(q dbtx, id int, image, markdown string) (*Note, error) {
+	if err := checkNoteUnlocked(q, id); err != nil {
+		return nil, err
+	}
+	if err := saveRevision(q, id, image, markdown); err != nil {
+		return nil, err
+	}
+
+	words := CountWords(markdown)
+	// Markdown that changes loses its provenance until the caller, if it
+	// was the AI, records the new one
+	result, err := q.Exec(updateNoteQuery, image, markdown, DetectDirection(markdown), words, ReadingTime(words), markdown, id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update note: %w", err)
 	}
@@ -53,52 +125,104 @@ func UpdateNote(db *sql.DB, id int, image, markdown string) (*Note, error) {
 		return nil, fmt.Errorf("failed to get rows affected: %w", err)
 	}
 	if rowsAffected == 0 {
-		return nil, fmt.Errorf("no note found with id %d", id)
+		return nil, notFound("no note found with id %d", id)
+	}
+
+	if err := syncLinks(q, id, markdown); err != nil {
+		return nil, err
 	}
 
 	// Retrieve the updated note
-	return GetNoteByID(db, id)
+	note, err := getNote(q, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordChange(q, id, ChangeUpdated, note.Revision); err != nil {
+		return nil, err
+	}
+	return note, nil
 }
 
-// DeleteNote removes a note from the database by ID
-func DeleteNote(db *sql.DB, id int) error {
-	query := `DELETE FROM notes WHERE id = ?`
-	result, err := db.Exec(query, id)
-	if err != nil {
-		return fmt.Errorf("failed to delete note: %w", err)
+// MaxTitleLength is the longest title a note can have, in characters
+const MaxTitleLength = 200
+
+// SetNoteTitle replaces a note's title. An empty title falls back to the
+// note's first heading when it is shown.
+func SetNoteTitle(db *sql.DB, id int, title string) (*Note, error) {
+	title = strings.TrimSpace(title)
+	if len([]rune(title)) > MaxTitleLength {
+		return nil, fmt.Errorf("title must be at most %d characters", MaxTitleLength)
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
+	var note *Note
+	err := inNoteTx(db, id, func(q dbtx) error {
+		// The new title ends the current revision, which is saved like any
+		// other, so the history has no gaps
+		if err := snapshotRevision(q, id); err != nil {
+			return err
+		}
+		result, err := q.Exec(`UPDATE notes SET title = ?, revision = revision + 1 WHERE id = ?`, title, id)
+		if err != nil {
+			return fmt.Errorf("failed to update note title: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return notFound("no note found with id %d", id)
+		}
+
+		if note, err = getNote(q, id); err != nil {
+			return err
+		}
+		return recordChange(q, id, ChangeUpdated, note.Revision)
+	})
+	return note, err
+}
+
+// DeleteNote moves a note to the trash. It keeps its links, properties and
+// image so RestoreNote can bring it back; PurgeNote removes it for good.
+func DeleteNote(db *sql.DB, id int) error {
+	return (&Store{DB: db}).DeleteNote(context.Background(), id)
+}
+
+func deleteNote(q dbtx, id int) error {
+	if err := checkNoteUnlocked(q, id); err != nil {
+		return err
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("no note found with id %d", id)
+	var revision int
+	err := q.QueryRow(deleteNoteQuery, id).Scan(&revision)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFound("no note found with id %d", id)
+		}
+		return fmt.Errorf("failed to delete note: %w", err)
 	}
 
-	return nil
+	return recordChange(q, id, ChangeDeleted, revision)
 }
 
 // GetNoteByID retrieves a note by its ID
 func GetNoteByID(db *sql.DB, id int) (*Note, error) {
-	query := `SELECT id, date_created, image, markdown FROM notes WHERE id = ?`
-	row := db.QueryRow(query, id)
+	return getNote(db, id)
+}
 
-	var note Note
-	err := row.Scan(&note.ID, &note.DateCreated, &note.Image, &note.Markdown)
+func getNote(q dbtx, id int) (*Note, error) {
+	note, err := scanNote(q.QueryRow(getNoteQuery, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("no note found with id %d", id)
+			return nil, notFound("no note found with id %d", id)
 		}
 		return nil, fmt.Errorf("failed to scan note: %w", err)
 	}
 
-	return &note, nil
+	return note, nil
 }
 
 // GetAllNotes retrieves all notes from the database
 func GetAllNotes(db *sql.DB) ([]Note, error) {
-	query := `SELECT id, date_created, image, markdown FROM notes ORDER BY date_created DESC`
+	query := `SELECT ` + noteColumns + ` FROM notes WHERE deleted_at IS NULL ORDER BY date_created DESC`
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query notes: %w", err)
@@ -107,12 +231,11 @@ func GetAllNotes(db *sql.DB) ([]Note, error) {
 
 	var notes []Note
 	for rows.Next() {
-		var note Note
-		err := rows.Scan(&note.ID, &note.DateCreated, &note.Image, &note.Markdown)
+		note, err := scanNote(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan note: %w", err)
 		}
-		notes = append(notes, note)
+		notes = append(notes, *note)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -122,9 +245,176 @@ func GetAllNotes(db *sql.DB) ([]Note, error) {
 	return notes, nil
 }
 
+// Orders accepted by ListNotes. SortCaptured orders by the date written on
+// the page, falling back to the upload date.
+const (
+	SortDate     = "date"
+	SortCaptured = "captured"
+	SortID       = "id"
+)
+
+// MaxListLimit caps the page size of ListNotes
+const MaxListLimit = 200
+
+// ListNotes returns one page of notes. Notes sorted by date are newest first
+// and notes sorted by ID oldest first, unless descending says otherwise.
+func ListNotes(db *sql.DB, sort string, descending bool, limit, offset int) ([]Note, error) {
+	return listNotes(db, sort, descending, limit, offset)
+}
+
+// listNotesQuery builds the query ListNotes runs for a sort order
+func listNotesQuery(sort string, descending bool) (string, error) {
+	var order string
+	switch sort {
+	case SortDate:
+		order = "date_created DESC, id DESC"
+		if !descending {
+			order = "date_created ASC, id ASC"
+		}
+	case SortCaptured:
+		order = "COALESCE(NULLIF(captured_at, ''), date(date_created)) DESC, id DESC"
+		if !descending {
+			order = "COALESCE(NULLIF(captured_at, ''), date(date_created)) ASC, id ASC"
+		}
+	case SortID:
+		order = "id ASC"
+		if descending {
+			order = "id DESC"
+		}
+	default:
+		return "", fmt.Errorf("unknown sort %q", sort)
+	}
+	return `SELECT ` + noteColumns + ` FROM notes WHERE deleted_at IS NULL ORDER BY ` + order + ` LIMIT ? OFFSET ?`, nil
+}
+
+func listNotes(q dbtx, sort string, descending bool, limit, offset int) ([]Note, error) {
+	query, err := listNotesQuery(sort, descending)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(query, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes = append(notes, *note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notes: %w", err)
+	}
+	return notes, nil
+}
+
+// CountNotes returns the number of stored notes
+func CountNotes(db *sql.DB) (int, error) {
+	return countNotes(db)
+}
+
+func countNotes(q dbtx) (int, error) {
+	var n int
+	if err := q.QueryRow(countNotesQuery).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count notes: %w", err)
+	}
+	return n, nil
+}
+
+// ImageInUse reports whether any note or saved revision still references
+// the image file. Notes in the trash count, so they can be restored with
+// their image.
+func ImageInUse(db *sql.DB, image string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM notes WHERE image = ?) +
+		(SELECT COUNT(*) FROM note_revisions WHERE image = ?)`, image, image).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to count image references: %w", err)
+	}
+	return count > 0, nil
+}
+
+// NoteImages lists the distinct images of the notes outside the trash,
+// newest first
+func NoteImages(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT image FROM notes WHERE deleted_at IS NULL AND image != ''
+		GROUP BY image ORDER BY MAX(id) DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query note images: %w", err)
+	}
+	defer rows.Close()
+
+	var images []string
+	for rows.Next() {
+		var image string
+		if err := rows.Scan(&image); err != nil {
+			return nil, fmt.Errorf("failed to scan note image: %w", err)
+		}
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating note images: %w", err)
+	}
+	return images, nil
+}
+
+// ImageKnown reports whether the image belongs to a note, including notes
+// in the trash and saved revisions, or is a paper notebook's cover
+func ImageKnown(db *sql.DB, image string) (bool, error) {
+	var known bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM notes WHERE image = ?)
+		OR EXISTS (SELECT 1 FROM note_revisions WHERE image = ?)
+		OR EXISTS (SELECT 1 FROM physical_notebooks WHERE cover_image = ?)`, image, image, image).Scan(&known)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up image: %w", err)
+	}
+	return known, nil
+}
+
+// NoteWithImage returns the ID of the newest note outside the trash that
+// shows the image, or 0 when there is none
+func NoteWithImage(db *sql.DB, image string) (int, error) {
+	var id int
+	err := db.QueryRow(`SELECT id FROM notes WHERE image = ? AND deleted_at IS NULL
+		ORDER BY id DESC LIMIT 1`, image).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to find note with image: %w", err)
+	}
+	return id, nil
+}
+
+// existingNote returns the newest note outside the trash that shows the
+// image, or nil when there is none
+func existingNote(db *sql.DB, image string) (*Note, error) {
+	id, err := NoteWithImage(db, image)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+	return GetNoteByID(db, id)
+}
+
 // InitDB initializes a new SQLite database connection and creates the schema
 func InitDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	// A path with its own parameters keeps them as they are. Transactions
+	// take the write lock when they begin: one that read first and upgraded
+	// later would fail with SQLITE_BUSY, without waiting out busy_timeout,
+	// when another connection wrote in between.
+	dsn := dbPath
+	if !strings.Contains(dsn, "?") {
+		params := url.Values{"_txlock": {"immediate"}}
+		for _, pragma := range dbPragmas {
+			params.Add("_pragma", pragma)
+		}
+		dsn += "?" + params.Encode()
+	}
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -140,16 +430,372 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
 		image TEXT NOT NULL,
-		markdown TEXT NOT NULL
+		title TEXT NOT NULL DEFAULT '',
+		markdown TEXT NOT NULL,
+		direction TEXT NOT NULL DEFAULT 'ltr',
+		word_count INTEGER NOT NULL DEFAULT 0,
+		reading_time INTEGER NOT NULL DEFAULT 0,
+		note_type TEXT NOT NULL DEFAULT '',
+		revision INTEGER NOT NULL DEFAULT 1,
+		notebook_id INTEGER NOT NULL DEFAULT 0,
+		physical_notebook_id INTEGER NOT NULL DEFAULT 0,
+		page_number INTEGER NOT NULL DEFAULT 0,
+		captured_at TEXT NOT NULL DEFAULT '',
+		review TEXT NOT NULL DEFAULT '',
+		provenance TEXT NOT NULL DEFAULT '',
+		deleted_at DATETIME
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_notes_date_created ON notes(date_created);
 	CREATE INDEX IF NOT EXISTS idx_notes_image ON notes(image);
+
+	CREATE TABLE IF NOT EXISTS note_links (
+		source_id INTEGER NOT NULL,
+		target_id INTEGER NOT NULL,
+		fragment TEXT NOT NULL DEFAULT '',
+		kind TEXT NOT NULL,
+		PRIMARY KEY (source_id, target_id, fragment, kind)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_note_links_target ON note_links(target_id);
+
+	CREATE TABLE IF NOT EXISTS note_properties (
+		note_id INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (note_id, key)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_note_properties_key ON note_properties(key, value);
+
+	CREATE TABLE IF NOT EXISTS note_types (
+		name TEXT PRIMARY KEY,
+		fields TEXT NOT NULL DEFAULT '[]'
+	);
+
+	CREATE TABLE IF NOT EXISTS note_feedback (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		note_id INTEGER NOT NULL,
+		rating INTEGER NOT NULL,
+		corrected_text TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL,
+		prompt_id TEXT NOT NULL,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_note_feedback_model ON note_feedback(model, prompt_id);
+
+	CREATE TABLE IF NOT EXISTS note_changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		note_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		revision INTEGER NOT NULL,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS notebooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		parent_id INTEGER NOT NULL DEFAULT 0,
+		locked INTEGER NOT NULL DEFAULT 0,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_notebooks_parent ON notebooks(parent_id);
+
+	CREATE TABLE IF NOT EXISTS physical_notebooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		cover_image TEXT NOT NULL DEFAULT '',
+		page_count INTEGER NOT NULL DEFAULT 0,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS pipelines (
+		name TEXT PRIMARY KEY,
+		steps TEXT NOT NULL DEFAULT '[]'
+	);
+
+	CREATE TABLE IF NOT EXISTS pipeline_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		pipeline TEXT NOT NULL,
+		note_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_pipeline_runs_note ON pipeline_runs(note_id);
+
+	CREATE TABLE IF NOT EXISTS pipeline_artifacts (
+		run_id INTEGER NOT NULL,
+		step INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		model TEXT NOT NULL,
+		output TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (run_id, step)
+	);
+
+	CREATE TABLE IF NOT EXISTS note_revisions (
+		note_id INTEGER NOT NULL,
+		revision INTEGER NOT NULL,
+		image TEXT NOT NULL,
+		markdown TEXT NOT NULL DEFAULT '',
+		content_hash TEXT NOT NULL DEFAULT '',
+		provenance TEXT NOT NULL DEFAULT '',
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (note_id, revision)
+	);
+
+	CREATE TABLE IF NOT EXISTS revision_blobs (
+		hash TEXT PRIMARY KEY,
+		base TEXT NOT NULL DEFAULT '',
+		depth INTEGER NOT NULL DEFAULT 0,
+		words INTEGER NOT NULL DEFAULT 0,
+		data BLOB NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		status TEXT NOT NULL,
+		batch_id INTEGER NOT NULL DEFAULT 0,
+		source TEXT NOT NULL DEFAULT '',
+		image TEXT NOT NULL,
+		params TEXT NOT NULL DEFAULT '{}',
+		note_id INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		result TEXT NOT NULL DEFAULT '',
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		date_finished DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status);
+
+	CREATE TABLE IF NOT EXISTS job_batches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS uploads (
+		id TEXT PRIMARY KEY,
+		filename TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS tag_suggestions (
+		note_id INTEGER PRIMARY KEY,
+		tags TEXT NOT NULL,
+		model TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS recent_views (
+		note_id INTEGER PRIMARY KEY,
+		viewed_at DATETIME NOT NULL,
+		views INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_recent_views_viewed ON recent_views(viewed_at);
+
+	CREATE TABLE IF NOT EXISTS ai_cache (
+		key TEXT PRIMARY KEY,
+		image_hash TEXT NOT NULL,
+		model TEXT NOT NULL,
+		prompt TEXT NOT NULL,
+		response TEXT NOT NULL,
+		hits INTEGER NOT NULL DEFAULT 0,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_hit DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS ai_usage (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		provider TEXT NOT NULL,
+		model TEXT NOT NULL,
+		prompt_tokens INTEGER NOT NULL DEFAULT 0,
+		completion_tokens INTEGER NOT NULL DEFAULT 0,
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_ai_usage_created ON ai_usage(date_created);
+
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		action TEXT NOT NULL,
+		notebook_id INTEGER NOT NULL DEFAULT 0,
+		actor TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
 	`
 
 	if _, err = db.Exec(schema); err != nil {
 		return nil, fmt.Errorf("failed to create schema: %w", err)
 	}
 
+	// Bring databases created before newer columns up to date
+	if err = addColumn(db, "notes", "direction", "TEXT NOT NULL DEFAULT 'ltr'"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notes", "word_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notes", "reading_time", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notes", "note_type", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_notes_note_type ON notes(note_type)`); err != nil {
+		return nil, fmt.Errorf("failed to create note type index: %w", err)
+	}
+	if err = addColumn(db, "notes", "revision", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notes", "notebook_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_notes_notebook ON notes(notebook_id)`); err != nil {
+		return nil, fmt.Errorf("failed to create notebook index: %w", err)
+	}
+	if err = addColumn(db, "notes", "physical_notebook_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notes", "page_number", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_notes_physical_page ON notes(physical_notebook_id, page_number)`); err != nil {
+		return nil, fmt.Errorf("failed to create notebook page index: %w", err)
+	}
+	if err = addColumn(db, "notes", "captured_at", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notes", "review", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notes", "title", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notes", "deleted_at", "DATETIME"); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_notes_deleted ON notes(deleted_at)`); err != nil {
+		return nil, fmt.Errorf("failed to create trash index: %w", err)
+	}
+	if err = addColumn(db, "jobs", "batch_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "jobs", "source", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_jobs_batch ON jobs(batch_id)`); err != nil {
+		return nil, fmt.Errorf("failed to create job batch index: %w", err)
+	}
+	if err = addColumn(db, "note_revisions", "content_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notes", "provenance", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "note_revisions", "provenance", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "notebooks", "locked", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err = migrateRevisions(db); err != nil {
+		return nil, err
+	}
+	if err = backfillWordCounts(db); err != nil {
+		return nil, err
+	}
+	if err = createSearchIndex(db); err != nil {
+		return nil, err
+	}
+
+	// Seed the change log for notes saved before it existed, so a sync
+	// from cursor 0 still sees every note
+	seed := `INSERT INTO note_changes (note_id, action, revision)
+		SELECT id, 'created', revision FROM notes
+		WHERE NOT EXISTS (SELECT 1 FROM note_changes) ORDER BY id`
+	if _, err = db.Exec(seed); err != nil {
+		return nil, fmt.Errorf("failed to seed change log: %w", err)
+	}
+
 	return db, nil
 }
+
+// backfillWordCounts computes word counts and reading times for notes saved
+// before those columns existed
+func backfillWordCounts(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, markdown FROM notes WHERE word_count = 0 AND markdown != ''`)
+	if err != nil {
+		return fmt.Errorf("failed to query notes for word counts: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[int]int{}
+	for rows.Next() {
+		var id int
+		var markdown string
+		if err := rows.Scan(&id, &markdown); err != nil {
+			return fmt.Errorf("failed to scan note: %w", err)
+		}
+		counts[id] = CountWords(markdown)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating notes: %w", err)
+	}
+	rows.Close()
+
+	for id, words := range counts {
+		if _, err := db.Exec(`UPDATE notes SET word_count = ?, reading_time = ? WHERE id = ?`, words, ReadingTime(words), id); err != nil {
+			return fmt.Errorf("failed to backfill word count for note %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to an existing table unless it is already present
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read %s columns: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan %s columns: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating %s columns: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s: %w", table, column, err)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultQueryTimeout bounds each Store call unless the caller's context
+// ends sooner
+const DefaultQueryTimeout = 10 * time.Second
+
+// Store is the notes database behind context-aware methods. Its queries are
+// prepared once and every call is cut off after Timeout, so a slow disk or a
+// locked database fails a request instead of hanging it. The functions
+// taking a *sql.DB run through a Store without prepared statements or a
+// timeout.
+type Store struct {
+	DB *sql.DB
+	// Timeout bounds each call; zero leaves it to the caller's context
+	Timeout time.Duration
+
+	stmts map[string]*sql.Stmt
+}
+
+// dbtx is satisfied by *sql.DB, *sql.Tx and storeConn
+type dbtx interface {
+	execer
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// storeQueries are prepared by NewStore
+var storeQueries = []string{
+	getNoteQuery, countNotesQuery, insertNoteQuery, updateNoteQuery, deleteNoteQuery,
+	revisionSourceQuery, insertRevisionQuery, latestRevisionHash, blobDepthQuery, getBlobQuery, insertBlobQuery, clearLinksQuery, insertLinkQuery, insertChangeQuery,
+	noteLockQuery,
+}
+
+// NewStore prepares the store's queries on db
+func NewStore(db *sql.DB, timeout time.Duration) (*Store, error) {
+	s := &Store{DB: db, Timeout: timeout, stmts: map[string]*sql.Stmt{}}
+	queries := append([]string{}, storeQueries...)
+	for _, sort := range []string{SortDate, SortCaptured, SortID} {
+		for _, descending := range []bool{false, true} {
+			query, _ := listNotesQuery(sort, descending)
+			queries = append(queries, query)
+		}
+	}
+	for _, query := range queries {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to prepare query: %w", err)
+		}
+		s.stmts[query] = stmt
+	}
+	return s, nil
+}
+
+// Close releases the prepared statements; the database is left open
+func (s *Store) Close() error {
+	for query, stmt := range s.stmts {
+		stmt.Close()
+		delete(s.stmts, query)
+	}
+	return nil
+}
+
+// GetNote retrieves a note that is not in the trash
+func (s *Store) GetNote(ctx context.Context, id int) (*Note, error) {
+	ctx, cancel := s.timeout(ctx)
+	defer cancel()
+	note, err := getNote(s.conn(ctx, nil), id)
+	if !errors.Is(err, ErrNotFound) {
+		countDBError(err)
+	}
+	return note, err
+}
+
+// ListNotes returns one page of notes, as ListNotes
+func (s *Store) ListNotes(ctx context.Context, sort string, descending bool, limit, offset int) ([]Note, error) {
+	ctx, cancel := s.timeout(ctx)
+	defer cancel()
+	return listNotes(s.conn(ctx, nil), sort, descending, limit, offset)
+}
+
+// CountNotes returns the number of notes outside the trash
+func (s *Store) CountNotes(ctx context.Context) (int, error) {
+	ctx, cancel := s.timeout(ctx)
+	defer cancel()
+	n, err := countNotes(s.conn(ctx, nil))
+	countDBError(err)
+	return n, err
+}
+
+// AddNote inserts a note along with its links and change log entry
+func (s *Store) AddNote(ctx context.Context, image, markdown string) (*Note, error) {
+	var note *Note
+	err := s.inTx(ctx, func(q dbtx) error {
+		var err error
+		note, err = addNote(q, image, markdown)
+		return err
+	})
+	return note, err
+}
+
+// UpdateNote replaces a note's image and markdown, keeping the old content
+// as a revision
+func (s *Store) UpdateNote(ctx context.Context, id int, image, markdown string) (*Note, error) {
+	var note *Note
+	err := s.inTx(ctx, func(q dbtx) error {
+		var err error
+		note, err = updateNote(q, id, image, markdown)
+		return err
+	})
+	return note, err
+}
+
+// DeleteNote moves a note to the trash
+func (s *Store) DeleteNote(ctx context.Context, id int) error {
+	return s.inTx(ctx, func(q dbtx) error {
+		return deleteNote(q, id)
+	})
+}
+
+func (s *Store) timeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.Timeout)
+}
+
+// inTx runs fn in a transaction, committing it when fn succeeds
+func (s *Store) inTx(ctx context.Context, fn func(q dbtx) error) error {
+	ctx, cancel := s.timeout(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		countDBError(err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := fn(s.conn(ctx, tx)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		countDBError(err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) conn(ctx context.Context, tx *sql.Tx) storeConn {
+	return storeConn{ctx: ctx, tx: tx, store: s}
+}
+
+// storeConn runs queries with a context, in a transaction when tx is set,
+// using the store's prepared statement for a query when it has one
+type storeConn struct {
+	ctx   context.Context
+	tx    *sql.Tx
+	store *Store
+}
+
+func (c storeConn) stmt(query string) *sql.Stmt {
+	stmt := c.store.stmts[query]
+	if stmt != nil && c.tx != nil {
+		return c.tx.StmtContext(c.ctx, stmt)
+	}
+	return stmt
+}
+
+func (c storeConn) Exec(query string, args ...any) (result sql.Result, err error) {
+	defer func() { countDBError(err) }()
+	if stmt := c.stmt(query); stmt != nil {
+		return stmt.ExecContext(c.ctx, args...)
+	}
+	if c.tx != nil {
+		return c.tx.ExecContext(c.ctx, query, args...)
+	}
+	return c.store.DB.ExecContext(c.ctx, query, args...)
+}
+
+func (c storeConn) Query(query string, args ...any) (rows *sql.Rows, err error) {
+	defer func() { countDBError(err) }()
+	if stmt := c.stmt(query); stmt != nil {
+		return stmt.QueryContext(c.ctx, args...)
+	}
+	if c.tx != nil {
+		return c.tx.QueryContext(c.ctx, query, args...)
+	}
+	return c.store.DB.QueryContext(c.ctx, query, args...)
+}
+
+func (c storeConn) QueryRow(query string, args ...any) *sql.Row {
+	if stmt := c.stmt(query); stmt != nil {
+		return stmt.QueryRowContext(c.ctx, args...)
+	}
+	if c.tx != nil {
+		return c.tx.QueryRowContext(c.ctx, query, args...)
+	}
+	return c.store.DB.QueryRowContext(c.ctx, query, args...)
+}
+
+var dbErrors = NewCounter("bookmd_db_errors_total",
+	"Failed queries and transactions of the store, by kind: timeout, locked or other.", "kind")
+
+// countDBError counts err, when set, as a failed query. A query given up
+// because the request went away is not counted.
+func countDBError(err error) {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	kind := "other"
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		kind = "timeout"
+	case strings.Contains(err.Error(), "SQLITE_BUSY"), strings.Contains(err.Error(), "database is locked"):
+		kind = "locked"
+	}
+	dbErrors.Inc(kind)
+}
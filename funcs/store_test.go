@@ -0,0 +1,152 @@
+package funcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a new database in a temporary directory behind a
+// Store with its prepared statements
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "notes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := NewStore(db, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStoreNoteLifecycle(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	note, err := s.AddNote(ctx, "a.png", "# First\n\nSee [[2]]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Revision != 1 || note.Markdown != "# First\n\nSee [[2]]\n" {
+		t.Fatalf("added %+v", note)
+	}
+
+	updated, err := s.UpdateNote(ctx, note.ID, "b.png", "# Second\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Revision != 2 || updated.Image != "b.png" || updated.Markdown != "# Second\n" {
+		t.Fatalf("updated %+v", updated)
+	}
+	if n, err := s.CountNotes(ctx); err != nil || n != 1 {
+		t.Fatalf("CountNotes = %d, %v, want 1", n, err)
+	}
+
+	if err := s.DeleteNote(ctx, note.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetNote(ctx, note.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetNote after delete = %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteNote(ctx, note.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second delete = %v, want ErrNotFound", err)
+	}
+	if _, err := s.UpdateNote(ctx, 99, "c.png", "# Missing\n"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateNote of unknown note = %v, want ErrNotFound", err)
+	}
+}
+
+func TestStoreListNotes(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	for _, image := range []string{"a.png", "b.png", "c.png"} {
+		if _, err := s.AddNote(ctx, image, "# Note\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notes, err := s.ListNotes(ctx, SortID, true, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || notes[0].ID != 3 || notes[1].ID != 2 {
+		t.Fatalf("first page = %+v, want notes 3 and 2", notes)
+	}
+	notes, err = s.ListNotes(ctx, SortID, true, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].ID != 1 {
+		t.Fatalf("second page = %+v, want note 1", notes)
+	}
+}
+
+func TestStoreInTxRollsBack(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	failed := errors.New("failed")
+
+	err := s.inTx(ctx, func(q dbtx) error {
+		if _, err := addNote(q, "a.png", "# Rolled back\n"); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("inTx = %v, want fn's error", err)
+	}
+	if n, err := s.CountNotes(ctx); err != nil || n != 0 {
+		t.Errorf("CountNotes = %d, %v, want the insert rolled back", n, err)
+	}
+}
+
+func TestStoreHonoursContext(t *testing.T) {
+	s := newTestStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.AddNote(ctx, "a.png", "# Note\n"); !errors.Is(err, context.Canceled) {
+		t.Errorf("AddNote with a canceled context = %v, want context.Canceled", err)
+	}
+	if _, err := s.GetNote(ctx, 1); err == nil {
+		t.Error("GetNote with a canceled context succeeded")
+	}
+}
+
+func TestStoreConcurrentWriters(t *testing.T) {
+	s := newTestStore(t)
+	var mode string
+	if err := s.DB.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("journal_mode = %q, %v, want wal", mode, err)
+	}
+
+	ctx := context.Background()
+	note, err := s.AddNote(ctx, "a.png", "# Shared\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each update reads before it writes, which in a deferred transaction
+	// fails with SQLITE_BUSY when another writer gets in between
+	errs := make(chan error, 8)
+	for i := range 8 {
+		go func() {
+			var err error
+			for j := 0; j < 10 && err == nil; j++ {
+				_, err = s.UpdateNote(ctx, note.ID, "a.png", fmt.Sprintf("# Writer %d\n\nedit %d\n", i, j))
+			}
+			errs <- err
+		}()
+	}
+	for range 8 {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
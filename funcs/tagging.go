@@ -0,0 +1,317 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TagProperty is the note property holding a note's tags, separated by commas
+const TagProperty = "tags"
+
+// Statuses of a tag suggestion. Applied suggestions are removed, since the
+// note is then tagged; dismissed ones are kept so the note is not offered
+// to the AI again.
+const (
+	SuggestionPending   = "pending"
+	SuggestionApplied   = "applied"
+	SuggestionDismissed = "dismissed"
+)
+
+// Limits of AI tagging
+const (
+	maxSuggestedTags  = 5
+	maxTagLength      = 40
+	knownTagsInPrompt = 30
+	tagOutputTokens   = 20
+)
+
+// tagPrompt asks for a short list of tags and nothing else
+const tagPrompt = `You tag transcribed handwritten notes. Reply with 1 to 5 short lowercase tags separated by commas and nothing else.`
+
+// TagSuggestion is a set of tags the AI proposed for an untagged note,
+// waiting for the reader to apply or dismiss it
+type TagSuggestion struct {
+	Note        Note      `json:"note"`
+	Tags        []string  `json:"tags"`
+	Model       string    `json:"model"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+// TagRun is the outcome of one batch of tag suggestions
+type TagRun struct {
+	Suggested  int      `json:"suggested"`
+	Failed     int      `json:"failed"`
+	Errors     []string `json:"errors"`
+	Remaining  int      `json:"remaining"`
+	CostUSD    float64  `json:"cost_usd"`
+	CapReached bool     `json:"cap_reached"`
+}
+
+// ParseTags splits a comma or newline separated list of tags, normalizing
+// each and dropping duplicates
+func ParseTags(s string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		tag = strings.ToLower(strings.Trim(strings.TrimSpace(tag), "#-*\"'`.[] "))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// KnownTags returns the tags in use, the most used first
+func KnownTags(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT value FROM note_properties WHERE key = ?`, TagProperty)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tags: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("failed to scan tags: %w", err)
+		}
+		for _, tag := range ParseTags(value) {
+			counts[tag]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tags: %w", err)
+	}
+
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if counts[tags[i]] != counts[tags[j]] {
+			return counts[tags[i]] > counts[tags[j]]
+		}
+		return tags[i] < tags[j]
+	})
+	return tags, nil
+}
+
+// untaggedQuery selects the notes outside the trash that have no tags and
+// no suggestion, pending or dismissed
+const untaggedQuery = `FROM notes WHERE deleted_at IS NULL
+	AND id NOT IN (SELECT note_id FROM note_properties WHERE key = '` + TagProperty + `' AND TRIM(value) != '')
+	AND id NOT IN (SELECT note_id FROM tag_suggestions)`
+
+// UntaggedNotes returns up to limit notes waiting for tag suggestions,
+// oldest first
+func UntaggedNotes(db *sql.DB, limit int) ([]Note, error) {
+	rows, err := db.Query(`SELECT `+noteColumns+` `+untaggedQuery+` ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query untagged notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes = append(notes, *note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating untagged notes: %w", err)
+	}
+	return notes, nil
+}
+
+// CountUntagged returns how many notes are waiting for tag suggestions
+func CountUntagged(db *sql.DB) (int, error) {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) ` + untaggedQuery).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count untagged notes: %w", err)
+	}
+	return n, nil
+}
+
+// tagSystemPrompt offers the most used tags along with tagPrompt, so the
+// AI keeps to the reader's vocabulary
+func tagSystemPrompt(known []string) string {
+	if len(known) == 0 {
+		return tagPrompt
+	}
+	return tagPrompt + " Prefer these existing tags when they fit: " + strings.Join(known[:min(len(known), knownTagsInPrompt)], ", ")
+}
+
+// estimateTagging projects the cost of tagging one note with prompt
+func estimateTagging(note Note, prompt string, pricing Pricing) Estimate {
+	e := Estimate{
+		InputTokens:  (len(prompt) + len(note.Markdown)) / charsPerToken,
+		OutputTokens: tagOutputTokens,
+	}
+	e.CostUSD = pricing.cost(e.InputTokens, e.OutputTokens)
+	return e
+}
+
+// EstimateTags projects the cost of suggesting tags for the next limit
+// untagged notes
+func EstimateTags(db *sql.DB, limit int, pricing Pricing) (Estimate, error) {
+	var total Estimate
+	notes, err := UntaggedNotes(db, limit)
+	if err != nil {
+		return total, err
+	}
+	known, err := KnownTags(db)
+	if err != nil {
+		return total, err
+	}
+	prompt := tagSystemPrompt(known)
+	for _, note := range notes {
+		total.Add(estimateTagging(note, prompt, pricing))
+	}
+	return total, nil
+}
+
+// SuggestTags asks the AI for tags for up to limit untagged notes and keeps
+// them as pending suggestions. The run stops before a note whose estimated
+// cost would take the batch over maxCost; zero sets no cap. A note the AI
+// fails on is skipped and counted. The AI is asked with the settings of ai.
+func SuggestTags(ctx context.Context, db *sql.DB, ai *Transcriber, limit int, maxCost float64, pricing Pricing) (*TagRun, error) {
+	notes, err := UntaggedNotes(db, limit)
+	if err != nil {
+		return nil, err
+	}
+	known, err := KnownTags(db)
+	if err != nil {
+		return nil, err
+	}
+	prompt := tagSystemPrompt(known)
+	settings, client := ai.Current()
+
+	run := &TagRun{Errors: []string{}}
+	for _, note := range notes {
+		cost := estimateTagging(note, prompt, pricing).CostUSD
+		if maxCost > 0 && run.CostUSD+cost > maxCost {
+			run.CapReached = true
+			break
+		}
+		run.CostUSD += cost
+
+		output, err := ai.CompleteText(ctx, client, settings.Model, prompt, note.Markdown)
+		// A reply that is not a plain list yields long pieces, not tags
+		tags := slices.DeleteFunc(ParseTags(output), func(tag string) bool { return len(tag) > maxTagLength })
+		if err == nil && len(tags) == 0 {
+			err = fmt.Errorf("no tags in the reply")
+		}
+		if err != nil {
+			run.Failed++
+			run.Errors = append(run.Errors, fmt.Sprintf("note %d: %v", note.ID, err))
+			continue
+		}
+		_, err = db.Exec(`INSERT INTO tag_suggestions (note_id, tags, model, status) VALUES (?, ?, ?, ?)
+			ON CONFLICT(note_id) DO UPDATE SET tags = excluded.tags, model = excluded.model, status = excluded.status`,
+			note.ID, strings.Join(tags[:min(len(tags), maxSuggestedTags)], ", "), settings.Model, SuggestionPending)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save tag suggestion: %w", err)
+		}
+		run.Suggested++
+	}
+
+	if run.Remaining, err = CountUntagged(db); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// GetTagSuggestions lists the pending suggestions of notes outside the
+// trash, oldest first
+func GetTagSuggestions(db *sql.DB) ([]TagSuggestion, error) {
+	rows, err := db.Query(`SELECT note_id, tags, model, date_created FROM tag_suggestions
+		WHERE status = ? AND note_id IN (SELECT id FROM notes WHERE deleted_at IS NULL) ORDER BY note_id`, SuggestionPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tag suggestions: %w", err)
+	}
+	suggestions := []TagSuggestion{}
+	for rows.Next() {
+		var s TagSuggestion
+		var tags string
+		if err := rows.Scan(&s.Note.ID, &tags, &s.Model, &s.DateCreated); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan tag suggestion: %w", err)
+		}
+		s.Tags = ParseTags(tags)
+		suggestions = append(suggestions, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tag suggestions: %w", err)
+	}
+
+	for i := range suggestions {
+		note, err := GetNoteByID(db, suggestions[i].Note.ID)
+		if err != nil {
+			return nil, err
+		}
+		suggestions[i].Note = *note
+	}
+	return suggestions, nil
+}
+
+// ApplyTagSuggestion adds the suggested tags to the note, or tags instead
+// when it is not nil, clears the suggestion and returns the note's tags
+func ApplyTagSuggestion(db *sql.DB, noteID int, tags []string) ([]string, error) {
+	if tags == nil {
+		var suggested string
+		err := db.QueryRow(`SELECT tags FROM tag_suggestions WHERE note_id = ? AND status = ?`,
+			noteID, SuggestionPending).Scan(&suggested)
+		if err == sql.ErrNoRows {
+			return nil, notFound("no tag suggestion for note %d", noteID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tag suggestion: %w", err)
+		}
+		tags = ParseTags(suggested)
+	}
+
+	// Keep tags added by hand since the suggestion was made
+	var existing string
+	err := db.QueryRow(`SELECT value FROM note_properties WHERE note_id = ? AND key = ?`, noteID, TagProperty).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get note tags: %w", err)
+	}
+	merged := ParseTags(existing + "," + strings.Join(tags, ","))
+	if len(merged) > 0 {
+		if err := SetProperty(db, noteID, TagProperty, strings.Join(merged, ", ")); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := db.Exec(`DELETE FROM tag_suggestions WHERE note_id = ?`, noteID); err != nil {
+		return nil, fmt.Errorf("failed to clear tag suggestion: %w", err)
+	}
+	return merged, nil
+}
+
+// DismissTagSuggestion rejects the suggested tags. The note is not offered
+// to the AI again.
+func DismissTagSuggestion(db *sql.DB, noteID int) error {
+	result, err := db.Exec(`UPDATE tag_suggestions SET status = ? WHERE note_id = ? AND status = ?`,
+		SuggestionDismissed, noteID, SuggestionPending)
+	if err != nil {
+		return fmt.Errorf("failed to dismiss tag suggestion: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return notFound("no tag suggestion for note %d", noteID)
+	}
+	return nil
+}
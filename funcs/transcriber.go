@@ -0,0 +1,128 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Transcriber is what AI requests are made with: the AI settings and their
+// client, the guardrails transcriptions are checked against, the databases
+// responses are cached and usage is logged in, and the limit on requests
+// sent at once. The server keeps one and changes it as settings are saved;
+// a request already under way finishes with what it started with.
+type Transcriber struct {
+	mu         sync.RWMutex
+	settings   AISettings
+	client     VisionClient
+	guardrails Guardrails
+	cache      *sql.DB
+	usage      *sql.DB
+	limit      AILimit
+}
+
+// NewTranscriber returns a Transcriber using settings with the default
+// guardrails, AI concurrency and timeout, caching nothing and logging no
+// usage
+func NewTranscriber(settings AISettings) *Transcriber {
+	t := &Transcriber{guardrails: DefaultGuardrails}
+	t.limit.SetConcurrency(DefaultAIConcurrency)
+	t.limit.SetTimeout(DefaultAITimeout)
+	t.UseSettings(settings)
+	return t
+}
+
+// UseSettings makes s the settings transcriptions are made with, with a
+// new client for them
+func (t *Transcriber) UseSettings(s AISettings) {
+	client := t.NewClient(s)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.settings, t.client = s, client
+}
+
+// UseClient keeps the settings but sends their requests to client, as demo
+// mode does with MockVision
+func (t *Transcriber) UseClient(client VisionClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.client = client
+}
+
+// UseGuardrails makes g the guardrails transcriptions are checked against
+func (t *Transcriber) UseGuardrails(g Guardrails) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.guardrails = g
+}
+
+// UseCache caches transcriptions in db, or stops caching when db is nil
+func (t *Transcriber) UseCache(db *sql.DB) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cache = db
+}
+
+// UseUsageLog logs the tokens of every AI reply in db, or stops logging
+// when db is nil
+func (t *Transcriber) UseUsageLog(db *sql.DB) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.usage = db
+}
+
+// Current returns the settings and their client, nil when no provider is
+// configured and tesseract is not installed
+func (t *Transcriber) Current() (AISettings, VisionClient) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.settings, t.client
+}
+
+// Settings returns the settings transcriptions are made with
+func (t *Transcriber) Settings() AISettings {
+	settings, _ := t.Current()
+	return settings
+}
+
+// Guardrails returns the guardrails transcriptions are checked against
+func (t *Transcriber) Guardrails() Guardrails {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.guardrails
+}
+
+// Limit is the limit on the AI requests sent at once, shared by every
+// client the Transcriber makes
+func (t *Transcriber) Limit() *AILimit {
+	return &t.limit
+}
+
+// NewClient builds a client for settings that waits its turn under the
+// Transcriber's limit, as UseSettings does
+func (t *Transcriber) NewClient(settings AISettings) VisionClient {
+	return settings.newClient(&t.limit)
+}
+
+// orCurrent resolves a nil client to the Transcriber's
+func (t *Transcriber) orCurrent(client VisionClient) VisionClient {
+	if client == nil {
+		_, client = t.Current()
+	}
+	return client
+}
+
+// usageKey holds the database a context's AI replies are logged in
+type usageKey struct{}
+
+// withUsageLog returns a context that logs the usage of the AI replies
+// made with it, when the Transcriber logs usage
+func (t *Transcriber) withUsageLog(ctx context.Context) context.Context {
+	t.mu.RLock()
+	db := t.usage
+	t.mu.RUnlock()
+	if db == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, usageKey{}, db)
+}
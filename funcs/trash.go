@@ -0,0 +1,163 @@
+package funcs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultTrashDays is how long a deleted note stays in the trash before it
+// is purged
+const DefaultTrashDays = 30
+
+// GetTrash lists the notes in the trash, most recently deleted first
+func GetTrash(db *sql.DB) ([]Note, error) {
+	rows, err := db.Query(`SELECT ` + noteColumns + ` FROM notes WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trash: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes = append(notes, *note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating trash: %w", err)
+	}
+	return notes, nil
+}
+
+// getTrashedNote retrieves a note in the trash by its ID
+func getTrashedNote(db *sql.DB, id int) (*Note, error) {
+	note, err := scanNote(db.QueryRow(`SELECT `+noteColumns+` FROM notes WHERE id = ? AND deleted_at IS NOT NULL`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound("no note in the trash with id %d", id)
+		}
+		return nil, fmt.Errorf("failed to scan note: %w", err)
+	}
+	return note, nil
+}
+
+// RestoreNote takes a note out of the trash. It is recorded as created
+// again so syncing clients that dropped it fetch it back.
+func RestoreNote(db *sql.DB, id int) (*Note, error) {
+	var note *Note
+	err := inNoteTx(db, id, func(q dbtx) error {
+		var revision int
+		err := q.QueryRow(`UPDATE notes SET deleted_at = NULL, revision = revision + 1
+			WHERE id = ? AND deleted_at IS NOT NULL RETURNING revision`, id).Scan(&revision)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return notFound("no note in the trash with id %d", id)
+			}
+			return fmt.Errorf("failed to restore note: %w", err)
+		}
+		if err := recordChange(q, id, ChangeCreated, revision); err != nil {
+			return err
+		}
+		note, err = getNote(q, id)
+		return err
+	})
+	return note, err
+}
+
+// PurgeNote permanently removes a note that is in the trash along with its
+// revisions. It returns the images they used, for the caller to remove once
+// no other note uses them.
+func PurgeNote(db *sql.DB, id int) ([]string, error) {
+	note, err := getTrashedNote(db, id)
+	if err != nil {
+		return nil, err
+	}
+	images := []string{note.Image}
+	rows, err := db.Query(`SELECT DISTINCT image FROM note_revisions WHERE note_id = ? AND image != ?`, id, note.Image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revision images: %w", err)
+	}
+	for rows.Next() {
+		var image string
+		if err := rows.Scan(&image); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan revision image: %w", err)
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating revision images: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkNoteUnlocked(tx, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM notes WHERE id = ?`, id); err != nil {
+		return nil, fmt.Errorf("failed to purge note: %w", err)
+	}
+	// Syncing clients already dropped it; the change is for the search index
+	if err := recordChange(tx, id, ChangeDeleted, note.Revision); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM note_links WHERE source_id = ?`, id); err != nil {
+		return nil, fmt.Errorf("failed to delete note links: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM note_properties WHERE note_id = ?`, id); err != nil {
+		return nil, fmt.Errorf("failed to delete note properties: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM note_revisions WHERE note_id = ?`, id); err != nil {
+		return nil, fmt.Errorf("failed to delete note revisions: %w", err)
+	}
+	if err := pruneRevisionBlobs(tx); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM recent_views WHERE note_id = ?`, id); err != nil {
+		return nil, fmt.Errorf("failed to delete note views: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM tag_suggestions WHERE note_id = ?`, id); err != nil {
+		return nil, fmt.Errorf("failed to delete tag suggestions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit note purge: %w", err)
+	}
+	return images, nil
+}
+
+// PurgeTrash permanently removes the notes deleted before cutoff. It
+// returns how many were removed and the images they used, as PurgeNote.
+// Notes of locked notebooks stay in the trash until they are unlocked.
+func PurgeTrash(db *sql.DB, cutoff time.Time) (int, []string, error) {
+	trash, err := GetTrash(db)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	purged, images := 0, []string{}
+	for _, note := range trash {
+		if !note.DeletedAt.Before(cutoff) {
+			continue
+		}
+		noteImages, err := PurgeNote(db, note.ID)
+		if errors.Is(err, ErrLocked) {
+			continue
+		}
+		if err != nil {
+			return purged, images, err
+		}
+		purged++
+		images = append(images, noteImages...)
+	}
+	return purged, images, nil
+}
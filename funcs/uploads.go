@@ -0,0 +1,92 @@
+package funcs
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// MaxResumableUpload is the largest file accepted in chunks, in bytes
+const MaxResumableUpload = 1 << 30
+
+// Upload is a file being sent in chunks. Offset is how much of it has been
+// received, which the caller reads off the spooled data.
+type Upload struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	Size        int64     `json:"size"`
+	Offset      int64     `json:"offset"`
+	DateCreated time.Time `json:"date_created"`
+}
+
+// Complete reports whether every byte of the upload has been received
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Size
+}
+
+// CreateUpload starts an upload of a file of size bytes. Its id is random,
+// so only the client that started it can add to it.
+func CreateUpload(db *sql.DB, filename string, size int64) (*Upload, error) {
+	if size <= 0 || size > MaxResumableUpload {
+		return nil, fmt.Errorf("upload size must be between 1 and %d bytes", MaxResumableUpload)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to make upload id: %w", err)
+	}
+	_, err := db.Exec(`INSERT INTO uploads (id, filename, size) VALUES (?, ?, ?)`, hex.EncodeToString(id), filename, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert upload: %w", err)
+	}
+	return GetUpload(db, hex.EncodeToString(id))
+}
+
+// GetUpload retrieves an upload by id
+func GetUpload(db *sql.DB, id string) (*Upload, error) {
+	var u Upload
+	err := db.QueryRow(`SELECT id, filename, size, date_created FROM uploads WHERE id = ?`, id).
+		Scan(&u.ID, &u.Filename, &u.Size, &u.DateCreated)
+	if err == sql.ErrNoRows {
+		return nil, notFound("no upload found with id %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan upload: %w", err)
+	}
+	return &u, nil
+}
+
+// DeleteUpload forgets an upload
+func DeleteUpload(db *sql.DB, id string) error {
+	result, err := db.Exec(`DELETE FROM uploads WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return notFound("no upload found with id %s", id)
+	}
+	return nil
+}
+
+// ExpireUploads forgets the uploads started before cutoff and returns
+// their ids, so their data can be removed
+func ExpireUploads(db *sql.DB, cutoff time.Time) ([]string, error) {
+	rows, err := db.Query(`DELETE FROM uploads WHERE date_created < datetime(?, 'unixepoch') RETURNING id`, cutoff.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire uploads: %w", err)
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan upload: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating uploads: %w", err)
+	}
+	return ids, nil
+}
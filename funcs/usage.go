@@ -0,0 +1,130 @@
+package funcs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Bounds of a usage report, in days
+const (
+	DefaultUsageDays = 30
+	MaxUsageDays     = 366
+)
+
+// UsageTotals adds up AI requests and their tokens. CostUSD prices the
+// tokens at the report's pricing.
+type UsageTotals struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// UsageDay is the usage of one UTC day, as YYYY-MM-DD
+type UsageDay struct {
+	Day string `json:"day"`
+	UsageTotals
+}
+
+// UsageModel is the usage of one model
+type UsageModel struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	UsageTotals
+}
+
+// UsageReport is the AI usage of the last Days days, newest day first and
+// the most used model first
+type UsageReport struct {
+	Days    int          `json:"days"`
+	Pricing Pricing      `json:"pricing"`
+	Total   UsageTotals  `json:"total"`
+	ByDay   []UsageDay   `json:"by_day"`
+	ByModel []UsageModel `json:"by_model"`
+}
+
+var aiTokens = NewCounter("bookmd_ai_tokens_total",
+	"Tokens AI providers reported using, by provider, model and type: prompt or completion.", "provider", "model", "type")
+
+// recordUsage logs the tokens a provider reported for one reply in the
+// usage log of ctx, if it has one. Failing to log is not worth failing the
+// request over.
+func recordUsage(ctx context.Context, provider, model string, promptTokens, completionTokens int) {
+	aiTokens.Add(float64(promptTokens), provider, model, "prompt")
+	aiTokens.Add(float64(completionTokens), provider, model, "completion")
+	db, ok := ctx.Value(usageKey{}).(*sql.DB)
+	if !ok {
+		return
+	}
+	_, err := db.Exec(`INSERT INTO ai_usage (provider, model, prompt_tokens, completion_tokens) VALUES (?, ?, ?, ?)`,
+		provider, model, promptTokens, completionTokens)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to record AI usage", "err", err)
+	}
+}
+
+// GetUsageSince adds up the AI usage since a time, priced at pricing
+func GetUsageSince(db *sql.DB, since time.Time, pricing Pricing) (UsageTotals, error) {
+	var totals UsageTotals
+	err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0)
+		FROM ai_usage WHERE date_created >= datetime(?, 'unixepoch')`, since.Unix()).
+		Scan(&totals.Requests, &totals.PromptTokens, &totals.CompletionTokens)
+	if err != nil {
+		return totals, fmt.Errorf("failed to query usage: %w", err)
+	}
+	totals.CostUSD = pricing.cost(totals.PromptTokens, totals.CompletionTokens)
+	return totals, nil
+}
+
+// GetUsage reports the AI usage of the last days days, priced at pricing
+func GetUsage(db *sql.DB, days int, pricing Pricing) (*UsageReport, error) {
+	report := &UsageReport{Days: days, Pricing: pricing, ByDay: []UsageDay{}, ByModel: []UsageModel{}}
+	since := fmt.Sprintf("-%d days", days)
+
+	rows, err := db.Query(`SELECT date(date_created) AS day, COUNT(*), SUM(prompt_tokens), SUM(completion_tokens)
+		FROM ai_usage WHERE date_created >= datetime('now', ?) GROUP BY day ORDER BY day DESC`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage by day: %w", err)
+	}
+	for rows.Next() {
+		var d UsageDay
+		if err := rows.Scan(&d.Day, &d.Requests, &d.PromptTokens, &d.CompletionTokens); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		d.CostUSD = pricing.cost(d.PromptTokens, d.CompletionTokens)
+		report.ByDay = append(report.ByDay, d)
+
+		report.Total.Requests += d.Requests
+		report.Total.PromptTokens += d.PromptTokens
+		report.Total.CompletionTokens += d.CompletionTokens
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating usage: %w", err)
+	}
+	report.Total.CostUSD = pricing.cost(report.Total.PromptTokens, report.Total.CompletionTokens)
+
+	rows, err = db.Query(`SELECT provider, model, COUNT(*), SUM(prompt_tokens), SUM(completion_tokens)
+		FROM ai_usage WHERE date_created >= datetime('now', ?) GROUP BY provider, model
+		ORDER BY SUM(prompt_tokens) + SUM(completion_tokens) DESC`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage by model: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m UsageModel
+		if err := rows.Scan(&m.Provider, &m.Model, &m.Requests, &m.PromptTokens, &m.CompletionTokens); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		m.CostUSD = pricing.cost(m.PromptTokens, m.CompletionTokens)
+		report.ByModel = append(report.ByModel, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating usage: %w", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,241 @@
+package funcs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MarkdownIssue describes a structural problem found in a markdown document
+type MarkdownIssue struct {
+	Line    int    `json:"line"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// Kinds of issues reported by ValidateMarkdown
+const (
+	IssueUnclosedFence = "unclosed_fence"
+	IssueBrokenTable   = "broken_table"
+	IssueHeadingJump   = "heading_jump"
+)
+
+// fenceMarker returns the fence a line opens or closes ("```" or "~~~"),
+// or "" if the line is not a fence
+func fenceMarker(line string) string {
+	trimmed := strings.TrimSpace(line)
+	for _, marker := range []string{"```", "~~~"} {
+		if strings.HasPrefix(trimmed, marker) {
+			return marker
+		}
+	}
+	return ""
+}
+
+// headingLevel returns the ATX heading level of a line, or 0
+func headingLevel(line string) int {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return 0
+	}
+	level := 0
+	for level < len(trimmed) && trimmed[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 {
+		return 0
+	}
+	if level < len(trimmed) && trimmed[level] != ' ' && trimmed[level] != '\t' {
+		return 0
+	}
+	return level
+}
+
+// isTableRow reports whether a line looks like a pipe table row
+func isTableRow(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, "|") && strings.Count(trimmed, "|") >= 2
+}
+
+// tableCells splits a pipe table row into its trimmed cells
+func tableCells(line string) []string {
+	trimmed := strings.TrimSpace(line)
+	trimmed = strings.TrimPrefix(trimmed, "|")
+	trimmed = strings.TrimSuffix(trimmed, "|")
+	cells := strings.Split(trimmed, "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+	return cells
+}
+
+// isDelimiterRow reports whether a table row is the header separator
+func isDelimiterRow(line string) bool {
+	for _, cell := range tableCells(line) {
+		if strings.Trim(cell, ":-") != "" || !strings.Contains(cell, "-") {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateMarkdown reports unclosed code fences, malformed pipe tables and
+// heading levels that skip a step (e.g. # followed by ###)
+func ValidateMarkdown(markdown string) []MarkdownIssue {
+	var issues []MarkdownIssue
+	lines := strings.Split(markdown, "\n")
+
+	openFence, fenceLine := "", 0
+	lastLevel := 0
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if marker := fenceMarker(line); marker != "" {
+			if openFence == "" {
+				openFence, fenceLine = marker, i+1
+			} else if marker == openFence {
+				openFence = ""
+			}
+			continue
+		}
+		if openFence != "" {
+			continue
+		}
+
+		if level := headingLevel(line); level > 0 {
+			if lastLevel > 0 && level > lastLevel+1 {
+				issues = append(issues, MarkdownIssue{
+					Line:    i + 1,
+					Kind:    IssueHeadingJump,
+					Message: fmt.Sprintf("heading jumps from level %d to %d", lastLevel, level),
+				})
+			}
+			lastLevel = level
+			continue
+		}
+
+		if isTableRow(line) {
+			start := i
+			for i+1 < len(lines) && isTableRow(lines[i+1]) {
+				i++
+			}
+			issues = append(issues, validateTable(lines[start:i+1], start+1)...)
+		}
+	}
+
+	if openFence != "" {
+		issues = append(issues, MarkdownIssue{
+			Line:    fenceLine,
+			Kind:    IssueUnclosedFence,
+			Message: fmt.Sprintf("code fence %s is never closed", openFence),
+		})
+	}
+
+	return issues
+}
+
+// validateTable checks one block of consecutive table rows starting at line
+func validateTable(rows []string, line int) []MarkdownIssue {
+	if len(rows) < 2 || !isDelimiterRow(rows[1]) {
+		return []MarkdownIssue{{
+			Line:    line,
+			Kind:    IssueBrokenTable,
+			Message: "table is missing its header separator row",
+		}}
+	}
+
+	var issues []MarkdownIssue
+	columns := len(tableCells(rows[0]))
+	for i, row := range rows[1:] {
+		if n := len(tableCells(row)); n != columns {
+			issues = append(issues, MarkdownIssue{
+				Line:    line + i + 1,
+				Kind:    IssueBrokenTable,
+				Message: fmt.Sprintf("table row has %d cells, header has %d", n, columns),
+			})
+		}
+	}
+	return issues
+}
+
+// FixMarkdown applies the fixes ValidateMarkdown can suggest: it closes
+// dangling code fences, demotes headings that skip levels, adds missing
+// table separator rows and pads or trims table rows to the header width
+func FixMarkdown(markdown string) string {
+	lines := strings.Split(markdown, "\n")
+	out := make([]string, 0, len(lines)+1)
+
+	openFence := ""
+	lastLevel := 0
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if marker := fenceMarker(line); marker != "" {
+			if openFence == "" {
+				openFence = marker
+			} else if marker == openFence {
+				openFence = ""
+			}
+			out = append(out, line)
+			continue
+		}
+		if openFence != "" {
+			out = append(out, line)
+			continue
+		}
+
+		if level := headingLevel(line); level > 0 {
+			if lastLevel > 0 && level > lastLevel+1 {
+				text := strings.TrimLeft(strings.TrimLeft(line, " "), "#")
+				level = lastLevel + 1
+				line = strings.Repeat("#", level) + text
+			}
+			lastLevel = level
+			out = append(out, line)
+			continue
+		}
+
+		if isTableRow(line) {
+			start := i
+			for i+1 < len(lines) && isTableRow(lines[i+1]) {
+				i++
+			}
+			out = append(out, fixTable(lines[start:i+1])...)
+			continue
+		}
+
+		out = append(out, line)
+	}
+
+	if openFence != "" {
+		out = append(out, openFence)
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// fixTable normalizes one block of table rows to the header's column count
+func fixTable(rows []string) []string {
+	header := tableCells(rows[0])
+	columns := len(header)
+
+	body := rows[1:]
+	if len(body) == 0 || !isDelimiterRow(body[0]) {
+		separator := make([]string, columns)
+		for i := range separator {
+			separator[i] = "---"
+		}
+		body = append([]string{"| " + strings.Join(separator, " | ") + " |"}, body...)
+	}
+
+	out := []string{rows[0], body[0]}
+	for _, row := range body[1:] {
+		cells := tableCells(row)
+		if len(cells) == columns {
+			out = append(out, row)
+			continue
+		}
+		for len(cells) < columns {
+			cells = append(cells, "")
+		}
+		out = append(out, "| "+strings.Join(cells[:columns], " | ")+" |")
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package funcs
+
+import "testing"
+
+// validMarkdown has none of the problems ValidateMarkdown reports
+var validMarkdown = []string{
+	"",
+	"plain text without a newline",
+	"# Title\n\nSome *text*.\n",
+	"# A\n## B\n### C\n## D\n# E\n## \n",
+	"# A\n\n```go\n# not a heading\n| not | a table\n```\n\n## B\n",
+	"~~~\n```\n~~~\n",
+	"| a | b |\n|:--|--:|\n| 1 | 2 |\n|3|4|\n",
+	"#hashtag is not a heading\n\n###### Six\n",
+	"    # indented code, not a heading\n# Top\n",
+	"Windows\r\nline endings\r\n",
+	"trailing spaces   \n\n\n\ttabs\t\n",
+}
+
+// brokenMarkdown needs fixing, each followed by its fixed form
+var brokenMarkdown = []struct {
+	name, markdown, fixed string
+}{
+	{"unclosed fence", "# A\n```\ncode\n", "# A\n```\ncode\n\n```"},
+	{"unclosed tilde fence", "~~~\n```\n", "~~~\n```\n\n~~~"},
+	{"heading jump", "# A\n### B\n#### C\n", "# A\n## B\n### C\n"},
+	{"heading jump after lower", "## A\n###### B\n", "## A\n### B\n"},
+	{"table without separator", "| a | b |\n| 1 | 2 |\n", "| a | b |\n| --- | --- |\n| 1 | 2 |\n"},
+	{"table short row", "| a | b | c |\n|---|---|---|\n| 1 |\n", "| a | b | c |\n|---|---|---|\n| 1 |  |  |\n"},
+	{"table long row", "| a |\n|---|\n| 1 | 2 |\n", "| a |\n|---|\n| 1 |\n"},
+	{"everything", "# A\n### B\n| x | y |\n| 1 |\n```\n", "# A\n## B\n| x | y |\n| --- | --- |\n| 1 |  |\n```\n\n```"},
+}
+
+func TestFixMarkdownLeavesValidMarkdown(t *testing.T) {
+	for _, markdown := range validMarkdown {
+		if issues := ValidateMarkdown(markdown); len(issues) > 0 {
+			t.Errorf("ValidateMarkdown(%q) = %+v, want no issues", markdown, issues)
+		}
+		if fixed := FixMarkdown(markdown); fixed != markdown {
+			t.Errorf("FixMarkdown(%q) = %q, want it unchanged", markdown, fixed)
+		}
+	}
+}
+
+func TestFixMarkdown(t *testing.T) {
+	for _, tc := range brokenMarkdown {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(ValidateMarkdown(tc.markdown)) == 0 {
+				t.Fatalf("ValidateMarkdown found nothing wrong with %q", tc.markdown)
+			}
+			fixed := FixMarkdown(tc.markdown)
+			if fixed != tc.fixed {
+				t.Errorf("FixMarkdown = %q, want %q", fixed, tc.fixed)
+			}
+			if issues := ValidateMarkdown(fixed); len(issues) > 0 {
+				t.Errorf("fixed markdown still has %+v", issues)
+			}
+			if again := FixMarkdown(fixed); again != fixed {
+				t.Errorf("FixMarkdown is not idempotent: %q became %q", fixed, again)
+			}
+		})
+	}
+}
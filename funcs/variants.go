@@ -0,0 +1,125 @@
+package funcs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Image variants. The original upload is never changed; the others are
+// JPEGs derived from it for each consumer.
+const (
+	VariantOriginal = "original"
+	VariantDisplay  = "display"
+	VariantThumb    = "thumb"
+	VariantAI       = "ai"
+)
+
+// VariantSpec sets the longest edge and JPEG quality of a variant
+type VariantSpec struct {
+	Edge    int
+	Quality int
+}
+
+// ImageVariants are the derived variants made for every upload: display
+// for the note page, thumb for galleries and ai for transcription, large
+// enough for handwriting but small enough for any provider.
+var ImageVariants = map[string]VariantSpec{
+	VariantDisplay: {Edge: 1600, Quality: 82},
+	VariantThumb:   {Edge: 320, Quality: 75},
+	VariantAI:      {Edge: 2048, Quality: 85},
+}
+
+// ImageName is the file name an upload is stored under: the SHA-256 of its
+// contents with the upload's extension, so identical images share a file
+// and different ones never overwrite each other
+func ImageName(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) + strings.ToLower(ext)
+}
+
+// VariantName is the file name a variant of image is stored under
+func VariantName(image, variant string) string {
+	if variant == VariantOriginal {
+		return image
+	}
+	return strings.TrimSuffix(image, filepath.Ext(image)) + "." + variant + ".jpg"
+}
+
+// variantNames lists the file names of every derived variant of image
+func variantNames(image string) []string {
+	var names []string
+	for variant := range ImageVariants {
+		names = append(names, VariantName(image, variant))
+	}
+	return names
+}
+
+// MaxDecodePixels is the largest image, in pixels, decoded to make
+// variants or shrink uploads for the AI; zero sets no limit. Bigger images
+// are used as they are.
+var MaxDecodePixels = 0
+
+// MakeVariants derives the given variants of an image, decoding it once
+func MakeVariants(data []byte, variants ...string) (map[string][]byte, error) {
+	return MakeVariantsFrom(bytes.NewReader(data), variants...)
+}
+
+// MakeVariantsFrom is MakeVariants decoding straight from r, so the encoded
+// image need not be held in memory alongside the decoded one
+func MakeVariantsFrom(r io.ReadSeeker, variants ...string) (map[string][]byte, error) {
+	if err := checkDecodeSize(r); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	out := map[string][]byte{}
+	for _, variant := range variants {
+		if out[variant], err = encodeVariant(img, variant); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// checkDecodeSize rejects images over MaxDecodePixels from their header,
+// leaving r at the start
+func checkDecodeSize(r io.ReadSeeker) error {
+	if MaxDecodePixels == 0 {
+		return nil
+	}
+	config, _, err := image.DecodeConfig(bufio.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind image: %w", err)
+	}
+	if config.Width*config.Height > MaxDecodePixels {
+		return fmt.Errorf("image is %dx%d, over the %d megapixel limit", config.Width, config.Height, MaxDecodePixels/1e6)
+	}
+	return nil
+}
+
+// encodeVariant scales an image down to the variant's size and encodes it
+// as a JPEG. Images already smaller are re-encoded at their own size.
+func encodeVariant(img image.Image, variant string) ([]byte, error) {
+	spec, ok := ImageVariants[variant]
+	if !ok {
+		return nil, fmt.Errorf("unknown image variant %q", variant)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleImage(img, spec.Edge), &jpeg.Options{Quality: spec.Quality}); err != nil {
+		return nil, fmt.Errorf("failed to encode %s variant: %w", variant, err)
+	}
+	return buf.Bytes(), nil
+}
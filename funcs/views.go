@@ -0,0 +1,60 @@
+package funcs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// MaxRecentViews is how many viewed notes are remembered. bookmd has a
+// single reader, so the views are kept once per instance.
+const MaxRecentViews = 50
+
+// RecordView counts a view of a note at the given time and forgets the
+// views that fall beyond MaxRecentViews
+func RecordView(db *sql.DB, noteID int, at time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO recent_views (note_id, viewed_at, views) VALUES (?, ?, 1)
+		ON CONFLICT(note_id) DO UPDATE SET viewed_at = excluded.viewed_at, views = views + 1`, noteID, at.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record view: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM recent_views WHERE note_id NOT IN
+		(SELECT note_id FROM recent_views ORDER BY viewed_at DESC LIMIT ?)`, MaxRecentViews)
+	if err != nil {
+		return fmt.Errorf("failed to trim recent views: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit view: %w", err)
+	}
+	return nil
+}
+
+// RecentlyViewed returns up to limit notes outside the trash, the most
+// recently viewed first
+func RecentlyViewed(db *sql.DB, limit int) ([]Note, error) {
+	rows, err := db.Query(`SELECT `+noteColumns+` FROM notes JOIN recent_views ON recent_views.note_id = notes.id
+		WHERE deleted_at IS NULL ORDER BY viewed_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recent views: %w", err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		note, err := scanNote(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes = append(notes, *note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating recent views: %w", err)
+	}
+	return notes, nil
+}
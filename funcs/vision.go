@@ -0,0 +1,526 @@
+package funcs
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// AI providers a VisionClient can talk to
+const (
+	ProviderOpenAI    = "openai"
+	ProviderGemini    = "gemini"
+	ProviderAnthropic = "anthropic"
+	ProviderOllama    = "ollama"
+	ProviderTesseract = "tesseract"
+)
+
+// Native API endpoints, used when the base URL is left at DefaultBaseURL
+const (
+	GeminiBaseURL    = "https://generativelanguage.googleapis.com/v1beta"
+	AnthropicBaseURL = "https://api.anthropic.com/v1"
+	OllamaBaseURL    = "http://localhost:11434/api"
+)
+
+// VisionRequest is one prompt to a model, optionally with an image
+type VisionRequest struct {
+	Model  string
+	System string
+	Prompt string
+	// Image is the raw image file, or nil for a text-only prompt
+	Image []byte
+	// Schema asks for a JSON reply in this shape where the provider
+	// supports it
+	Schema *jsonschema.Definition
+	// Temperature and MaxTokens are left to the provider when unset
+	Temperature *float64
+	MaxTokens   int
+}
+
+// VisionClient sends a request to an AI provider and returns the text of
+// the reply
+type VisionClient interface {
+	Complete(ctx context.Context, req VisionRequest) (string, error)
+}
+
+// imageLimits is the largest image a provider accepts, in bytes of the file
+// and pixels along the longer edge. Bigger images are scaled down first.
+type imageLimits struct {
+	MaxBytes int
+	MaxEdge  int
+}
+
+// OpenAIVision talks to any OpenAI-compatible chat completions API,
+// sending images inline as base64 data URLs
+type OpenAIVision struct {
+	Client *openai.Client
+}
+
+// openAILimits follows OpenAI's 20 MB per-image limit
+var openAILimits = imageLimits{MaxBytes: 20 << 20}
+
+func (c *OpenAIVision) Complete(ctx context.Context, req VisionRequest) (string, error) {
+	var messages []openai.ChatCompletionMessage
+	if req.System != "" {
+		messages = append(messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: req.System})
+	}
+	if req.Image == nil {
+		messages = append(messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: req.Prompt})
+	} else {
+		data, mimeType := fitImage(req.Image, openAILimits)
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role: openai.ChatMessageRoleUser,
+			MultiContent: []openai.ChatMessagePart{
+				{Type: openai.ChatMessagePartTypeText, Text: req.Prompt},
+				{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{
+					URL: fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)),
+				}},
+			},
+		})
+	}
+
+	chat := openai.ChatCompletionRequest{Model: req.Model, Messages: messages, MaxCompletionTokens: req.MaxTokens}
+	if req.Temperature != nil {
+		chat.Temperature = float32(*req.Temperature)
+		if chat.Temperature == 0 {
+			// A zero temperature is omitted from the request, so send the
+			// smallest one there is
+			chat.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+	if req.Schema != nil {
+		chat.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   "response",
+				Schema: req.Schema,
+			},
+		}
+	}
+
+	resp, err := c.Client.CreateChatCompletion(ctx, chat)
+	if err != nil {
+		return "", openAIError(fmt.Errorf("ai request failed: %w", err))
+	}
+	recordUsage(ctx, ProviderOpenAI, req.Model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	recordResponse(ctx, ProviderOpenAI, resp.ID)
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("no response choices returned")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// GeminiVision talks to Gemini's native generateContent API, which takes
+// the image as an inline_data part rather than a data URL, or as a Files
+// API upload for big scans
+type GeminiVision struct {
+	APIKey  string
+	BaseURL string
+	HTTP    *http.Client
+}
+
+// geminiLimits keeps inline images well inside the 20 MB request limit;
+// Gemini tiles large images itself, so the size is not capped
+var geminiLimits = imageLimits{MaxBytes: 15 << 20}
+
+type geminiPart struct {
+	Text       string      `json:"text,omitempty"`
+	InlineData *geminiBlob `json:"inline_data,omitempty"`
+	FileData   *geminiFile `json:"file_data,omitempty"`
+}
+
+type geminiFile struct {
+	MimeType string `json:"mime_type"`
+	FileURI  string `json:"file_uri"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+func (c *GeminiVision) Complete(ctx context.Context, req VisionRequest) (string, error) {
+	parts := []geminiPart{{Text: req.Prompt}}
+	switch {
+	case len(req.Image) > FileUploadThreshold:
+		// Big scans go through the Files API at full size
+		mimeType := http.DetectContentType(req.Image)
+		file, err := c.upload(ctx, req.Image, mimeType)
+		if err != nil {
+			return "", err
+		}
+		defer c.deleteFile(file.Name)
+		parts = append(parts, geminiPart{FileData: &geminiFile{MimeType: mimeType, FileURI: file.URI}})
+	case req.Image != nil:
+		data, mimeType := fitImage(req.Image, geminiLimits)
+		parts = append(parts, geminiPart{InlineData: &geminiBlob{MimeType: mimeType, Data: base64.StdEncoding.EncodeToString(data)}})
+	}
+
+	body := map[string]any{
+		"contents": []geminiContent{{Role: "user", Parts: parts}},
+	}
+	if req.System != "" {
+		body["system_instruction"] = geminiContent{Parts: []geminiPart{{Text: req.System}}}
+	}
+	config := map[string]any{}
+	if req.Schema != nil {
+		config["responseMimeType"] = "application/json"
+		config["responseJsonSchema"] = req.Schema
+	}
+	if req.Temperature != nil {
+		config["temperature"] = *req.Temperature
+	}
+	if req.MaxTokens != 0 {
+		config["maxOutputTokens"] = req.MaxTokens
+	}
+	if len(config) > 0 {
+		body["generationConfig"] = config
+	}
+
+	var resp struct {
+		ResponseID string `json:"responseId"`
+		Candidates []struct {
+			Content geminiContent `json:"content"`
+		} `json:"candidates"`
+		UsageMetadata struct {
+			PromptTokenCount     int `json:"promptTokenCount"`
+			CandidatesTokenCount int `json:"candidatesTokenCount"`
+		} `json:"usageMetadata"`
+	}
+	url := strings.TrimSuffix(c.BaseURL, "/") + "/models/" + req.Model + ":generateContent"
+	header := http.Header{"x-goog-api-key": {c.APIKey}}
+	if err := postJSON(ctx, c.HTTP, url, header, body, &resp); err != nil {
+		return "", err
+	}
+	recordUsage(ctx, ProviderGemini, req.Model, resp.UsageMetadata.PromptTokenCount, resp.UsageMetadata.CandidatesTokenCount)
+	recordResponse(ctx, ProviderGemini, resp.ResponseID)
+	if len(resp.Candidates) == 0 {
+		return "", fmt.Errorf("no response candidates returned")
+	}
+
+	var text strings.Builder
+	for _, part := range resp.Candidates[0].Content.Parts {
+		text.WriteString(part.Text)
+	}
+	return text.String(), nil
+}
+
+// AnthropicVision talks to Anthropic's Messages API. Big images are sent
+// through the Files API.
+type AnthropicVision struct {
+	APIKey  string
+	BaseURL string
+	HTTP    *http.Client
+}
+
+// anthropicLimits follow the 5 MB per-image limit. Images are scaled to
+// 1568 pixels on the long edge, which the API would otherwise do itself.
+var anthropicLimits = imageLimits{MaxBytes: 5 << 20, MaxEdge: 1568}
+
+// anthropicMaxTokens bounds the reply unless the request sets its own; a
+// dense page of notes fits easily
+const anthropicMaxTokens = 8192
+
+func (c *AnthropicVision) Complete(ctx context.Context, req VisionRequest) (string, error) {
+	prompt := req.Prompt
+	if req.Schema != nil {
+		// The Messages API has no response format, so the shape is asked for
+		// in the prompt; parseTranscription copes with a fenced reply
+		schema, err := json.Marshal(req.Schema)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode response schema: %w", err)
+		}
+		prompt += "\n\nAnswer with only a JSON object matching this schema: " + string(schema)
+	}
+
+	header := http.Header{"x-api-key": {c.APIKey}, "anthropic-version": {"2023-06-01"}}
+	content := []map[string]any{}
+	if req.Image != nil {
+		data, mimeType := fitImage(req.Image, anthropicLimits)
+		var source map[string]string
+		if len(data) > FileUploadThreshold {
+			fileID, err := c.upload(ctx, data, mimeType)
+			if err != nil {
+				return "", err
+			}
+			defer c.deleteFile(fileID)
+			source = map[string]string{"type": "file", "file_id": fileID}
+			header.Set("anthropic-beta", anthropicFilesBeta)
+		} else {
+			source = map[string]string{
+				"type":       "base64",
+				"media_type": mimeType,
+				"data":       base64.StdEncoding.EncodeToString(data),
+			}
+		}
+		content = append(content, map[string]any{"type": "image", "source": source})
+	}
+	content = append(content, map[string]any{"type": "text", "text": prompt})
+
+	body := map[string]any{
+		"model":      req.Model,
+		"max_tokens": cmp.Or(req.MaxTokens, anthropicMaxTokens),
+		"messages":   []map[string]any{{"role": "user", "content": content}},
+	}
+	if req.System != "" {
+		body["system"] = req.System
+	}
+	if req.Temperature != nil {
+		// Anthropic's range is 0 to 1
+		body["temperature"] = min(*req.Temperature, 1)
+	}
+
+	var resp struct {
+		ID      string `json:"id"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := postJSON(ctx, c.HTTP, strings.TrimSuffix(c.BaseURL, "/")+"/messages", header, body, &resp); err != nil {
+		return "", err
+	}
+	recordUsage(ctx, ProviderAnthropic, req.Model, resp.Usage.InputTokens, resp.Usage.OutputTokens)
+	recordResponse(ctx, ProviderAnthropic, resp.ID)
+
+	var text strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	if text.Len() == 0 {
+		return "", fmt.Errorf("no text returned")
+	}
+	return text.String(), nil
+}
+
+// OllamaVision talks to Ollama's native chat API, for vision models run
+// locally or on a machine of your own. The API key is optional and sent as
+// a bearer token, for servers behind an authenticating proxy.
+type OllamaVision struct {
+	APIKey  string
+	BaseURL string
+	HTTP    *http.Client
+}
+
+// ollamaLimits keeps local models fast; most resize to well under this
+var ollamaLimits = imageLimits{MaxBytes: 20 << 20, MaxEdge: 2048}
+
+func (c *OllamaVision) Complete(ctx context.Context, req VisionRequest) (string, error) {
+	messages := []map[string]any{}
+	if req.System != "" {
+		messages = append(messages, map[string]any{"role": "system", "content": req.System})
+	}
+	message := map[string]any{"role": "user", "content": req.Prompt}
+	if req.Image != nil {
+		data, _ := fitImage(req.Image, ollamaLimits)
+		message["images"] = []string{base64.StdEncoding.EncodeToString(data)}
+	}
+	messages = append(messages, message)
+
+	body := map[string]any{
+		"model":    req.Model,
+		"messages": messages,
+		"stream":   false,
+	}
+	if req.Schema != nil {
+		body["format"] = req.Schema
+	}
+	options := map[string]any{}
+	if req.Temperature != nil {
+		options["temperature"] = *req.Temperature
+	}
+	if req.MaxTokens != 0 {
+		options["num_predict"] = req.MaxTokens
+	}
+	if len(options) > 0 {
+		body["options"] = options
+	}
+
+	header := http.Header{}
+	if c.APIKey != "" {
+		header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	var resp struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		PromptEvalCount int `json:"prompt_eval_count"`
+		EvalCount       int `json:"eval_count"`
+	}
+	if err := postJSON(ctx, c.HTTP, strings.TrimSuffix(c.BaseURL, "/")+"/chat", header, body, &resp); err != nil {
+		return "", err
+	}
+	recordUsage(ctx, ProviderOllama, req.Model, resp.PromptEvalCount, resp.EvalCount)
+	// Ollama gives its responses no ID
+	recordResponse(ctx, ProviderOllama, "")
+	if resp.Message.Content == "" {
+		return "", fmt.Errorf("no text returned")
+	}
+	return resp.Message.Content, nil
+}
+
+// postJSON sends body as JSON and decodes a successful reply into out
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, body, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode ai request: %w", err)
+	}
+	return sendRequest(ctx, client, http.MethodPost, url, header, "application/json", bytes.NewReader(payload), out)
+}
+
+// sendRequest makes an API call and decodes a successful JSON reply into
+// out, if out is not nil. Error replies are reported with the provider's
+// message when it has one, as an UnavailableError when they are transient.
+func sendRequest(ctx context.Context, client *http.Client, method, url string, header http.Header, contentType string, body io.Reader, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return fmt.Errorf("failed to build ai request: %w", err)
+	}
+	req.Header = header.Clone()
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("ai request failed: %w", err)
+		if ctx.Err() == nil {
+			err = &UnavailableError{Err: err}
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read ai response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		err := fmt.Errorf("ai request failed: %s", resp.Status)
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+			err = fmt.Errorf("ai request failed: %s: %s", resp.Status, apiErr.Error.Message)
+		}
+		if retryableStatus(resp.StatusCode) {
+			return &UnavailableError{
+				Status:     resp.StatusCode,
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+				Err:        err,
+			}
+		}
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode ai response: %w", err)
+	}
+	return nil
+}
+
+// fitImage returns the image and its MIME type, scaled down and re-encoded
+// as JPEG when it is over the limits. Images that cannot be decoded are
+// sent as they are and left for the provider to reject.
+func fitImage(data []byte, limits imageLimits) ([]byte, string) {
+	mimeType := http.DetectContentType(data)
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return data, mimeType
+	}
+
+	edge := max(config.Width, config.Height)
+	tooBig := limits.MaxBytes > 0 && len(data) > limits.MaxBytes
+	tooWide := limits.MaxEdge > 0 && edge > limits.MaxEdge
+	tooMany := MaxDecodePixels > 0 && config.Width*config.Height > MaxDecodePixels
+	if !tooBig && !tooWide || tooMany {
+		return data, mimeType
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, mimeType
+	}
+	target := edge
+	if tooWide {
+		target = limits.MaxEdge
+	}
+	// Halve the size until the JPEG fits; handwriting stays legible well
+	// below the sizes scans usually come in at
+	for target >= 256 {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scaleImage(img, target), &jpeg.Options{Quality: 85}); err != nil {
+			return data, mimeType
+		}
+		if limits.MaxBytes == 0 || buf.Len() <= limits.MaxBytes {
+			return buf.Bytes(), "image/jpeg"
+		}
+		target /= 2
+	}
+	return data, mimeType
+}
+
+// scaleImage shrinks img so its longer edge is edge pixels, averaging the
+// source pixels under each destination pixel
+func scaleImage(img image.Image, edge int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if max(w, h) <= edge {
+		return img
+	}
+	dw, dh := w*edge/max(w, h), h*edge/max(w, h)
+	dst := image.NewRGBA(image.Rect(0, 0, max(dw, 1), max(dh, 1)))
+
+	for y := 0; y < dst.Bounds().Dy(); y++ {
+		sy0, sy1 := b.Min.Y+y*h/dh, b.Min.Y+max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dst.Bounds().Dx(); x++ {
+			sx0, sx1 := b.Min.X+x*w/dw, b.Min.X+max((x+1)*w/dw, x*w/dw+1)
+			var r, g, bl, a, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
@@ -4,7 +4,9 @@ go 1.25.3
 
 require (
 	github.com/a-h/templ v0.3.977
+	github.com/joho/godotenv v1.5.1
 	github.com/sashabaranov/go-openai v1.41.2
+	github.com/yuin/goldmark v1.7.13
 	modernc.org/sqlite v1.44.3
 )
 
@@ -12,7 +14,6 @@ require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/google/generative-ai-go v0.20.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/ncruces/go-strftime v1.0.0 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"seesharpsi/bookmd/funcs"
+)
+
+// requestIDHeader carries a request's ID: one sent by a proxy in front of
+// the server is kept, else a new one is made, and either is sent back
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID is what an ID from a client may look like, so it cannot
+// forge log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// setupLogging sends everything logged, through slog or the log package,
+// to stderr at level and above (debug, info, warn or error) as text or as
+// JSON, with the request or job each line belongs to
+func setupLogging(level, format string) error {
+	var min slog.Level
+	if err := min.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: use debug, info, warn or error", level)
+	}
+	options := &slog.HandlerOptions{Level: min}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid log format %q: use text or json", format)
+	}
+	slog.SetDefault(slog.New(funcs.ContextHandler{Handler: handler}))
+	return nil
+}
+
+// requestID is the ID of the request ctx belongs to, or "" outside one
+func requestID(ctx context.Context) string {
+	if id, ok := funcs.LogAttr(ctx, "request_id"); ok {
+		return id.String()
+	}
+	return ""
+}
+
+// newRequestID makes a random ID for a request
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends what is buffered of the response, for event streams
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, to flush an
+// event stream or change its deadlines
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+var (
+	httpRequests = funcs.NewCounter("bookmd_http_requests_total",
+		"HTTP requests answered, by route, method and status code.", "route", "method", "code")
+	httpDuration = funcs.NewHistogram("bookmd_http_request_duration_seconds",
+		"Time taken to answer HTTP requests, by route.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "route")
+)
+
+// metricMethods are the methods counted by name; clients can send any
+// other, so those are counted together
+var metricMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// logRequests gives each request an ID, logged with every line about it
+// and sent back in the X-Request-ID header and error responses, and logs
+// each request once it is answered: server errors as errors, client errors
+// as warnings and the rest as info, static files only at debug level. Each
+// is counted under its route pattern, so paths with IDs in them share one.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(funcs.WithLogAttrs(r.Context(), "request_id", id))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		case strings.HasPrefix(r.URL.Path, "/static/"):
+			level = slog.LevelDebug
+		}
+		took := time.Since(start)
+		slog.Log(r.Context(), level, "request",
+			"method", r.Method, "path", r.URL.Path, "status", status,
+			"bytes", recorder.bytes, "duration_ms", took.Milliseconds())
+
+		// The mux sets the pattern on the request it was given, which is r
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		method := r.Method
+		if !slices.Contains(metricMethods, method) {
+			method = "other"
+		}
+		httpRequests.Inc(route, method, strconv.Itoa(status))
+		httpDuration.Observe(took.Seconds(), route)
+	})
+}
@@ -1,31 +1,48 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
-	"database/sql"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
-	"github.com/sashabaranov/go-openai"
 	"seesharpsi/bookmd/funcs"
 	"seesharpsi/bookmd/templ"
 
 	_ "modernc.org/sqlite"
 )
 
-var (
-	db       *sql.DB
-	aiClient *openai.Client
+// Server timeouts. The write timeout leaves room for a conversion answered
+// in the request, retries included.
+const (
+	readHeaderTimeout   = 10 * time.Second
+	defaultReadTimeout  = 5 * time.Minute
+	defaultWriteTimeout = 10 * time.Minute
+	idleTimeout         = 2 * time.Minute
+	// Conversions cut off by the shutdown timeout run again on the next start
+	defaultShutdownTimeout = time.Minute
 )
 
 func main() {
@@ -34,31 +51,201 @@ func main() {
 		log.Println("Warning: Could not load .env file")
 	}
 
+	// Subcommands run instead of the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "convert":
+			os.Exit(runConvert(os.Args[2:]))
+		case "convert-dir":
+			os.Exit(runConvertDir(os.Args[2:]))
+		case "seed":
+			os.Exit(runSeed(os.Args[2:]))
+		}
+	}
+
+	srv := &Server{Now: time.Now, Events: &funcs.EventBus{}}
 	port := flag.Int("port", 9779, "port the server runs on")
 	address := flag.String("address", "http://localhost", "address the server runs on")
+	flag.StringVar(&srv.Paths.Data, "data-dir", "", "directory for the database and images (default $XDG_DATA_HOME/bookmd)")
+	flag.StringVar(&srv.Paths.DB, "db", "", "database file (default <data-dir>/notes.db)")
+	flag.StringVar(&srv.Paths.Images, "images", "", "images directory (default <data-dir>/images)")
+	flag.StringVar(&srv.Paths.Static, "static", "", "serve static assets from this directory instead of those built in (with -dev, default static/ next to the binary, else ./static)")
+	dev := flag.Bool("dev", false, "read static assets from disk on every request, without fingerprints or caching, for editing them live")
+	flag.StringVar(&srv.Paths.Spool, "spool-dir", "", "directory large uploads are written to while they are read (default <data-dir>/spool)")
+	flag.Int64Var(&srv.UploadMemory, "upload-memory", defaultUploadMemory, "bytes of an upload's files kept in memory before the rest is spooled to disk")
+	demo := flag.Bool("demo", false, "run a public demo: sample data, no AI calls, no deleting or settings changes")
+	demoReset := flag.Duration("demo-reset", time.Hour, "how often the demo data is reset (0 never resets it)")
+	queryTimeout := flag.Duration("query-timeout", funcs.DefaultQueryTimeout, "longest a database call may take (0 for no limit)")
+	workers := flag.Int("workers", 2, "number of uploads converted at the same time")
+	aiConcurrency := flag.Int("ai-concurrency", funcs.DefaultAIConcurrency, "most AI requests sent at the same time, queueing the rest (0 for no limit)")
+	aiTimeout := flag.Duration("ai-timeout", funcs.DefaultAITimeout, "longest one attempt at an AI request may take before it is retried (0 for no limit)")
+	readTimeout := flag.Duration("read-timeout", defaultReadTimeout, "longest a client may take to send a request, upload included (0 for no limit)")
+	writeTimeout := flag.Duration("write-timeout", defaultWriteTimeout, "longest a request may take from the end of its headers to the end of the answer (0 for no limit)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", defaultShutdownTimeout, "longest to wait on stopping for open requests and running conversions to finish")
+	trashDays := flag.Int("trash-days", funcs.DefaultTrashDays, "days a deleted note stays in the trash before it is purged (0 keeps it forever)")
+	maintenance := flag.Duration("maintenance-interval", defaultMaintenanceInterval, "how often the database is vacuumed and analyzed (0 never does it)")
+	flag.BoolVar(&srv.Metrics, "metrics", false, "serve Prometheus metrics at /metrics")
+	corsOrigins := flag.String("cors-origins", "", "comma-separated origins whose scripts may call the API, or * for any (default none)")
+	memoryIndex := flag.Bool("memory-index", false, "keep a search index in memory instead of querying the database's, for slow disks")
+	lowPower := flag.Bool("low-power", false, "run on a constrained device such as a Raspberry Pi (see below)")
+	logLevel := flag.String("log-level", "info", "least severe messages logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log as text (key=value pairs) or json")
+	flag.String("config", "", "config file (default ./bookmd.toml, else $XDG_CONFIG_HOME/bookmd/bookmd.toml, when there is one)")
+	flag.Usage = usage
 	flag.Parse()
+	configFile, err := applyConfig(flag.CommandLine)
+	if err != nil {
+		log.Panic("failed to load config: ", err)
+	}
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		log.Panic(err)
+	}
+	if configFile != "" {
+		slog.Info("using config", "path", configFile)
+	}
+
+	// The low-power profile converts one upload at a time unless told
+	// otherwise, so only one image is decoded and sent to the AI at once
+	if *lowPower {
+		funcs.UseLowPower()
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["workers"] {
+			*workers = 1
+		}
+		if !set["ai-concurrency"] {
+			*aiConcurrency = 1
+		}
+	}
+	if *aiConcurrency < 0 {
+		log.Panic("-ai-concurrency must be 0 or more")
+	}
+
+	// The demo wipes its database, so it keeps its own rather than risk
+	// using a real one
+	if *demo {
+		if srv.Paths.Data == "" {
+			srv.Paths.Data = defaultDataDir()
+		}
+		srv.Paths.Data = filepath.Join(srv.Paths.Data, "demo")
+		srv.Paths.DB = filepath.Join(srv.Paths.Data, "notes.db")
+		srv.Paths.Images = filepath.Join(srv.Paths.Data, "images")
+	}
+
+	srv.Paths, err = resolvePaths(srv.Paths)
+	if err != nil {
+		log.Panic(err)
+	}
+	slog.Info("using data", "db", srv.Paths.DB, "images", srv.Paths.Images)
+	if err := srv.useStaticAssets(*dev); err != nil {
+		log.Panic(err)
+	}
+	srv.Images = DirImages(srv.Paths.Images)
+	clearSpool(srv.Paths.Spool)
 
 	// Initialize database
-	var err error
-	db, err = funcs.InitDB("./notes.db")
+	srv.DB, err = funcs.InitDB(srv.Paths.DB)
 	if err != nil {
 		log.Panic("failed to initialize database:", err)
 	}
-	defer db.Close()
+	defer srv.DB.Close()
+	srv.Store, err = funcs.NewStore(srv.DB, *queryTimeout)
+	if err != nil {
+		log.Panic("failed to prepare queries:", err)
+	}
+	defer srv.Store.Close()
 
-	// Initialize OpenAI client
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		log.Println("Warning: OPENAI_API_KEY not set, AI features will not work")
-	} else {
-		config := openai.DefaultConfig(apiKey)
-		config.BaseURL = "https://generativelanguage.googleapis.com/v1beta/openai/"
-		aiClient = openai.NewClientWithConfig(config)
+	// Initialize the AI client from stored settings, falling back to the
+	// environment
+	settings, err := funcs.LoadAISettings(srv.DB)
+	if err != nil {
+		log.Panic("failed to load settings:", err)
+	}
+	srv.AI = funcs.NewTranscriber(settings)
+	srv.AI.Limit().SetConcurrency(*aiConcurrency)
+	srv.AI.Limit().SetTimeout(*aiTimeout)
+	guardrails, err := funcs.GetGuardrails(srv.DB)
+	if err != nil {
+		log.Panic("failed to load guardrails:", err)
+	}
+	srv.AI.UseGuardrails(guardrails)
+	srv.AI.UseCache(srv.DB)
+	srv.AI.UseUsageLog(srv.DB)
+	if *memoryIndex {
+		if srv.Index, err = funcs.NewMemoryIndex(srv.DB); err != nil {
+			log.Panic("failed to build search index:", err)
+		}
+		slog.Info("search index built in memory", "notes", srv.Index.Stats().Notes)
+	}
+	_, client := srv.AI.Current()
+	if *demo {
+		srv.AI.UseClient(funcs.MockVision{})
+		srv.resetDemo()
+		if *demoReset > 0 {
+			go func() {
+				for range time.Tick(*demoReset) {
+					srv.resetDemo()
+				}
+			}()
+		}
+	} else if client == nil {
+		slog.Warn("no AI API key configured and tesseract is not installed, AI features will not work")
+	} else if _, ok := client.(*funcs.TesseractVision); ok && settings.Provider != funcs.ProviderTesseract {
+		slog.Warn("no AI API key configured, transcribing with local tesseract OCR")
+	}
+
+	// Slack work is cancelled only when shutdown gives up waiting for it; the
+	// Matrix bot stops taking new images once shutdown starts
+	srv.chatCtx, srv.stopChats = context.WithCancel(context.Background())
+	shutdownStarted, startShutdown := context.WithCancel(context.Background())
+
+	// Start the Matrix bot if it is configured
+	if homeserver, token := os.Getenv("MATRIX_HOMESERVER"), os.Getenv("MATRIX_ACCESS_TOKEN"); homeserver != "" && token != "" && !*demo {
+		bot := &funcs.MatrixBot{
+			Homeserver:  homeserver,
+			AccessToken: token,
+			DB:          srv.DB,
+			AI:          srv.AI,
+			SaveImage:   srv.saveUpload,
+			ImagePath:   srv.Images.Path,
+		}
+		srv.goChat(func(ctx context.Context) {
+			ctx, stop := context.WithCancel(ctx)
+			defer stop()
+			context.AfterFunc(shutdownStarted, stop)
+			if err := bot.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				slog.Error("matrix bot stopped", "err", err)
+			}
+		})
+	}
+
+	// Convert uploads in the background
+	srv.Jobs = &funcs.JobQueue{DB: srv.DB, Workers: *workers, Process: srv.processUpload, Notify: srv.jobChanged}
+	if err := srv.Jobs.Start(context.Background()); err != nil {
+		log.Panic("failed to start job queue:", err)
 	}
 
-	// Create images directory if it doesn't exist
-	if err := os.MkdirAll("./images", 0755); err != nil {
-		log.Panic("failed to create images directory:", err)
+	go srv.backfillThumbnails()
+	go srv.expireUploads()
+
+	// Purge the trash hourly
+	if *trashDays > 0 {
+		go srv.purgeTrash(time.Duration(*trashDays) * 24 * time.Hour)
+	}
+	if *maintenance > 0 {
+		go srv.maintainDB(*maintenance)
+	}
+
+	// Enable the Slack endpoints if the app is configured
+	if token, secret := os.Getenv("SLACK_BOT_TOKEN"), os.Getenv("SLACK_SIGNING_SECRET"); token != "" && secret != "" && !*demo {
+		srv.Slack = &funcs.SlackApp{
+			BotToken:      token,
+			SigningSecret: secret,
+			DB:            srv.DB,
+			AI:            srv.AI,
+			SaveImage:     srv.saveUpload,
+			ImagePath:     srv.Images.Path,
+		}
 	}
 
 	// ip parsing
@@ -70,236 +257,4120 @@ func main() {
 	}
 
 	mux := http.NewServeMux()
-	add_routes(mux)
+	srv.add_routes(mux)
 
+	// A client that sends its request slowly, or stops reading the answer,
+	// is cut off rather than holding a connection and its memory forever
 	server := http.Server{
-		Addr:    root_ip.Host,
-		Handler: mux,
+		Addr:              root_ip.Host,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       idleTimeout,
 	}
+	// Requests are logged outermost so the log has the status the client got,
+	// panics included; the demo guard's refusals are compressed like answers
+	stack := []middleware{logRequests, recoverPanics, securityHeaders, corsHeaders(parseOrigins(*corsOrigins))}
+	if *demo {
+		stack = append(stack, demoGuard)
+	}
+	server.Handler = chain(mux, append(stack, gzipResponses)...)
+	server.RegisterOnShutdown(srv.Events.Close)
 
 	// start server
-	log.Printf("running server on %s\n", root_ip.Host)
-	err = server.ListenAndServe()
-	defer server.Close()
-	if errors.Is(err, http.ErrServerClosed) {
-		log.Printf("server closed\n")
-	} else if err != nil {
-		log.Printf("error starting server: %s\n", err)
+	slog.Info("running server", "address", root_ip.Host)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe() }()
+	select {
+	case err := <-served:
+		slog.Error("failed to start server", "err", err)
 		os.Exit(1)
+	case sig := <-stop:
+		slog.Info("shutting down", "signal", sig.String())
+	}
+	signal.Stop(stop)
+	startShutdown()
+
+	// Finish the requests in flight, then the conversions and Slack and
+	// Matrix transcriptions already running, before the database is closed.
+	// Pending jobs stay queued for next time.
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("failed to finish open requests", "err", err)
+	}
+	if err := srv.Jobs.Drain(ctx); err != nil {
+		slog.Warn("stopped conversions still running, they will resume on the next start", "err", err)
+	}
+	if err := srv.drainChats(ctx); err != nil {
+		slog.Warn("stopped Slack and Matrix transcriptions still running", "err", err)
+	}
+	slog.Info("server closed")
+}
+
+// usage prints the server's flags and what the low-power profile needs
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags]\n       %s convert|convert-dir|seed [flags]\n\nFlags:\n", os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprint(out, `
+Configuration:
+  Flags take precedence over environment variables, which take precedence
+  over the config file. Any flag can be set in the environment as BOOKMD_
+  and its name in capitals, such as BOOKMD_AI_TIMEOUT=5m, or in the file,
+  which is TOML: a [section] prefixes the names of its keys.
+
+    data-dir = "/var/lib/bookmd"
+    workers = 1
+
+    [ai]
+    timeout = "5m"          # -ai-timeout
+    provider = "ollama"     # BOOKMD_AI_PROVIDER
+    base-url = "http://localhost:11434"
+    model = "llava"
+    prompt = """
+    Transcribe this page into Markdown.
+    """
+
+  Besides flags the file takes ai.provider, ai.api-key, ai.base-url,
+  ai.model, ai.prompt, ai.temperature, ai.max-tokens, ai.retries,
+  ai.retry-delay, input-price, output-price, tesseract-lang and
+  admin-token, which stand in for their BOOKMD_ environment variables. AI
+  settings saved on the settings page override them all.
+
+Admin access:
+  Settings, backups, legal holds and the other admin tools need the token
+  in BOOKMD_ADMIN_TOKEN when it is set, sent as a bearer token or as an
+  admin_token cookie or form value. Without a token they are open only to
+  clients on the same machine, and never to requests carrying Forwarded,
+  X-Forwarded-For or X-Real-IP, so behind a reverse proxy the token is
+  required. Changes a browser sends from another site's page, by its
+  Origin or Sec-Fetch-Site header, are always refused.
+
+Low-power profile (-low-power):
+  For ARM boards and other devices with 512 MB to 1 GB of memory. Uploads
+  are converted and sent to the AI one at a time (unless -workers or
+  -ai-concurrency is given), display variants are at most 1200 px and
+  images sent to the AI at most 1600 px, and SQLite keeps a 2 MB page cache
+  and reads the database through a 256 MB memory map the kernel can
+  reclaim. Images over 24 megapixels are not decoded:
+  they get no variants and go to the AI as uploaded.
+
+  Expect the server to use 20 to 40 MB when idle and to peak around 120 MB
+  while converting a 24 megapixel photo. One CPU core is enough; conversion
+  time is bound by the AI provider, not the device.
+`)
+}
+
+// resetDemo replaces the demo data with the sample notes, so visitors'
+// changes do not last
+func (s *Server) resetDemo() {
+	sample, err := fs.ReadFile(s.staticAssets(), "sample-note.png")
+	if err != nil {
+		slog.Error("failed to read demo image", "err", err)
+		return
+	}
+	if err := funcs.ResetDemo(s.DB, s.Paths.Images, sample); err != nil {
+		slog.Error("failed to reset demo", "err", err)
+		return
 	}
+	slog.Info("demo data reset")
 }
 
-func add_routes(mux *http.ServeMux) {
-	mux.HandleFunc("/", GetIndex)
-	mux.HandleFunc("/static/{file}", ServeStatic)
-	mux.HandleFunc("/api/add-note", AddNoteHandler)
-	mux.HandleFunc("/api/update-note", UpdateNoteHandler)
-	mux.HandleFunc("/api/regenerate-note", RegenerateNoteHandler)
+// demoBlockedPrefixes are the paths that only read in demo mode: settings,
+// admin tools and explicit deletions
+var demoBlockedPrefixes = []string{
+	"/settings", "/api/settings", "/api/guardrails", "/api/ai-cache", "/api/maintenance", "/api/backup", "/api/trash", "/api/delete-",
 }
 
-func ServeStatic(w http.ResponseWriter, r *http.Request) {
-	file := r.PathValue("file")
-	log.Printf("got /static/%s request\n", file)
-	http.ServeFile(w, r, "./static/"+file)
+// demoGuard refuses deletions and changes to configuration, so a public
+// demo cannot be broken by its visitors
+func demoGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blocked := r.Method == http.MethodDelete
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			for _, prefix := range demoBlockedPrefixes {
+				if strings.HasPrefix(r.URL.Path, prefix) {
+					blocked = true
+				}
+			}
+		}
+		if blocked {
+			writeError(w, r, "This is disabled in the demo", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
-func GetIndex(w http.ResponseWriter, r *http.Request) {
-	log.Printf("got / request\n")
-	component := templ.Index()
-	component.Render(context.Background(), w)
+// purgeTrash permanently removes notes that have been in the trash longer
+// than retention, now and then every hour
+func (s *Server) purgeTrash(retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		purged, images, err := funcs.PurgeTrash(s.DB, s.now().Add(-retention))
+		if err != nil {
+			slog.Error("failed to purge trash", "err", err)
+		}
+		for _, image := range images {
+			s.removeImage(image)
+		}
+		if purged > 0 {
+			slog.Info("purged notes from the trash", "notes", purged)
+		}
+		<-ticker.C
+	}
 }
 
-func AddNoteHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("got %s request\n", r.URL.Path)
+// defaultMaintenanceInterval is how often maintainDB runs unless
+// -maintenance-interval says otherwise
+const defaultMaintenanceInterval = 24 * time.Hour
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// maintainDB vacuums and analyzes the database every interval, the first
+// time one interval after starting, so a restart is not slowed by it
+func (s *Server) maintainDB(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := funcs.RunMaintenance(s.DB)
+		if err != nil {
+			slog.Error("failed to maintain database", "err", err)
+			continue
+		}
+		slog.Info("database maintained", "duration_ms", report.DurationMS, "bytes_freed", report.BytesFreed)
+	}
+}
+
+// storage reports the space the library takes, images included
+func (s *Server) storage() (*funcs.StorageReport, error) {
+	report, err := funcs.GetStorage(s.DB, func(name string) int64 {
+		info, err := os.Stat(s.Images.Path(name))
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(s.Paths.Images, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if info, err := d.Info(); err == nil {
+			report.ImagesBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure images: %w", err)
+	}
+	return report, nil
+}
+
+// newTranscriber transcribes with the AI settings from the environment,
+// falling back to local OCR
+func newTranscriber() *funcs.Transcriber {
+	return funcs.NewTranscriber(funcs.DefaultAISettings())
+}
+
+// pricingFromEnv reads BOOKMD_INPUT_PRICE and BOOKMD_OUTPUT_PRICE (US dollars
+// per million tokens), falling back to the list price of the default model
+func pricingFromEnv() funcs.Pricing {
+	pricing := funcs.DefaultPricing
+	if v, err := strconv.ParseFloat(os.Getenv("BOOKMD_INPUT_PRICE"), 64); err == nil {
+		pricing.InputPerMillion = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("BOOKMD_OUTPUT_PRICE"), 64); err == nil {
+		pricing.OutputPerMillion = v
+	}
+	return pricing
+}
+
+// dryRun reports whether the request asks for an estimate instead of an AI call
+func dryRun(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.FormValue("dry_run"))
+	return v
+}
+
+// writeEstimate answers a dry run with the projected cost
+func writeEstimate(w http.ResponseWriter, estimate funcs.Estimate) {
+	writeData(w, http.StatusOK, estimateResponse{DryRun: true, Estimate: estimate})
+}
+
+func (s *Server) add_routes(mux *http.ServeMux) {
+	mux.HandleFunc("/", s.GetIndex)
+	mux.HandleFunc("/static/{file}", s.ServeStatic)
+	mux.HandleFunc("/images/{name}", s.ImageHandler)
+	mux.HandleFunc("/n/{slug}", s.GetNotePage)
+	mux.HandleFunc("/open/{id}", s.OpenNoteHandler)
+	mux.HandleFunc("/trash", s.GetTrashPage)
+	mux.HandleFunc("/history/{id}", s.GetHistoryPage)
+	mux.HandleFunc("/open/{id}/qr.svg", s.OpenNoteQRHandler)
+	mux.HandleFunc("/api/deep-links", s.DeepLinksHandler)
+	mux.HandleFunc("/api/notes", s.ListNotesHandler)
+	mux.HandleFunc("/search", s.GetSearchPage)
+	mux.HandleFunc("/api/search", s.SearchHandler)
+	mux.HandleFunc("/metrics", s.MetricsHandler)
+	mux.HandleFunc("/api/notes/{id}", s.NoteHandler)
+	mux.HandleFunc("/api/notes/{id}/qr", s.NoteQRHandler)
+	mux.HandleFunc("/api/notes/{id}/image", s.NoteImageHandler)
+	mux.HandleFunc("/api/notes/{id}/thumbnail", s.NoteThumbnailHandler)
+	mux.HandleFunc("/api/notes/{id}/markdown", s.NoteMarkdownHandler)
+	mux.HandleFunc("/api/notes/{id}/cleanup", s.CleanupNoteHandler)
+	mux.HandleFunc("/api/notes/{id}/outline", s.NoteOutlineHandler)
+	mux.HandleFunc("/api/notes/{id}/restore", s.RestoreNoteHandler)
+	mux.HandleFunc("/api/notes/{id}/revisions", s.NoteRevisionsHandler)
+	mux.HandleFunc("/api/notes/{id}/provenance", s.NoteProvenanceHandler)
+	mux.HandleFunc("/api/notes/{id}/revisions/{revision}", s.NoteRevisionHandler)
+	mux.HandleFunc("/api/notes/{id}/rollback", s.RollbackNoteHandler)
+	mux.HandleFunc("/api/trash", s.TrashHandler)
+	mux.HandleFunc("/api/trash/{id}", s.TrashNoteHandler)
+	mux.HandleFunc("/api/labels", s.LabelsHandler)
+	mux.HandleFunc("/graph", s.GetGraphPage)
+	mux.HandleFunc("/api/graph", s.GraphHandler)
+	mux.HandleFunc("/report", s.GetReportPage)
+	mux.HandleFunc("/api/properties", s.GetPropertiesHandler)
+	mux.HandleFunc("/api/set-property", s.SetPropertyHandler)
+	mux.HandleFunc("/api/delete-property", s.DeletePropertyHandler)
+	mux.HandleFunc("/api/notes-by-property", s.NotesByPropertyHandler)
+	mux.HandleFunc("/api/export-note", s.ExportNoteHandler)
+	mux.HandleFunc("/api/note-types", s.NoteTypesHandler)
+	mux.HandleFunc("/api/delete-note-type", s.DeleteNoteTypeHandler)
+	mux.HandleFunc("/types/{name}", s.GetNoteTypePage)
+	mux.HandleFunc("/api/pipelines", s.PipelinesHandler)
+	mux.HandleFunc("/api/delete-pipeline", s.DeletePipelineHandler)
+	mux.HandleFunc("/api/run-pipeline", s.RunPipelineHandler)
+	mux.HandleFunc("/api/pipeline-runs/{id}", s.PipelineRunHandler)
+	mux.HandleFunc("/replace", s.GetReplacePage)
+	mux.HandleFunc("/api/replace", s.ReplaceHandler)
+	mux.HandleFunc("/tags/review", s.GetTagReviewPage)
+	mux.HandleFunc("/api/tag-suggestions", s.TagSuggestionsHandler)
+	mux.HandleFunc("/api/tag-suggestions/{id}", s.TagSuggestionHandler)
+	mux.HandleFunc("/api/feedback", s.FeedbackHandler)
+	mux.HandleFunc("/api/feedback-stats", s.FeedbackStatsHandler)
+	mux.HandleFunc("/api/changes", s.ChangesHandler)
+	mux.HandleFunc("/notebooks/{id}", s.GetNotebookPage)
+	mux.HandleFunc("/notebooks/{id}/compiled", s.GetCompiledNotebookPage)
+	mux.HandleFunc("/api/notebooks/{id}/export", s.ExportNotebookHandler)
+	mux.HandleFunc("/api/notebooks", s.NotebooksHandler)
+	mux.HandleFunc("/api/notebooks/{id}", s.NotebookHandler)
+	mux.HandleFunc("/api/notebooks/{id}/lock", s.NotebookLockHandler)
+	mux.HandleFunc("/api/audit", s.AuditLogHandler)
+	mux.HandleFunc("/api/move-notes", s.MoveNotesHandler)
+	mux.HandleFunc("/physical", s.GetPhysicalNotebooksPage)
+	mux.HandleFunc("/physical/{id}", s.GetPhysicalNotebookPage)
+	mux.HandleFunc("/api/physical-notebooks", s.PhysicalNotebooksHandler)
+	mux.HandleFunc("/api/physical-notebooks/{id}/pages", s.PhysicalNotebookPagesHandler)
+	mux.HandleFunc("/api/delete-physical-notebook", s.DeletePhysicalNotebookHandler)
+	mux.HandleFunc("/api/set-note-page", s.SetNotePageHandler)
+	mux.HandleFunc("/api/review-note", s.ReviewNoteHandler)
+	mux.HandleFunc("/settings", s.GetSettingsPage)
+	mux.HandleFunc("/api/settings", s.SettingsHandler)
+	mux.HandleFunc("/api/guardrails", s.GuardrailsHandler)
+	mux.HandleFunc("/api/ai-cache", s.AICacheHandler)
+	mux.HandleFunc("/api/usage", s.UsageHandler)
+	mux.HandleFunc("/api/maintenance", s.MaintenanceHandler)
+	mux.HandleFunc("/api/backup", s.BackupHandler)
+	mux.HandleFunc("/api/ai-cache/{key}", s.AICacheEntryHandler)
+	mux.HandleFunc("/api/preferences", s.PreferencesHandler)
+	mux.HandleFunc("/slack/commands", s.SlackCommandHandler)
+	mux.HandleFunc("/slack/events", s.SlackEventsHandler)
+	mux.HandleFunc("/api/add-note", s.AddNoteHandler)
+	mux.HandleFunc("/api/add-notes", s.AddNotesHandler)
+	mux.HandleFunc("/api/batches/{id}", s.BatchHandler)
+	mux.HandleFunc("/api/jobs/{id}", s.JobHandler)
+	mux.HandleFunc("/api/uploads", s.UploadsHandler)
+	mux.HandleFunc("/api/uploads/{id}", s.UploadHandler)
+	mux.HandleFunc("/api/events", s.EventsHandler)
+	mux.HandleFunc("/thumbnail/{id}", s.GetThumbnail)
+	mux.HandleFunc("/api/update-note", s.UpdateNoteHandler)
+	mux.HandleFunc("/api/regenerate-note", s.RegenerateNoteHandler)
+}
+
+// indexNoteLimit is how many of the newest notes the index lists
+const indexNoteLimit = 50
+
+// recentViewLimit is how many recently viewed notes the index offers
+const recentViewLimit = 6
+
+func (s *Server) GetIndex(w http.ResponseWriter, r *http.Request) {
+	tree, err := funcs.NotebookTree(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to load notebooks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	notes, err := s.Store.ListNotes(r.Context(), funcs.SortDate, true, indexNoteLimit, 0)
+	if err != nil {
+		http.Error(w, "Failed to load notes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recent, err := funcs.RecentlyViewed(s.DB, recentViewLimit)
+	if err != nil {
+		http.Error(w, "Failed to load recent notes: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	component := templ.Index(tree, recent, notes, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
 
-	// Parse multipart form (max 32MB)
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+func (s *Server) GetNotePage(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+
+	id, err := funcs.ParseNoteSlug(slug)
+	if err != nil {
+		http.Error(w, "Note not found", http.StatusNotFound)
 		return
 	}
 
-	file, header, err := r.FormFile("image")
+	note, err := s.Store.GetNote(r.Context(), id)
 	if err != nil {
-		http.Error(w, "No image file provided", http.StatusBadRequest)
+		http.Error(w, "Note not found", http.StatusNotFound)
 		return
 	}
-	defer file.Close()
 
-	// Generate unique filename
-	ext := filepath.Ext(header.Filename)
-	filename := fmt.Sprintf("%d%s", header.Size, ext)
-	imagePath := filepath.Join("./images", filename)
+	// Redirect stale slugs to the current one; browsers keep the #fragment
+	if canonical := funcs.NoteSlug(note); canonical != slug {
+		http.Redirect(w, r, "/n/"+canonical, http.StatusMovedPermanently)
+		return
+	}
 
-	// Save image to images folder
-	dst, err := os.Create(imagePath)
+	html, headings, err := funcs.RenderMarkdown(funcs.ExpandTransclusions(s.DB, note))
 	if err != nil {
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
+		http.Error(w, "Failed to render note", http.StatusInternalServerError)
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
+	backlinks, err := funcs.GetBacklinks(s.DB, note.ID)
+	if err != nil {
+		http.Error(w, "Failed to load backlinks", http.StatusInternalServerError)
 		return
 	}
 
-	// Convert image to markdown using AI
-	markdown, err := funcs.ConvertImageToMarkdown(context.Background(), aiClient, imagePath)
+	properties, err := funcs.GetProperties(s.DB, note.ID)
 	if err != nil {
-		print(err.Error())
-		http.Error(w, "Failed to convert image to markdown", http.StatusInternalServerError)
+		http.Error(w, "Failed to load properties", http.StatusInternalServerError)
 		return
 	}
-
-	// Save to database
-	note, err := funcs.AddNote(db, filename, markdown)
+	provenance, err := funcs.GetNoteProvenance(s.DB, note.ID)
 	if err != nil {
-		http.Error(w, "Failed to save to database", http.StatusInternalServerError)
+		http.Error(w, "Failed to load provenance", http.StatusInternalServerError)
 		return
 	}
 
-	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"success": true, "id": %d, "image": "%s", "markdown": "%s"}`,
-		note.ID, note.Image, strings.ReplaceAll(note.Markdown, "\n", "\\n"))
+	if err := funcs.RecordView(s.DB, note.ID, s.now()); err != nil {
+		slog.ErrorContext(r.Context(), "failed to record view", "note_id", note.ID, "err", err)
+	}
+
+	component := templ.NotePage(*note, html, headings, backlinks, properties, provenance, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
 }
 
-func UpdateNoteHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("got %s request\n", r.URL.Path)
+func (s *Server) GetGraphPage(w http.ResponseWriter, r *http.Request) {
+	component := templ.GraphPage(s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+func (s *Server) GraphHandler(w http.ResponseWriter, r *http.Request) {
+	graph, err := funcs.GraphData(s.DB)
+	if err != nil {
+		writeError(w, r, "Failed to load graph: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Get note ID from form
-	idStr := r.FormValue("id")
-	if idStr == "" {
-		http.Error(w, "Note ID required", http.StatusBadRequest)
+	writeData(w, http.StatusOK, graph)
+}
+
+func (s *Server) GetReportPage(w http.ResponseWriter, r *http.Request) {
+	report, err := funcs.TidyReport(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to build report: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	id, err := strconv.Atoi(idStr)
+	component := templ.ReportPage(report, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// displayPrefs resolves the locale and timezone used to render a page
+func (s *Server) displayPrefs(w http.ResponseWriter, r *http.Request) funcs.DisplayPrefs {
+	preferences, err := funcs.GetPreferences(s.DB)
 	if err != nil {
-		http.Error(w, "Invalid note ID", http.StatusBadRequest)
+		slog.ErrorContext(r.Context(), "failed to load preferences", "err", err)
+	}
+	return funcs.DisplayPrefs{
+		Locale:   requestLocale(w, r),
+		Location: requestTimezone(w, r),
+		Theme:    preferences.Theme,
+		Density:  preferences.ListDensity,
+	}
+}
+
+// requestLocale negotiates the UI language for a request. A ?lang= query
+// parameter overrides Accept-Language and is remembered in a cookie.
+func requestLocale(w http.ResponseWriter, r *http.Request) string {
+	override := r.URL.Query().Get("lang")
+	if funcs.SupportedLocale(override) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "lang",
+			Value:    override,
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			SameSite: http.SameSiteLaxMode,
+		})
+	} else if cookie, err := r.Cookie("lang"); err == nil {
+		override = cookie.Value
+	}
+	return funcs.NegotiateLocale(r.Header.Get("Accept-Language"), override)
+}
+
+// requestTimezone resolves the viewer's timezone. The index page detects it
+// in the browser and stores it in the tz cookie; a ?tz= query parameter
+// overrides the detected value.
+func requestTimezone(w http.ResponseWriter, r *http.Request) *time.Location {
+	name := r.URL.Query().Get("tz")
+	if _, err := time.LoadLocation(name); name != "" && err == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "tz",
+			Value:    url.QueryEscape(name),
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			SameSite: http.SameSiteLaxMode,
+		})
+	} else if cookie, err := r.Cookie("tz"); err == nil {
+		name, _ = url.QueryUnescape(cookie.Value)
+	}
+	return funcs.ParseTimezone(name)
+}
+
+func (s *Server) AddNoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Parse multipart form (max 32MB)
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	form, err := s.parseUpload(r)
+	if err != nil {
+		writeError(w, r, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	defer form.RemoveAll()
 
-	file, header, err := r.FormFile("image")
+	file, header, err := form.FormFile("image")
 	if err != nil {
-		http.Error(w, "No image file provided", http.StatusBadRequest)
+		writeError(w, r, "No image file provided", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	// Generate unique filename
-	ext := filepath.Ext(header.Filename)
-	filename := fmt.Sprintf("%d%s", header.Size, ext)
-	imagePath := filepath.Join("./images", filename)
-
-	// Save image to images folder
-	dst, err := os.Create(imagePath)
+	// Validate typed fields before spending an AI call on the image
+	noteType, fields, err := s.typedFields(r)
 	if err != nil {
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
+		writeError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer dst.Close()
+	overrides, err := aiOverrides(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Without an entered page the one read off the image is used
+	notebookID, page, err := s.notePage(r)
+	if err == nil && page != 0 {
+		err = funcs.ValidateNotePage(s.DB, notebookID, page)
+	}
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := uploadParams{
+		Autofix:    r.FormValue("autofix") == "true",
+		NoteType:   noteType,
+		Fields:     fields,
+		NotebookID: notebookID,
+		Page:       page,
+		AI:         overrides,
+	}
 
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Failed to save image", http.StatusInternalServerError)
+	var magic [5]byte
+	if n, _ := file.ReadAt(magic[:], 0); funcs.IsPDF(magic[:n]) {
+		s.addPDF(w, r, file, header.Filename, params)
 		return
 	}
 
-	// Convert image to markdown using AI
-	markdown, err := funcs.ConvertImageToMarkdown(context.Background(), aiClient, imagePath)
+	if dryRun(r) {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			writeError(w, r, "Failed to read image", http.StatusBadRequest)
+			return
+		}
+		writeEstimate(w, s.AI.EstimateImage(data, pricingFromEnv()))
+		return
+	}
+
+	filename, err := s.saveUpload(header.Filename, file)
 	if err != nil {
-		http.Error(w, "Failed to convert image to markdown", http.StatusInternalServerError)
+		writeError(w, r, "Failed to save image", http.StatusInternalServerError)
+		return
+	}
+	if s.existingNote(w, r, filename) {
 		return
 	}
 
-	// Update database
-	note, err := funcs.UpdateNote(db, id, filename, markdown)
+	job, err := s.Jobs.Enqueue(r.Context(), 0, header.Filename, filename, params)
 	if err != nil {
-		http.Error(w, "Failed to update database", http.StatusInternalServerError)
+		writeError(w, r, "Failed to queue conversion", http.StatusInternalServerError)
 		return
 	}
+	s.writeJob(w, r, job)
+}
+
+// writeJob answers an upload with its queued job, or with the finished note
+// when the request asks to wait=true for it
+func (s *Server) writeJob(w http.ResponseWriter, r *http.Request, job *funcs.Job) {
+	var err error
+	if wait, _ := strconv.ParseBool(r.FormValue("wait")); wait {
+		job, err = s.Jobs.Wait(r.Context(), job.ID)
+		if err != nil {
+			writeError(w, r, "Failed to wait for conversion: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		if job.Status == funcs.JobFailed {
+			writeError(w, r, job.Error, http.StatusBadGateway)
+			return
+		}
+	}
 
-	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"success": true, "id": %d, "image": "%s", "markdown": "%s"}`,
-		note.ID, note.Image, strings.ReplaceAll(note.Markdown, "\n", "\\n"))
+	if redirectBack(w, r) {
+		return
+	}
+	if job.Status == funcs.JobDone {
+		var result uploadResult
+		if err := json.Unmarshal(job.Result, &result); err != nil {
+			slog.ErrorContext(r.Context(), "failed to decode job result", "job_id", job.ID, "err", err)
+		}
+		s.writeNote(w, r, http.StatusCreated, job.NoteID, result.Warnings, result.PageGaps)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/jobs/%d", job.ID))
+	writeData(w, http.StatusAccepted, job)
 }
 
-func RegenerateNoteHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("got %s request\n", r.URL.Path)
+// addPDF converts each page of an uploaded PDF. By default every page
+// becomes a note of its own, queued as a batch; with pdf=single the pages
+// become sections of one note, which keeps the first page as its image.
+func (s *Server) addPDF(w http.ResponseWriter, r *http.Request, file io.Reader, name string, params uploadParams) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeError(w, r, "Failed to read PDF", http.StatusBadRequest)
+		return
+	}
+	pages, err := funcs.PDFPages(r.Context(), data)
+	if err != nil {
+		writeError(w, r, "Failed to read PDF: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if dryRun(r) {
+		var estimate funcs.Estimate
+		for _, page := range pages {
+			estimate.Add(s.AI.EstimateImage(page, pricingFromEnv()))
+		}
+		writeEstimate(w, estimate)
 		return
 	}
 
-	// Get note ID from form
-	idStr := r.FormValue("id")
-	if idStr == "" {
-		http.Error(w, "Note ID required", http.StatusBadRequest)
+	single := r.FormValue("pdf") == "single"
+	if !single && params.Page != 0 {
+		for i := 1; i < len(pages); i++ {
+			if err := funcs.ValidateNotePage(s.DB, params.NotebookID, params.Page+i); err != nil {
+				writeError(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	images := make([]string, len(pages))
+	for i, page := range pages {
+		images[i], err = s.saveUpload(pdfPageName(name, i), bytes.NewReader(page))
+		if err != nil {
+			writeError(w, r, "Failed to save image", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if single {
+		params.Pages = images
+		job, err := s.Jobs.Enqueue(r.Context(), 0, name, images[0], params)
+		if err != nil {
+			writeError(w, r, "Failed to queue conversion", http.StatusInternalServerError)
+			return
+		}
+		s.writeJob(w, r, job)
 		return
 	}
 
-	id, err := strconv.Atoi(idStr)
+	batch, err := s.Jobs.NewBatch()
 	if err != nil {
-		http.Error(w, "Invalid note ID", http.StatusBadRequest)
+		writeError(w, r, "Failed to queue conversion", http.StatusInternalServerError)
 		return
 	}
+	for i, image := range images {
+		pageParams := params
+		if params.Page != 0 {
+			pageParams.Page = params.Page + i
+		}
+		if _, err := s.Jobs.Enqueue(r.Context(), batch, pdfPageName(name, i), image, pageParams); err != nil {
+			writeError(w, r, "Failed to queue conversion", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.writeBatch(w, r, batch)
+}
 
-	// Parse form
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+// pdfPageName names the image of the i-th page of a PDF, counting from 0
+func pdfPageName(pdf string, i int) string {
+	return fmt.Sprintf("%s-page-%d.jpg", strings.TrimSuffix(pdf, filepath.Ext(pdf)), i+1)
+}
+
+// saveUpload stores an uploaded image under the hash of its contents and
+// returns that name. An image already stored is not written again.
+func (s *Server) saveUpload(name string, file io.Reader) (string, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+	filename := funcs.ImageName(data, filepath.Ext(name))
+	if f, err := s.Images.Open(filename); err == nil {
+		f.Close()
+		return filename, nil
+	}
+	if err := s.Images.Save(filename, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// existingNote looks for a note already made from an uploaded image and
+// links to it from the response. With existing=true that note is answered
+// instead of converting the image again, and true is returned.
+func (s *Server) existingNote(w http.ResponseWriter, r *http.Request, image string) bool {
+	id, err := funcs.NoteWithImage(s.DB, image)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to look for duplicates", "image", image, "err", err)
+		return false
+	}
+	if id == 0 {
+		return false
+	}
+	w.Header().Set("Link", fmt.Sprintf(`</api/notes/%d>; rel="duplicate"`, id))
+	if existing, _ := strconv.ParseBool(r.FormValue("existing")); !existing {
+		return false
+	}
+	if redirectBack(w, r) {
+		return true
+	}
+	s.writeNote(w, r, http.StatusOK, id, nil, nil)
+	return true
+}
+
+// Limits of a batch upload, counting the images inside zips
+const (
+	maxBatchFiles = 500
+	maxBatchImage = 32 << 20
+)
+
+// batchImageExts are the files taken from a zip; others, such as a scanner
+// app's metadata, are skipped
+var batchImageExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true}
+
+// batchFile is one image of a batch upload, sent directly or inside a zip
+type batchFile struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+// batchFiles lists the images of a batch upload, unpacking zips. The zips
+// stay open for the images to be read until close is called.
+func batchFiles(ctx context.Context, headers []*uploadFile) (files []batchFile, closeAll func(), err error) {
+	var zips []multipart.File
+	closeAll = func() {
+		for _, f := range zips {
+			f.Close()
+		}
+	}
+	defer func() {
+		if err != nil {
+			closeAll()
+		}
+	}()
+
+	for _, header := range headers {
+		if strings.EqualFold(filepath.Ext(header.Filename), ".pdf") {
+			pdf, err := readPDF(ctx, header)
+			if err != nil {
+				return nil, nil, err
+			}
+			files = append(files, pdf...)
+			continue
+		}
+		if !strings.EqualFold(filepath.Ext(header.Filename), ".zip") {
+			files = append(files, batchFile{header.Filename, func() (io.ReadCloser, error) {
+				return header.Open()
+			}})
+			continue
+		}
+
+		f, err := header.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read %s", header.Filename)
+		}
+		zips = append(zips, f)
+		archive, err := zip.NewReader(f, header.Size)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a valid zip", header.Filename)
+		}
+		for _, entry := range archive.File {
+			base := path.Base(entry.Name)
+			if entry.FileInfo().IsDir() || strings.HasPrefix(base, ".") || strings.HasPrefix(entry.Name, "__MACOSX/") ||
+				!batchImageExts[strings.ToLower(path.Ext(base))] {
+				continue
+			}
+			if entry.UncompressedSize64 > maxBatchImage {
+				return nil, nil, fmt.Errorf("%s in %s is too large", entry.Name, header.Filename)
+			}
+			files = append(files, batchFile{base, entry.Open})
+		}
+	}
+	if len(files) > maxBatchFiles {
+		return nil, nil, fmt.Errorf("A batch can hold at most %d images", maxBatchFiles)
+	}
+	return files, closeAll, nil
+}
+
+// readPDF lists the pages of an uploaded PDF as batch images
+func readPDF(ctx context.Context, header *uploadFile) ([]batchFile, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s", header.Filename)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s", header.Filename)
+	}
+	pages, err := funcs.PDFPages(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", header.Filename, err)
+	}
+	files := make([]batchFile, len(pages))
+	for i, page := range pages {
+		files[i] = batchFile{pdfPageName(header.Filename, i), func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(page)), nil
+		}}
+	}
+	return files, nil
+}
+
+// AddNotesHandler converts several images into notes in the background, one
+// job per image, and answers with the batch tracking them. Images are sent
+// as "images"; zips of images are unpacked and PDFs split into pages. A page given with a paper
+// notebook is the page of the first image, and the rest follow in order.
+func (s *Server) AddNotesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Get the existing note from database
-	note, err := funcs.GetNoteByID(db, id)
+	form, err := s.parseUpload(r)
+	if err != nil {
+		writeError(w, r, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer form.RemoveAll()
+	files, closeFiles, err := batchFiles(r.Context(), form.Files("images"))
 	if err != nil {
-		http.Error(w, "Failed to retrieve note: "+err.Error(), http.StatusNotFound)
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer closeFiles()
+	if len(files) == 0 {
+		writeError(w, r, "No image files provided", http.StatusBadRequest)
 		return
 	}
 
-	// Construct full image path
-	imagePath := filepath.Join("./images", note.Image)
+	noteType, fields, err := s.typedFields(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	overrides, err := aiOverrides(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	notebookID, page, err := s.notePage(r)
+	if err == nil && page != 0 {
+		for i := range files {
+			if err = funcs.ValidateNotePage(s.DB, notebookID, page+i); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Check if image file exists
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-		http.Error(w, "Image file not found", http.StatusNotFound)
+	batch, err := s.Jobs.NewBatch()
+	if err != nil {
+		writeError(w, r, "Failed to queue conversion", http.StatusInternalServerError)
 		return
 	}
+	for i, file := range files {
+		params := uploadParams{
+			Autofix:    r.FormValue("autofix") == "true",
+			NoteType:   noteType,
+			Fields:     fields,
+			NotebookID: notebookID,
+			AI:         overrides,
+		}
+		if page != 0 {
+			params.Page = page + i
+		}
 
-	// Convert image to markdown using AI (regenerating)
-	markdown, err := funcs.ConvertImageToMarkdown(context.Background(), aiClient, imagePath)
+		src, err := file.open()
+		if err != nil {
+			writeError(w, r, "Failed to read "+file.name, http.StatusBadRequest)
+			return
+		}
+		filename, err := s.saveUpload(file.name, io.LimitReader(src, maxBatchImage))
+		src.Close()
+		if err != nil {
+			writeError(w, r, "Failed to save "+file.name, http.StatusInternalServerError)
+			return
+		}
+		if _, err := s.Jobs.Enqueue(r.Context(), batch, file.name, filename, params); err != nil {
+			writeError(w, r, "Failed to queue conversion", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.writeBatch(w, r, batch)
+}
+
+// writeBatch answers a batch upload with the status of its jobs
+func (s *Server) writeBatch(w http.ResponseWriter, r *http.Request, batch int) {
+	if redirectBack(w, r) {
+		return
+	}
+	status, err := funcs.GetBatch(s.DB, batch)
 	if err != nil {
-		http.Error(w, "Failed to convert image to markdown: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, "Failed to load batch: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Location", fmt.Sprintf("/api/batches/%d", batch))
+	writeData(w, http.StatusAccepted, status)
+}
 
-	// Update database with new markdown (keeping same image)
-	updatedNote, err := funcs.UpdateNote(db, id, note.Image, markdown)
+// BatchHandler reports the status of a batch upload and each of its files
+func (s *Server) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Batch not found", http.StatusNotFound)
+		return
+	}
+	batch, err := funcs.GetBatch(s.DB, id)
 	if err != nil {
-		http.Error(w, "Failed to update database: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, "Failed to load batch: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
 		return
 	}
+	writeData(w, http.StatusOK, batch)
+}
 
-	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"success": true, "id": %d, "image": "%s", "markdown": "%s"}`,
-		updatedNote.ID, updatedNote.Image, strings.ReplaceAll(updatedNote.Markdown, "\n", "\\n"))
+// uploadParams are the options of an upload, kept with its job until a
+// worker converts it
+type uploadParams struct {
+	Autofix    bool              `json:"autofix"`
+	NoteType   string            `json:"note_type"`
+	Fields     map[string]string `json:"fields"`
+	NotebookID int               `json:"notebook_id"`
+	Page       int               `json:"page"`
+	AI         funcs.AIOverrides `json:"ai"`
+	// Pages are the images of a PDF converted into a single note
+	Pages []string `json:"pages,omitempty"`
+}
+
+// uploadResult is stored with a finished upload job
+type uploadResult struct {
+	Warnings []funcs.MarkdownIssue `json:"warnings"`
+	PageGaps []int                 `json:"page_gaps"`
+}
+
+// transcribeUpload makes the variants of a stored upload and transcribes it
+func (s *Server) transcribeUpload(ctx context.Context, image string, o funcs.AIOverrides) (*funcs.Transcription, error) {
+	s.makeVariants(image)
+	path, steps := s.aiImage(image)
+	transcription, err := s.AI.TranscribeImageOverride(ctx, path, o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert image to markdown: %w", err)
+	}
+	transcription.Provenance.Preprocessing = steps
+	return transcription, nil
+}
+
+// processUpload transcribes a queued upload and saves it as a new note
+func (s *Server) processUpload(ctx context.Context, job *funcs.Job) (int, any, error) {
+	var params uploadParams
+	if err := json.Unmarshal(job.Params, &params); err != nil {
+		return 0, nil, fmt.Errorf("invalid job params: %w", err)
+	}
+
+	// Convert image to markdown using AI
+	transcription, err := s.transcribeUpload(ctx, job.Image, params.AI)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(params.Pages) > 1 {
+		// The pages of a PDF become sections of one note, keeping the first
+		// page's scan and details
+		sections := []string{transcription.Markdown}
+		for i, image := range params.Pages[1:] {
+			page, err := s.transcribeUpload(ctx, image, params.AI)
+			if err != nil {
+				return 0, nil, fmt.Errorf("page %d: %w", i+2, err)
+			}
+			sections = append(sections, page.Markdown)
+			transcription.Provenance.Merge(page.Provenance)
+		}
+		transcription.Markdown = strings.Join(sections, "\n\n---\n\n")
+		transcription.Provenance.Preprocessing = append(transcription.Provenance.Preprocessing,
+			fmt.Sprintf("%s:%d", funcs.StepPages, len(params.Pages)))
+	}
+	markdown, warnings := fixMarkdown(params.Autofix, transcription.Markdown)
+	recordAutofix(transcription.Provenance, params.Autofix)
+
+	// Save to database
+	note, err := s.Store.AddNote(ctx, job.Image, markdown)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to save to database: %w", err)
+	}
+	for _, image := range params.Pages[min(1, len(params.Pages)):] {
+		s.removeImage(image)
+	}
+
+	if params.NoteType != "" {
+		if err := funcs.SetNoteType(s.DB, note.ID, params.NoteType, params.Fields); err != nil {
+			return note.ID, nil, fmt.Errorf("failed to save note fields: %w", err)
+		}
+	}
+
+	if err := funcs.SetNoteCapture(s.DB, note.ID, transcription); err != nil {
+		return note.ID, nil, fmt.Errorf("failed to save note metadata: %w", err)
+	}
+	page := params.Page
+	if page == 0 {
+		page = transcription.PageNumber
+	}
+	if params.NotebookID != 0 && page != 0 {
+		// A detected page may not fit the notebook; the note is kept unmapped
+		if err := funcs.SetNotePage(s.DB, note.ID, params.NotebookID, page); err != nil {
+			slog.WarnContext(ctx, "failed to map note to page", "note_id", note.ID, "page", page, "err", err)
+		}
+	}
+	return note.ID, uploadResult{Warnings: warnings, PageGaps: s.pageGaps(params.NotebookID)}, nil
+}
+
+// JobHandler reports the status of an upload job. Once it is done the
+// result holds the markdown warnings and page gaps of the new note.
+func (s *Server) JobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Job not found", http.StatusNotFound)
+		return
+	}
+	job, err := funcs.GetJob(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Failed to load job: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	writeData(w, http.StatusOK, job)
+}
+
+// jobChanged publishes a job's new status, and the note it created once it
+// is done
+func (s *Server) jobChanged(job *funcs.Job) {
+	s.Events.Publish(funcs.Event{Type: funcs.EventJob, Data: job})
+	if job.Status != funcs.JobDone {
+		return
+	}
+	note, err := s.Store.GetNote(context.Background(), job.NoteID)
+	if err != nil {
+		slog.Error("failed to load note of job", "job_id", job.ID, "err", err)
+		return
+	}
+	s.Events.Publish(funcs.Event{Type: funcs.EventNote, Data: note})
+}
+
+// eventPing is how often an idle event stream sends a comment, so proxies
+// do not close it
+const eventPing = 30 * time.Second
+
+// healthInterval is how often a stream asking for health checks it for
+// changes between job events, such as spend from an AI request
+const healthInterval = 5 * time.Second
+
+// EventsHandler streams job status changes and new notes as server-sent
+// events, so pages can update without polling. With ?health=true it also
+// sends the queue's health when the stream opens and whenever it changes,
+// counting today's spend in the viewer's timezone.
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// The stream outlives the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.WarnContext(r.Context(), "failed to clear write deadline of event stream", "err", err)
+	}
+	events, stop := s.Events.Subscribe()
+	defer stop()
+	withHealth, _ := strconv.ParseBool(r.URL.Query().Get("health"))
+	loc := requestTimezone(w, r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+
+	// lastHealth is the health last sent, so an unchanged one is not sent again
+	var lastHealth []byte
+	sendHealth := func() {
+		if !withHealth {
+			return
+		}
+		now := s.now().In(loc)
+		health, err := funcs.GetHealth(s.DB, s.Jobs.Workers, s.AI.Limit(), time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc), pricingFromEnv())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to check health", "err", err)
+			return
+		}
+		data, err := json.Marshal(health)
+		if err != nil || bytes.Equal(data, lastHealth) {
+			return
+		}
+		lastHealth = data
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", funcs.EventHealth, data)
+	}
+	sendHealth()
+	flusher.Flush()
+
+	ping := time.NewTicker(eventPing)
+	defer ping.Stop()
+	var checks <-chan time.Time
+	if withHealth {
+		check := time.NewTicker(healthInterval)
+		defer check.Stop()
+		checks = check.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-checks:
+			sendHealth()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "failed to encode event", "event", event.Type, "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			if event.Type == funcs.EventJob {
+				sendHealth()
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// GetThumbnail renders one note's thumbnail, for pages adding notes that
+// arrive over /api/events
+func (s *Server) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Note not found", http.StatusNotFound)
+		return
+	}
+	note, err := s.Store.GetNote(r.Context(), id)
+	if err != nil {
+		http.Error(w, "Failed to load note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	component := templ.Thumbnail(*note, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+func (s *Server) UpdateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The form is read first: reading a field would parse the body, which
+	// parseUpload streams
+	form, err := s.parseUpload(r)
+	if err != nil {
+		writeError(w, r, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer form.RemoveAll()
+
+	idStr := r.FormValue("id")
+	if idStr == "" {
+		writeError(w, r, "Note ID required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, r, "Invalid note ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.Store.GetNote(r.Context(), id); err != nil {
+		writeError(w, r, "Note not found", errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	file, header, err := form.FormFile("image")
+	if err != nil {
+		writeError(w, r, "No image file provided", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	// Validate typed fields before spending an AI call on the image
+	noteType, fields, err := s.typedFields(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	overrides, err := aiOverrides(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun(r) {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			writeError(w, r, "Failed to read image", http.StatusBadRequest)
+			return
+		}
+		writeEstimate(w, s.AI.EstimateImage(data, pricingFromEnv()))
+		return
+	}
+
+	filename, err := s.saveUpload(header.Filename, file)
+	if err != nil {
+		writeError(w, r, "Failed to save image", http.StatusInternalServerError)
+		return
+	}
+
+	// Convert image to markdown using AI
+	transcription, err := s.AI.TranscribeImageOverride(r.Context(), s.Images.Path(filename), overrides)
+	if err != nil {
+		writeError(w, r, "Failed to convert image to markdown", errorStatus(err, http.StatusBadGateway))
+		return
+	}
+	transcription.Provenance.Preprocessing = funcs.VariantSteps(funcs.VariantOriginal)
+	markdown, warnings := checkMarkdown(r, transcription.Markdown)
+	recordAutofix(transcription.Provenance, r.FormValue("autofix") == "true")
+
+	// Update database
+	note, err := s.Store.UpdateNote(r.Context(), id, filename, markdown)
+	if err != nil {
+		writeError(w, r, "Failed to update database: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	if err := funcs.SetNoteCapture(s.DB, id, transcription); err != nil {
+		writeError(w, r, "Failed to save note metadata", http.StatusInternalServerError)
+		return
+	}
+
+	if noteType != "" {
+		if err := funcs.SetNoteType(s.DB, note.ID, noteType, fields); err != nil {
+			writeError(w, r, "Failed to save note fields: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+	}
+
+	s.writeNote(w, r, http.StatusOK, note.ID, warnings, nil)
+}
+
+func (s *Server) RegenerateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get note ID from form
+	idStr := r.FormValue("id")
+	if idStr == "" {
+		writeError(w, r, "Note ID required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, r, "Invalid note ID", http.StatusBadRequest)
+		return
+	}
+
+	// Parse form
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	overrides, err := aiOverrides(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get the existing note from database
+	note, err := s.Store.GetNote(r.Context(), id)
+	if err != nil {
+		writeError(w, r, "Failed to retrieve note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	// Construct full image path
+	imagePath := s.Images.Path(note.Image)
+
+	// Check if image file exists
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		writeError(w, r, "Image file not found", http.StatusNotFound)
+		return
+	}
+
+	if dryRun(r) {
+		data, err := os.ReadFile(imagePath)
+		if err != nil {
+			writeError(w, r, "Failed to read image", http.StatusInternalServerError)
+			return
+		}
+		writeEstimate(w, s.AI.EstimateImage(data, pricingFromEnv()))
+		return
+	}
+
+	// Convert image to markdown using AI (regenerating)
+	path, steps := s.aiImage(note.Image)
+	transcription, err := s.AI.TranscribeImageOverride(r.Context(), path, overrides)
+	if err != nil {
+		writeError(w, r, "Failed to convert image to markdown: "+err.Error(), errorStatus(err, http.StatusBadGateway))
+		return
+	}
+	transcription.Provenance.Preprocessing = steps
+	markdown, warnings := checkMarkdown(r, transcription.Markdown)
+	recordAutofix(transcription.Provenance, r.FormValue("autofix") == "true")
+
+	// Update database with new markdown (keeping same image)
+	updatedNote, err := s.Store.UpdateNote(r.Context(), id, note.Image, markdown)
+	if err != nil {
+		writeError(w, r, "Failed to update database: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	if err := funcs.SetNoteCapture(s.DB, id, transcription); err != nil {
+		writeError(w, r, "Failed to save note metadata", http.StatusInternalServerError)
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	s.writeNote(w, r, http.StatusOK, updatedNote.ID, warnings, nil)
+}
+
+// NoteMarkdownHandler saves hand-edited markdown for a note, keeping its
+// image, so a transcription mistake can be fixed without re-uploading. The
+// markdown is the "markdown" form field, or the whole body when it is sent
+// as text/plain or text/markdown.
+func (s *Server) NoteMarkdownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+
+	var markdown string
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+	case "text/plain", "text/markdown":
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			writeError(w, r, "Failed to read markdown", http.StatusBadRequest)
+			return
+		}
+		markdown = string(body)
+	default:
+		markdown = r.FormValue("markdown")
+	}
+	if strings.TrimSpace(markdown) == "" {
+		writeError(w, r, "Markdown required", http.StatusBadRequest)
+		return
+	}
+	markdown, warnings := checkMarkdown(r, markdown)
+
+	updated, err := s.Store.UpdateNote(r.Context(), note.ID, note.Image, markdown)
+	if err != nil {
+		writeError(w, r, "Failed to update note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	s.writeNote(w, r, http.StatusOK, updated.ID, warnings, nil)
+}
+
+// CleanupNoteHandler has the AI fix OCR artifacts, spelling and formatting
+// in a note's markdown, without looking at the image. The result is saved
+// as a new revision and returned with its diff against the old markdown.
+func (s *Server) CleanupNoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	if dryRun(r) {
+		writeEstimate(w, funcs.EstimateCleanup(note.Markdown, pricingFromEnv()))
+		return
+	}
+
+	ctx, provenance := funcs.TrackProvenance(r.Context())
+	cleaned, err := s.AI.CleanupMarkdown(ctx, note.Markdown)
+	if err != nil {
+		writeError(w, r, "Failed to clean up note: "+err.Error(), errorStatus(err, http.StatusBadGateway))
+		return
+	}
+	cleaned, warnings := checkMarkdown(r, cleaned)
+	recordAutofix(provenance, r.FormValue("autofix") == "true")
+	updated, err := s.Store.UpdateNote(r.Context(), note.ID, note.Image, cleaned)
+	if err != nil {
+		writeError(w, r, "Failed to update note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	if err := funcs.SetNoteProvenance(s.DB, note.ID, provenance); err != nil {
+		writeError(w, r, "Failed to save provenance: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	if warnings == nil {
+		warnings = []funcs.MarkdownIssue{}
+	}
+	writeData(w, http.StatusOK, cleanupResponse{
+		noteResponse: noteResponse{Note: updated, Warnings: warnings},
+		Diff:         funcs.DiffLines(note.Markdown, updated.Markdown),
+	})
+}
+
+// NoteOutlineHandler lists a note's headings on GET. On POST it rewrites
+// the heading given by its index: action=promote or demote shifts the
+// levels of its section, up or down swaps the section with its sibling and
+// move puts it before heading to. The result is saved as a new revision.
+func (s *Server) NoteOutlineHandler(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeData(w, http.StatusOK, funcs.Outline(note.Markdown))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	index, err := strconv.Atoi(r.FormValue("heading"))
+	if err != nil {
+		writeError(w, r, "Invalid heading", http.StatusBadRequest)
+		return
+	}
+	outline := funcs.Outline(note.Markdown)
+	if index < 0 || index >= len(outline) {
+		writeError(w, r, "Heading not found", http.StatusNotFound)
+		return
+	}
+
+	var markdown string
+	switch action := r.FormValue("action"); action {
+	case "promote":
+		markdown, err = funcs.ShiftHeading(note.Markdown, index, -1)
+	case "demote":
+		markdown, err = funcs.ShiftHeading(note.Markdown, index, 1)
+	case "up", "down":
+		to := outline[index].Up
+		if action == "down" {
+			to = outline[index].Down
+		}
+		if to < 0 {
+			writeError(w, r, "The heading has no sibling to swap with", http.StatusBadRequest)
+			return
+		}
+		markdown, err = funcs.MoveHeading(note.Markdown, index, to)
+	case "move":
+		to, convErr := strconv.Atoi(r.FormValue("to"))
+		if convErr != nil {
+			writeError(w, r, "Invalid target heading", http.StatusBadRequest)
+			return
+		}
+		markdown, err = funcs.MoveHeading(note.Markdown, index, to)
+	default:
+		writeError(w, r, "Action must be promote, demote, up, down or move", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if markdown != note.Markdown {
+		if _, err := s.Store.UpdateNote(r.Context(), note.ID, note.Image, markdown); err != nil {
+			writeError(w, r, "Failed to update note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+	}
+	if redirectBack(w, r) {
+		return
+	}
+	s.writeNote(w, r, http.StatusOK, note.ID, nil, nil)
+}
+
+// aiOverrides reads the model, prompt, temperature and max_tokens fields
+// that replace the AI settings for one request
+func aiOverrides(r *http.Request) (funcs.AIOverrides, error) {
+	o := funcs.AIOverrides{
+		Model:  strings.TrimSpace(r.FormValue("model")),
+		Prompt: strings.TrimSpace(r.FormValue("prompt")),
+		Force:  r.FormValue("force") == "true",
+	}
+	var err error
+	if o.Temperature, err = funcs.ParseTemperature(strings.TrimSpace(r.FormValue("temperature"))); err != nil {
+		return o, err
+	}
+	if o.MaxTokens, err = funcs.ParseMaxTokens(strings.TrimSpace(r.FormValue("max_tokens"))); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// checkMarkdown validates markdown before it is saved. When the request sets
+// autofix=true the fixable problems are corrected first, and only what is
+// left is reported back as warnings.
+func checkMarkdown(r *http.Request, markdown string) (string, []funcs.MarkdownIssue) {
+	return fixMarkdown(r.FormValue("autofix") == "true", markdown)
+}
+
+// fixMarkdown is checkMarkdown for a background job, which has no request
+func fixMarkdown(autofix bool, markdown string) (string, []funcs.MarkdownIssue) {
+	if autofix {
+		markdown = funcs.FixMarkdown(markdown)
+	}
+	return markdown, funcs.ValidateMarkdown(markdown)
+}
+
+// recordAutofix adds autofixing to the postprocessing of the AI's markdown
+// when it was asked for
+func recordAutofix(p *funcs.Provenance, autofix bool) {
+	if autofix {
+		p.Postprocessing = append(p.Postprocessing, funcs.StepAutofix)
+	}
+}
+
+// parseNoteID reads the note ID form value, writing a 400 response and
+// returning false when it is missing or malformed
+func parseNoteID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	idStr := r.FormValue("id")
+	if idStr == "" {
+		writeError(w, r, "Note ID required", http.StatusBadRequest)
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, r, "Invalid note ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// baseURL is the scheme and host the request was made to, honouring
+// X-Forwarded-Proto from a reverse proxy
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// openNote resolves the {id} path value of the /open and /api/notes routes
+func (s *Server) openNote(w http.ResponseWriter, r *http.Request) (*funcs.Note, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Note not found", http.StatusNotFound)
+		return nil, false
+	}
+	note, err := s.Store.GetNote(r.Context(), id)
+	if err != nil {
+		writeError(w, r, "Note not found", errorStatus(err, http.StatusInternalServerError))
+		return nil, false
+	}
+	return note, true
+}
+
+// OpenNoteHandler is a short, stable link for shortcuts and QR codes. It
+// redirects to the note's current page.
+func (s *Server) OpenNoteHandler(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, "/n/"+funcs.NoteSlug(note), http.StatusFound)
+}
+
+// OpenNoteQRHandler renders a QR code of a note's /open link as SVG
+func (s *Server) OpenNoteQRHandler(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	code, err := funcs.EncodeQR(fmt.Sprintf("%s/open/%d", baseURL(r), note.ID))
+	if err != nil {
+		writeError(w, r, "Failed to encode QR code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	fmt.Fprint(w, code.SVG())
+}
+
+// ListNotesHandler returns a page of notes as an array. ?page= starts at
+// 1, ?limit= defaults to 50, ?sort= is date or captured (newest first) or id
+// (oldest first) and ?order=asc|desc reverses any of them. The total is sent in
+// X-Total-Count and the next page in a Link header.
+func (s *Server) ListNotesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	page, limit, ok := pageParams(w, r, 50)
+	if !ok {
+		return
+	}
+
+	sort := query.Get("sort")
+	switch sort {
+	case "":
+		sort = funcs.SortDate
+	case funcs.SortDate, funcs.SortCaptured, funcs.SortID:
+	default:
+		writeError(w, r, fmt.Sprintf("Sort must be %s, %s or %s", funcs.SortDate, funcs.SortCaptured, funcs.SortID), http.StatusBadRequest)
+		return
+	}
+	descending := sort != funcs.SortID
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		descending = false
+	case "desc":
+		descending = true
+	default:
+		writeError(w, r, "Order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+
+	notes, err := s.Store.ListNotes(r.Context(), sort, descending, limit, (page-1)*limit)
+	if err != nil {
+		writeError(w, r, "Failed to list notes: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	total, err := s.Store.CountNotes(r.Context())
+	if err != nil {
+		writeError(w, r, "Failed to count notes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setPageHeaders(w, r, page, limit, total)
+	writeData(w, http.StatusOK, notes)
+}
+
+// pageParams reads the page and limit query parameters, writing an error
+// when they are invalid
+func pageParams(w http.ResponseWriter, r *http.Request, defaultLimit int) (page, limit int, ok bool) {
+	query := r.URL.Query()
+	page, limit = 1, defaultLimit
+	if p := query.Get("page"); p != "" {
+		var err error
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 1 {
+			writeError(w, r, "Invalid page", http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > funcs.MaxListLimit {
+			writeError(w, r, fmt.Sprintf("Limit must be between 1 and %d", funcs.MaxListLimit), http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	return page, limit, true
+}
+
+// setPageHeaders reports the total and links the next page when there is one
+func setPageHeaders(w http.ResponseWriter, r *http.Request, page, limit, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if page*limit < total {
+		next := r.URL.Query()
+		next.Set("page", strconv.Itoa(page+1))
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+}
+
+// searchPageSize is how many results the search page shows at a time
+const searchPageSize = 20
+
+// SearchHandler searches the notes with the same query syntax as the search
+// page: words, "exact phrases", tag:, notebook:, before: and after:
+func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page, limit, ok := pageParams(w, r, searchPageSize)
+	if !ok {
+		return
+	}
+	query, err := funcs.ParseSearch(r.URL.Query().Get("q"))
+	if err == nil && query.Empty() {
+		err = fmt.Errorf("search query required")
+	}
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, total, err := funcs.Search(s.DB, s.Index, query, limit, (page-1)*limit)
+	if err != nil {
+		writeError(w, r, "Failed to search notes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setPageHeaders(w, r, page, limit, total)
+	writeData(w, http.StatusOK, results)
+}
+
+// MetricsHandler reports the server's metrics in the Prometheus text format:
+// the counters and histograms kept as it runs and gauges read now. It is
+// not found unless the server runs with -metrics.
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.Metrics {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobs, err := funcs.CountJobs(s.DB)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var stats funcs.MemoryIndexStats
+	enabled := 0
+	if s.Index != nil {
+		stats, enabled = s.Index.Stats(), 1
+	}
+	running, queued := s.AI.Limit().Load()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, help string
+		value      int
+	}{
+		{"bookmd_search_index_enabled", "Whether searches use the in-memory index.", enabled},
+		{"bookmd_search_index_notes", "Notes in the in-memory search index.", stats.Notes},
+		{"bookmd_search_index_terms", "Distinct terms in the in-memory search index.", stats.Terms},
+		{"bookmd_search_index_postings", "Note and term pairs in the in-memory search index.", stats.Postings},
+		{"bookmd_search_index_bytes", "Estimated memory used by the in-memory search index.", stats.Bytes},
+		{"bookmd_ai_requests_running", "AI requests being sent to the provider.", running},
+		{"bookmd_ai_requests_queued", "AI requests waiting for a free slot under -ai-concurrency.", queued},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+	funcs.WriteGauge(w, "bookmd_jobs", "Conversion jobs in the queue, by status: pending or running.", map[string]float64{
+		funcs.MetricLabel("status", funcs.JobPending): float64(jobs[funcs.JobPending]),
+		funcs.MetricLabel("status", funcs.JobRunning): float64(jobs[funcs.JobRunning]),
+	})
+	funcs.WriteMetrics(w)
+}
+
+func (s *Server) GetSearchPage(w http.ResponseWriter, r *http.Request) {
+	page := templ.SearchForm{Query: r.URL.Query().Get("q"), Page: 1}
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 1 {
+		page.Page = p
+	}
+	page.Offset = (page.Page - 1) * searchPageSize
+	query, err := funcs.ParseSearch(page.Query)
+	if err == nil && !query.Empty() {
+		page.Results, page.Total, err = funcs.Search(s.DB, s.Index, query, searchPageSize, page.Offset)
+	}
+	if err != nil {
+		page.Error = err.Error()
+	}
+	page.More = page.Offset+len(page.Results) < page.Total
+
+	component := templ.SearchPage(page, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// NoteHandler returns a single note on GET, edits it on PATCH and deletes
+// it on DELETE
+func (s *Server) NoteHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		note, ok := s.openNote(w, r)
+		if !ok {
+			return
+		}
+		writeData(w, http.StatusOK, note)
+
+	case http.MethodPatch:
+		s.patchNote(w, r)
+
+	case http.MethodDelete:
+		s.deleteNote(w, r)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// notePatch holds the fields a PATCH may change; absent fields are left
+// as they are
+type notePatch struct {
+	Title *string `json:"title"`
+}
+
+// patchNote applies a JSON notePatch to the note
+func (s *Server) patchNote(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	var patch notePatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, r, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if patch.Title != nil {
+		updated, err := funcs.SetNoteTitle(s.DB, note.ID, *patch.Title)
+		if err != nil {
+			writeError(w, r, "Failed to update title: "+err.Error(), errorStatus(err, http.StatusBadRequest))
+			return
+		}
+		note = updated
+	}
+	writeData(w, http.StatusOK, note)
+}
+
+// deleteNote moves the note to the trash
+func (s *Server) deleteNote(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	if err := s.Store.DeleteNote(r.Context(), note.ID); err != nil {
+		writeError(w, r, "Failed to delete note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	writeData(w, http.StatusOK, deletedResponse{ID: note.ID, Deleted: true})
+}
+
+// removeImage deletes an image file once no note, including those in the
+// trash, references it. Notes uploaded from identical files share an image.
+func (s *Server) removeImage(image string) {
+	if image == "" {
+		return
+	}
+	inUse, err := funcs.ImageInUse(s.DB, image)
+	if err != nil {
+		slog.Error("failed to check image", "image", image, "err", err)
+		return
+	}
+	if inUse {
+		return
+	}
+	if err := s.Images.Remove(image); err != nil {
+		slog.Error("failed to remove image", "image", image, "err", err)
+	}
+	for variant := range funcs.ImageVariants {
+		if err := s.Images.Remove(funcs.VariantName(image, variant)); err != nil {
+			slog.Error("failed to remove image variant", "image", image, "variant", variant, "err", err)
+		}
+	}
+}
+
+// GetHistoryPage lists a note's saved revisions and shows the changes
+// between two versions: ?from= and ?to= are revision numbers, where a
+// missing or zero to is the current content. By default the newest saved
+// revision is compared with the current content.
+func (s *Server) GetHistoryPage(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	revisions, err := funcs.GetRevisions(s.DB, note.ID)
+	if err != nil {
+		http.Error(w, "Failed to load revisions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var diff []funcs.DiffLine
+	from, _ := strconv.Atoi(r.FormValue("from"))
+	to, _ := strconv.Atoi(r.FormValue("to"))
+	if from == 0 && len(revisions) > 0 {
+		from = revisions[0].Revision
+	}
+	if from != 0 {
+		before, err := s.revisionMarkdown(note, from)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		after, err := s.revisionMarkdown(note, to)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		diff = funcs.DiffLines(before, after)
+	}
+
+	component := templ.HistoryPage(*note, revisions, from, to, diff, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// revisionMarkdown is the markdown of a saved revision, or the current
+// markdown for revision 0 or the note's own revision
+func (s *Server) revisionMarkdown(note *funcs.Note, revision int) (string, error) {
+	if revision == 0 || revision == note.Revision {
+		return note.Markdown, nil
+	}
+	rev, err := funcs.GetRevision(s.DB, note.ID, revision)
+	if err != nil {
+		return "", err
+	}
+	return rev.Markdown, nil
+}
+
+// NoteRevisionsHandler lists the saved revisions of a note, newest first
+func (s *Server) NoteRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	revisions, err := funcs.GetRevisions(s.DB, note.ID)
+	if err != nil {
+		writeError(w, r, "Failed to load revisions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, revisions)
+}
+
+// NoteProvenanceHandler returns how the note's current markdown was
+// produced, null when it is not known; each revision carries its own
+func (s *Server) NoteProvenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	provenance, err := funcs.GetNoteProvenance(s.DB, note.ID)
+	if err != nil {
+		writeError(w, r, "Failed to load provenance: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	writeData(w, http.StatusOK, provenance)
+}
+
+// NoteRevisionHandler returns one saved revision with its markdown
+func (s *Server) NoteRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	revision, err := strconv.Atoi(r.PathValue("revision"))
+	if err != nil {
+		writeError(w, r, "Revision not found", http.StatusNotFound)
+		return
+	}
+	rev, err := funcs.GetRevision(s.DB, note.ID, revision)
+	if err != nil {
+		writeError(w, r, "Failed to load revision: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	writeData(w, http.StatusOK, rev)
+}
+
+// RollbackNoteHandler restores a saved revision of a note. The content it
+// replaces becomes a revision itself.
+func (s *Server) RollbackNoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	revision, err := strconv.Atoi(r.FormValue("revision"))
+	if err != nil {
+		writeError(w, r, "Revision required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := funcs.RollbackNote(s.DB, note.ID, revision); err != nil {
+		writeError(w, r, "Failed to roll back note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	s.writeNote(w, r, http.StatusOK, note.ID, nil, nil)
+}
+
+// GetTrashPage lists the deleted notes with buttons to restore or purge them
+func (s *Server) GetTrashPage(w http.ResponseWriter, r *http.Request) {
+	notes, err := funcs.GetTrash(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to load trash: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	component := templ.TrashPage(notes, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// TrashHandler lists the notes in the trash (GET) or empties it (DELETE, or
+// POST from the trash page)
+func (s *Server) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		notes, err := funcs.GetTrash(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to load trash: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, notes)
+
+	case http.MethodDelete, http.MethodPost:
+		purged, images, err := funcs.PurgeTrash(s.DB, s.now())
+		for _, image := range images {
+			s.removeImage(image)
+		}
+		if err != nil {
+			writeError(w, r, "Failed to empty trash: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if redirectBack(w, r) {
+			return
+		}
+		writeData(w, http.StatusOK, map[string]any{"purged": purged})
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TrashNoteHandler permanently removes one note from the trash, with
+// DELETE or a POST from the trash page
+func (s *Server) TrashNoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Note not found", http.StatusNotFound)
+		return
+	}
+
+	images, err := funcs.PurgeNote(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Failed to purge note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	for _, image := range images {
+		s.removeImage(image)
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusOK, deletedResponse{ID: id, Deleted: true})
+}
+
+// RestoreNoteHandler takes a note out of the trash
+func (s *Server) RestoreNoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Note not found", http.StatusNotFound)
+		return
+	}
+
+	note, err := funcs.RestoreNote(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Failed to restore note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusOK, note)
+}
+
+// NoteImageHandler serves a note's image. ?variant= picks a size: thumb,
+// display or ai, made on the spot if missing, or the original upload.
+func (s *Server) NoteImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	variant, ok := variantParam(w, r)
+	if !ok {
+		return
+	}
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+
+	s.serveImage(w, r, note.Image, variant)
+}
+
+// NoteThumbnailHandler serves the small JPEG preview of a note's image used
+// in note lists, as NoteImageHandler with variant=thumb
+func (s *Server) NoteThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	s.serveImage(w, r, note.Image, funcs.VariantThumb)
+}
+
+// ImageHandler serves a stored image by the name notes refer to it by,
+// taking ?variant= as NoteImageHandler. Only images of notes, revisions and
+// paper notebook covers are served, never other files in the directory.
+func (s *Server) ImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	variant, ok := variantParam(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	if !validImageName(name) {
+		writeError(w, r, "Image not found", http.StatusNotFound)
+		return
+	}
+	known, err := funcs.ImageKnown(s.DB, name)
+	if err != nil {
+		writeError(w, r, "Failed to look up image: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !known {
+		writeError(w, r, "Image not found", http.StatusNotFound)
+		return
+	}
+	s.serveImage(w, r, name, variant)
+}
+
+// variantParam reads the image variant asked for by ?variant=, which is
+// the original upload by default
+func variantParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	variant := r.URL.Query().Get("variant")
+	if variant == "" {
+		return funcs.VariantOriginal, true
+	}
+	if _, ok := funcs.ImageVariants[variant]; !ok && variant != funcs.VariantOriginal {
+		writeError(w, r, "Unknown image variant", http.StatusBadRequest)
+		return "", false
+	}
+	return variant, true
+}
+
+// validImageName rejects names that could reach outside the image
+// directory, such as ../ paths, or hidden files
+func validImageName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\\x00") && !strings.HasPrefix(name, ".") &&
+		filepath.Base(name) == name
+}
+
+// serveImage sends a variant of a stored image. The content type is taken
+// from the file's contents; anything that is not an image is sent as a
+// download so it cannot run in the page's origin.
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request, image, variant string) {
+	name := s.imageVariant(image, variant)
+	f, err := s.Images.Open(name)
+	if err != nil {
+		writeError(w, r, "Image file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	var head [512]byte
+	n, _ := io.ReadFull(f, head[:])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		writeError(w, r, "Failed to read image", http.StatusInternalServerError)
+		return
+	}
+	contentType := http.DetectContentType(head[:n])
+	if !strings.HasPrefix(contentType, "image/") || contentType == "image/svg+xml" {
+		contentType = "application/octet-stream"
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	http.ServeContent(w, r, name, time.Time{}, f)
+}
+
+// NoteQRHandler renders a QR code of a note's /open link as PNG, sized for
+// printing on a sticker. ?scale= sets the pixels per module (default 8).
+func (s *Server) NoteQRHandler(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.openNote(w, r)
+	if !ok {
+		return
+	}
+	scale := 8
+	if v := r.FormValue("scale"); v != "" {
+		var err error
+		scale, err = strconv.Atoi(v)
+		if err != nil || scale < 1 || scale > 32 {
+			writeError(w, r, "Scale must be between 1 and 32", http.StatusBadRequest)
+			return
+		}
+	}
+
+	code, err := funcs.EncodeQR(fmt.Sprintf("%s/open/%d", baseURL(r), note.ID))
+	if err != nil {
+		writeError(w, r, "Failed to encode QR code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := code.PNG(scale)
+	if err != nil {
+		writeError(w, r, "Failed to render QR code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
+
+// LabelsHandler returns a printable PDF of archive labels for the notes in
+// ?ids= (comma separated). ?size= picks a built-in stock, or ?width= and
+// ?height= in millimetres give a custom one-label-per-page size.
+func (s *Server) LabelsHandler(w http.ResponseWriter, r *http.Request) {
+	sheet, ok := funcs.LabelSheets["62x29"]
+	if size := r.FormValue("size"); size != "" {
+		sheet, ok = funcs.LabelSheets[size]
+		if !ok {
+			writeError(w, r, "Unknown label size "+size, http.StatusBadRequest)
+			return
+		}
+	}
+	if width, height := r.FormValue("width"), r.FormValue("height"); width != "" || height != "" {
+		wmm, werr := strconv.ParseFloat(width, 64)
+		hmm, herr := strconv.ParseFloat(height, 64)
+		if werr != nil || herr != nil || wmm < 15 || hmm < 10 || wmm > 300 || hmm > 300 {
+			writeError(w, r, "Width and height must be between 15x10 and 300x300 mm", http.StatusBadRequest)
+			return
+		}
+		sheet = funcs.SingleLabel(wmm, hmm)
+	}
+
+	prefs := s.displayPrefs(w, r)
+	var labels []funcs.Label
+	for _, field := range strings.Split(r.FormValue("ids"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			writeError(w, r, "Invalid note ID "+field, http.StatusBadRequest)
+			return
+		}
+		note, err := s.Store.GetNote(r.Context(), id)
+		if err != nil {
+			writeError(w, r, "Note not found: "+field, errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		labels = append(labels, funcs.Label{
+			Title:   funcs.NoteTitle(note),
+			Date:    prefs.Date(note.DateCreated),
+			Caption: funcs.T(prefs.Locale, "label.caption", note.ID),
+			QRText:  fmt.Sprintf("%s/open/%d", baseURL(r), note.ID),
+		})
+	}
+	if len(labels) == 0 {
+		writeError(w, r, "Note IDs required", http.StatusBadRequest)
+		return
+	}
+
+	pdf, err := funcs.RenderLabels(labels, sheet)
+	if err != nil {
+		writeError(w, r, "Failed to render labels: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="labels-%s.pdf"`, sheet.Name))
+	w.Write(pdf)
+}
+
+// DeepLinksHandler lists the links that open a note: its page, the stable
+// /open redirect, the bookmd:// scheme for apps that register it, and a QR code
+func (s *Server) DeepLinksHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseNoteID(w, r)
+	if !ok {
+		return
+	}
+	note, err := s.Store.GetNote(r.Context(), id)
+	if err != nil {
+		writeError(w, r, "Note not found", errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	base := baseURL(r)
+	writeData(w, http.StatusOK, map[string]any{
+		"id":     note.ID,
+		"title":  funcs.NoteTitle(note),
+		"url":    base + "/n/" + funcs.NoteSlug(note),
+		"open":   fmt.Sprintf("%s/open/%d", base, note.ID),
+		"scheme": fmt.Sprintf("bookmd://note/%d", note.ID),
+		"qr":     fmt.Sprintf("%s/open/%d/qr.svg", base, note.ID),
+	})
+}
+
+// redirectBack sends HTML form submissions back to the page they came from
+// when they include a local redirect field. It reports whether it did.
+func redirectBack(w http.ResponseWriter, r *http.Request) bool {
+	target := r.FormValue("redirect")
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return false
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+	return true
+}
+
+func (s *Server) GetPropertiesHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseNoteID(w, r)
+	if !ok {
+		return
+	}
+
+	properties, err := funcs.GetProperties(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Failed to load properties: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeData(w, http.StatusOK, properties)
+}
+
+func (s *Server) SetPropertyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := parseNoteID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := funcs.SetProperty(s.DB, id, r.FormValue("key"), r.FormValue("value")); err != nil {
+		writeError(w, r, "Failed to set property: "+err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	s.writeProperties(w, r, id)
+}
+
+func (s *Server) DeletePropertyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := parseNoteID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := funcs.DeleteProperty(s.DB, id, r.FormValue("key")); err != nil {
+		writeError(w, r, "Failed to delete property: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	s.writeProperties(w, r, id)
+}
+
+// writeProperties answers a property change with the note's properties
+func (s *Server) writeProperties(w http.ResponseWriter, r *http.Request, id int) {
+	properties, err := funcs.GetProperties(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Failed to load properties: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, properties)
+}
+
+func (s *Server) NotesByPropertyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	if key == "" {
+		writeError(w, r, "Property key required", http.StatusBadRequest)
+		return
+	}
+
+	notes, err := funcs.FindNotesByProperty(s.DB, key, r.FormValue("value"))
+	if err != nil {
+		writeError(w, r, "Failed to query notes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeData(w, http.StatusOK, notes)
+}
+
+func (s *Server) ExportNoteHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseNoteID(w, r)
+	if !ok {
+		return
+	}
+
+	note, err := s.Store.GetNote(r.Context(), id)
+	if err != nil {
+		writeError(w, r, "Failed to retrieve note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	properties, err := funcs.GetProperties(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Failed to load properties: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	markdown := funcs.WithFrontmatter(note.Markdown, properties)
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.md"`, funcs.NoteSlug(note)))
+	w.Header().Set("Content-Digest", contentDigest(markdown))
+	fmt.Fprint(w, markdown)
+}
+
+// typedFields reads the optional note type and its field.<name> form values
+// and validates them against the type's schema
+func (s *Server) typedFields(r *http.Request) (string, map[string]string, error) {
+	typeName := strings.TrimSpace(r.FormValue("type"))
+	if typeName == "" {
+		return "", nil, nil
+	}
+
+	noteType, err := funcs.GetNoteType(s.DB, typeName)
+	if err != nil {
+		return "", nil, err
+	}
+
+	values := map[string]string{}
+	for key, v := range r.Form {
+		if name, ok := strings.CutPrefix(key, "field."); ok && len(v) > 0 {
+			values[name] = v[0]
+		}
+	}
+
+	fields, err := noteType.ValidateFields(values)
+	if err != nil {
+		return "", nil, err
+	}
+	return typeName, fields, nil
+}
+
+func (s *Server) NoteTypesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		types, err := funcs.GetNoteTypes(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to load note types: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, types)
+
+	case http.MethodPost:
+		var noteType funcs.NoteType
+		if err := json.NewDecoder(r.Body).Decode(&noteType); err != nil {
+			writeError(w, r, "Invalid note type JSON", http.StatusBadRequest)
+			return
+		}
+		saved, err := funcs.SaveNoteType(s.DB, noteType)
+		if err != nil {
+			writeError(w, r, "Failed to save note type: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeData(w, http.StatusOK, saved)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) DeleteNoteTypeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := funcs.DeleteNoteType(s.DB, r.FormValue("name")); err != nil {
+		writeError(w, r, "Failed to delete note type: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	writeData(w, http.StatusOK, deletedResponse{ID: r.FormValue("name"), Deleted: true})
+}
+
+func (s *Server) PipelinesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		pipelines, err := funcs.GetPipelines(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to load pipelines: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, pipelines)
+
+	case http.MethodPost:
+		var pipeline funcs.Pipeline
+		if err := json.NewDecoder(r.Body).Decode(&pipeline); err != nil {
+			writeError(w, r, "Invalid pipeline JSON", http.StatusBadRequest)
+			return
+		}
+		saved, err := funcs.SavePipeline(s.DB, pipeline)
+		if err != nil {
+			writeError(w, r, "Failed to save pipeline: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeData(w, http.StatusOK, saved)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) DeletePipelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	if err := funcs.DeletePipeline(s.DB, name); err != nil {
+		writeError(w, r, "Failed to delete pipeline: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	writeData(w, http.StatusOK, deletedResponse{ID: name, Deleted: true})
+}
+
+// RunPipelineHandler runs the named pipeline over a note and returns the
+// run with the artifact of every step. The run is kept when it fails, so
+// its artifacts can be fetched from /api/pipeline-runs/{id}.
+func (s *Server) RunPipelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := parseNoteID(w, r)
+	if !ok {
+		return
+	}
+	note, err := s.Store.GetNote(r.Context(), id)
+	if err != nil {
+		writeError(w, r, "Note not found", errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	pipeline, err := funcs.GetPipeline(s.DB, r.FormValue("pipeline"))
+	if err != nil {
+		writeError(w, r, "Pipeline not found", errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	run, err := funcs.RunPipeline(r.Context(), s.DB, s.AI, pipeline, note, s.Paths.Images)
+	if err != nil {
+		if run == nil {
+			writeError(w, r, "Failed to run pipeline: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeError(w, r, fmt.Sprintf("Pipeline run %d failed: %s", run.ID, err), errorStatus(err, http.StatusBadGateway))
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusOK, run)
+}
+
+// PipelineRunHandler returns a pipeline run with its artifacts
+func (s *Server) PipelineRunHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid run ID", http.StatusBadRequest)
+		return
+	}
+	run, err := funcs.GetPipelineRun(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Failed to load run: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	writeData(w, http.StatusOK, run)
+}
+
+func (s *Server) GetNoteTypePage(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	noteType, err := funcs.GetNoteType(s.DB, name)
+	if err != nil {
+		http.Error(w, "Note type not found", http.StatusNotFound)
+		return
+	}
+
+	notes, values, err := funcs.GetNotesByType(s.DB, name)
+	if err != nil {
+		http.Error(w, "Failed to load notes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	component := templ.NoteTypePage(*noteType, notes, values, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// replaceForm reads a find and replace from the request: find, with and
+// regex=true, scoped by notebook, tag, q and ids, which may repeat
+func replaceForm(r *http.Request) (funcs.ReplaceScope, funcs.Replacement, error) {
+	scope := funcs.ReplaceScope{
+		Tag:   r.FormValue("tag"),
+		Query: r.FormValue("q"),
+	}
+	replacement := funcs.Replacement{
+		Find: r.FormValue("find"),
+		With: r.FormValue("with"),
+	}
+	replacement.Regex, _ = strconv.ParseBool(r.FormValue("regex"))
+	if v := r.FormValue("notebook"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return scope, replacement, fmt.Errorf("invalid notebook ID")
+		}
+		scope.NotebookID = id
+	}
+	for _, v := range r.Form["ids"] {
+		for _, field := range strings.Split(v, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return scope, replacement, fmt.Errorf("invalid note ID %q", field)
+			}
+			scope.NoteIDs = append(scope.NoteIDs, id)
+		}
+	}
+	return scope, replacement, nil
+}
+
+// GetReplacePage finds text across notes and previews its replacement.
+// The notes to change can be picked from the preview before applying it.
+func (s *Server) GetReplacePage(w http.ResponseWriter, r *http.Request) {
+	notebooks, err := funcs.GetNotebooks(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to load notebooks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.ParseForm()
+	scope, replacement, err := replaceForm(r)
+	page := templ.ReplaceForm{Scope: scope, Replacement: replacement, URL: r.URL.RequestURI()}
+	if err == nil && replacement.Find != "" {
+		page.Previews, err = funcs.PreviewReplace(s.DB, scope, replacement)
+	}
+	if err != nil {
+		page.Error = err.Error()
+	}
+
+	component := templ.ReplacePage(page, notebooks, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// ReplaceHandler replaces text across the notes in scope, saving each note
+// it changes as a new revision. With dry_run=true it only lists the
+// matches in each note.
+func (s *Server) ReplaceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	scope, replacement, err := replaceForm(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dryRun(r) {
+		previews, err := funcs.PreviewReplace(s.DB, scope, replacement)
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeData(w, http.StatusOK, replaceResponse{DryRun: true, Notes: previews, Changed: []int{}})
+		return
+	}
+
+	changed, err := funcs.ApplyReplace(r.Context(), s.Store, scope, replacement)
+	if err != nil {
+		if changed == nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeError(w, r, fmt.Sprintf("Replaced in %d notes, then failed: %s", len(changed), err), http.StatusInternalServerError)
+		return
+	}
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusOK, replaceResponse{Changed: changed})
+}
+
+// Sizes of a batch of AI tag suggestions
+const (
+	defaultTagBatch = 20
+	maxTagBatch     = 100
+)
+
+// GetTagReviewPage lists the tags the AI suggested for untagged notes, for
+// the reader to edit, apply or dismiss, and starts new batches
+func (s *Server) GetTagReviewPage(w http.ResponseWriter, r *http.Request) {
+	suggestions, err := funcs.GetTagSuggestions(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to load tag suggestions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	untagged, err := funcs.CountUntagged(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to count untagged notes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	component := templ.TagReviewPage(suggestions, untagged, defaultTagBatch, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// TagSuggestionsHandler lists the pending tag suggestions. A POST asks the
+// AI for tags for the next ?limit= untagged notes, stopping before the
+// estimated cost reaches ?max_cost= US dollars when it is set.
+func (s *Server) TagSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		suggestions, err := funcs.GetTagSuggestions(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to load tag suggestions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, suggestions)
+	case http.MethodPost:
+		limit := defaultTagBatch
+		if v := r.FormValue("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > maxTagBatch {
+				writeError(w, r, fmt.Sprintf("Limit must be between 1 and %d", maxTagBatch), http.StatusBadRequest)
+				return
+			}
+		}
+		var maxCost float64
+		if v := r.FormValue("max_cost"); v != "" {
+			var err error
+			maxCost, err = strconv.ParseFloat(v, 64)
+			if err != nil || maxCost < 0 {
+				writeError(w, r, "Invalid max cost", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if dryRun(r) {
+			estimate, err := funcs.EstimateTags(s.DB, limit, pricingFromEnv())
+			if err != nil {
+				writeError(w, r, "Failed to estimate tagging: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeEstimate(w, estimate)
+			return
+		}
+
+		run, err := funcs.SuggestTags(r.Context(), s.DB, s.AI, limit, maxCost, pricingFromEnv())
+		if err != nil {
+			writeError(w, r, "Failed to suggest tags: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if redirectBack(w, r) {
+			return
+		}
+		writeData(w, http.StatusOK, run)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TagSuggestionHandler reviews the tags suggested for a note. A POST
+// applies them, or the edited ?tags= instead; a DELETE, or a POST with
+// action=dismiss, rejects them.
+func (s *Server) TagSuggestionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Tag suggestion not found", http.StatusNotFound)
+		return
+	}
+
+	response := tagReviewResponse{NoteID: id, Tags: []string{}}
+	if r.Method == http.MethodDelete || r.FormValue("action") == "dismiss" {
+		if err := funcs.DismissTagSuggestion(s.DB, id); err != nil {
+			writeError(w, r, "Failed to dismiss tags: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		response.Status = funcs.SuggestionDismissed
+	} else {
+		var tags []string
+		if _, ok := r.Form["tags"]; ok {
+			tags = funcs.ParseTags(r.FormValue("tags"))
+		}
+		response.Tags, err = funcs.ApplyTagSuggestion(s.DB, id, tags)
+		if err != nil {
+			writeError(w, r, "Failed to apply tags: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		response.Status = funcs.SuggestionApplied
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusOK, response)
+}
+
+func (s *Server) FeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := parseNoteID(w, r)
+	if !ok {
+		return
+	}
+
+	var rating int
+	switch r.FormValue("rating") {
+	case "up", "1":
+		rating = 1
+	case "down", "-1":
+		rating = -1
+	default:
+		writeError(w, r, "Rating must be up or down", http.StatusBadRequest)
+		return
+	}
+
+	feedback, err := funcs.AddFeedback(s.DB, s.AI.Settings(), id, rating, strings.TrimSpace(r.FormValue("corrected_text")))
+	if err != nil {
+		writeError(w, r, "Failed to save feedback: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusCreated, feedback)
+}
+
+func (s *Server) FeedbackStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := funcs.GetFeedbackStats(s.DB)
+	if err != nil {
+		writeError(w, r, "Failed to load feedback stats: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeData(w, http.StatusOK, stats)
+}
+
+func (s *Server) ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var cursor int64
+	if since := r.FormValue("since"); since != "" {
+		var err error
+		cursor, err = strconv.ParseInt(since, 10, 64)
+		if err != nil || cursor < 0 {
+			writeError(w, r, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := funcs.MaxChangesLimit
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			writeError(w, r, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, hasMore, err := funcs.GetChangesSince(s.DB, cursor, limit)
+	if err != nil {
+		writeError(w, r, "Failed to load changes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The next cursor is the last change returned, or the caller's own
+	// cursor when nothing has changed since
+	next := cursor
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+
+	writeData(w, http.StatusOK, map[string]any{
+		"changes":  changes,
+		"cursor":   strconv.FormatInt(next, 10),
+		"has_more": hasMore,
+	})
+}
+
+// notebook resolves the {id} path value to a notebook, writing a 400 or 404
+// response and returning false when it fails
+func (s *Server) notebook(w http.ResponseWriter, r *http.Request) (*funcs.Notebook, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid notebook ID", http.StatusBadRequest)
+		return nil, false
+	}
+	nb, err := funcs.GetNotebook(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Notebook not found", errorStatus(err, http.StatusInternalServerError))
+		return nil, false
+	}
+	return nb, true
+}
+
+// GetCompiledNotebookPage shows every note of a notebook and its
+// sub-notebooks as one document, in the order they were written
+func (s *Server) GetCompiledNotebookPage(w http.ResponseWriter, r *http.Request) {
+	nb, ok := s.notebook(w, r)
+	if !ok {
+		return
+	}
+	compilation, err := funcs.CompileNotebook(s.DB, nb.ID)
+	if err != nil {
+		http.Error(w, "Failed to compile notebook: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	component := templ.CompiledNotebookPage(*compilation, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// ExportNotebookHandler downloads a compiled notebook as a single markdown
+// file, or as JSON with format=json. The file's SHA-256 is sent in the
+// Content-Digest header.
+func (s *Server) ExportNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	nb, ok := s.notebook(w, r)
+	if !ok {
+		return
+	}
+	compilation, err := funcs.CompileNotebook(s.DB, nb.ID)
+	if err != nil {
+		writeError(w, r, "Failed to compile notebook: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	if r.FormValue("format") == "json" {
+		writeData(w, http.StatusOK, compilation)
+		return
+	}
+
+	name := funcs.Slugify(nb.Name)
+	if name == "" {
+		name = fmt.Sprintf("notebook-%d", nb.ID)
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.md"`, name))
+	w.Header().Set("Content-Digest", contentDigest(compilation.Markdown))
+	fmt.Fprint(w, compilation.Markdown)
+}
+
+// notebookParent reads the parent form value; a missing parent is the top
+// level
+func (s *Server) notebookParent(r *http.Request, fallback int) (int, error) {
+	parent := r.FormValue("parent")
+	if parent == "" {
+		return fallback, nil
+	}
+	id, err := strconv.Atoi(parent)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("Invalid parent notebook ID")
+	}
+	return id, nil
+}
+
+func (s *Server) GetNotebookPage(w http.ResponseWriter, r *http.Request) {
+	nb, ok := s.notebook(w, r)
+	if !ok {
+		return
+	}
+	children, err := funcs.GetChildNotebooks(s.DB, nb.ID)
+	if err != nil {
+		http.Error(w, "Failed to load notebooks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	notes, err := funcs.GetNotebookNotes(s.DB, nb.ID)
+	if err != nil {
+		http.Error(w, "Failed to load notes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tree, err := funcs.NotebookTree(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to load notebooks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	audit, err := funcs.GetAuditLog(s.DB, nb.ID, 10)
+	if err != nil {
+		http.Error(w, "Failed to load audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	component := templ.NotebookPage(*nb, children, notes, tree, audit, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// NotebookLockHandler puts a notebook on legal hold, so its notes cannot
+// be changed, moved or deleted, or takes it off with a reason. Both are
+// admin actions and are recorded in the audit log.
+func (s *Server) NotebookLockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	nb, ok := s.notebook(w, r)
+	if !ok {
+		return
+	}
+	locked, err := strconv.ParseBool(r.FormValue("locked"))
+	if err != nil {
+		writeError(w, r, "Invalid locked value", http.StatusBadRequest)
+		return
+	}
+	actor := adminActor(r)
+	updated, err := funcs.SetNotebookLocked(s.DB, nb.ID, locked, actor, r.FormValue("reason"))
+	if err != nil {
+		writeError(w, r, "Failed to change notebook lock: "+err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+	slog.InfoContext(r.Context(), "notebook lock changed", "notebook", nb.ID, "locked", locked, "actor", actor)
+
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusOK, updated)
+}
+
+// AuditLogHandler returns the newest entries of the audit log, only those
+// about one notebook when given one
+func (s *Server) AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	notebookID := 0
+	if v := r.URL.Query().Get("notebook"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, r, "Invalid notebook ID", http.StatusBadRequest)
+			return
+		}
+		notebookID = id
+	}
+	entries, err := funcs.GetAuditLog(s.DB, notebookID, auditLogLimit)
+	if err != nil {
+		writeError(w, r, "Failed to load audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, entries)
+}
+
+// auditLogLimit is how many audit entries are shown at once
+const auditLogLimit = 100
+
+// adminActor names who made an admin request for the audit log: the
+// client's address, and whether it gave the admin token
+func adminActor(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if os.Getenv("BOOKMD_ADMIN_TOKEN") != "" {
+		return host + " (admin token)"
+	}
+	return host
+}
+
+// NotebooksHandler returns the notebook tree, or creates a notebook from a
+// name and an optional parent
+func (s *Server) NotebooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tree, err := funcs.NotebookTree(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to load notebooks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, tree)
+
+	case http.MethodPost:
+		parent, err := s.notebookParent(r, 0)
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		nb, err := funcs.CreateNotebook(s.DB, r.FormValue("name"), parent)
+		if err != nil {
+			writeError(w, r, "Failed to save notebook: "+err.Error(), errorStatus(err, http.StatusBadRequest))
+			return
+		}
+
+		if redirectBack(w, r) {
+			return
+		}
+		writeData(w, http.StatusCreated, nb)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// NotebookHandler returns a notebook with its contents on GET, renames or
+// moves it on POST, and deletes it on DELETE. Deleting a notebook moves its
+// contents up to its parent.
+func (s *Server) NotebookHandler(w http.ResponseWriter, r *http.Request) {
+	nb, ok := s.notebook(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		children, err := funcs.GetChildNotebooks(s.DB, nb.ID)
+		if err != nil {
+			writeError(w, r, "Failed to load notebooks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		notes, err := funcs.GetNotebookNotes(s.DB, nb.ID)
+		if err != nil {
+			writeError(w, r, "Failed to load notes: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, notebookResponse{Notebook: nb, Children: children, Notes: notes})
+
+	case http.MethodPost:
+		name := r.FormValue("name")
+		if name == "" {
+			name = nb.Name
+		}
+		parent, err := s.notebookParent(r, nb.ParentID)
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated, err := funcs.UpdateNotebook(s.DB, nb.ID, name, parent)
+		if err != nil {
+			writeError(w, r, "Failed to update notebook: "+err.Error(), errorStatus(err, http.StatusBadRequest))
+			return
+		}
+
+		if redirectBack(w, r) {
+			return
+		}
+		writeData(w, http.StatusOK, updated)
+
+	case http.MethodDelete:
+		if err := funcs.DeleteNotebook(s.DB, nb.ID); err != nil {
+			writeError(w, r, "Failed to delete notebook: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		writeData(w, http.StatusOK, deletedResponse{ID: nb.ID, Deleted: true})
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MoveNotesHandler moves the comma-separated note ids into a notebook. A
+// notebook of 0 or none takes them out of every notebook.
+func (s *Server) MoveNotesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []int
+	for _, field := range strings.Split(r.FormValue("ids"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			writeError(w, r, "Invalid note ID "+field, http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	notebookID := 0
+	if nb := r.FormValue("notebook"); nb != "" {
+		var err error
+		if notebookID, err = strconv.Atoi(nb); err != nil {
+			writeError(w, r, "Invalid notebook ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := funcs.MoveNotes(s.DB, ids, notebookID); err != nil {
+		writeError(w, r, "Failed to move notes: "+err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	notes := make([]*funcs.Note, 0, len(ids))
+	for _, id := range ids {
+		note, err := s.Store.GetNote(r.Context(), id)
+		if err != nil {
+			writeError(w, r, "Failed to load note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		notes = append(notes, note)
+	}
+	writeData(w, http.StatusOK, notes)
+}
+
+// physicalNotebook resolves the {id} path value to a paper notebook,
+// writing a 400 or 404 response and returning false when it fails
+func (s *Server) physicalNotebook(w http.ResponseWriter, r *http.Request) (*funcs.PhysicalNotebook, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid notebook ID", http.StatusBadRequest)
+		return nil, false
+	}
+	nb, err := funcs.GetPhysicalNotebook(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Notebook not found", errorStatus(err, http.StatusInternalServerError))
+		return nil, false
+	}
+	return nb, true
+}
+
+func (s *Server) GetPhysicalNotebooksPage(w http.ResponseWriter, r *http.Request) {
+	notebooks, err := funcs.GetPhysicalNotebooks(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to load notebooks: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	component := templ.PhysicalNotebooksPage(notebooks, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+func (s *Server) GetPhysicalNotebookPage(w http.ResponseWriter, r *http.Request) {
+	nb, ok := s.physicalNotebook(w, r)
+	if !ok {
+		return
+	}
+	pages, err := funcs.NotebookPages(s.DB, nb)
+	if err != nil {
+		http.Error(w, "Failed to load pages: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	component := templ.PhysicalNotebookPage(*nb, pages, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// PhysicalNotebooksHandler lists paper notebooks, or registers one from a
+// multipart form with a name, an optional page count and a cover photo
+func (s *Server) PhysicalNotebooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		notebooks, err := funcs.GetPhysicalNotebooks(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to load notebooks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, notebooks)
+
+	case http.MethodPost:
+		form, err := s.parseUpload(r)
+		if err != nil {
+			writeError(w, r, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer form.RemoveAll()
+
+		pageCount := 0
+		if p := r.FormValue("pages"); p != "" {
+			var err error
+			pageCount, err = strconv.Atoi(p)
+			if err != nil || pageCount < 0 {
+				writeError(w, r, "Invalid page count", http.StatusBadRequest)
+				return
+			}
+		}
+
+		cover := ""
+		if file, header, err := form.FormFile("cover"); err == nil {
+			defer file.Close()
+			cover = fmt.Sprintf("cover-%d%s", s.now().UnixNano(), filepath.Ext(header.Filename))
+			if err := s.Images.Save(cover, file); err != nil {
+				writeError(w, r, "Failed to save cover", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		nb, err := funcs.CreatePhysicalNotebook(s.DB, r.FormValue("name"), cover, pageCount)
+		if err != nil {
+			writeError(w, r, "Failed to save notebook: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if redirectBack(w, r) {
+			return
+		}
+		writeData(w, http.StatusCreated, nb)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PhysicalNotebookPagesHandler reports which pages of a paper notebook have
+// been digitized, as a list of pages and the notes scanned from each
+func (s *Server) PhysicalNotebookPagesHandler(w http.ResponseWriter, r *http.Request) {
+	nb, ok := s.physicalNotebook(w, r)
+	if !ok {
+		return
+	}
+	pages, err := funcs.NotebookPages(s.DB, nb)
+	if err != nil {
+		writeError(w, r, "Failed to load pages: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]any{
+		"notebook":  nb,
+		"pages":     pages,
+		"digitized": funcs.DigitizedPages(pages),
+		"missing":   funcs.MissingPages(pages),
+		"gaps":      funcs.PageGaps(pages),
+	})
+}
+
+func (s *Server) DeletePhysicalNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid notebook ID", http.StatusBadRequest)
+		return
+	}
+	nb, err := funcs.GetPhysicalNotebook(s.DB, id)
+	if err != nil {
+		writeError(w, r, "Notebook not found", errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	if err := funcs.DeletePhysicalNotebook(s.DB, id); err != nil {
+		writeError(w, r, "Failed to delete notebook: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	if nb.CoverImage != "" {
+		if err := s.Images.Remove(nb.CoverImage); err != nil {
+			slog.ErrorContext(r.Context(), "failed to remove cover", "image", nb.CoverImage, "err", err)
+		}
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusOK, deletedResponse{ID: id, Deleted: true})
+}
+
+// SetNotePageHandler maps a note to a page of a paper notebook. A notebook
+// of 0 or an empty value clears the mapping.
+func (s *Server) SetNotePageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := parseNoteID(w, r)
+	if !ok {
+		return
+	}
+
+	notebookID, page, err := s.notePage(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := funcs.SetNotePage(s.DB, id, notebookID, page); err != nil {
+		writeError(w, r, "Failed to set note page: "+err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusOK, notePageResponse{NoteID: id, NotebookID: notebookID, Page: page, PageGaps: s.pageGaps(notebookID)})
+}
+
+// ReviewNoteHandler clears the review mark left on a note whose
+// transcription broke a guardrail
+func (s *Server) ReviewNoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := parseNoteID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := funcs.SetNoteReview(s.DB, id, ""); err != nil {
+		writeError(w, r, "Failed to clear review: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	if redirectBack(w, r) {
+		return
+	}
+	s.writeNote(w, r, http.StatusOK, id, nil, nil)
+}
+
+// notePage reads the notebook and page form values. A missing or 0
+// notebook means the note is not mapped to a paper notebook, and a missing
+// page is 0.
+func (s *Server) notePage(r *http.Request) (notebookID, page int, err error) {
+	nb := r.FormValue("notebook")
+	if nb == "" {
+		return 0, 0, nil
+	}
+	if notebookID, err = strconv.Atoi(nb); err != nil {
+		return 0, 0, fmt.Errorf("Invalid notebook ID")
+	}
+	if notebookID == 0 {
+		return 0, 0, nil
+	}
+	if p := r.FormValue("page"); p != "" {
+		if page, err = strconv.Atoi(p); err != nil {
+			return 0, 0, fmt.Errorf("Invalid page number")
+		}
+	}
+	return notebookID, page, nil
+}
+
+// pageGaps lists the breaks in a paper notebook's page sequence for a
+// response warning, logging rather than failing when they can't be read
+func (s *Server) pageGaps(notebookID int) []int {
+	if notebookID == 0 {
+		return []int{}
+	}
+	gaps, err := funcs.NotebookGaps(s.DB, notebookID)
+	if err != nil {
+		slog.Error("failed to check page gaps", "physical_notebook_id", notebookID, "err", err)
+		return []int{}
+	}
+	if len(gaps) > 0 {
+		slog.Info("notebook has page gaps", "physical_notebook_id", notebookID, "gaps", funcs.PageRanges(gaps))
+	}
+	return gaps
+}
+
+// adminOrigins refuses state-changing admin requests a browser sends from
+// another site, by their Sec-Fetch-Site or Origin header
+var adminOrigins = http.NewCrossOriginProtection()
+
+// requireAdmin allows a request to change server configuration. With
+// BOOKMD_ADMIN_TOKEN set the token must be sent as a bearer token or an
+// admin_token cookie or form value; otherwise only loopback clients pass,
+// and not when a proxy forwarded the request, since behind one on the same
+// machine every client looks local. Either way a POST, PUT, PATCH or DELETE
+// from another site's page is refused, so no page open in a local browser can
+// use the loopback shortcut.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if err := adminOrigins.Check(r); err != nil {
+		writeError(w, r, "Admin changes must come from this server's own pages", http.StatusForbidden)
+		return false
+	}
+	token := os.Getenv("BOOKMD_ADMIN_TOKEN")
+	if token == "" {
+		if proxied(r) {
+			writeError(w, r, "Settings are not available through a proxy unless BOOKMD_ADMIN_TOKEN is set", http.StatusForbidden)
+			return false
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+			return true
+		}
+		writeError(w, r, "Settings are only available from this machine unless BOOKMD_ADMIN_TOKEN is set", http.StatusForbidden)
+		return false
+	}
+
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if cookie, err := r.Cookie("admin_token"); given == "" && err == nil {
+		given = cookie.Value
+	}
+	if form := r.FormValue("admin_token"); form != "" {
+		given = form
+		http.SetCookie(w, &http.Cookie{Name: "admin_token", Value: form, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		writeError(w, r, "Admin token required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// proxied reports whether a proxy forwarded the request, by the headers
+// proxies add
+func proxied(r *http.Request) bool {
+	for _, header := range []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"} {
+		if r.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSettingsPage shows the AI settings. A POST runs a test transcription of
+// the bundled sample image with the saved settings and shows the result.
+func (s *Server) GetSettingsPage(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	settings, err := funcs.LoadAISettings(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to load settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var test *templ.SettingsTest
+	if r.Method == http.MethodPost {
+		ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+		defer cancel()
+		markdown, err := s.convertSample(ctx, settings)
+		test = &templ.SettingsTest{Markdown: markdown}
+		if err != nil {
+			test.Error = err.Error()
+		}
+	}
+
+	cache, err := funcs.GetAICacheStats(s.DB)
+	if err != nil {
+		http.Error(w, "Failed to load AI cache: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	usage, err := funcs.GetUsage(s.DB, funcs.DefaultUsageDays, pricingFromEnv())
+	if err != nil {
+		http.Error(w, "Failed to load AI usage: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	storage, err := s.storage()
+	if err != nil {
+		http.Error(w, "Failed to measure storage: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	component := templ.SettingsPage(settings, test, cache, usage, storage, s.displayPrefs(w, r))
+	component.Render(r.Context(), w)
+}
+
+// convertSample transcribes the sample note with settings, to test them.
+// The AI is sent files, so the built-in image is copied to the spool first.
+func (s *Server) convertSample(ctx context.Context, settings funcs.AISettings) (string, error) {
+	sample, err := fs.ReadFile(s.staticAssets(), "sample-note.png")
+	if err != nil {
+		return "", fmt.Errorf("failed to read sample note: %w", err)
+	}
+	f, err := os.CreateTemp(s.Paths.Spool, "sample-*.png")
+	if err != nil {
+		return "", fmt.Errorf("failed to copy sample note: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(sample)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to copy sample note: %w", err)
+	}
+	return s.AI.ConvertImageWith(ctx, s.AI.NewClient(settings), settings.Model, settings.Prompt, f.Name())
+}
+
+// SettingsHandler saves the AI settings and applies them immediately. A
+// blank api_key keeps the stored key unless clear_api_key is set.
+func (s *Server) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		settings, err := funcs.LoadAISettings(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to load settings: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, map[string]any{
+			"settings":    settings,
+			"api_key_set": settings.APIKey != "",
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	current, err := funcs.LoadAISettings(s.DB)
+	if err != nil {
+		writeError(w, r, "Failed to load settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defaults := funcs.DefaultAISettings()
+
+	// Values equal to the defaults are not stored, so later changes to the
+	// defaults still apply
+	stored := func(value, fallback string) string {
+		value = strings.TrimSpace(value)
+		if value == fallback {
+			return ""
+		}
+		return value
+	}
+	apiKey := strings.TrimSpace(r.FormValue("api_key"))
+	if apiKey == "" && current.APIKey != defaults.APIKey {
+		apiKey = current.APIKey
+	}
+	if clear, _ := strconv.ParseBool(r.FormValue("clear_api_key")); clear {
+		apiKey = ""
+	}
+	update := funcs.AISettings{
+		Provider: stored(r.FormValue("provider"), defaults.Provider),
+		APIKey:   stored(apiKey, defaults.APIKey),
+		BaseURL:  stored(r.FormValue("base_url"), defaults.BaseURL),
+		Model:    stored(r.FormValue("model"), defaults.Model),
+		Prompt:   stored(r.FormValue("prompt"), defaults.Prompt),
+	}
+	if update.Temperature, err = funcs.ParseTemperature(strings.TrimSpace(r.FormValue("temperature"))); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t := update.Temperature; t != nil && defaults.Temperature != nil && *t == *defaults.Temperature {
+		update.Temperature = nil
+	}
+	if update.MaxTokens, err = funcs.ParseMaxTokens(strings.TrimSpace(r.FormValue("max_tokens"))); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.MaxTokens == defaults.MaxTokens {
+		update.MaxTokens = 0
+	}
+	if update.Provider != "" && !funcs.ValidProvider(update.Provider) {
+		writeError(w, r, "Provider must be openai, gemini, anthropic, ollama or tesseract", http.StatusBadRequest)
+		return
+	}
+	if update.BaseURL != "" {
+		if u, err := url.Parse(update.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			writeError(w, r, "Base URL must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := funcs.SaveAISettings(s.DB, update); err != nil {
+		writeError(w, r, "Failed to save settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	settings, err := funcs.LoadAISettings(s.DB)
+	if err != nil {
+		writeError(w, r, "Failed to load settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.AI.UseSettings(settings)
+
+	if redirectBack(w, r) {
+		return
+	}
+	writeData(w, http.StatusOK, map[string]any{
+		"settings":    settings,
+		"api_key_set": settings.APIKey != "",
+	})
+}
+
+// PreferencesHandler returns the interface preferences on GET and replaces
+// them with a JSON body on POST. Omitted fields keep their current value.
+func (s *Server) PreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	preferences, err := funcs.GetPreferences(s.DB)
+	if err != nil {
+		writeError(w, r, "Failed to load preferences: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&preferences); err != nil {
+			writeError(w, r, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := funcs.SavePreferences(s.DB, preferences); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeData(w, http.StatusOK, preferences)
+}
+
+// GuardrailsHandler reads (GET) or replaces (POST, JSON) the checks run on
+// transcriptions before they are saved
+func (s *Server) GuardrailsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	guardrails, err := funcs.GetGuardrails(s.DB)
+	if err != nil {
+		writeError(w, r, "Failed to load guardrails: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&guardrails); err != nil {
+			writeError(w, r, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := funcs.SaveGuardrails(s.DB, guardrails); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.AI.UseGuardrails(guardrails)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeData(w, http.StatusOK, guardrails)
+}
+
+// aiCacheListLimit is how many cache entries GET /api/ai-cache lists
+const aiCacheListLimit = 100
+
+// UsageHandler reports the tokens the AI used over the last days days
+// (default 30) by day and by model, priced at BOOKMD_INPUT_PRICE and
+// BOOKMD_OUTPUT_PRICE
+func (s *Server) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := funcs.DefaultUsageDays
+	if d := r.URL.Query().Get("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+		if err != nil || days < 1 || days > funcs.MaxUsageDays {
+			writeError(w, r, fmt.Sprintf("Days must be between 1 and %d", funcs.MaxUsageDays), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := funcs.GetUsage(s.DB, days, pricingFromEnv())
+	if err != nil {
+		writeError(w, r, "Failed to load AI usage: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeData(w, http.StatusOK, report)
+}
+
+// AICacheHandler shows the cached AI responses (GET) or clears them
+// (DELETE, or POST from the settings page)
+func (s *Server) AICacheHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		stats, err := funcs.GetAICacheStats(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to load AI cache: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries, err := funcs.GetAICacheEntries(s.DB, aiCacheListLimit)
+		if err != nil {
+			writeError(w, r, "Failed to load AI cache: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, map[string]any{"stats": stats, "entries": entries})
+
+	case http.MethodDelete, http.MethodPost:
+		cleared, err := funcs.ClearAICache(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to clear AI cache: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if redirectBack(w, r) {
+			return
+		}
+		writeData(w, http.StatusOK, map[string]any{"cleared": cleared})
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MaintenanceHandler reports the space the library takes (GET) or runs the
+// database maintenance now (POST, also from the settings page)
+func (s *Server) MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		report, err := s.storage()
+		if err != nil {
+			writeError(w, r, "Failed to measure storage: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeData(w, http.StatusOK, report)
+
+	case http.MethodPost:
+		report, err := funcs.RunMaintenance(s.DB)
+		if err != nil {
+			writeError(w, r, "Failed to maintain database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "database maintained", "duration_ms", report.DurationMS, "bytes_freed", report.BytesFreed)
+		if redirectBack(w, r) {
+			return
+		}
+		writeData(w, http.StatusOK, report)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// BackupHandler downloads every note with its image as a zip whose manifest
+// holds the SHA-256 of each file and the provenance of each note's markdown,
+// or on POST imports such a zip sent as backup. An import checks every file
+// against the manifest first and adds nothing when one does not match, so a
+// damaged or altered archive is refused as a whole.
+func (s *Server) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if !requireAdmin(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="bookmd-backup-%s.zip"`, s.now().Format("2006-01-02")))
+		openImage := func(name string) (io.ReadCloser, error) { return s.Images.Open(name) }
+		if err := funcs.WriteBackup(s.DB, w, openImage); err != nil {
+			// The archive is cut short, which unzipping it will report
+			slog.ErrorContext(r.Context(), "failed to write backup", "err", err)
+		}
+
+	case http.MethodPost:
+		// The form is read first: requireAdmin reads the admin_token field
+		form, err := s.parseUpload(r)
+		if err != nil {
+			writeError(w, r, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer form.RemoveAll()
+		if !requireAdmin(w, r) {
+			return
+		}
+		file, header, err := form.FormFile("backup")
+		if err != nil {
+			writeError(w, r, "No backup file provided", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		archive, err := zip.NewReader(file, header.Size)
+		if err != nil {
+			writeError(w, r, header.Filename+" is not a valid zip", http.StatusBadRequest)
+			return
+		}
+
+		saveImage := func(name string, data []byte) (string, error) {
+			image, err := s.saveUpload(name, bytes.NewReader(data))
+			if err == nil {
+				s.makeVariants(image)
+			}
+			return image, err
+		}
+		result, err := funcs.ImportBackup(s.DB, archive, saveImage)
+		if errors.Is(err, funcs.ErrIntegrity) {
+			slog.WarnContext(r.Context(), "backup failed verification", "file", header.Filename, "err", err)
+			writeError(w, r, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			writeError(w, r, "Failed to import backup: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.InfoContext(r.Context(), "backup imported", "file", header.Filename, "imported", result.Imported, "skipped", result.Skipped)
+		if redirectBack(w, r) {
+			return
+		}
+		writeData(w, http.StatusOK, result)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// AICacheEntryHandler shows (GET) or removes (DELETE) one cached response
+func (s *Server) AICacheEntryHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	key := r.PathValue("key")
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, err := funcs.GetAICacheEntry(s.DB, key)
+		if err != nil {
+			writeError(w, r, "Failed to load cache entry: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		writeData(w, http.StatusOK, entry)
+
+	case http.MethodDelete:
+		if err := funcs.DeleteAICacheEntry(s.DB, key); err != nil {
+			writeError(w, r, "Failed to delete cache entry: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		writeData(w, http.StatusOK, map[string]any{"deleted": key})
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// readSlackRequest reads and verifies a signed request from Slack, writing
+// the error response itself when it returns false
+func (s *Server) readSlackRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if s.Slack == nil {
+		http.Error(w, "Slack is not configured", http.StatusNotFound)
+		return nil, false
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := funcs.VerifySlackRequest(s.Slack.SigningSecret, r.Header, body, s.now()); err != nil {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+// SlackCommandHandler handles the slash command, which transcribes the most
+// recent image posted in the channel it is run from
+func (s *Server) SlackCommandHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.readSlackRequest(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	channelID := form.Get("channel_id")
+
+	// Slack expects an answer within three seconds, so the work happens in
+	// the background and the result is posted to the channel
+	s.goChat(func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+		fileID, err := s.Slack.LatestImage(ctx, channelID)
+		if err == nil {
+			err = s.Slack.TranscribeFile(ctx, fileID, channelID)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "slack command failed", "channel", channelID, "err", err)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"response_type": "ephemeral",
+		"text":          "Transcribing the latest image in this channel...",
+	})
+}
+
+// SlackEventsHandler receives Events API callbacks: it answers the URL
+// verification challenge and transcribes images as they are shared
+func (s *Server) SlackEventsHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := s.readSlackRequest(w, r)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Event     struct {
+			Type      string `json:"type"`
+			FileID    string `json:"file_id"`
+			ChannelID string `json:"channel_id"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	switch payload.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, payload.Challenge)
+		return
+	case "event_callback":
+		// Retries of an event already being handled are acknowledged only
+		if payload.Event.Type == "file_shared" && r.Header.Get("X-Slack-Retry-Num") == "" {
+			event := payload.Event
+			s.goChat(func(ctx context.Context) {
+				ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+				defer cancel()
+				if err := s.Slack.TranscribeFile(ctx, event.FileID, event.ChannelID); err != nil {
+					slog.ErrorContext(r.Context(), "slack file failed", "file", event.FileID, "err", err)
+				}
+			})
+		}
+	}
+	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"seesharpsi/bookmd/funcs"
+)
+
+// fakeAI answers every transcription with markdown
+type fakeAI struct {
+	markdown string
+}
+
+func (f fakeAI) Complete(ctx context.Context, req funcs.VisionRequest) (string, error) {
+	if req.Schema == nil {
+		return f.markdown, nil
+	}
+	data, err := json.Marshal(funcs.Transcription{Title: "Fake title", Markdown: f.markdown})
+	return string(data), err
+}
+
+// fakeMarkdown is what the test server's fakeAI transcribes every image as
+const fakeMarkdown = "# Fake\n\nTranscribed text\n"
+
+// newTestServer serves the routes over a database and images in a
+// temporary directory, transcribing with a fakeAI
+func newTestServer(t *testing.T) (*Server, http.Handler) {
+	t.Helper()
+	dir := t.TempDir()
+	paths, err := resolvePaths(Paths{Data: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := funcs.InitDB(filepath.Join(dir, "notes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store, err := funcs.NewStore(db, funcs.DefaultQueryTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	ai := funcs.NewTranscriber(funcs.DefaultAISettings())
+	ai.UseClient(fakeAI{markdown: fakeMarkdown})
+	s := &Server{
+		DB:     db,
+		Store:  store,
+		AI:     ai,
+		Images: DirImages(paths.Images),
+		Now:    func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) },
+		Events: &funcs.EventBus{},
+		Paths:  paths,
+	}
+	mux := http.NewServeMux()
+	s.add_routes(mux)
+	return s, mux
+}
+
+// startJobs runs the queue uploads are converted on, for the tests that
+// upload; the others leave its workers out of their way
+func startJobs(t *testing.T, s *Server) {
+	t.Helper()
+	s.Jobs = &funcs.JobQueue{DB: s.DB, Workers: 1, Process: s.processUpload, Notify: s.jobChanged}
+	if err := s.Jobs.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Jobs.Drain(context.Background()) })
+}
+
+// testImage encodes a one pixel PNG of shade, so that images of different
+// shades are stored under different names
+func testImage(t *testing.T, shade uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 1, 1))
+	img.SetGray(0, 0, color.Gray{Y: shade})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// addTestNote stores a test image of shade and adds a note showing it
+func addTestNote(t *testing.T, s *Server, shade uint8, markdown string) *funcs.Note {
+	t.Helper()
+	name, err := s.saveUpload("page.png", bytes.NewReader(testImage(t, shade)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := funcs.AddNote(s.DB, name, markdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return note
+}
+
+// serve sends req to h asking for JSON and records the response
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// postForm sends fields to path as a URL-encoded form
+func postForm(h http.Handler, path string, fields url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(fields.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(h, req)
+}
+
+// wantStatus fails the test unless rec has status code
+func wantStatus(t *testing.T, rec *httptest.ResponseRecorder, code int) {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, code, rec.Body)
+	}
+}
+
+// multipartBody builds a form of fields and one file sent as image
+func multipartBody(t *testing.T, fields map[string]string, filename string, image []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if filename != "" {
+		fw, err := mw.CreateFormFile("image", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(image)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, mw.FormDataContentType()
+}
+
+// decodeData decodes the data of a JSON response into v
+func decodeData(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	var envelope struct {
+		Data  json.RawMessage `json:"data"`
+		Error *string         `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("failed to decode %q: %v", rec.Body.String(), err)
+	}
+	if envelope.Error != nil {
+		t.Fatalf("unexpected error: %s", *envelope.Error)
+	}
+	if err := json.Unmarshal(envelope.Data, v); err != nil {
+		t.Fatalf("failed to decode data %s: %v", envelope.Data, err)
+	}
+}
+
+func TestAddNote(t *testing.T) {
+	s, h := newTestServer(t)
+	startJobs(t, s)
+	body, contentType := multipartBody(t, map[string]string{"wait": "true"}, "page.png", testImage(t, 1))
+	req := httptest.NewRequest(http.MethodPost, "/api/add-note", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := serve(h, req)
+
+	wantStatus(t, rec, http.StatusCreated)
+	var note funcs.Note
+	decodeData(t, rec, &note)
+	if note.Markdown != fakeMarkdown {
+		t.Errorf("markdown = %q, want the fake transcription", note.Markdown)
+	}
+	if note.Title != "Fake title" {
+		t.Errorf("title = %q, want the transcribed title", note.Title)
+	}
+}
+
+func TestAddNoteQueuesJob(t *testing.T) {
+	s, h := newTestServer(t)
+	startJobs(t, s)
+	body, contentType := multipartBody(t, nil, "page.png", testImage(t, 1))
+	req := httptest.NewRequest(http.MethodPost, "/api/add-note", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := serve(h, req)
+
+	wantStatus(t, rec, http.StatusAccepted)
+	var job funcs.Job
+	decodeData(t, rec, &job)
+	if want := "/api/jobs/" + strconv.Itoa(job.ID); rec.Header().Get("Location") != want {
+		t.Errorf("Location = %q, want %q", rec.Header().Get("Location"), want)
+	}
+}
+
+func TestAddNoteErrors(t *testing.T) {
+	_, h := newTestServer(t)
+
+	rec := serve(h, httptest.NewRequest(http.MethodGet, "/api/add-note", nil))
+	wantStatus(t, rec, http.StatusMethodNotAllowed)
+
+	body, contentType := multipartBody(t, map[string]string{"wait": "true"}, "", nil)
+	req := httptest.NewRequest(http.MethodPost, "/api/add-note", body)
+	req.Header.Set("Content-Type", contentType)
+	rec = serve(h, req)
+	wantStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestUpdateNoteReplacesImage(t *testing.T) {
+	s, h := newTestServer(t)
+	note, err := funcs.AddNote(s.DB, "old.png", "# Old\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, contentType := multipartBody(t, map[string]string{"id": "1"}, "new.png", []byte("new image"))
+	req := httptest.NewRequest(http.MethodPost, "/api/update-note", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := serve(h, req)
+
+	wantStatus(t, rec, http.StatusOK)
+	var updated funcs.Note
+	decodeData(t, rec, &updated)
+	if updated.ID != note.ID {
+		t.Errorf("updated note %d, want %d", updated.ID, note.ID)
+	}
+	if want := funcs.ImageName([]byte("new image"), ".png"); updated.Image != want {
+		t.Errorf("image = %q, want %q", updated.Image, want)
+	}
+	if updated.Markdown != fakeMarkdown {
+		t.Errorf("markdown = %q, want the fake transcription", updated.Markdown)
+	}
+}
+
+func TestUpdateNoteErrors(t *testing.T) {
+	_, h := newTestServer(t)
+	for _, tc := range []struct {
+		name   string
+		fields map[string]string
+		code   int
+	}{
+		{"missing id", nil, http.StatusBadRequest},
+		{"invalid id", map[string]string{"id": "one"}, http.StatusBadRequest},
+		{"unknown note", map[string]string{"id": "99"}, http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, tc.fields, "new.png", testImage(t, 2))
+			req := httptest.NewRequest(http.MethodPost, "/api/update-note", body)
+			req.Header.Set("Content-Type", contentType)
+			wantStatus(t, serve(h, req), tc.code)
+		})
+	}
+}
+
+func TestRegenerateNote(t *testing.T) {
+	s, h := newTestServer(t)
+	note := addTestNote(t, s, 1, "# Typo\n")
+
+	rec := postForm(h, "/api/regenerate-note", url.Values{"id": {strconv.Itoa(note.ID)}})
+	wantStatus(t, rec, http.StatusOK)
+	var regenerated funcs.Note
+	decodeData(t, rec, &regenerated)
+	if regenerated.Markdown != fakeMarkdown {
+		t.Errorf("markdown = %q, want the fake transcription", regenerated.Markdown)
+	}
+	if regenerated.Image != note.Image {
+		t.Errorf("image = %q, want it kept as %q", regenerated.Image, note.Image)
+	}
+	if regenerated.Revision != note.Revision+1 {
+		t.Errorf("revision = %d, want %d", regenerated.Revision, note.Revision+1)
+	}
+}
+
+func TestRegenerateNoteErrors(t *testing.T) {
+	s, h := newTestServer(t)
+	missing, err := funcs.AddNote(s.DB, "missing.png", "# No image\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantStatus(t, serve(h, httptest.NewRequest(http.MethodGet, "/api/regenerate-note?id=1", nil)), http.StatusMethodNotAllowed)
+	wantStatus(t, postForm(h, "/api/regenerate-note", nil), http.StatusBadRequest)
+	wantStatus(t, postForm(h, "/api/regenerate-note", url.Values{"id": {"99"}}), http.StatusNotFound)
+	wantStatus(t, postForm(h, "/api/regenerate-note", url.Values{"id": {strconv.Itoa(missing.ID)}}), http.StatusNotFound)
+}
+
+func TestDeleteNote(t *testing.T) {
+	s, h := newTestServer(t)
+	note := addTestNote(t, s, 1, "# Gone soon\n")
+	path := "/api/notes/" + strconv.Itoa(note.ID)
+
+	rec := serve(h, httptest.NewRequest(http.MethodDelete, path, nil))
+	wantStatus(t, rec, http.StatusOK)
+	var deleted struct {
+		ID      int  `json:"id"`
+		Deleted bool `json:"deleted"`
+	}
+	decodeData(t, rec, &deleted)
+	if deleted.ID != note.ID || !deleted.Deleted {
+		t.Errorf("response = %+v, want note %d deleted", deleted, note.ID)
+	}
+
+	wantStatus(t, serve(h, httptest.NewRequest(http.MethodGet, path, nil)), http.StatusNotFound)
+	wantStatus(t, serve(h, httptest.NewRequest(http.MethodDelete, path, nil)), http.StatusNotFound)
+	wantStatus(t, serve(h, httptest.NewRequest(http.MethodPut, path, nil)), http.StatusMethodNotAllowed)
+}
+
+func TestListNotes(t *testing.T) {
+	s, h := newTestServer(t)
+	for i := range 3 {
+		addTestNote(t, s, uint8(i), "# Note\n")
+	}
+
+	rec := serve(h, httptest.NewRequest(http.MethodGet, "/api/notes?sort=id&limit=2", nil))
+	wantStatus(t, rec, http.StatusOK)
+	var notes []funcs.Note
+	decodeData(t, rec, &notes)
+	if len(notes) != 2 || notes[0].ID != 1 || notes[1].ID != 2 {
+		t.Fatalf("listed %+v, want notes 1 and 2", notes)
+	}
+	if got := rec.Header().Get("X-Total-Count"); got != "3" {
+		t.Errorf("X-Total-Count = %q, want 3", got)
+	}
+	if got := rec.Header().Get("Link"); !strings.Contains(got, "page=2") {
+		t.Errorf("Link = %q, want the next page", got)
+	}
+
+	for _, query := range []string{"order=up", "sort=title", "limit=0", "page=0"} {
+		wantStatus(t, serve(h, httptest.NewRequest(http.MethodGet, "/api/notes?"+query, nil)), http.StatusBadRequest)
+	}
+	wantStatus(t, serve(h, httptest.NewRequest(http.MethodPost, "/api/notes", nil)), http.StatusMethodNotAllowed)
+
+	// A database that fails is the server's fault, not the request's
+	s.DB.Close()
+	wantStatus(t, serve(h, httptest.NewRequest(http.MethodGet, "/api/notes", nil)), http.StatusInternalServerError)
+}
+
+func TestSearchMemoryIndexFollowsChanges(t *testing.T) {
+	s, h := newTestServer(t)
+	note := addTestNote(t, s, 1, "# Before\n\nphotosynthesis\n")
+	var err error
+	if s.Index, err = funcs.NewMemoryIndex(s.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(q string) []funcs.SearchResult {
+		t.Helper()
+		rec := serve(h, httptest.NewRequest(http.MethodGet, "/api/search?q="+url.QueryEscape(q), nil))
+		wantStatus(t, rec, http.StatusOK)
+		var results []funcs.SearchResult
+		decodeData(t, rec, &results)
+		return results
+	}
+	if results := search("photosynthesis"); len(results) != 1 {
+		t.Fatalf("found %d notes before the edit, want 1", len(results))
+	}
+
+	rec := postForm(h, "/api/notes/"+strconv.Itoa(note.ID)+"/markdown", url.Values{"markdown": {"# After\n\nrespiration\n"}})
+	wantStatus(t, rec, http.StatusOK)
+	if results := search("photosynthesis"); len(results) != 0 {
+		t.Errorf("found %d notes by their old text, want 0", len(results))
+	}
+	if results := search("respiration"); len(results) != 1 {
+		t.Errorf("found %d notes by their new text, want 1", len(results))
+	}
+
+	wantStatus(t, serve(h, httptest.NewRequest(http.MethodDelete, "/api/notes/"+strconv.Itoa(note.ID), nil)), http.StatusOK)
+	if _, err := funcs.PurgeNote(s.DB, note.ID); err != nil {
+		t.Fatal(err)
+	}
+	search("respiration")
+	if stats := s.Index.Stats(); stats.Notes != 0 {
+		t.Errorf("index holds %d notes after the purge, want 0", stats.Notes)
+	}
+}
+
+func TestLockedNotebookRefusesNoteChanges(t *testing.T) {
+	s, h := newTestServer(t)
+	note := addTestNote(t, s, 1, "# Held\n")
+	if _, err := funcs.SaveNoteType(s.DB, funcs.NoteType{Name: "minutes"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := funcs.SetNoteType(s.DB, note.ID, "minutes", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := funcs.SetProperty(s.DB, note.ID, "course", "LAW 101"); err != nil {
+		t.Fatal(err)
+	}
+	nb, err := funcs.CreateNotebook(s.DB, "Evidence", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := funcs.MoveNotes(s.DB, []int{note.ID}, nb.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := funcs.SetNotebookLocked(s.DB, nb.ID, true, "test", "litigation"); err != nil {
+		t.Fatal(err)
+	}
+
+	id := strconv.Itoa(note.ID)
+	for _, tc := range []struct {
+		name string
+		rec  *httptest.ResponseRecorder
+	}{
+		{"set property", postForm(h, "/api/set-property", url.Values{"id": {id}, "key": {"course"}, "value": {"LAW 102"}})},
+		{"delete property", postForm(h, "/api/delete-property", url.Values{"id": {id}, "key": {"course"}})},
+		{"delete note type", postForm(h, "/api/delete-note-type", url.Values{"name": {"minutes"}})},
+		{"edit markdown", postForm(h, "/api/notes/"+id+"/markdown", url.Values{"markdown": {"# Changed\n"}})},
+		{"delete note", serve(h, httptest.NewRequest(http.MethodDelete, "/api/notes/"+id, nil))},
+	} {
+		if tc.rec.Code != http.StatusLocked {
+			t.Errorf("%s: status = %d, want %d: %s", tc.name, tc.rec.Code, http.StatusLocked, tc.rec.Body)
+		}
+	}
+
+	kept, err := funcs.GetNoteByID(s.DB, note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.NoteType != "minutes" || kept.Markdown != "# Held\n" {
+		t.Errorf("locked note changed to type %q and markdown %q", kept.NoteType, kept.Markdown)
+	}
+}
+
+func TestAdminRefusesProxiedLoopback(t *testing.T) {
+	t.Setenv("BOOKMD_ADMIN_TOKEN", "")
+	_, h := newTestServer(t)
+	for _, tc := range []struct {
+		name   string
+		remote string
+		header string
+		code   int
+	}{
+		{"loopback", "127.0.0.1:5000", "", http.StatusOK},
+		{"remote", "192.0.2.1:5000", "", http.StatusForbidden},
+		{"forwarded", "127.0.0.1:5000", "Forwarded", http.StatusForbidden},
+		{"x-forwarded-for", "[::1]:5000", "X-Forwarded-For", http.StatusForbidden},
+		{"x-real-ip", "127.0.0.1:5000", "X-Real-IP", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/audit", nil)
+			req.RemoteAddr = tc.remote
+			if tc.header != "" {
+				req.Header.Set(tc.header, "203.0.113.7")
+			}
+			wantStatus(t, serve(h, req), tc.code)
+		})
+	}
+}
+
+func TestAdminRefusesCrossSiteChanges(t *testing.T) {
+	t.Setenv("BOOKMD_ADMIN_TOKEN", "")
+	_, h := newTestServer(t)
+	for _, tc := range []struct {
+		name    string
+		method  string
+		headers map[string]string
+		code    int
+	}{
+		{"no browser headers", http.MethodDelete, nil, http.StatusOK},
+		{"same origin", http.MethodDelete, map[string]string{"Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+		{"typed by the user", http.MethodDelete, map[string]string{"Sec-Fetch-Site": "none"}, http.StatusOK},
+		{"matching origin", http.MethodDelete, map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+		{"cross site", http.MethodDelete, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same site", http.MethodPost, map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"other origin", http.MethodPost, map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"cross site read", http.MethodGet, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/api/ai-cache", nil)
+			req.RemoteAddr = "127.0.0.1:5000"
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			wantStatus(t, serve(h, req), tc.code)
+		})
+	}
+}
+
+func TestTitleChangeKeepsRevision(t *testing.T) {
+	s, h := newTestServer(t)
+	note := addTestNote(t, s, 1, "# Lecture\n")
+	path := "/api/notes/" + strconv.Itoa(note.ID)
+
+	req := httptest.NewRequest(http.MethodPatch, path, strings.NewReader(`{"title":"Week 1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := serve(h, req)
+	wantStatus(t, rec, http.StatusOK)
+	var renamed funcs.Note
+	decodeData(t, rec, &renamed)
+	if renamed.Revision != note.Revision+1 {
+		t.Fatalf("revision = %d, want %d", renamed.Revision, note.Revision+1)
+	}
+
+	rec = serve(h, httptest.NewRequest(http.MethodGet, path+"/revisions/"+strconv.Itoa(note.Revision), nil))
+	wantStatus(t, rec, http.StatusOK)
+	var rev funcs.NoteRevision
+	decodeData(t, rec, &rev)
+	if rev.Markdown != note.Markdown {
+		t.Errorf("revision markdown = %q, want %q", rev.Markdown, note.Markdown)
+	}
+
+	rec = postForm(h, path+"/rollback", url.Values{"revision": {strconv.Itoa(note.Revision)}})
+	wantStatus(t, rec, http.StatusOK)
+}
+
+func TestDrainChatsWaitsForWork(t *testing.T) {
+	s, _ := newTestServer(t)
+	var finished atomic.Bool
+	s.goChat(func(ctx context.Context) {
+		time.Sleep(20 * time.Millisecond)
+		finished.Store(true)
+	})
+	if err := s.drainChats(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !finished.Load() {
+		t.Error("drainChats returned before the work finished")
+	}
+}
+
+func TestDrainChatsCancelsOnTimeout(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.chatCtx, s.stopChats = context.WithCancel(context.Background())
+	var canceled atomic.Bool
+	s.goChat(func(ctx context.Context) {
+		<-ctx.Done()
+		canceled.Store(true)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.drainChats(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("drainChats = %v, want the deadline", err)
+	}
+	if !canceled.Load() {
+		t.Error("drainChats returned before the cancelled work did")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Paths are the locations the server reads and writes
+type Paths struct {
+	Data   string
+	DB     string
+	Images string
+	Static string
+	// Spool holds uploads too large to keep in memory while they are read
+	Spool string
+}
+
+// defaultDataDir is $BOOKMD_DATA_DIR, else $XDG_DATA_HOME/bookmd, else
+// ~/.local/share/bookmd
+func defaultDataDir() string {
+	if dir := os.Getenv("BOOKMD_DATA_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "bookmd")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "share", "bookmd")
+	}
+	return "."
+}
+
+// defaultStaticDir is where -dev reads static assets: a static directory
+// next to the executable, else ./static (as under go run)
+func defaultStaticDir() string {
+	if exe, err := os.Executable(); err == nil {
+		dir := filepath.Join(filepath.Dir(exe), "static")
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return "./static"
+}
+
+// resolvePaths fills in the database, image and spool paths that were not
+// given explicitly and creates the directories they live in
+func resolvePaths(p Paths) (Paths, error) {
+	if p.Data == "" {
+		p.Data = defaultDataDir()
+	}
+	explicit := p.DB != "" || p.Images != ""
+	if p.DB == "" {
+		p.DB = filepath.Join(p.Data, "notes.db")
+	}
+	if p.Images == "" {
+		p.Images = filepath.Join(p.Data, "images")
+	}
+	if p.Spool == "" {
+		p.Spool = filepath.Join(p.Data, "spool")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.DB), 0755); err != nil {
+		return p, fmt.Errorf("failed to create database directory: %w", err)
+	}
+	if !explicit {
+		migrateLegacyData(p)
+	}
+	if err := os.MkdirAll(p.Images, 0755); err != nil {
+		return p, fmt.Errorf("failed to create images directory: %w", err)
+	}
+	if err := os.MkdirAll(p.Spool, 0700); err != nil {
+		return p, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	return p, nil
+}
+
+// migrateLegacyData moves notes.db and images/ from the working directory,
+// where older versions kept them, into the data directory. Nothing is moved
+// once the data directory has a database of its own.
+func migrateLegacyData(p Paths) {
+	if _, err := os.Stat(p.DB); err == nil {
+		return
+	}
+	if _, err := os.Stat("notes.db"); err != nil {
+		return
+	}
+	if abs, err := filepath.Abs(p.DB); err == nil {
+		if legacy, err := filepath.Abs("notes.db"); err == nil && abs == legacy {
+			return
+		}
+	}
+
+	slog.Info("moving notes.db and images/ from the working directory", "to", p.Data)
+	// The WAL and shared-memory files must travel with the database
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if _, err := os.Stat("notes.db" + suffix); err != nil {
+			continue
+		}
+		if err := os.Rename("notes.db"+suffix, p.DB+suffix); err != nil {
+			slog.Warn("failed to move notes.db"+suffix, "err", err)
+			return
+		}
+	}
+	if _, err := os.Stat(p.Images); os.IsNotExist(err) {
+		if err := os.Rename("images", p.Images); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to move images/", "err", err)
+		}
+	}
+}
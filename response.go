@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"seesharpsi/bookmd/funcs"
+)
+
+// envelope is the body of every JSON API response. Exactly one of Data and
+// Error is set; errors also name the request, for finding it in the logs.
+type envelope struct {
+	Data      any     `json:"data"`
+	Error     *string `json:"error"`
+	RequestID string  `json:"request_id,omitempty"`
+}
+
+// noteResponse is a note as returned after it is created or transcribed
+type noteResponse struct {
+	*funcs.Note
+	Warnings []funcs.MarkdownIssue `json:"warnings"`
+	PageGaps []int                 `json:"page_gaps,omitempty"`
+}
+
+// cleanupResponse is a note after an AI clean up, with the changes made
+type cleanupResponse struct {
+	noteResponse
+	Diff []funcs.DiffLine `json:"diff"`
+}
+
+// estimateResponse answers a dry run in place of a transcription
+type estimateResponse struct {
+	DryRun   bool           `json:"dry_run"`
+	Estimate funcs.Estimate `json:"estimate"`
+}
+
+// deletedResponse confirms that the record with ID was removed
+type deletedResponse struct {
+	ID      any  `json:"id"`
+	Deleted bool `json:"deleted"`
+}
+
+// notePageResponse is a note's place in a paper notebook
+type notePageResponse struct {
+	NoteID     int   `json:"note_id"`
+	NotebookID int   `json:"physical_notebook_id"`
+	Page       int   `json:"page_number"`
+	PageGaps   []int `json:"page_gaps"`
+}
+
+// notebookResponse is a notebook with the notebooks and notes directly in it
+type notebookResponse struct {
+	*funcs.Notebook
+	Children []*funcs.Notebook `json:"children"`
+	Notes    []funcs.Note      `json:"notes"`
+}
+
+// tagReviewResponse is the outcome of reviewing a note's suggested tags:
+// its tags once applied, or none when they were dismissed
+type tagReviewResponse struct {
+	NoteID int      `json:"note_id"`
+	Status string   `json:"status"`
+	Tags   []string `json:"tags"`
+}
+
+// replaceResponse lists the notes a find and replace changed, or on a dry
+// run the matches it would replace
+type replaceResponse struct {
+	DryRun  bool                   `json:"dry_run"`
+	Notes   []funcs.ReplacePreview `json:"notes,omitempty"`
+	Changed []int                  `json:"changed"`
+}
+
+// contentDigest is the Content-Digest header of a body, its SHA-256 as RFC
+// 9530 writes it, so a download can be checked against what was sent
+func contentDigest(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// writeData sends data in the response envelope
+func writeData(w http.ResponseWriter, status int, data any) {
+	body, err := json.Marshal(envelope{Data: data})
+	if err != nil {
+		slog.Error("failed to encode response", "err", err)
+		writeError(w, nil, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// writeError is http.Error for handlers shared by pages and the API: /api/
+// requests (and a nil request) get the JSON envelope, pages get plain text.
+// Both include the request's ID.
+func writeError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	id := w.Header().Get(requestIDHeader)
+	if r != nil && !strings.HasPrefix(r.URL.Path, "/api/") {
+		if id != "" {
+			message += " (request " + id + ")"
+		}
+		http.Error(w, message, status)
+		return
+	}
+	body, _ := json.Marshal(envelope{Error: &message, RequestID: id})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// errorStatus is 404 for lookups of missing records, 423 for changes to a
+// locked notebook, 503 for AI requests that may succeed later and fallback
+// otherwise
+func errorStatus(err error, fallback int) int {
+	if errors.Is(err, funcs.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, funcs.ErrLocked) {
+		return http.StatusLocked
+	}
+	if errors.Is(err, funcs.ErrUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
+
+// writeNote sends the stored note with id, reloaded so that metadata saved
+// after the transcription is included
+func (s *Server) writeNote(w http.ResponseWriter, r *http.Request, status, id int, warnings []funcs.MarkdownIssue, gaps []int) {
+	note, err := s.Store.GetNote(r.Context(), id)
+	if err != nil {
+		writeError(w, r, "Failed to load note: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	if warnings == nil {
+		warnings = []funcs.MarkdownIssue{}
+	}
+	writeData(w, status, noteResponse{Note: note, Warnings: warnings, PageGaps: gaps})
+}
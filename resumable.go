@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"seesharpsi/bookmd/funcs"
+)
+
+// Resumable uploads send a file in chunks: POST /api/uploads with its
+// filename and size starts one, each PATCH /api/uploads/{id} appends a chunk
+// at the Upload-Offset it names, and GET tells how much has arrived after a
+// dropped connection. A complete upload is then used in place of a file on
+// the upload forms, as a field named after the file field with ".upload"
+// added, such as image.upload=<id>.
+const (
+	maxUploadChunk = 16 << 20
+	uploadExpiry   = 24 * time.Hour
+	uploadSuffix   = ".upload"
+)
+
+// uploadLocks keeps two chunks of the same upload from being written at once
+var uploadLocks sync.Map
+
+// resumablePath is where the data of an upload is kept
+func (s *Server) resumablePath(id string) string {
+	return filepath.Join(s.Paths.Spool, "resume-"+id)
+}
+
+// uploadOffset is how many bytes of the upload have been received
+func (s *Server) uploadOffset(upload *funcs.Upload) error {
+	info, err := os.Stat(s.resumablePath(upload.ID))
+	if errors.Is(err, os.ErrNotExist) {
+		upload.Offset = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	upload.Offset = info.Size()
+	return nil
+}
+
+// writeUpload answers with an upload and its offset, also sent as the
+// Upload-Offset header
+func writeUpload(w http.ResponseWriter, status int, upload *funcs.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	writeData(w, status, upload)
+}
+
+func (s *Server) UploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filename := filepath.Base(strings.TrimSpace(r.FormValue("filename")))
+	if filename == "." || filename == string(filepath.Separator) {
+		writeError(w, r, "Filename required", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil {
+		writeError(w, r, "Invalid size", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := funcs.CreateUpload(s.DB, filename, size)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Location", "/api/uploads/"+upload.ID)
+	writeUpload(w, http.StatusCreated, upload)
+}
+
+func (s *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload, err := funcs.GetUpload(s.DB, r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Upload not found", errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if err := s.uploadOffset(upload); err != nil {
+			writeError(w, r, "Failed to read upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeUpload(w, http.StatusOK, upload)
+
+	case http.MethodPatch:
+		s.appendChunk(w, r, upload)
+
+	case http.MethodDelete:
+		if err := funcs.DeleteUpload(s.DB, upload.ID); err != nil {
+			writeError(w, r, "Failed to delete upload: "+err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		if err := os.Remove(s.resumablePath(upload.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.ErrorContext(r.Context(), "failed to remove upload", "upload_id", upload.ID, "err", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// appendChunk adds the request body to the upload at the Upload-Offset the
+// client names, which must be where the upload stops. What arrives of a
+// chunk cut off midway is kept, for the client to resume from.
+func (s *Server) appendChunk(w http.ResponseWriter, r *http.Request, upload *funcs.Upload) {
+	lock, _ := uploadLocks.LoadOrStore(upload.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	if err := s.uploadOffset(upload); err != nil {
+		writeError(w, r, "Failed to read upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, r, "Upload-Offset header required", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		writeError(w, r, fmt.Sprintf("Upload is at offset %d, not %d", upload.Offset, offset), http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(s.resumablePath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		writeError(w, r, "Failed to open upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxUploadChunk)
+	n, copyErr := io.Copy(f, io.LimitReader(body, upload.Size-upload.Offset))
+	if closeErr := f.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	upload.Offset += n
+	if copyErr != nil {
+		slog.WarnContext(r.Context(), "upload stopped", "upload_id", upload.ID, "offset", upload.Offset, "err", copyErr)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		writeError(w, r, "Failed to receive chunk: "+copyErr.Error(), http.StatusBadRequest)
+		return
+	}
+	// A chunk running past the declared size is refused whole
+	if extra, _ := body.Read(make([]byte, 1)); extra > 0 {
+		if err := os.Truncate(s.resumablePath(upload.ID), offset); err != nil {
+			slog.ErrorContext(r.Context(), "failed to truncate upload", "upload_id", upload.ID, "err", err)
+		}
+		upload.Offset = offset
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		writeError(w, r, fmt.Sprintf("Chunk runs past the upload's size of %d bytes", upload.Size), http.StatusRequestEntityTooLarge)
+		return
+	}
+	writeUpload(w, http.StatusOK, upload)
+}
+
+// resumedFile is a complete upload as a file of an upload form
+func (s *Server) resumedFile(id string) (*uploadFile, error) {
+	upload, err := funcs.GetUpload(s.DB, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.uploadOffset(upload); err != nil {
+		return nil, err
+	}
+	if !upload.Complete() {
+		return nil, fmt.Errorf("upload %s has %d of %d bytes", id, upload.Offset, upload.Size)
+	}
+	return &uploadFile{Filename: upload.Filename, Size: upload.Size, path: s.resumablePath(upload.ID)}, nil
+}
+
+// expireUploads removes, hourly, uploads started over a day ago and data
+// left without an upload, as after a demo reset
+func (s *Server) expireUploads() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		ids, err := funcs.ExpireUploads(s.DB, s.now().Add(-uploadExpiry))
+		if err != nil {
+			slog.Error("failed to expire uploads", "err", err)
+		}
+		for _, id := range ids {
+			os.Remove(s.resumablePath(id))
+			uploadLocks.Delete(id)
+		}
+		if len(ids) > 0 {
+			slog.Info("expired uploads", "uploads", len(ids))
+		}
+
+		orphans, _ := filepath.Glob(filepath.Join(s.Paths.Spool, "resume-*"))
+		for _, path := range orphans {
+			id := strings.TrimPrefix(filepath.Base(path), "resume-")
+			if _, err := funcs.GetUpload(s.DB, id); errors.Is(err, funcs.ErrNotFound) {
+				os.Remove(path)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -1,15 +1,343 @@
 -- SQLite schema for notes converter database
 -- Table: notes
+-- provenance is the JSON record of how the AI produced the markdown: model,
+-- prompt, preprocessing, response IDs and latency; empty when it was edited
+-- by hand or predates provenance
 
 CREATE TABLE IF NOT EXISTS notes (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
     image TEXT NOT NULL,
-    markdown TEXT NOT NULL
+    title TEXT NOT NULL DEFAULT '',
+    markdown TEXT NOT NULL,
+    direction TEXT NOT NULL DEFAULT 'ltr',
+    word_count INTEGER NOT NULL DEFAULT 0,
+    reading_time INTEGER NOT NULL DEFAULT 0,
+    note_type TEXT NOT NULL DEFAULT '',
+    revision INTEGER NOT NULL DEFAULT 1,
+    notebook_id INTEGER NOT NULL DEFAULT 0,
+    physical_notebook_id INTEGER NOT NULL DEFAULT 0,
+    page_number INTEGER NOT NULL DEFAULT 0,
+    captured_at TEXT NOT NULL DEFAULT '',
+    review TEXT NOT NULL DEFAULT '',
+    provenance TEXT NOT NULL DEFAULT '',
+    deleted_at DATETIME
 );
 
 -- Index for faster lookups by creation date
 CREATE INDEX IF NOT EXISTS idx_notes_date_created ON notes(date_created);
 
 -- Index for image file path lookups
-CREATE INDEX IF NOT EXISTS idx_notes_image ON notes(image);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_notes_image ON notes(image);
+
+-- Index for listing notes of a type
+CREATE INDEX IF NOT EXISTS idx_notes_note_type ON notes(note_type);
+
+-- Index for listing the notes in a notebook
+CREATE INDEX IF NOT EXISTS idx_notes_notebook ON notes(notebook_id);
+
+-- Index for mapping notes to the pages of a physical notebook
+CREATE INDEX IF NOT EXISTS idx_notes_physical_page ON notes(physical_notebook_id, page_number);
+
+-- Index for listing and purging the trash
+CREATE INDEX IF NOT EXISTS idx_notes_deleted ON notes(deleted_at);
+
+-- Table: note_links
+-- References between notes, e.g. ![[note-slug#heading]] embeds
+
+CREATE TABLE IF NOT EXISTS note_links (
+    source_id INTEGER NOT NULL,
+    target_id INTEGER NOT NULL,
+    fragment TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL,
+    PRIMARY KEY (source_id, target_id, fragment, kind)
+);
+
+-- Index for backlink lookups
+CREATE INDEX IF NOT EXISTS idx_note_links_target ON note_links(target_id);
+
+-- Table: note_properties
+-- User-defined key/value metadata, exported as frontmatter
+
+CREATE TABLE IF NOT EXISTS note_properties (
+    note_id INTEGER NOT NULL,
+    key TEXT NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (note_id, key)
+);
+
+-- Index for filtering notes by property
+CREATE INDEX IF NOT EXISTS idx_note_properties_key ON note_properties(key, value);
+
+-- Table: note_types
+-- Named schemas whose fields (a JSON array) are stored as note_properties
+
+CREATE TABLE IF NOT EXISTS note_types (
+    name TEXT PRIMARY KEY,
+    fields TEXT NOT NULL DEFAULT '[]'
+);
+
+-- Table: note_feedback
+-- Thumbs up/down on transcriptions, attributed to the model and prompt
+
+CREATE TABLE IF NOT EXISTS note_feedback (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    note_id INTEGER NOT NULL,
+    rating INTEGER NOT NULL,
+    corrected_text TEXT NOT NULL DEFAULT '',
+    model TEXT NOT NULL,
+    prompt_id TEXT NOT NULL,
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Index for per-model feedback aggregates
+CREATE INDEX IF NOT EXISTS idx_note_feedback_model ON note_feedback(model, prompt_id);
+
+-- Table: note_changes
+-- Append-only log of note creates, updates and deletes for incremental sync
+
+CREATE TABLE IF NOT EXISTS note_changes (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    note_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    revision INTEGER NOT NULL,
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: settings
+-- Runtime configuration edited from the settings page, such as the AI provider
+
+CREATE TABLE IF NOT EXISTS settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+
+-- Table: notebooks
+-- Folders that group notes, e.g. per course; parent_id 0 is the top level.
+-- A locked notebook is on legal hold: its notes cannot be edited, moved or
+-- deleted, nor the notebook renamed, moved or deleted, until an admin
+-- unlocks it.
+
+CREATE TABLE IF NOT EXISTS notebooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    parent_id INTEGER NOT NULL DEFAULT 0,
+    locked INTEGER NOT NULL DEFAULT 0,
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Index for listing the children of a notebook
+CREATE INDEX IF NOT EXISTS idx_notebooks_parent ON notebooks(parent_id);
+
+-- Table: physical_notebooks
+-- Paper notebooks that scanned notes come from; notes reference them by
+-- physical_notebook_id and page_number
+
+CREATE TABLE IF NOT EXISTS physical_notebooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    cover_image TEXT NOT NULL DEFAULT '',
+    page_count INTEGER NOT NULL DEFAULT 0,
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: pipelines
+-- Named, ordered AI steps (a JSON array) run over a note, e.g. transcribe,
+-- clean up, summarize, tag
+
+CREATE TABLE IF NOT EXISTS pipelines (
+    name TEXT PRIMARY KEY,
+    steps TEXT NOT NULL DEFAULT '[]'
+);
+
+-- Table: pipeline_runs
+-- One execution of a pipeline over a note
+
+CREATE TABLE IF NOT EXISTS pipeline_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pipeline TEXT NOT NULL,
+    note_id INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Index for listing the runs of a note
+CREATE INDEX IF NOT EXISTS idx_pipeline_runs_note ON pipeline_runs(note_id);
+
+-- Table: pipeline_artifacts
+-- The output of each step of a run, kept for debugging
+
+CREATE TABLE IF NOT EXISTS pipeline_artifacts (
+    run_id INTEGER NOT NULL,
+    step INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    model TEXT NOT NULL,
+    output TEXT NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (run_id, step)
+);
+
+-- Table: note_revisions
+-- Earlier versions of a note's markdown and image, saved when it is
+-- overwritten so it can be rolled back. The markdown is the revision blob
+-- content_hash; the markdown column only held it before blobs existed.
+-- provenance is the provenance the note had with this markdown.
+
+CREATE TABLE IF NOT EXISTS note_revisions (
+    note_id INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    image TEXT NOT NULL,
+    markdown TEXT NOT NULL DEFAULT '',
+    content_hash TEXT NOT NULL DEFAULT '',
+    provenance TEXT NOT NULL DEFAULT '',
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (note_id, revision)
+);
+
+-- Table: revision_blobs
+-- Revision markdown keyed by its SHA-256, stored once however many
+-- revisions share it: whole when base is empty, else as a line delta
+-- against the blob base, depth deltas away from a whole text
+
+CREATE TABLE IF NOT EXISTS revision_blobs (
+    hash TEXT PRIMARY KEY,
+    base TEXT NOT NULL DEFAULT '',
+    depth INTEGER NOT NULL DEFAULT 0,
+    words INTEGER NOT NULL DEFAULT 0,
+    data BLOB NOT NULL
+);
+
+-- Table: jobs
+-- Uploaded images waiting to be, or already, converted into notes
+
+CREATE TABLE IF NOT EXISTS jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    status TEXT NOT NULL,
+    batch_id INTEGER NOT NULL DEFAULT 0,
+    source TEXT NOT NULL DEFAULT '',
+    image TEXT NOT NULL,
+    params TEXT NOT NULL DEFAULT '{}',
+    note_id INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    result TEXT NOT NULL DEFAULT '',
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
+    date_finished DATETIME
+);
+
+-- Index for workers claiming the next pending job
+CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status);
+
+-- Index for listing the jobs of a batch upload
+CREATE INDEX IF NOT EXISTS idx_jobs_batch ON jobs(batch_id);
+
+-- Table: job_batches
+-- Uploads of several images at once, whose jobs share a batch_id
+
+CREATE TABLE IF NOT EXISTS job_batches (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: uploads
+-- Files sent in chunks so an interrupted upload can resume. The bytes
+-- received so far are in the spool directory, under the upload's id.
+
+CREATE TABLE IF NOT EXISTS uploads (
+    id TEXT PRIMARY KEY,
+    filename TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: tag_suggestions
+-- Tags proposed by the AI for untagged notes, pending until the reader
+-- applies or dismisses them. Dismissed ones keep the note from being
+-- offered again.
+
+CREATE TABLE IF NOT EXISTS tag_suggestions (
+    note_id INTEGER PRIMARY KEY,
+    tags TEXT NOT NULL,
+    model TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: recent_views
+-- The notes the reader opened most recently, with how often, capped at the
+-- newest 50
+
+CREATE TABLE IF NOT EXISTS recent_views (
+    note_id INTEGER PRIMARY KEY,
+    viewed_at DATETIME NOT NULL,
+    views INTEGER NOT NULL DEFAULT 0
+);
+
+-- Index for listing and trimming the recent views
+CREATE INDEX IF NOT EXISTS idx_recent_views_viewed ON recent_views(viewed_at);
+
+-- Table: ai_cache
+-- AI responses keyed by a hash of the image, model and prompt, so the same
+-- image is never sent to the provider twice
+
+CREATE TABLE IF NOT EXISTS ai_cache (
+    key TEXT PRIMARY KEY,
+    image_hash TEXT NOT NULL,
+    model TEXT NOT NULL,
+    prompt TEXT NOT NULL,
+    response TEXT NOT NULL,
+    hits INTEGER NOT NULL DEFAULT 0,
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_hit DATETIME
+);
+
+-- Table: ai_usage
+-- The tokens each AI reply used, as the provider reported them, for usage
+-- and cost reports
+
+CREATE TABLE IF NOT EXISTS ai_usage (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    provider TEXT NOT NULL,
+    model TEXT NOT NULL,
+    prompt_tokens INTEGER NOT NULL DEFAULT 0,
+    completion_tokens INTEGER NOT NULL DEFAULT 0,
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Index for reporting usage over a period
+CREATE INDEX IF NOT EXISTS idx_ai_usage_created ON ai_usage(date_created);
+
+-- Table: audit_log
+-- Administrative actions kept for record keeping, such as locking and
+-- unlocking notebooks, with who did them and why. Entries are only added.
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    action TEXT NOT NULL,
+    notebook_id INTEGER NOT NULL DEFAULT 0,
+    actor TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    date_created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: notes_fts
+-- Full-text index of note titles and markdown for search, read from the
+-- notes table and kept up to date by the triggers below
+
+CREATE VIRTUAL TABLE IF NOT EXISTS notes_fts USING fts5(
+    title, markdown, content='notes', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+);
+
+CREATE TRIGGER IF NOT EXISTS notes_fts_insert AFTER INSERT ON notes BEGIN
+    INSERT INTO notes_fts(rowid, title, markdown) VALUES (new.id, new.title, new.markdown);
+END;
+
+CREATE TRIGGER IF NOT EXISTS notes_fts_delete AFTER DELETE ON notes BEGIN
+    INSERT INTO notes_fts(notes_fts, rowid, title, markdown) VALUES ('delete', old.id, old.title, old.markdown);
+END;
+
+CREATE TRIGGER IF NOT EXISTS notes_fts_update AFTER UPDATE OF title, markdown ON notes BEGIN
+    INSERT INTO notes_fts(notes_fts, rowid, title, markdown) VALUES ('delete', old.id, old.title, old.markdown);
+    INSERT INTO notes_fts(rowid, title, markdown) VALUES (new.id, new.title, new.markdown);
+END;
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"seesharpsi/bookmd/funcs"
+)
+
+// Server holds what the handlers depend on, so a test can serve them over a
+// temporary database with a fake AI and clock
+type Server struct {
+	// DB stores the notes and everything about them; Store runs the core
+	// note queries on it with the request's context
+	DB    *sql.DB
+	Store *funcs.Store
+	// AI transcribes images with the saved AI settings, taking on new ones
+	// as they are saved
+	AI *funcs.Transcriber
+	// Index answers searches from memory when it is set, and the database's
+	// FTS5 index when it is nil
+	Index  *funcs.MemoryIndex
+	Images ImageStore
+	// Now is the clock used for trash retention and request signatures
+	Now   func() time.Time
+	Slack *funcs.SlackApp
+	Jobs  *funcs.JobQueue
+	// Events pushes job and note changes to /api/events
+	Events *funcs.EventBus
+	Paths  Paths
+	// Static holds the files served under /static/; nil serves those built
+	// into the binary
+	Static fs.FS
+	// UploadMemory is how much of an upload's files is kept in memory before
+	// the rest is spooled to Paths.Spool; 0 uses defaultUploadMemory
+	UploadMemory int64
+	// Metrics turns on /metrics, which anyone who can reach the server can
+	// read
+	Metrics bool
+
+	// chats is the Slack and Matrix work running outside any request, which
+	// drainChats waits for. It runs with chatCtx, or the background context
+	// when that is nil, and stopChats cancels it.
+	chats     sync.WaitGroup
+	chatCtx   context.Context
+	stopChats context.CancelFunc
+}
+
+// now reads the server's clock, falling back to the system clock
+func (s *Server) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+// goChat runs fn in the background as Slack or Matrix work that shutdown
+// waits for
+func (s *Server) goChat(fn func(ctx context.Context)) {
+	ctx := s.chatCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.chats.Go(func() { fn(ctx) })
+}
+
+// drainChats waits for the Slack and Matrix work to finish. When ctx ends
+// first the work is cancelled and waited for, and ctx's error returned.
+func (s *Server) drainChats(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.chats.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	if s.stopChats != nil {
+		s.stopChats()
+	}
+	<-done
+	return ctx.Err()
+}
+
+// ImageStore keeps uploaded images by file name. Path gives a file the AI
+// and pipelines can read the image from.
+type ImageStore interface {
+	Path(name string) string
+	Open(name string) (io.ReadSeekCloser, error)
+	Save(name string, r io.Reader) error
+	Remove(name string) error
+}
+
+// makeVariants derives every variant of a newly stored image. Images the
+// standard library cannot decode get none and are used as they are.
+func (s *Server) makeVariants(image string) {
+	variants := slices.Sorted(maps.Keys(funcs.ImageVariants))
+	if err := s.saveVariants(image, variants...); err != nil {
+		slog.Error("failed to make variants", "image", image, "err", err)
+	}
+}
+
+// imageVariant returns the stored name of a variant of image, making it
+// first if it is missing. When it cannot be made the original is used.
+func (s *Server) imageVariant(image, variant string) string {
+	name := funcs.VariantName(image, variant)
+	if name == image {
+		return image
+	}
+	if f, err := s.Images.Open(name); err == nil {
+		f.Close()
+		return name
+	}
+	if err := s.saveVariants(image, variant); err != nil {
+		slog.Error("failed to make variant", "image", image, "variant", variant, "err", err)
+		return image
+	}
+	return name
+}
+
+// aiImage is the path of the file sent to the AI to transcribe image, its
+// AI variant when one can be made, with the preprocessing steps that made it
+func (s *Server) aiImage(image string) (string, []string) {
+	name := s.imageVariant(image, funcs.VariantAI)
+	if name == image {
+		return s.Images.Path(image), funcs.VariantSteps(funcs.VariantOriginal)
+	}
+	return s.Images.Path(name), funcs.VariantSteps(funcs.VariantAI)
+}
+
+// backfillThumbnails makes the missing thumbnails of notes' images, such as
+// those uploaded before thumbnails were made at ingest
+func (s *Server) backfillThumbnails() {
+	images, err := funcs.NoteImages(s.DB)
+	if err != nil {
+		slog.Error("failed to list images for thumbnails", "err", err)
+		return
+	}
+	made := 0
+	for _, image := range images {
+		name := funcs.VariantName(image, funcs.VariantThumb)
+		if f, err := s.Images.Open(name); err == nil {
+			f.Close()
+			continue
+		}
+		if err := s.saveVariants(image, funcs.VariantThumb); err != nil {
+			slog.Error("failed to make thumbnail", "image", image, "err", err)
+			continue
+		}
+		made++
+	}
+	if made > 0 {
+		slog.Info("made missing thumbnails", "thumbnails", made)
+	}
+}
+
+func (s *Server) saveVariants(image string, variants ...string) error {
+	f, err := s.Images.Open(image)
+	if err != nil {
+		return err
+	}
+	out, err := funcs.MakeVariantsFrom(f, variants...)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for variant, data := range out {
+		if err := s.Images.Save(funcs.VariantName(image, variant), bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DirImages stores images as files in a directory
+type DirImages string
+
+// Path returns where the image is stored
+func (d DirImages) Path(name string) string {
+	return filepath.Join(string(d), name)
+}
+
+// Open reads the image
+func (d DirImages) Open(name string) (io.ReadSeekCloser, error) {
+	return os.Open(d.Path(name))
+}
+
+// Save writes the image, replacing any with the same name
+func (d DirImages) Save(name string, r io.Reader) error {
+	dst, err := os.Create(d.Path(name))
+	if err != nil {
+		return fmt.Errorf("failed to create image: %w", err)
+	}
+	_, err = io.Copy(dst, r)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes the image; removing one that does not exist is not an error
+func (d DirImages) Remove(name string) error {
+	if err := os.Remove(d.Path(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove image: %w", err)
+	}
+	return nil
+}
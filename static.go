@@ -0,0 +1,70 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"seesharpsi/bookmd/funcs"
+)
+
+//go:embed static
+var embeddedStatic embed.FS
+
+// embeddedAssets are the static files built into the binary
+func embeddedAssets() fs.FS {
+	assets, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	return assets
+}
+
+// useStaticAssets picks the static files the server sends: those built
+// into the binary, or the directory given with -static instead. With dev
+// the directory is read on every request, so edits show on reload, and
+// nothing is fingerprinted or cached.
+func (s *Server) useStaticAssets(dev bool) error {
+	switch {
+	case dev:
+		if s.Paths.Static == "" {
+			s.Paths.Static = defaultStaticDir()
+		}
+		s.Static = os.DirFS(s.Paths.Static)
+		slog.Info("serving static assets from disk", "dir", s.Paths.Static)
+		return funcs.UseStaticAssets(nil)
+	case s.Paths.Static != "":
+		s.Static = os.DirFS(s.Paths.Static)
+	default:
+		s.Static = embeddedAssets()
+	}
+	return funcs.UseStaticAssets(s.Static)
+}
+
+// staticAssets are the static files served, built in unless chosen otherwise
+func (s *Server) staticAssets() fs.FS {
+	if s.Static == nil {
+		return embeddedAssets()
+	}
+	return s.Static
+}
+
+// ServeStatic sends a static file. Requested by its current fingerprint, as
+// pages link it, it is cached for a year; the URL changes with the file.
+// Otherwise it is revalidated on every use.
+func (s *Server) ServeStatic(w http.ResponseWriter, r *http.Request) {
+	file := r.PathValue("file")
+	if version := funcs.StaticVersion(file); version != "" {
+		w.Header().Set("ETag", `"`+version+`"`)
+		if r.URL.Query().Get("v") == version {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeFileFS(w, r, s.staticAssets(), file)
+}
@@ -0,0 +1,127 @@
+// Force-directed view of the note link graph served by /api/graph.
+// Drag nodes to rearrange them; click a node to open the note.
+(function () {
+    const canvas = document.getElementById("graph");
+    if (!canvas) return;
+    const ctx = canvas.getContext("2d");
+    const reduceMotion = window.matchMedia("(prefers-reduced-motion: reduce)").matches;
+
+    let nodes = [];
+    let edges = [];
+    let dragging = null;
+
+    fetch(canvas.dataset.src)
+        .then((resp) => resp.json())
+        .then(({ data: graph }) => {
+            const byId = new Map();
+            nodes = graph.nodes.map((n, i) => {
+                const angle = (2 * Math.PI * i) / Math.max(graph.nodes.length, 1);
+                const node = {
+                    ...n,
+                    x: canvas.width / 2 + Math.cos(angle) * canvas.width / 4,
+                    y: canvas.height / 2 + Math.sin(angle) * canvas.height / 4,
+                    vx: 0,
+                    vy: 0,
+                };
+                byId.set(n.id, node);
+                return node;
+            });
+            edges = graph.edges
+                .map((e) => ({ source: byId.get(e.source), target: byId.get(e.target), kind: e.kind }))
+                .filter((e) => e.source && e.target);
+            if (reduceMotion) {
+                for (let i = 0; i < 300; i++) step();
+                draw();
+            } else {
+                requestAnimationFrame(tick);
+            }
+        });
+
+    function step() {
+        const repulsion = 4000;
+        const spring = 0.01;
+        const length = 120;
+        for (const a of nodes) {
+            for (const b of nodes) {
+                if (a === b) continue;
+                const dx = a.x - b.x;
+                const dy = a.y - b.y;
+                const d2 = Math.max(dx * dx + dy * dy, 1);
+                a.vx += (dx / d2) * repulsion / Math.sqrt(d2);
+                a.vy += (dy / d2) * repulsion / Math.sqrt(d2);
+            }
+            a.vx += (canvas.width / 2 - a.x) * 0.001;
+            a.vy += (canvas.height / 2 - a.y) * 0.001;
+        }
+        for (const e of edges) {
+            const dx = e.target.x - e.source.x;
+            const dy = e.target.y - e.source.y;
+            const d = Math.max(Math.sqrt(dx * dx + dy * dy), 1);
+            const f = (d - length) * spring;
+            e.source.vx += (dx / d) * f;
+            e.source.vy += (dy / d) * f;
+            e.target.vx -= (dx / d) * f;
+            e.target.vy -= (dy / d) * f;
+        }
+        for (const n of nodes) {
+            if (n === dragging) continue;
+            n.vx *= 0.85;
+            n.vy *= 0.85;
+            n.x = Math.min(Math.max(n.x + n.vx, 10), canvas.width - 10);
+            n.y = Math.min(Math.max(n.y + n.vy, 10), canvas.height - 10);
+        }
+    }
+
+    function draw() {
+        const style = getComputedStyle(document.body);
+        ctx.clearRect(0, 0, canvas.width, canvas.height);
+        ctx.strokeStyle = style.color;
+        ctx.fillStyle = style.color;
+        ctx.font = "12px " + style.fontFamily;
+        for (const e of edges) {
+            ctx.setLineDash(e.kind === "embed" ? [4, 3] : []);
+            ctx.beginPath();
+            ctx.moveTo(e.source.x, e.source.y);
+            ctx.lineTo(e.target.x, e.target.y);
+            ctx.stroke();
+        }
+        ctx.setLineDash([]);
+        for (const n of nodes) {
+            ctx.beginPath();
+            ctx.arc(n.x, n.y, 6, 0, 2 * Math.PI);
+            ctx.fill();
+            ctx.fillText(n.title, n.x + 9, n.y + 4);
+        }
+    }
+
+    function tick() {
+        step();
+        draw();
+        requestAnimationFrame(tick);
+    }
+
+    function nodeAt(event) {
+        const rect = canvas.getBoundingClientRect();
+        const x = ((event.clientX - rect.left) * canvas.width) / rect.width;
+        const y = ((event.clientY - rect.top) * canvas.height) / rect.height;
+        return nodes.find((n) => (n.x - x) ** 2 + (n.y - y) ** 2 < 100) || null;
+    }
+
+    let moved = false;
+    canvas.addEventListener("pointerdown", (event) => {
+        dragging = nodeAt(event);
+        moved = false;
+    });
+    canvas.addEventListener("pointermove", (event) => {
+        if (!dragging) return;
+        const rect = canvas.getBoundingClientRect();
+        dragging.x = ((event.clientX - rect.left) * canvas.width) / rect.width;
+        dragging.y = ((event.clientY - rect.top) * canvas.height) / rect.height;
+        moved = true;
+        if (reduceMotion) draw();
+    });
+    canvas.addEventListener("pointerup", () => {
+        if (dragging && !moved) window.location = dragging.url;
+        dragging = null;
+    });
+})();
@@ -0,0 +1,61 @@
+// Drag-to-reorder for the outline panel on the note page. Dropping a
+// heading on another moves its section before that one; dropping it below
+// the list moves it to the end. The buttons work without this script.
+(function () {
+    const list = document.querySelector(".note-outline ol[data-src]");
+    if (!list) return;
+    const items = Array.from(list.querySelectorAll("li[data-index]"));
+    let dragged = null;
+    let target = null;
+
+    function mark(item) {
+        if (target) target.classList.remove("outline-target");
+        target = item;
+        if (target) target.classList.add("outline-target");
+    }
+
+    items.forEach((item) => {
+        item.addEventListener("dragstart", (e) => {
+            dragged = item;
+            item.classList.add("outline-dragging");
+            e.dataTransfer.effectAllowed = "move";
+            e.dataTransfer.setData("text/plain", item.dataset.index);
+        });
+        item.addEventListener("dragend", () => {
+            item.classList.remove("outline-dragging");
+            dragged = null;
+            mark(null);
+        });
+        item.addEventListener("dragover", (e) => {
+            if (!dragged) return;
+            e.preventDefault();
+            e.stopPropagation();
+            mark(item);
+        });
+    });
+
+    // Below the last heading means the end of the note
+    list.addEventListener("dragover", (e) => {
+        if (!dragged) return;
+        e.preventDefault();
+        mark(null);
+    });
+
+    list.addEventListener("drop", (e) => {
+        if (!dragged) return;
+        e.preventDefault();
+        const body = new FormData();
+        body.set("action", "move");
+        body.set("heading", dragged.dataset.index);
+        body.set("to", target ? target.dataset.index : String(items.length));
+        fetch(list.dataset.src, { method: "POST", body })
+            .then((resp) => resp.json())
+            .then(({ error }) => {
+                if (error) {
+                    alert(error);
+                    return;
+                }
+                location.reload();
+            });
+    });
+})();
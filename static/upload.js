@@ -0,0 +1,142 @@
+// Resumable uploads for the upload forms. Files over largeFile are sent to
+// /api/uploads in chunks; when the connection drops the script waits for it
+// and carries on from the last byte the server has. Uploads are remembered
+// by file, so picking the same file again after a reload resumes it too.
+// Small files, and browsers without this script, post the form as usual.
+(function () {
+    const script = document.currentScript;
+    const largeFile = 8 << 20;
+    const chunkSize = 4 << 20;
+    const maxRetryDelay = 30000;
+
+    function format(text, ...args) {
+        return text.replace(/%[sd]/g, () => args.shift()).replace("%%", "%");
+    }
+
+    function fileKey(file) {
+        return "upload:" + [file.name, file.size, file.lastModified].join(":");
+    }
+
+    async function errorOf(res) {
+        try {
+            return (await res.json()).error || res.statusText;
+        } catch {
+            return res.statusText;
+        }
+    }
+
+    // offsetOf asks the server how much of an upload it has, or null when
+    // it does not know the upload or cannot be reached
+    async function offsetOf(id) {
+        try {
+            const res = await fetch("/api/uploads/" + id);
+            return res.ok ? Number(res.headers.get("Upload-Offset")) : null;
+        } catch {
+            return null;
+        }
+    }
+
+    async function start(file) {
+        const saved = localStorage.getItem(fileKey(file));
+        if (saved) {
+            const offset = await offsetOf(saved);
+            if (offset !== null) return { id: saved, offset };
+            localStorage.removeItem(fileKey(file));
+        }
+        const res = await fetch("/api/uploads", {
+            method: "POST",
+            body: new URLSearchParams({ filename: file.name, size: file.size }),
+        });
+        if (!res.ok) throw new Error(await errorOf(res));
+        const { data } = await res.json();
+        localStorage.setItem(fileKey(file), data.id);
+        return { id: data.id, offset: 0 };
+    }
+
+    function online() {
+        if (navigator.onLine) return Promise.resolve();
+        return new Promise((resolve) => window.addEventListener("online", resolve, { once: true }));
+    }
+
+    // send uploads a file in chunks and returns the upload's id
+    async function send(file, status) {
+        let { id, offset } = await start(file);
+        let failures = 0;
+        while (offset < file.size) {
+            status(format(script.dataset.progress, file.name, Math.floor((100 * offset) / file.size)));
+            let res = null;
+            try {
+                res = await fetch("/api/uploads/" + id, {
+                    method: "PATCH",
+                    headers: { "Upload-Offset": String(offset) },
+                    body: file.slice(offset, offset + chunkSize),
+                });
+            } catch {
+                // The connection dropped; the retry below finds out how much arrived
+            }
+            // A conflict means the server is elsewhere in the file, as after
+            // a chunk that arrived without its answer
+            if (res && (res.ok || res.status === 409)) {
+                offset = Number(res.headers.get("Upload-Offset"));
+                failures = 0;
+                continue;
+            }
+            if (res && res.status < 500) throw new Error(await errorOf(res));
+
+            failures++;
+            status(format(script.dataset.waiting, file.name));
+            await online();
+            await new Promise((resolve) => setTimeout(resolve, Math.min(1000 * 2 ** failures, maxRetryDelay)));
+            const known = await offsetOf(id);
+            if (known !== null) offset = known;
+        }
+        return id;
+    }
+
+    document.querySelectorAll("form.upload-form").forEach((form) => {
+        const inputs = Array.from(form.querySelectorAll("input[type=file]"));
+        form.addEventListener("submit", async (e) => {
+            const files = inputs.flatMap((input) => Array.from(input.files));
+            if (!files.some((file) => file.size > largeFile)) return;
+            e.preventDefault();
+
+            let status = form.querySelector(".upload-status");
+            if (!status) {
+                status = document.createElement("p");
+                status.className = "upload-status";
+                status.setAttribute("role", "status");
+                form.append(status);
+            }
+            const show = (text) => (status.textContent = text);
+            const button = form.querySelector("button[type=submit]");
+            if (button) button.disabled = true;
+
+            try {
+                const data = new FormData(form);
+                const sent = [];
+                for (const input of inputs) {
+                    data.delete(input.name);
+                    for (const file of input.files) {
+                        if (file.size <= largeFile) {
+                            data.append(input.name, file);
+                            continue;
+                        }
+                        data.append(input.name + ".upload", await send(file, show));
+                        sent.push(file);
+                    }
+                }
+
+                show(script.dataset.converting);
+                const res = await fetch(form.action, { method: "POST", body: data });
+                if (!res.ok) throw new Error(await errorOf(res));
+                sent.forEach((file) => localStorage.removeItem(fileKey(file)));
+                if (res.redirected) window.location.href = res.url;
+                else window.location.reload();
+            } catch (err) {
+                show(format(script.dataset.failed, err.message));
+            } finally {
+                if (button) button.disabled = false;
+            }
+        });
+    });
+})();
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Limits of an upload form. Files are kept in memory up to the server's
+// upload memory, together, and written to the spool directory past it;
+// the other fields are always held in memory.
+const (
+	defaultUploadMemory = 32 << 20
+	maxFormValues       = 10 << 20
+)
+
+// uploadForm is a parsed multipart upload. RemoveAll must be called once the
+// files are no longer needed, which deletes the spooled ones.
+type uploadForm struct {
+	files   map[string][]*uploadFile
+	spooled []string
+}
+
+// uploadFile is a file sent in an upload form, held in memory or spooled
+type uploadFile struct {
+	Filename string
+	Size     int64
+	data     []byte
+	path     string
+}
+
+// memFile is an in-memory upload opened for reading
+type memFile struct{ *bytes.Reader }
+
+func (memFile) Close() error { return nil }
+
+// Open reads the file from memory or from its spool file
+func (f *uploadFile) Open() (multipart.File, error) {
+	if f.path == "" {
+		return memFile{bytes.NewReader(f.data)}, nil
+	}
+	return os.Open(f.path)
+}
+
+// FormFile opens the first file sent as key, as http.Request.FormFile does
+func (u *uploadForm) FormFile(key string) (multipart.File, *uploadFile, error) {
+	if len(u.files[key]) == 0 {
+		return nil, nil, http.ErrMissingFile
+	}
+	f, err := u.files[key][0].Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, u.files[key][0], nil
+}
+
+// Files lists the files sent as key
+func (u *uploadForm) Files(key string) []*uploadFile {
+	return u.files[key]
+}
+
+// RemoveAll deletes the spool files of the upload
+func (u *uploadForm) RemoveAll() {
+	for _, path := range u.spooled {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("failed to remove spooled upload", "path", path, "err", err)
+		}
+	}
+	u.spooled = nil
+}
+
+// parseUpload reads a multipart upload, keeping files in memory up to
+// s.UploadMemory and spooling the rest to disk, and fills in r.Form and
+// r.PostForm with the other fields. Resumable uploads named in the form
+// are added to its files. Nothing is left on disk when it fails.
+func (s *Server) parseUpload(r *http.Request) (_ *uploadForm, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	form := &uploadForm{files: map[string][]*uploadFile{}}
+	defer func() {
+		if err != nil {
+			form.RemoveAll()
+		}
+	}()
+
+	memory := s.UploadMemory
+	if memory <= 0 {
+		memory = defaultUploadMemory
+	}
+	values := url.Values{}
+	valueBytes := int64(0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		if part.FileName() == "" {
+			var value bytes.Buffer
+			n, err := io.CopyN(&value, part, maxFormValues-valueBytes+1)
+			part.Close()
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			if valueBytes += n; valueBytes > maxFormValues {
+				return nil, fmt.Errorf("form fields are over %d bytes", maxFormValues)
+			}
+			// A resumable upload sent in place of a file
+			if field, ok := strings.CutSuffix(name, uploadSuffix); ok {
+				file, err := s.resumedFile(value.String())
+				if err != nil {
+					return nil, err
+				}
+				form.files[field] = append(form.files[field], file)
+				continue
+			}
+			values.Add(name, value.String())
+			continue
+		}
+
+		file, err := s.spoolPart(part, form, memory)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+		if file.path == "" {
+			memory -= file.Size
+		}
+		form.files[name] = append(form.files[name], file)
+	}
+
+	// Fields sent in the body come before those in the URL, as with
+	// ParseMultipartForm
+	r.PostForm = values
+	r.Form = url.Values{}
+	for k, v := range values {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+	for k, v := range r.URL.Query() {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+	r.MultipartForm = &multipart.Form{Value: values, File: map[string][]*multipart.FileHeader{}}
+	return form, nil
+}
+
+// spoolPart reads a file part into memory if it fits in memory bytes, and
+// into a new file in the spool directory otherwise
+func (s *Server) spoolPart(part *multipart.Part, form *uploadForm, memory int64) (*uploadFile, error) {
+	file := &uploadFile{Filename: part.FileName()}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, part, max(memory, 0)+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= memory {
+		file.data, file.Size = buf.Bytes(), n
+		return file, nil
+	}
+
+	spool, err := os.CreateTemp(s.Paths.Spool, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool upload: %w", err)
+	}
+	form.spooled = append(form.spooled, spool.Name())
+	file.path = spool.Name()
+	size, err := io.Copy(spool, io.MultiReader(&buf, part))
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool upload: %w", err)
+	}
+	file.Size = size
+	return file, nil
+}
+
+// clearSpool removes the uploads a previous run left in the spool directory
+func clearSpool(dir string) {
+	leftovers, err := filepath.Glob(filepath.Join(dir, "upload-*"))
+	if err != nil {
+		return
+	}
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+	if len(leftovers) > 0 {
+		slog.Info("removed uploads left from a previous run", "uploads", len(leftovers), "dir", dir)
+	}
+}